@@ -15,8 +15,10 @@
 package addrindex
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -24,7 +26,6 @@ import (
 	"strconv"
 
 	"github.com/btcsuite/btcd/btcjson"
-	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcutil"
 	"github.com/gorilla/mux"
 )
@@ -37,44 +38,69 @@ func (as *AddrServer) HandleAddrUTXO(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	addr := mux.Vars(r)["addr"]
 
-	// Fetch current block info
-	info, err := as.Client.GetInfo()
+	decoded, err := as.DecodeAddress(addr)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("failed to getInfo", err))
+		writeError(w, fmt.Sprintf("invalid %s address", as.Network), InvalidInput(err))
 		return
 	}
 
-	// paginate through transactions
-	txns, err := as.GetAddressUTXOs([]string{addr})
+	utxos, err := as.addressUTXOs(r.Context(), []btcutil.Address{decoded})
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching all transactions for address", err))
+		writeError(w, "error fetching utxos for address", err)
 		return
 	}
+	out, _ := json.Marshal(utxos)
+	w.Write(out)
+}
 
-	mptxns, err := as.GetAddressMempool([]string{addr})
+// HandleAddrsUTXO handles the /addrs/<addr,addr,...>/utxo route
+func (as *AddrServer) HandleAddrsUTXO(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	addrs, err := as.DecodeAddressList(mux.Vars(r)["addrs"])
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching mempool transactions for address", err))
+		writeError(w, fmt.Sprintf("invalid %s address", as.Network), InvalidInput(err))
 		return
 	}
 
-	// If there are no mempool transactions then just return the historical
-	if len(mptxns.Result) < 1 {
-		o := UTXOInsOuts{}
-		for _, utxo := range txns.Result {
-			o = append(o, utxo.Enrich(info.Blocks))
-		}
-		sort.Sort(o)
-		out, _ := json.Marshal(o)
-		w.Write(out)
+	utxos, err := as.addressUTXOs(r.Context(), addrs)
+	if err != nil {
+		writeError(w, "error fetching utxos for addresses", err)
 		return
 	}
+	out, _ := json.Marshal(utxos)
+	w.Write(out)
+}
 
-	var check UTXOInsOuts
-	var out UTXOInsOuts
+// addressUTXOs returns the unspent outputs of addrs, including unconfirmed
+// ones and excluding ones spent in the mempool, sorted by confirmations
+func (as *AddrServer) addressUTXOs(ctx context.Context, addrs []btcutil.Address) (UTXOInsOuts, error) {
+	encoded := encodeAddresses(addrs)
+
+	// Fetch the block height, UTXOs and mempool in one round trip
+	addrParams := []interface{}{map[string][]string{"addresses": encoded}}
+	res := as.Batch(ctx, []BitcoreRequest{
+		{JSONRPC: "1.0", Method: "getinfo"},
+		{JSONRPC: "1.0", Method: "getaddressutxos", Params: addrParams},
+		{JSONRPC: "1.0", Method: "getaddressmempool", Params: addrParams},
+	})
 
+	var info btcjson.InfoWalletResult
+	if err := res[0].Unmarshal(&info); err != nil {
+		return nil, err
+	}
+
+	var txns GetAddressUTXOsResponse
+	if err := res[1].Unmarshal(&txns.Result); err != nil {
+		return nil, addressIndexError(addrs, err)
+	}
+
+	var mptxns GetAddressMempoolResponse
+	if err := res[2].Unmarshal(&mptxns.Result); err != nil {
+		return nil, addressIndexError(addrs, err)
+	}
+
+	check := UTXOInsOuts{}
 	for _, tx := range txns.Result {
 		check = append(check, tx.Enrich(info.Blocks))
 	}
@@ -85,6 +111,7 @@ func (as *AddrServer) HandleAddrUTXO(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	out := UTXOInsOuts{}
 	for _, toCheck := range check {
 		valid := true
 		for _, mptx := range mptxns.Result {
@@ -93,14 +120,14 @@ func (as *AddrServer) HandleAddrUTXO(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if valid {
+			toCheck.ScriptType = as.utxoScriptType(toCheck.Script, toCheck.Address)
 			out = append(out, toCheck)
 		}
 	}
 
 	// Sort by confirmations and return
 	sort.Sort(out)
-	o, _ := json.Marshal(out)
-	w.Write(o)
+	return out, nil
 }
 
 // HandleAddrUnconfirmedBalance handles the /addr/<addr>/unconfirmedBalance route
@@ -108,10 +135,15 @@ func (as *AddrServer) HandleAddrUnconfirmedBalance(w http.ResponseWriter, r *htt
 	w.Header().Set("Content-Type", "application/json")
 	addr := mux.Vars(r)["addr"]
 
-	mptxns, err := as.GetAddressMempool([]string{addr})
+	decoded, err := as.DecodeAddress(addr)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching mempool transactions for address", err))
+		writeError(w, fmt.Sprintf("invalid %s address", as.Network), InvalidInput(err))
+		return
+	}
+
+	mptxns, err := as.GetAddressMempool(r.Context(), []string{addr})
+	if err != nil {
+		writeError(w, "error fetching mempool transactions for address", addressIndexError([]btcutil.Address{decoded}, err))
 		return
 	}
 
@@ -135,11 +167,10 @@ func (as *AddrServer) HandleGetBlocks(w http.ResponseWriter, r *http.Request) {
 	}
 	lim, err := strconv.ParseInt(limit, 10, 64)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("failed parsing ?limit={val}", err))
+		writeError(w, "failed parsing ?limit={val}", InvalidInput(err))
 		return
 	}
-	w.Write(as.GetBlocksResponse(lim))
+	w.Write(as.GetBlocksResponse(r.Context(), lim))
 }
 
 // HandleAddrBalance handles the /addr/<addr>/balance route
@@ -147,11 +178,16 @@ func (as *AddrServer) HandleAddrBalance(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	addr := mux.Vars(r)["addr"]
 
+	decoded, err := as.DecodeAddress(addr)
+	if err != nil {
+		writeError(w, fmt.Sprintf("invalid %s address", as.Network), InvalidInput(err))
+		return
+	}
+
 	// paginate through transactions
-	txns, err := as.GetAddressBalance([]string{addr})
+	txns, err := as.GetAddressBalance(r.Context(), []string{addr})
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching all transactions for address", err))
+		writeError(w, "error fetching all transactions for address", addressIndexError([]btcutil.Address{decoded}, err))
 		return
 	}
 	out, _ := json.Marshal(txns.Result.Balance)
@@ -163,11 +199,16 @@ func (as *AddrServer) HandleAddrRecieved(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	addr := mux.Vars(r)["addr"]
 
+	decoded, err := as.DecodeAddress(addr)
+	if err != nil {
+		writeError(w, fmt.Sprintf("invalid %s address", as.Network), InvalidInput(err))
+		return
+	}
+
 	// paginate through transactions
-	txns, err := as.GetAddressBalance([]string{addr})
+	txns, err := as.GetAddressBalance(r.Context(), []string{addr})
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching all transactions for address", err))
+		writeError(w, "error fetching all transactions for address", addressIndexError([]btcutil.Address{decoded}, err))
 		return
 	}
 	out, _ := json.Marshal(txns.Result.Received)
@@ -179,11 +220,16 @@ func (as *AddrServer) HandleAddrSent(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	addr := mux.Vars(r)["addr"]
 
+	decoded, err := as.DecodeAddress(addr)
+	if err != nil {
+		writeError(w, fmt.Sprintf("invalid %s address", as.Network), InvalidInput(err))
+		return
+	}
+
 	// paginate through transactions
-	txns, err := as.GetAddressBalance([]string{addr})
+	txns, err := as.GetAddressBalance(r.Context(), []string{addr})
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching all transactions for address", err))
+		writeError(w, "error fetching all transactions for address", addressIndexError([]btcutil.Address{decoded}, err))
 		return
 	}
 	out, _ := json.Marshal(txns.Result.Received - txns.Result.Balance)
@@ -196,10 +242,9 @@ func (as *AddrServer) HandleTxGet(w http.ResponseWriter, r *http.Request) {
 	txid := mux.Vars(r)["txid"]
 
 	// paginate through transactions
-	txns, err := as.GetRawTransaction(txid)
+	txns, err := as.GetRawTransaction(r.Context(), txid)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching all transactions for address", err))
+		writeError(w, "error fetching transaction", err)
 		return
 	}
 	out, _ := json.Marshal(txns.Result)
@@ -212,10 +257,9 @@ func (as *AddrServer) HandleRawTxGet(w http.ResponseWriter, r *http.Request) {
 	addr := mux.Vars(r)["txid"]
 
 	// paginate through transactions
-	txns, err := as.GetRawTransaction(addr)
+	txns, err := as.GetRawTransaction(r.Context(), addr)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching all transactions for address", err))
+		writeError(w, "error fetching transaction", err)
 		return
 	}
 	out, _ := json.Marshal(map[string]string{"rawtx": txns.Result.Hex})
@@ -231,39 +275,34 @@ func (as *AddrServer) HandleTransactionSend(w http.ResponseWriter, r *http.Reque
 	// Read post body
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("unable to read post body", err))
+		writeError(w, "unable to read post body", InvalidInput(err))
 		return
 	}
 
 	// Unmarshal
 	err = json.Unmarshal(b, &tx)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("unable to unmarshall body", err))
+		writeError(w, "unable to unmarshall body", InvalidInput(err))
 		return
 	}
 
 	// Convert hex to string
 	dec, err := hex.DecodeString(tx.Tx)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("unable to decode hex string", err))
+		writeError(w, "unable to decode hex string", InvalidInput(err))
 		return
 	}
 
 	// Convert tansaction to send format
 	txn, err := btcutil.NewTxFromBytes(dec)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("unable to parse transaction", err))
+		writeError(w, "unable to parse transaction", InvalidInput(err))
 		return
 	}
 
-	ret, err := as.Client.SendRawTransaction(txn.MsgTx(), true)
+	ret, err := as.SendTransaction(r.Context(), txn)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("unable to post transaction to node", err))
+		writeError(w, "unable to post transaction to node", err)
 		return
 	}
 
@@ -280,30 +319,32 @@ func (as *AddrServer) HandleMessagesVerify(w http.ResponseWriter, r *http.Reques
 	// Read post body
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("unable to read post body", err))
+		writeError(w, "unable to read post body", InvalidInput(err))
 		return
 	}
 
 	// Unmarshal
-	err = json.Unmarshal(b, tx)
+	err = json.Unmarshal(b, &tx)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("unable to unmarshall body", err))
+		writeError(w, "unable to unmarshall body", InvalidInput(err))
 		return
 	}
 
-	addr, err := btcutil.DecodeAddress(tx.BitcoinAddress, nil)
+	addr, err := as.DecodeAddress(tx.BitcoinAddress)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("unable to decode bitcoin address", err))
+		writeError(w, fmt.Sprintf("unable to decode %s bitcoin address", as.Network), InvalidInput(err))
 		return
 	}
 
-	ret, err := as.Client.VerifyMessage(addr, tx.Signature, tx.Message)
+	// bitcoind only verifies messages signed by P2PKH addresses
+	var ret bool
+	if _, ok := addr.(*btcutil.AddressPubKeyHash); ok {
+		ret, err = as.Client.VerifyMessage(r.Context(), addr, tx.Signature, tx.Message)
+	} else {
+		ret, err = verifyMessage(addr, tx.Signature, tx.Message)
+	}
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("unable verify message", err))
+		writeError(w, "unable verify message", err)
 		return
 	}
 
@@ -317,18 +358,16 @@ func (as *AddrServer) HandleGetBlock(w http.ResponseWriter, r *http.Request) {
 	blockhash := mux.Vars(r)["blockHash"]
 
 	// Make the chainhash for fetching data
-	hash, err := chainhash.NewHashFromStr(blockhash)
+	hash, err := ParseHash(blockhash)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error parsing txhash", err))
+		writeError(w, "error parsing blockhash", InvalidInput(err))
 		return
 	}
 
 	// paginate through transactions
-	block, err := as.Client.GetBlockVerbose(hash)
+	block, err := as.Client.GetBlockVerbose(r.Context(), hash)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching block", err))
+		writeError(w, "error fetching block", err)
 		return
 	}
 	out, _ := json.Marshal(block)
@@ -340,17 +379,15 @@ func (as *AddrServer) HandleGetBlockHash(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	height := mux.Vars(r)["height"]
 
-	h, err := strconv.ParseInt(height, 10, 64)
+	h, err := ParseHeight(height)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error parsing blockheight", err))
+		writeError(w, "error parsing blockheight", InvalidInput(err))
 		return
 	}
 
-	block, err := as.Client.GetBlockHash(h)
+	block, err := as.Client.GetBlockHash(r.Context(), h)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching blockhash", err))
+		writeError(w, "error fetching blockhash", err)
 		return
 	}
 
@@ -362,10 +399,9 @@ func (as *AddrServer) HandleGetBlockHash(w http.ResponseWriter, r *http.Request)
 func (as *AddrServer) HandleGetSync(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	chainInfo, err := as.Client.GetBlockChainInfo()
+	chainInfo, err := as.Client.GetBlockChainInfo(r.Context())
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write(NewPostError("error fetching blockchain info", err))
+		writeError(w, "error fetching blockchain info", err)
 		return
 	}
 
@@ -384,33 +420,42 @@ func (as *AddrServer) HandleGetStatus(w http.ResponseWriter, r *http.Request) {
 
 	switch method {
 	case "getDifficulty":
-		info, err := as.Client.GetDifficulty()
+		info, err := as.Client.GetDifficulty(r.Context())
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write(NewPostError("failed to getDifficulty", err))
+			writeError(w, "failed to getDifficulty", err)
 			return
 		}
 		w.Write(NewGetDifficultyReturn(info))
 	case "getBestBlockHash":
-		info, err := as.Client.GetBestBlockHash()
+		info, err := as.Client.GetBestBlockHash(r.Context())
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write(NewPostError("failed to getBestBlockHash", err))
+			writeError(w, "failed to getBestBlockHash", err)
 			return
 		}
 		w.Write(NewGetBestBlockHashReturn(info.String()))
 	default:
-		info, err := as.Client.GetInfo()
+		info, err := as.Client.GetInfo(r.Context())
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write(NewPostError("failed to getInfo", err))
+			writeError(w, "failed to getInfo", err)
 			return
 		}
-		out, _ := json.Marshal(info)
+		out, _ := json.Marshal(StatusInfo{
+			InfoWalletResult: info,
+			Backend:          backendFromContext(r.Context()),
+			Backends:         as.Client.Statuses(),
+		})
 		w.Write(out)
 	}
 }
 
+// StatusInfo models a response to /status?q=getInfo, the node's info with
+// the backend that served it and the health of every backend
+type StatusInfo struct {
+	*btcjson.InfoWalletResult
+	Backend  string          `json:"backend"`
+	Backends []BackendStatus `json:"backends"`
+}
+
 // HandleGetTransactions handles the /txs route
 func (as *AddrServer) HandleGetTransactions(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -418,74 +463,76 @@ func (as *AddrServer) HandleGetTransactions(w http.ResponseWriter, r *http.Reque
 	query := r.URL.Query()
 
 	var (
-		page    int
 		address string
 		block   string
 	)
 
-	if len(query["page"]) > 0 {
-		pg, err := strconv.ParseInt(query["page"][0], 10, 64)
-		if err != nil {
-			page = 0
-		} else {
-			page = int(pg)
-		}
-	} else {
-		page = 0
-	}
-
 	if len(query["address"]) > 0 {
 		address = query["address"][0]
 	}
 
-	if len(query["block"]) > 0 {
-		block = query["block"][0]
-	} else if len(query["block"]) > 1 {
-		w.WriteHeader(400)
-		w.Write(NewPostError("only one block accepted in query", fmt.Errorf("")))
+	partial := false
+	if p := query.Get("partial"); p != "" {
+		var err error
+		if partial, err = strconv.ParseBool(p); err != nil {
+			writeError(w, "partial must be true or false", InvalidInput(err))
+			return
+		}
+	}
+
+	if len(query["block"]) > 1 {
+		writeError(w, "only one block accepted in query", InvalidInput(fmt.Errorf("got %d", len(query["block"]))))
 		return
+	} else if len(query["block"]) > 0 {
+		block = query["block"][0]
 	}
 
 	if address != "" {
-		// Fetch Block Height
-		info, err := as.Client.GetInfo()
+		decoded, err := as.DecodeAddress(address)
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write(NewPostError("failed to getInfo", err))
+			writeError(w, fmt.Sprintf("invalid %s address", as.Network), InvalidInput(err))
 			return
 		}
 
-		// paginate through transactions
-		txns, err := as.GetAddressTxIDs([]string{address}, BlockstackStartBlock, int(info.Blocks))
+		params, err := parsePageParams(query)
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write(NewPostError("error fetching page of transactions for address", err))
+			writeError(w, "invalid paging parameters", InvalidInput(err))
 			return
 		}
 
-		var retTxns []string
-		var out []TransactionIns
+		// Fetch Block Height
+		info, err := as.Client.GetInfo(r.Context())
+		if err != nil {
+			writeError(w, "failed to getInfo", err)
+			return
+		}
 
-		// Pull off a page of transactions
-		if len(txns.Result) < 10 {
-			retTxns = txns.Result
-		} else if len(txns.Result) > ((page + 1) * 10) {
-			retTxns = []string{}
-		} else if len(txns.Result) > (page*10) && len(txns.Result) < ((page+1)*10) {
-			retTxns = txns.Result[page*10:]
-		} else {
-			retTxns = txns.Result[page*10 : (page+1)*10]
+		// Deltas carry the height and block position pages are anchored to
+		deltas, err := as.GetAddressDeltas(r.Context(), []string{address}, as.StartBlock, int(info.Blocks))
+		if err != nil {
+			writeError(w, "error fetching page of transactions for address", addressIndexError([]btcutil.Address{decoded}, err))
+			return
 		}
 
-		for _, txid := range retTxns {
-			tx, err := as.GetRawTransaction(txid)
-			if err != nil {
-				w.WriteHeader(400)
-				w.Write(NewPostError("error fetching page of transactions for address", err))
-				return
-			}
-			out = append(out, tx.Result)
+		items := txAnchors(deltas.Result)
+		anchors, next := pageTxAnchors(items, params)
+		out := TxsPage{
+			TotalItems: len(items),
+			PagesTotal: (len(items) + params.size - 1) / params.size,
+			PageSize:   params.size,
+			Next:       next,
+		}
+		txids := make([]string, len(anchors))
+		for i, a := range anchors {
+			txids[i] = a.Txid
 		}
+		var errs []error
+		out.Txs, errs = as.GetRawTransactions(r.Context(), txids)
+		if err := firstError(errs); err != nil && !partial {
+			writeError(w, "error fetching page of transactions for address", err)
+			return
+		}
+		out.Errors = txErrors(txids, errs)
 
 		o, _ := json.Marshal(out)
 		w.Write(o)
@@ -494,66 +541,56 @@ func (as *AddrServer) HandleGetTransactions(w http.ResponseWriter, r *http.Reque
 
 	if block != "" {
 		// Make the chainhash for fetching data
-		blockhash, err := chainhash.NewHashFromStr(block)
+		blockhash, err := ParseHash(block)
+		if err != nil {
+			writeError(w, "error parsing blockhash", InvalidInput(err))
+			return
+		}
+		page, err := parsePage(query.Get("page"))
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write(NewPostError("error parsing blockhash", err))
+			writeError(w, "invalid paging parameters", InvalidInput(err))
 			return
 		}
 
 		// Fetch block data
-		blockData, err := as.Client.GetBlockVerbose(blockhash)
+		blockData, err := as.Client.GetBlockVerbose(r.Context(), blockhash)
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write(NewPostError("failed to fetch block transactions", err))
+			writeError(w, "failed to fetch block transactions", err)
 			return
 		}
 
-		// Initialize output
-		var txns = []*btcjson.TxRawResult{}
-
-		// fetch proper slice of transactions
-		var txs []string
-
-		// Pick the proper slice from the txs array
-		if len(blockData.Tx) < ((page) * 10) {
+		// Pick the proper slice from the txs array, checking the page before
+		// multiplying so huge pages can't overflow
+		if page > len(blockData.Tx)/10 {
 			// If there is no data left to fetch, return error
-			w.WriteHeader(400)
-			w.Write(NewPostError("Out of bounds", fmt.Errorf("page %v doesn't exist", page)))
+			writeError(w, "Out of bounds", NotFound(fmt.Errorf("page %v doesn't exist", page)))
 			return
-			// If it's the last page, just return the last few transactions
-		} else if len(blockData.Tx)-((page+1)*10) <= 0 {
-			txs = blockData.Tx[int(page)*10:]
-			// Otherwise return a full page
-		} else {
-			txs = blockData.Tx[int(page)*10 : int(page+1)*10]
 		}
+		start := page * 10
+		end := start + 10
+		if end > len(blockData.Tx) {
+			end = len(blockData.Tx)
+		}
+		txs := blockData.Tx[start:end]
 
-		// Fetch individual transaction data and append it to the txns array
-		for _, tx := range txs {
-			txhash, err := chainhash.NewHashFromStr(tx)
-			if err != nil {
-				w.WriteHeader(400)
-				w.Write(NewPostError(fmt.Sprintf("error parsing transaction %v", tx), err))
-				return
-			}
-
-			txData, err := as.Client.GetRawTransactionVerbose(txhash)
-			if err != nil {
-				w.WriteHeader(400)
-				w.Write(NewPostError(fmt.Sprintf("error fetching transaction details: %v", tx), err))
-				return
-			}
-			txns = append(txns, txData)
+		// Fetch the transactions of the page in batches, in block order
+		txns, errs := as.GetRawTransactionsVerbose(r.Context(), txs)
+		if err := firstError(errs); err != nil && !partial {
+			writeError(w, "error fetching transaction details", err)
+			return
 		}
 
-		// Return the JSON
-		out, _ := json.Marshal(txns)
+		// Partial results are wrapped to carry the per transaction errors
+		var out []byte
+		if partial {
+			out, _ = json.Marshal(BlockTxs{Txs: txns, Errors: txErrors(txs, errs)})
+		} else {
+			out, _ = json.Marshal(txns)
+		}
 		w.Write(out)
 		return
 	}
-	w.WriteHeader(400)
-	w.Write(NewPostError("Need to pass ?block=BLOCKHASH or ?address=ADDR", fmt.Errorf("")))
+	writeError(w, "Need to pass ?block=BLOCKHASH or ?address=ADDR", InvalidInput(fmt.Errorf("")))
 }
 
 // HandleGetVersion handles the /version route
@@ -593,15 +630,21 @@ func NewGetBestBlockHashReturn(blockhash string) []byte {
 type PostError struct {
 	Message string `json:"message"`
 	Error   string `json:"error"`
+	Code    string `json:"code,omitempty"`
 }
 
 // NewPostError is a convinence function for returning errors to clients
 func NewPostError(msg string, err error) []byte {
-	out, _ := json.Marshal(PostError{
+	out := PostError{
 		Message: msg,
 		Error:   err.Error(),
-	})
-	return out
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		out.Code = apiErr.Code
+	}
+	o, _ := json.Marshal(out)
+	return o
 }
 
 // SyncResponse models a response to the sync command
@@ -644,7 +687,7 @@ func NewSyncResponse(bc *btcjson.GetBlockChainInfoResult) []byte {
 
 // HandleGetCurrency handles the /currency route
 func (as *AddrServer) HandleGetCurrency(w http.ResponseWriter, r *http.Request) {
-	cd := NewCurrencyData()
+	cd := NewCurrencyData(r.Context())
 	cd.Status = 200
 	w.Write(cd.JSON())
 }
@@ -40,6 +40,7 @@ func handlerTestSetup() (*AddrServer, *httptest.Server) {
 		Pass:    testPass,
 		SSL:     testSSL,
 		Port:    testPort,
+		Network: NetworkMainnet,
 		Version: "test",
 		Commit:  "test",
 		Branch:  "test",
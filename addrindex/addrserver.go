@@ -15,12 +15,21 @@
 package addrindex
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/gorilla/mux"
+	"github.com/jackzampolin/addrindex-server/apikey"
+	"github.com/jackzampolin/addrindex-server/blockstack"
 	"github.com/jackzampolin/addrindex-server/cache"
+	"github.com/jackzampolin/addrindex-server/index"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // AddrServer is the struct where all methods are defined
@@ -30,11 +39,83 @@ type AddrServer struct {
 	Pass            string
 	DisableTLS      bool
 	Port            int
-	Client          *rpcclient.Client
+	Client          *RPCClient
 	Blocks          *Blocks
 	RedisConnection string
+	Network         string
+	Params          *chaincfg.Params
+	StartBlock      int
+	Bind            string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	MaxHeaderBytes  int
+	TLSCert         string
+	TLSKey          string
+	TLSClientCA     string
+	TLSClientAuth   string
+	TLSRedirectPort int
+
+	ReadyMaxBlocksBehind int
+	ReadyMaxTipAge       time.Duration
+
+	APIKeys string
+
+	XpubGapLimit int
+
+	TxsConcurrency int
+	RPCBatchSize   int
+
+	BackendCheckInterval time.Duration
+
+	ReorgDepth         int
+	ReorgCheckInterval time.Duration
+
+	IndexPath string
+
+	BlockstackStorePath string
 
 	versionData versionData
+
+	// tipHeight is the last chain height seen from the node
+	tipHeight atomic.Int64
+
+	// reorgs tracks recent blocks and the reorgs seen
+	reorgs *reorgDetector
+
+	// index answers the address methods when indexPath is configured, with
+	// mempool holding the unconfirmed part
+	index   *index.Index
+	mempool *mempoolIndex
+
+	// blockstackStore keeps the Blockstack operations of the addresses
+	// looked up, in blockstackTemp when no store path is set
+	blockstackStore *blockstack.Store
+	blockstackTemp  string
+
+	// pageCache holds the pages of cached routes
+	pageCache *cache.MemoryCache
+
+	// scanMu serializes scantxoutset calls, the node only runs one at a time
+	scanMu sync.Mutex
+
+	// quit is closed to stop background workers, which register with workers
+	quit      chan struct{}
+	workers   sync.WaitGroup
+	closeOnce sync.Once
+
+	// auth checks API keys when apiKeys is configured
+	auth *apikey.Authenticator
+
+	// limiter rate limits clients when rateLimit is configured
+	limiter *clientLimiter
+
+	// cors handles cross origin requests when corsOrigins is configured
+	cors *corsPolicy
+
+	// stopTracing flushes and stops the span exporter
+	stopTracing func(context.Context) error
 }
 
 func (as *AddrServer) version() []byte {
@@ -50,19 +131,85 @@ type versionData struct {
 
 // AddrServerConfig configures the AddrServer
 type AddrServerConfig struct {
-	Host            string `json:"host"`
-	Usr             string `json:"usr"`
-	Pass            string `json:"pass"`
-	SSL             bool   `json:"ssl"`
-	Port            int    `json:"port"`
-	RedisConnection string `json:"redis"`
-	Version         string
-	Commit          string
-	Branch          string
+	Host            string        `json:"host"`
+	Usr             string        `json:"usr"`
+	Pass            string        `json:"pass"`
+	SSL             bool          `json:"ssl"`
+	Port            int           `json:"port"`
+	RedisConnection string        `json:"redis"`
+	Network         string        `json:"network"`
+	Bind            string        `json:"bind"`
+	ReadTimeout     time.Duration `json:"readTimeout"`
+	WriteTimeout    time.Duration `json:"writeTimeout"`
+	IdleTimeout     time.Duration `json:"idleTimeout"`
+	ShutdownTimeout time.Duration `json:"shutdownTimeout"`
+	MaxHeaderBytes  int           `json:"maxHeaderBytes"`
+	TLSCert         string        `json:"tlsCert"`
+	TLSKey          string        `json:"tlsKey"`
+	TLSClientCA     string        `json:"tlsClientCA"`
+	TLSClientAuth   string        `json:"tlsClientAuth"`
+	TLSRedirectPort int           `json:"tlsRedirectPort"`
+	LogFormat       string        `json:"logFormat"`
+	LogLevel        string        `json:"logLevel"`
+	TraceEndpoint   string        `json:"traceEndpoint"`
+	TraceInsecure   bool          `json:"traceInsecure"`
+	TraceSample     float64       `json:"traceSample"`
+
+	ReadyMaxBlocksBehind int           `json:"readyMaxBlocksBehind"`
+	ReadyMaxTipAge       time.Duration `json:"readyMaxTipAge"`
+
+	APIKeys string `json:"apiKeys"`
+
+	XpubGapLimit int `json:"xpubGapLimit"`
+
+	TxsConcurrency int `json:"txsConcurrency"`
+	RPCBatchSize   int `json:"rpcBatchSize"`
+
+	Backends             []BackendConfig `json:"backends"`
+	BackendCheckInterval time.Duration   `json:"backendCheckInterval"`
+
+	RPCRetries       int           `json:"rpcRetries"`
+	RPCRetryBackoff  time.Duration `json:"rpcRetryBackoff"`
+	BreakerThreshold int           `json:"breakerThreshold"`
+	BreakerCooldown  time.Duration `json:"breakerCooldown"`
+
+	ReorgDepth         int           `json:"reorgDepth"`
+	ReorgCheckInterval time.Duration `json:"reorgCheckInterval"`
+
+	IndexPath string `json:"indexPath"`
+
+	BlockstackStorePath string `json:"blockstackStorePath"`
+
+	RateLimit         float64        `json:"rateLimit"`
+	RateBurst         int            `json:"rateBurst"`
+	RateCosts         map[string]int `json:"rateCosts"`
+	TrustedProxies    []string       `json:"trustedProxies"`
+	MaxRPCConcurrency int            `json:"maxRPCConcurrency"`
+	RPCQueueTimeout   time.Duration  `json:"rpcQueueTimeout"`
+
+	CORSOrigins     []string      `json:"corsOrigins"`
+	CORSMethods     []string      `json:"corsMethods"`
+	CORSHeaders     []string      `json:"corsHeaders"`
+	CORSMaxAge      time.Duration `json:"corsMaxAge"`
+	CORSCredentials bool          `json:"corsCredentials"`
+
+	Version string
+	Commit  string
+	Branch  string
+
+	// ConfigFile is the config file the settings were read from, if any
+	ConfigFile string
 }
 
 // NewAddrServer returns a new AddrServer instance
 func NewAddrServer(cfg *AddrServerConfig) *AddrServer {
+	if err := ConfigureLogging(cfg.LogFormat, cfg.LogLevel); err != nil {
+		panic(err)
+	}
+	stopTracing, err := ConfigureTracing(cfg.TraceEndpoint, cfg.TraceInsecure, cfg.TraceSample, cfg.Version)
+	if err != nil {
+		panic(err)
+	}
 	out := &AddrServer{
 		Host:            cfg.Host,
 		User:            cfg.Usr,
@@ -75,13 +222,46 @@ func NewAddrServer(cfg *AddrServerConfig) *AddrServer {
 			Commit:  cfg.Commit,
 			Branch:  cfg.Branch,
 		},
-		Blocks: &Blocks{},
+		Blocks:      &Blocks{},
+		quit:        make(chan struct{}),
+		stopTracing: stopTracing,
 	}
-	client, err := rpcclient.New(out.connCfg(), nil)
-	if err != nil {
+	out.setHTTPConfig(cfg)
+	out.setHealthConfig(cfg)
+	out.setXpubConfig(cfg)
+	out.setTxsConfig(cfg)
+	out.setBatchConfig(cfg)
+	if err := out.setBackendConfig(cfg); err != nil {
+		panic(err)
+	}
+	out.setRetryConfig(cfg)
+	out.setReorgConfig(cfg)
+	if err := out.setNetwork(cfg.Network); err != nil {
+		panic(err)
+	}
+	if err := out.setIndexConfig(cfg); err != nil {
+		panic(err)
+	}
+	if err := out.setBlockstackConfig(cfg); err != nil {
+		panic(err)
+	}
+	if err := out.setCORSConfig(cfg); err != nil {
+		panic(err)
+	}
+	if err := out.setRateLimitConfig(cfg); err != nil {
 		panic(err)
 	}
-	out.Client = client
+	if err := out.setAPIKeyConfig(cfg); err != nil {
+		panic(err)
+	}
+	out.startWorker(out.pollChainHeight)
+	out.startWorker(out.checkBackends)
+	if out.ReorgDepth > 0 {
+		out.startWorker(out.watchReorgs)
+	}
+	if out.index != nil {
+		out.startWorker(out.syncIndex)
+	}
 	return out
 }
 
@@ -99,55 +279,112 @@ func NewTestAddrServer(cfg *AddrServerConfig) *AddrServer {
 			Branch:  cfg.Branch,
 		},
 		Blocks: &Blocks{},
+		quit:   make(chan struct{}),
 	}
-	client, err := rpcclient.New(out.connCfg(), nil)
-	if err != nil {
+	out.setHTTPConfig(cfg)
+	out.setHealthConfig(cfg)
+	out.setXpubConfig(cfg)
+	out.setTxsConfig(cfg)
+	out.setBatchConfig(cfg)
+	if err := out.setBackendConfig(cfg); err != nil {
+		panic(err)
+	}
+	out.setRetryConfig(cfg)
+	out.setReorgConfig(cfg)
+	if err := out.setNetwork(cfg.Network); err != nil {
+		panic(err)
+	}
+	if err := out.setIndexConfig(cfg); err != nil {
 		panic(err)
 	}
-	out.Client = client
 	return out
 }
 
-// URL returns the backend server's URL
-func (as *AddrServer) URL() string {
-	if as.DisableTLS {
-		return fmt.Sprintf("http://%s:%s@%v", as.User, as.Pass, as.Host)
-	}
-	return fmt.Sprintf("https://%s:%s@%v", as.User, as.Pass, as.Host)
+// startWorker runs f in the background until Close is called
+func (as *AddrServer) startWorker(f func(quit <-chan struct{})) {
+	as.workers.Add(1)
+	go func() {
+		defer as.workers.Done()
+		f(as.quit)
+	}()
 }
 
-func (as *AddrServer) connCfg() *rpcclient.ConnConfig {
-	return &rpcclient.ConnConfig{
-		Host:         as.Host,
-		User:         as.User,
-		Pass:         as.Pass,
-		HTTPPostMode: true,
-		DisableTLS:   as.DisableTLS,
-	}
+// Close stops any background workers, shuts down the RPC client and flushes traces
+func (as *AddrServer) Close() {
+	as.closeOnce.Do(func() {
+		close(as.quit)
+		as.workers.Wait()
+		if as.index != nil {
+			if err := as.index.Close(); err != nil {
+				slog.Warn("Failed closing the address index", "error", err)
+			}
+		}
+		as.closeBlockstack()
+		as.Client.Shutdown()
+		as.Client.WaitForShutdown()
+		if as.stopTracing != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := as.stopTracing(ctx); err != nil {
+				slog.Warn("Failed flushing traces", "error", err)
+			}
+		}
+	})
 }
 
 // Router holds the routing table for the AddrServer
 func (as *AddrServer) Router() *mux.Router {
 	router := mux.NewRouter()
-	c := cache.NewMemoryCache()
+	router.NotFoundHandler = http.HandlerFunc(handleNotFound)
+	router.Use(tracingMiddleware, metricsMiddleware, backendMiddleware)
+	if as.cors != nil {
+		router.Use(as.cors.middleware)
+	}
+	if as.limiter != nil {
+		router.Use(as.limiter.middleware)
+	}
+	if as.auth != nil {
+		router.Use(as.auth.Middleware(routeScope))
+	}
+	router.Use(as.validationMiddleware)
+	if as.pageCache == nil {
+		as.pageCache = cache.NewMemoryCache()
+	}
+	c := as.pageCache
 	cacheTime := "1m"
 
-	router.HandleFunc("/addr/{addr}/utxo", as.HandleAddrUTXO).Methods("GET")
-	router.HandleFunc("/addr/{addr}/balance", as.HandleAddrBalance).Methods("GET")
-	router.HandleFunc("/addr/{addr}/totalReceived", as.HandleAddrRecieved).Methods("GET")
-	router.HandleFunc("/addr/{addr}/totalSent", as.HandleAddrSent).Methods("GET")
-	router.HandleFunc("/addr/{addr}/unconfirmedBalance", as.HandleAddrUnconfirmedBalance).Methods("GET")
-	router.HandleFunc("/tx/{txid}", as.HandleTxGet).Methods("GET")
+	router.HandleFunc("/addr/{addr:"+addressPattern+"}/utxo", as.HandleAddrUTXO).Methods("GET")
+	router.HandleFunc("/addr/{addr:"+addressPattern+"}/balance", as.HandleAddrBalance).Methods("GET")
+	router.HandleFunc("/addr/{addr:"+addressPattern+"}/totalReceived", as.HandleAddrRecieved).Methods("GET")
+	router.HandleFunc("/addr/{addr:"+addressPattern+"}/totalSent", as.HandleAddrSent).Methods("GET")
+	router.HandleFunc("/addr/{addr:"+addressPattern+"}/unconfirmedBalance", as.HandleAddrUnconfirmedBalance).Methods("GET")
+	router.HandleFunc("/addrs/{addrs:"+addressesPattern+"}/utxo", as.HandleAddrsUTXO).Methods("GET")
+	router.HandleFunc("/xpub/{xpub:"+addressPattern+"}/addresses", as.HandleXpubAddresses).Methods("GET")
+	router.HandleFunc("/xpub/{xpub:"+addressPattern+"}/balance", as.HandleXpubBalance).Methods("GET")
+	router.HandleFunc("/xpub/{xpub:"+addressPattern+"}/utxo", as.HandleXpubUTXO).Methods("GET")
+	router.HandleFunc("/xpub/{xpub:"+addressPattern+"}/txs", as.HandleXpubTxs).Methods("GET")
+	router.HandleFunc("/tx/{txid:"+hashPattern+"}", as.HandleTxGet).Methods("GET")
 	router.HandleFunc("/txs", as.HandleGetTransactions).Methods("GET")
-	router.HandleFunc("/rawtx/{txid}", as.HandleRawTxGet).Methods("GET")
+	router.HandleFunc("/rawtx/{txid:"+hashPattern+"}", as.HandleRawTxGet).Methods("GET")
 	router.HandleFunc("/tx/send", as.HandleTransactionSend).Methods("POST")
 	router.HandleFunc("/messages/verify", as.HandleMessagesVerify).Methods("POST")
-	router.HandleFunc("/block/{blockHash}", as.HandleGetBlock).Methods("GET")
+	router.HandleFunc("/descriptor/scan", as.HandleDescriptorScan).Methods("POST")
+	router.HandleFunc("/block/{blockHash:"+hashPattern+"}", as.HandleGetBlock).Methods("GET")
 	router.HandleFunc("/blocks", cache.Middleware(cacheTime, c, as.HandleGetBlocks)).Methods("GET")
-	router.HandleFunc("/block-index/{height}", as.HandleGetBlockHash).Methods("GET")
+	router.HandleFunc("/block-index/{height:"+heightPattern+"}", as.HandleGetBlockHash).Methods("GET")
 	router.HandleFunc("/status", as.HandleGetStatus).Methods("GET")
 	router.HandleFunc("/sync", as.HandleGetSync).Methods("GET")
+	router.HandleFunc("/reorgs", as.HandleGetReorgs).Methods("GET")
+	router.HandleFunc("/blockstack/tx/{txid:"+hashPattern+"}", as.HandleBlockstackTx).Methods("GET")
+	router.HandleFunc("/blockstack/block/{height:"+heightPattern+"}", as.HandleBlockstackBlock).Methods("GET")
+	router.HandleFunc("/blockstack/addr/{addr:"+addressPattern+"}/ops", as.HandleBlockstackAddrOps).Methods("GET")
 	router.HandleFunc("/version", as.HandleGetVersion).Methods("GET")
 	router.HandleFunc("/currency", cache.Middleware(cacheTime, c, as.HandleGetCurrency)).Methods("GET")
+	router.HandleFunc("/healthz", as.HandleHealthz).Methods("GET")
+	router.HandleFunc("/readyz", as.HandleReadyz).Methods("GET")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	if as.cors != nil {
+		addPreflightRoutes(router)
+	}
 	return router
 }
@@ -0,0 +1,63 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jackzampolin/addrindex-server/apikey"
+)
+
+// apiKeyReloadInterval is how often the key file is checked for changes and
+// usage counters are saved
+const apiKeyReloadInterval = 10 * time.Second
+
+// publicRoutes are served without an API key so probes and scrapers keep working
+var publicRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+	"/version": true,
+}
+
+// setAPIKeyConfig turns on API key authentication when a key file is configured
+func (as *AddrServer) setAPIKeyConfig(cfg *AddrServerConfig) error {
+	as.APIKeys = cfg.APIKeys
+	if as.APIKeys == "" {
+		return nil
+	}
+	auth, err := apikey.NewAuthenticator(as.APIKeys)
+	if err != nil {
+		return err
+	}
+	as.auth = auth
+	as.startWorker(func(quit <-chan struct{}) {
+		auth.Watch(quit, apiKeyReloadInterval)
+	})
+	return nil
+}
+
+// routeScope returns the API key scope needed to call the matched route
+func routeScope(r *http.Request) string {
+	tmpl := routeTemplate(r)
+	switch {
+	case publicRoutes[tmpl]:
+		return ""
+	case tmpl == "/tx/send":
+		return apikey.ScopeBroadcast
+	}
+	return apikey.ScopeRead
+}
@@ -0,0 +1,389 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/gorilla/mux"
+)
+
+// DefaultBackendCheckInterval is how often the health of each backend node
+// is checked
+const DefaultBackendCheckInterval = 15 * time.Second
+
+// ErrNoBackends is returned for calls made without any backend configured
+var ErrNoBackends = errors.New("no backend nodes configured")
+
+// BackendConfig configures a backend node
+type BackendConfig struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Usr  string `json:"usr"`
+	Pass string `json:"pass"`
+	SSL  bool   `json:"ssl"`
+}
+
+// BackendStatus is the result of the last health check of a backend
+type BackendStatus struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Height    int64     `json:"height"`
+	Circuit   string    `json:"circuit"`
+	CheckedAt time.Time `json:"checkedAt,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Backend is a bitcoind node the server reads from
+type Backend struct {
+	Name       string
+	Host       string
+	User       string
+	Pass       string
+	DisableTLS bool
+
+	client  *rpcclient.Client
+	breaker *circuitBreaker
+
+	mu      sync.Mutex
+	checked bool
+	status  BackendStatus
+}
+
+// NewBackend returns a backend for the node in cfg, named after its host
+// unless it has a name
+func NewBackend(cfg BackendConfig) (*Backend, error) {
+	out := &Backend{
+		Name:       cfg.Name,
+		Host:       cfg.Host,
+		User:       cfg.Usr,
+		Pass:       cfg.Pass,
+		DisableTLS: !cfg.SSL,
+	}
+	if out.Name == "" {
+		out.Name = cfg.Host
+	}
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         out.Host,
+		User:         out.User,
+		Pass:         out.Pass,
+		HTTPPostMode: true,
+		DisableTLS:   out.DisableTLS,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	out.client = client
+	return out, nil
+}
+
+// URL returns the backend's URL
+func (b *Backend) URL() string {
+	if b.DisableTLS {
+		return fmt.Sprintf("http://%s:%s@%v", b.User, b.Pass, b.Host)
+	}
+	return fmt.Sprintf("https://%s:%s@%v", b.User, b.Pass, b.Host)
+}
+
+// Status returns the result of the backend's last health check. Backends
+// that haven't been checked yet are assumed to be healthy.
+func (b *Backend) Status() BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := b.status
+	out.Name = b.Name
+	out.Circuit = b.breaker.state()
+	if !b.checked {
+		out.Healthy = true
+	}
+	return out
+}
+
+func (b *Backend) setStatus(s BackendStatus) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checked = true
+	b.status = s
+	backendUp.WithLabelValues(b.Name).Set(boolGauge(s.Healthy))
+	if s.Height > 0 {
+		backendHeight.WithLabelValues(b.Name).Set(float64(s.Height))
+	}
+}
+
+// markDown takes the backend out of rotation until its next health check
+func (b *Backend) markDown(err error) {
+	s := b.Status()
+	s.Healthy = false
+	s.Error = err.Error()
+	s.CheckedAt = time.Now()
+	b.setStatus(s)
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// setBackendConfig creates the backends in cfg, or a single backend for the
+// node in the top level host settings. Backends may lag the best one by as
+// many blocks as /readyz allows, so it runs after setHealthConfig.
+func (as *AddrServer) setBackendConfig(cfg *AddrServerConfig) error {
+	as.BackendCheckInterval = durationOrDefault(cfg.BackendCheckInterval, DefaultBackendCheckInterval)
+	configs := cfg.Backends
+	if len(configs) == 0 {
+		configs = []BackendConfig{{Host: cfg.Host, Usr: cfg.Usr, Pass: cfg.Pass, SSL: cfg.SSL}}
+	}
+	seen := map[string]bool{}
+	var backends []*Backend
+	for _, c := range configs {
+		b, err := NewBackend(c)
+		if err != nil {
+			return fmt.Errorf("backend %s: %s", c.Host, err)
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("duplicate backend name %q", b.Name)
+		}
+		seen[b.Name] = true
+		backends = append(backends, b)
+	}
+	as.Client = newRPCClient(backends)
+	as.Client.maxLag = as.ReadyMaxBlocksBehind
+	return nil
+}
+
+// checkBackends checks the health of every backend, every
+// BackendCheckInterval, until quit is closed
+func (as *AddrServer) checkBackends(quit <-chan struct{}) {
+	ticker := time.NewTicker(as.BackendCheckInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range as.Client.backends {
+			wg.Add(1)
+			go func(b *Backend) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), as.BackendCheckInterval)
+				defer cancel()
+				as.checkBackend(ctx, b)
+			}(b)
+		}
+		wg.Wait()
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackend runs the readiness checks against a single backend
+func (as *AddrServer) checkBackend(ctx context.Context, b *Backend) {
+	ctx = withBackend(ctx, b)
+	s := BackendStatus{Name: b.Name, CheckedAt: time.Now()}
+	if height, err := as.Client.GetBlockCount(ctx); err == nil {
+		s.Height = height
+	}
+	ready := as.Ready(ctx)
+	s.Healthy = ready.Status == "ready"
+	for _, c := range ready.Checks {
+		if !c.OK {
+			s.Error = fmt.Sprintf("%s check failed: %s", c.Name, strings.TrimSpace(c.Error+" "+c.Detail))
+			break
+		}
+	}
+	if was := b.Status(); was.Healthy != s.Healthy {
+		slog.Info("Backend health changed", "backend", b.Name, "healthy", s.Healthy, "height", s.Height, "error", s.Error)
+	}
+	b.setStatus(s)
+}
+
+// candidates returns the backends to try for a call, best first. Healthy
+// backends at the best known height come first, in config order or, for
+// requests with a sticky key, in an order picked by the key. Lagging and
+// unhealthy backends are kept as a last resort.
+func (c *RPCClient) candidates(ctx context.Context) []*Backend {
+	if b, ok := ctx.Value(backendKey{}).(*Backend); ok {
+		return []*Backend{b}
+	}
+
+	type ranked struct {
+		b      *Backend
+		status BackendStatus
+		order  uint32
+	}
+	all := make([]ranked, len(c.backends))
+	best := int64(0)
+	for i, b := range c.backends {
+		all[i] = ranked{b: b, status: b.Status(), order: uint32(i)}
+		if all[i].status.Healthy && all[i].status.Height > best {
+			best = all[i].status.Height
+		}
+	}
+	synced := func(r ranked) bool {
+		return r.status.Healthy && (c.maxLag < 0 || best-r.status.Height <= int64(c.maxLag))
+	}
+	if key, ok := ctx.Value(stickyKey{}).(string); ok && key != "" {
+		for i := range all {
+			h := fnv.New32a()
+			h.Write([]byte(key + "/" + all[i].b.Name))
+			all[i].order = h.Sum32()
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if synced(a) != synced(b) {
+			return synced(a)
+		}
+		if synced(a) {
+			return a.order < b.order
+		}
+		if a.status.Healthy != b.status.Healthy {
+			return a.status.Healthy
+		}
+		return a.status.Height > b.status.Height
+	})
+	out := make([]*Backend, len(all))
+	for i, r := range all {
+		out[i] = r.b
+	}
+	return out
+}
+
+// canFailover returns whether a call that failed with err can be made on
+// another backend. Errors from the node itself are answers, not failures.
+// Broadcasts only fail over when the node never got them, so a transaction
+// is never sent twice.
+func canFailover(ctx context.Context, method string, err error) bool {
+	if !isFailure(ctx, err) {
+		return false
+	}
+	if method == "sendrawtransaction" {
+		return notReceived(err)
+	}
+	return true
+}
+
+type backendKey struct{}
+
+// withBackend pins the calls made with ctx to b
+func withBackend(ctx context.Context, b *Backend) context.Context {
+	return context.WithValue(ctx, backendKey{}, b)
+}
+
+type stickyKey struct{}
+
+// servedBy records the backend that answered the calls for a request
+type servedBy struct {
+	mu   sync.Mutex
+	name string
+}
+
+func (s *servedBy) set(name string) {
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+func (s *servedBy) get() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+type servedByKey struct{}
+
+// recordBackend notes that b answered a call made for the request in ctx
+func recordBackend(ctx context.Context, b *Backend) {
+	if s, ok := ctx.Value(servedByKey{}).(*servedBy); ok {
+		s.set(b.Name)
+	}
+}
+
+// backendFromContext returns the backend that last answered a call for the
+// request in ctx
+func backendFromContext(ctx context.Context) string {
+	if s, ok := ctx.Value(servedByKey{}).(*servedBy); ok {
+		return s.get()
+	}
+	return ""
+}
+
+// requestStickyKey returns the key that keeps the pages of a paginated query
+// on the same backend, so their order and totals agree
+func requestStickyKey(r *http.Request) string {
+	if xpub := mux.Vars(r)["xpub"]; xpub != "" {
+		return "xpub:" + xpub
+	}
+	if routeTemplate(r) == "/txs" {
+		query := r.URL.Query()
+		if address := query.Get("address"); address != "" {
+			return "address:" + address
+		}
+		if block := query.Get("block"); block != "" {
+			return "block:" + block
+		}
+	}
+	return ""
+}
+
+// backendMiddleware routes the calls of paginated queries to a sticky
+// backend and reports the backend that served a request in X-Backend
+func backendMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &servedBy{}
+		ctx := context.WithValue(r.Context(), servedByKey{}, s)
+		if key := requestStickyKey(r); key != "" {
+			ctx = context.WithValue(ctx, stickyKey{}, key)
+		}
+		next.ServeHTTP(&backendWriter{ResponseWriter: w, served: s}, r.WithContext(ctx))
+	})
+}
+
+// backendWriter sets X-Backend before the response is written
+type backendWriter struct {
+	http.ResponseWriter
+	served  *servedBy
+	written bool
+}
+
+func (w *backendWriter) WriteHeader(code int) {
+	if !w.written {
+		w.written = true
+		if name := w.served.get(); name != "" {
+			w.Header().Set("X-Backend", name)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *backendWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,117 @@
+package addrindex
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/gorilla/mux"
+)
+
+func backendNames(backends []*Backend) string {
+	var out []string
+	for _, b := range backends {
+		out = append(out, b.Name)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestCandidates(t *testing.T) {
+	c := testBackends(t,
+		BackendStatus{Name: "down", Height: 500},
+		BackendStatus{Name: "lagging", Healthy: true, Height: 490},
+		BackendStatus{Name: "a", Healthy: true, Height: 500},
+		BackendStatus{Name: "b", Healthy: true, Height: 499},
+	)
+
+	if got := backendNames(c.candidates(context.Background())); got != "a,b,lagging,down" {
+		t.Errorf("Expected '%s', got '%s'\n", "a,b,lagging,down", got)
+	}
+
+	// Sticky keys spread queries over the synced backends, and keep each on one
+	picked := map[string]bool{}
+	for _, key := range []string{"address:1", "address:2", "address:3", "address:4", "address:5", "address:6"} {
+		ctx := context.WithValue(context.Background(), stickyKey{}, key)
+		first := backendNames(c.candidates(ctx))
+		for i := 0; i < 3; i++ {
+			if got := backendNames(c.candidates(ctx)); got != first {
+				t.Errorf("Expected '%s' for %s, got '%s'\n", first, key, got)
+			}
+		}
+		if !strings.HasSuffix(first, ",lagging,down") {
+			t.Errorf("Expected only synced backends first for %s, got '%s'\n", key, first)
+		}
+		picked[strings.Split(first, ",")[0]] = true
+	}
+	if len(picked) != 2 {
+		t.Errorf("Expected '%d' backends to serve sticky queries, got '%d'\n", 2, len(picked))
+	}
+
+	// Calls pinned to a backend only go to it
+	ctx := withBackend(context.Background(), c.backends[0])
+	if got := backendNames(c.candidates(ctx)); got != "down" {
+		t.Errorf("Expected '%s', got '%s'\n", "down", got)
+	}
+}
+
+func TestCanFailover(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	reset := &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cases := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		err    error
+		want   bool
+	}{
+		{"refused", context.Background(), "getinfo", refused, true},
+		{"reset", context.Background(), "getinfo", reset, true},
+		{"node error", context.Background(), "getinfo", &btcjson.RPCError{Code: -5}, false},
+		{"busy", context.Background(), "getinfo", ErrRPCBusy, false},
+		{"canceled", canceled, "getinfo", reset, false},
+		{"broadcast refused", context.Background(), "sendrawtransaction", refused, true},
+		{"broadcast reset", context.Background(), "sendrawtransaction", reset, false},
+	}
+	for _, c := range cases {
+		if got := canFailover(c.ctx, c.method, c.err); got != c.want {
+			t.Errorf("%s: Expected '%t', got '%t'\n", c.name, c.want, got)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	txid := "b3922b88ba526df9cab9634785892de245004c96c36ede9b5b50f68abe584e98"
+	as := fakeBitcore(t, 200, `{"result":{"txid":"`+txid+`"},"error":null,"id":null}`, 0)
+	up := as.Client.backends[0]
+	down, err := NewBackend(BackendConfig{Name: "down", Host: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	as.Client = newRPCClient([]*Backend{down, up})
+
+	router := mux.NewRouter()
+	router.Use(backendMiddleware)
+	router.HandleFunc("/tx/{txid}", as.HandleTxGet)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/tx/"+txid, nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected '%d', got '%d' %s\n", http.StatusOK, rr.Code, rr.Body)
+	}
+	if got := rr.Header().Get("X-Backend"); got != up.Name {
+		t.Errorf("Expected '%s', got '%s'\n", up.Name, got)
+	}
+	if down.Status().Healthy {
+		t.Errorf("Expected the unreachable backend to be marked down\n")
+	}
+	if got := backendNames(as.Client.candidates(context.Background())); got != up.Name+",down" {
+		t.Errorf("Expected '%s', got '%s'\n", up.Name+",down", got)
+	}
+}
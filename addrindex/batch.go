@@ -0,0 +1,242 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// DefaultRPCBatchSize is the number of calls sent to the node in one
+// JSON-RPC batch request
+const DefaultRPCBatchSize = 50
+
+func (as *AddrServer) setBatchConfig(cfg *AddrServerConfig) {
+	as.RPCBatchSize = cfg.RPCBatchSize
+	if as.RPCBatchSize <= 0 {
+		as.RPCBatchSize = DefaultRPCBatchSize
+	}
+}
+
+// BatchResult is the response to one call of a batch
+type BatchResult struct {
+	Result json.RawMessage
+	Err    error
+}
+
+// Unmarshal returns the error of the call, or unmarshals its result into out
+func (r BatchResult) Unmarshal(out interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	return json.Unmarshal(r.Result, out)
+}
+
+// batchRequest is a call in a JSON-RPC batch, with the ID its response is
+// matched by
+type batchRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type batchResponse struct {
+	Result json.RawMessage   `json:"result"`
+	Error  *btcjson.RPCError `json:"error"`
+	ID     *int              `json:"id"`
+}
+
+// Batch sends reqs to the node as JSON-RPC batch requests of at most
+// RPCBatchSize calls, up to TxsConcurrency of them at once, and returns the
+// response to each call in order. Calls fail one by one: a batch that can't
+// be sent fails each of its calls. Calls the built-in index answers don't go
+// to the node.
+func (as *AddrServer) Batch(ctx context.Context, reqs []BitcoreRequest) []BatchResult {
+	if as.index == nil {
+		return as.batchNode(ctx, reqs)
+	}
+	out := make([]BatchResult, len(reqs))
+	var local, remote []int
+	var remoteReqs []BitcoreRequest
+	for i, r := range reqs {
+		if as.indexAnswers(r) {
+			local = append(local, i)
+		} else {
+			remote = append(remote, i)
+			remoteReqs = append(remoteReqs, r)
+		}
+	}
+	fetchAll(ctx, len(local), as.TxsConcurrency, true, func(ctx context.Context, i int) error {
+		res := &out[local[i]]
+		res.Result, res.Err = as.callIndex(ctx, reqs[local[i]])
+		return res.Err
+	})
+	for i, res := range as.batchNode(ctx, remoteReqs) {
+		out[remote[i]] = res
+	}
+	return out
+}
+
+// batchNode sends reqs to the node in batches
+func (as *AddrServer) batchNode(ctx context.Context, reqs []BitcoreRequest) []BatchResult {
+	size := as.RPCBatchSize
+	if size <= 0 {
+		size = DefaultRPCBatchSize
+	}
+	out := make([]BatchResult, len(reqs))
+	chunks := (len(reqs) + size - 1) / size
+	fetchAll(ctx, chunks, as.TxsConcurrency, true, func(ctx context.Context, c int) error {
+		start, end := c*size, (c+1)*size
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+		res, err := as.postBitcoreBatch(ctx, reqs[start:end])
+		for i := range res {
+			if err != nil {
+				res[i].Err = err
+			}
+			out[start+i] = res[i]
+		}
+		return err
+	})
+	return out
+}
+
+// postBitcoreBatch sends reqs to the node as a single batch request
+func (as *AddrServer) postBitcoreBatch(ctx context.Context, reqs []BitcoreRequest) (out []BatchResult, err error) {
+	out = make([]BatchResult, len(reqs))
+	body := make([]batchRequest, len(reqs))
+	method := ""
+	for i, r := range reqs {
+		body[i] = batchRequest{JSONRPC: "1.0", ID: i, Method: r.Method, Params: r.Params}
+		if method == "" || method == r.Method {
+			method = r.Method
+		} else {
+			method = "batch"
+		}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return out, err
+	}
+
+	err = as.Client.call(ctx, method, func(ctx context.Context, backend *Backend) error {
+		b, err := as.post(ctx, backend, b)
+		if err != nil {
+			return err
+		}
+		var resps []batchResponse
+		if err := json.Unmarshal(b, &resps); err != nil {
+			// Nodes answer a batch they can't parse with a single error
+			var resp batchResponse
+			if json.Unmarshal(b, &resp) == nil && resp.Error != nil {
+				return resp.Error
+			}
+			return err
+		}
+		answered := make([]bool, len(reqs))
+		for _, resp := range resps {
+			if resp.ID == nil || *resp.ID < 0 || *resp.ID >= len(reqs) || answered[*resp.ID] {
+				continue
+			}
+			answered[*resp.ID] = true
+			out[*resp.ID].Result = resp.Result
+			if resp.Error != nil {
+				out[*resp.ID].Err = resp.Error
+			}
+		}
+		for i := range out {
+			if !answered[i] {
+				out[i].Err = fmt.Errorf("no response to batched %s call", reqs[i].Method)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+// rawTransactionRequests returns verbose getrawtransaction calls for txids
+func rawTransactionRequests(txids []string) []BitcoreRequest {
+	out := make([]BitcoreRequest, len(txids))
+	for i, txid := range txids {
+		out[i] = BitcoreRequest{JSONRPC: "1.0", Method: "getrawtransaction", Params: []interface{}{txid, 1}}
+	}
+	return out
+}
+
+// GetRawTransactions is GetRawTransaction for many transactions, sent in
+// batches. Transactions that can't be fetched are nil, with their error.
+func (as *AddrServer) GetRawTransactions(ctx context.Context, txids []string) ([]*TransactionIns, []error) {
+	out := make([]*TransactionIns, len(txids))
+	errs := make([]error, len(txids))
+	for i, res := range as.Batch(ctx, rawTransactionRequests(txids)) {
+		var tx TransactionIns
+		if errs[i] = res.Unmarshal(&tx); errs[i] != nil {
+			errs[i] = fmt.Errorf("%s: %w", txids[i], errs[i])
+			continue
+		}
+		out[i] = &tx
+	}
+	return out, errs
+}
+
+// GetRawTransactionsVerbose is GetRawTransactionVerbose for many
+// transactions, sent in batches
+func (as *AddrServer) GetRawTransactionsVerbose(ctx context.Context, txids []string) ([]*btcjson.TxRawResult, []error) {
+	out := make([]*btcjson.TxRawResult, len(txids))
+	errs := make([]error, len(txids))
+	for i, res := range as.Batch(ctx, rawTransactionRequests(txids)) {
+		var tx btcjson.TxRawResult
+		if errs[i] = res.Unmarshal(&tx); errs[i] != nil {
+			errs[i] = fmt.Errorf("%s: %w", txids[i], errs[i])
+			continue
+		}
+		out[i] = &tx
+	}
+	return out, errs
+}
+
+// GetBlocksVerbose is GetBlockVerbose for many blocks, sent in batches
+func (as *AddrServer) GetBlocksVerbose(ctx context.Context, hashes []string) ([]*btcjson.GetBlockVerboseResult, []error) {
+	reqs := make([]BitcoreRequest, len(hashes))
+	for i, hash := range hashes {
+		reqs[i] = BitcoreRequest{JSONRPC: "1.0", Method: "getblock", Params: []interface{}{hash, true}}
+	}
+	out := make([]*btcjson.GetBlockVerboseResult, len(hashes))
+	errs := make([]error, len(hashes))
+	for i, res := range as.Batch(ctx, reqs) {
+		var block btcjson.GetBlockVerboseResult
+		if errs[i] = res.Unmarshal(&block); errs[i] != nil {
+			errs[i] = fmt.Errorf("%s: %w", hashes[i], errs[i])
+			continue
+		}
+		out[i] = &block
+	}
+	return out, errs
+}
+
+// firstError returns the first error of errs
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
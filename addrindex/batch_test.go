@@ -0,0 +1,101 @@
+package addrindex
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcutil"
+)
+
+func TestGetRawTransactions(t *testing.T) {
+	node := &fakeNode{answer: func(req fakeRequest) (interface{}, *btcjson.RPCError) {
+		var txid string
+		req.param(0, &txid)
+		switch txid {
+		case "missing":
+			return nil, &btcjson.RPCError{Code: -5, Message: "No information available about transaction"}
+		case "dropped":
+			return nil, noReply
+		}
+		return map[string]interface{}{"txid": txid}, nil
+	}}
+	as := node.start(t)
+
+	txids := []string{"a", "b", "missing", "c", "d", "dropped", "e", "f", "g", "h"}
+	txs, errs := as.GetRawTransactions(context.Background(), txids)
+	if node.batchCount() != 3 {
+		t.Errorf("Expected '%d' batches, got '%d'\n", 3, node.batchCount())
+	}
+	for i, txid := range txids {
+		switch txid {
+		case "missing":
+			if classifyError(errs[i]).Code != CodeNotFound {
+				t.Errorf("Expected '%s' for %s, got '%v'\n", CodeNotFound, txid, errs[i])
+			}
+		case "dropped":
+			if errs[i] == nil || txs[i] != nil {
+				t.Errorf("Expected an error for %s, got '%v'\n", txid, txs[i])
+			}
+		default:
+			if errs[i] != nil || txs[i] == nil || txs[i].Txid != txid {
+				t.Errorf("Expected '%s' at %d, got '%v' '%v'\n", txid, i, txs[i], errs[i])
+			}
+		}
+	}
+}
+
+func TestBatchUnsupported(t *testing.T) {
+	as := &AddrServer{Client: testClient(t, "127.0.0.1:1"), RPCBatchSize: 4}
+	res := as.Batch(context.Background(), rawTransactionRequests([]string{"a", "b"}))
+	for i, r := range res {
+		if r.Err == nil {
+			t.Errorf("Expected an error for call %d, got '%s'\n", i, r.Result)
+		}
+	}
+
+	// A node that can't parse batches answers with a single error
+	as = fakeBitcore(t, 500, `{"result":null,"error":{"code":-32700,"message":"Parse error"},"id":null}`, 0)
+	res = as.Batch(context.Background(), rawTransactionRequests([]string{"a"}))
+	if !strings.Contains(res[0].Err.Error(), "Parse error") {
+		t.Errorf("Expected '%s', got '%v'\n", "Parse error", res[0].Err)
+	}
+}
+
+func TestAddressUTXOsBatch(t *testing.T) {
+	addr := "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"
+	node := &fakeNode{answer: func(req fakeRequest) (interface{}, *btcjson.RPCError) {
+		switch req.Method {
+		case "getinfo":
+			return map[string]interface{}{"blocks": 100}, nil
+		case "getaddressutxos":
+			return []map[string]interface{}{
+				{"address": addr, "txid": "aa", "outputIndex": 0, "script": "76a914", "satoshis": 5000, "height": 91},
+				{"address": addr, "txid": "bb", "outputIndex": 1, "script": "76a914", "satoshis": 7000, "height": 95},
+			}, nil
+		case "getaddressmempool":
+			return []map[string]interface{}{
+				{"address": addr, "txid": "cc", "index": 0, "satoshis": -7000, "prevtxid": "bb", "prevout": 1},
+			}, nil
+		}
+		return nil, nil
+	}}
+	as := node.start(t)
+	as.setNetwork("mainnet")
+	decoded, err := btcutil.DecodeAddress(addr, as.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utxos, err := as.addressUTXOs(context.Background(), []btcutil.Address{decoded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.batchCount() != 1 {
+		t.Errorf("Expected '%d' batch, got '%d'\n", 1, node.batchCount())
+	}
+	if len(utxos) != 1 || utxos[0].Txid != "aa" || utxos[0].Confirmations != 10 {
+		t.Errorf("Expected the unspent 'aa' output with '%d' confirmations, got '%+v'\n", 10, utxos)
+	}
+}
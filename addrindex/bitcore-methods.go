@@ -16,11 +16,79 @@ package addrindex
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/btcsuite/btcd/btcjson"
 )
 
+// postBitcore sends a JSON-RPC request body to the node, or the built-in
+// index when it answers the method, and unmarshals the response into out
+func (as *AddrServer) postBitcore(ctx context.Context, method string, body []byte, out interface{}) error {
+	if as.index != nil {
+		var req BitcoreRequest
+		if json.Unmarshal(body, &req) == nil && as.indexAnswers(req) {
+			return as.postIndex(ctx, req, out)
+		}
+	}
+	return as.postNode(ctx, method, body, out)
+}
+
+// postNode sends a JSON-RPC request body to the node and unmarshals the
+// response into out
+func (as *AddrServer) postNode(ctx context.Context, method string, body []byte, out interface{}) error {
+	return as.Client.call(ctx, method, func(ctx context.Context, backend *Backend) error {
+		b, err := as.post(ctx, backend, body)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(b, out)
+		if err != nil {
+			return err
+		}
+
+		// JSON-RPC errors are returned in the response body
+		var rpcErr struct {
+			Error *btcjson.RPCError `json:"error"`
+		}
+		if json.Unmarshal(b, &rpcErr) == nil && rpcErr.Error != nil {
+			return rpcErr.Error
+		}
+		return nil
+	})
+}
+
+// post sends a JSON-RPC request body to a backend and returns the response body
+func (as *AddrServer) post(ctx context.Context, backend *Backend, body []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", backend.URL(), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	injectTraceContext(ctx, req)
+	req.Header.Set("Content-Type", "text/plain")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// A node with a full work queue answers with plain text
+	if resp.StatusCode != http.StatusOK && bytes.Contains(b, []byte("Work queue depth exceeded")) {
+		return nil, ErrWorkQueueFull
+	}
+	return b, nil
+}
+
 // BitcoreRequest represents a request to a bitcore node
 type BitcoreRequest struct {
 	JSONRPC string        `json:"jsonrpc"`
@@ -48,30 +116,10 @@ func getAddressTxIDsRequest(addresses []string, start int, end int) []byte {
 // GetAddressTxIDs searches for all txid associated with an address.
 //   - Most recient last
 //   - Only confirmed
-func (as *AddrServer) GetAddressTxIDs(addresses []string, start, end int) (GetAddressTxIDsResponse, error) {
+func (as *AddrServer) GetAddressTxIDs(ctx context.Context, addresses []string, start, end int) (GetAddressTxIDsResponse, error) {
 	out := GetAddressTxIDsResponse{}
-	req, err := http.NewRequest("POST", as.URL(), bytes.NewBuffer(getAddressTxIDsRequest(addresses, start, end)))
-	if err != nil {
-		return out, err
-	}
-	req.Header.Set("Content-Type", "text/plain")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return out, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return out, err
-	}
-	err = json.Unmarshal(body, &out)
-	if err != nil {
-		return out, err
-	}
-	return out, nil
+	err := as.postBitcore(ctx, "getaddresstxids", getAddressTxIDsRequest(addresses, start, end), &out)
+	return out, err
 }
 
 // GetAddressTxIDsResponse wraps the return
@@ -95,41 +143,25 @@ func getAddressDeltasRequest(addresses []string, start int, end int) []byte {
 }
 
 // GetAddressDeltas searches for all inputs, outputs and top level detail for transactions
+//
 //   - Only confirmed
 //   - Negative "satoshis" = Vin
 //   - Positve "satoshis"  = Vout
-// {
-//   "satoshis": 30000,
-//   "txid": "20fb69a94413637cb50f65e473f91d2599a04d5a0bf9bf6a5e9e843df2710ea4",
-//   "index": 0,
-//   "blockindex": 165,
-//   "height": 228208,
-//   "address": "12cbQLTFMXRnSzktFkuoG3eHoMeFtpTu3S"
-// }
-func (as *AddrServer) GetAddressDeltas(addresses []string, start, end int) (GetAddressDeltasResponse, error) {
+//
+// A delta looks like:
+//
+//	{
+//	  "satoshis": 30000,
+//	  "txid": "20fb69a94413637cb50f65e473f91d2599a04d5a0bf9bf6a5e9e843df2710ea4",
+//	  "index": 0,
+//	  "blockindex": 165,
+//	  "height": 228208,
+//	  "address": "12cbQLTFMXRnSzktFkuoG3eHoMeFtpTu3S"
+//	}
+func (as *AddrServer) GetAddressDeltas(ctx context.Context, addresses []string, start, end int) (GetAddressDeltasResponse, error) {
 	out := GetAddressDeltasResponse{}
-	req, err := http.NewRequest("POST", as.URL(), bytes.NewBuffer(getAddressDeltasRequest(addresses, start, end)))
-	if err != nil {
-		return out, err
-	}
-	req.Header.Set("Content-Type", "text/plain")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return out, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return out, err
-	}
-	err = json.Unmarshal(body, &out)
-	if err != nil {
-		return out, err
-	}
-	return out, nil
+	err := as.postBitcore(ctx, "getaddressdeltas", getAddressDeltasRequest(addresses, start, end), &out)
+	return out, err
 }
 
 // GetAddressDeltasResponse is the response struct for GetAddressDeltas
@@ -153,31 +185,10 @@ func getAddressBalanceRequest(addresses []string) []byte {
 }
 
 // GetAddressBalance returns the balance of confirmed transactions
-func (as *AddrServer) GetAddressBalance(addresses []string) (GetAddressBalanceResult, error) {
+func (as *AddrServer) GetAddressBalance(ctx context.Context, addresses []string) (GetAddressBalanceResult, error) {
 	out := GetAddressBalanceResult{}
-	req, err := http.NewRequest("POST", as.URL(), bytes.NewBuffer(getAddressBalanceRequest(addresses)))
-	if err != nil {
-		return out, err
-	}
-	req.Header.Set("Content-Type", "text/plain")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return out, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return out, err
-	}
-
-	err = json.Unmarshal(body, &out)
-	if err != nil {
-		return out, err
-	}
-	return out, nil
+	err := as.postBitcore(ctx, "getaddressbalance", getAddressBalanceRequest(addresses), &out)
+	return out, err
 }
 
 // GetAddressBalanceResult is the response struct for GetAddressBalance
@@ -201,31 +212,10 @@ func getAddressUTXORequest(addresses []string) []byte {
 }
 
 // GetAddressUTXOs returns the list of UTXO for an address sorted by block height
-func (as *AddrServer) GetAddressUTXOs(addresses []string) (GetAddressUTXOsResponse, error) {
+func (as *AddrServer) GetAddressUTXOs(ctx context.Context, addresses []string) (GetAddressUTXOsResponse, error) {
 	out := GetAddressUTXOsResponse{}
-	req, err := http.NewRequest("POST", as.URL(), bytes.NewBuffer(getAddressUTXORequest(addresses)))
-	if err != nil {
-		return out, err
-	}
-	req.Header.Set("Content-Type", "text/plain")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return out, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return out, err
-	}
-
-	err = json.Unmarshal(body, &out)
-	if err != nil {
-		return out, err
-	}
-	return out, nil
+	err := as.postBitcore(ctx, "getaddressutxos", getAddressUTXORequest(addresses), &out)
+	return out, err
 }
 
 // GetAddressUTXOsResponse is the response struct for GetAddressUTXOs
@@ -249,42 +239,26 @@ func getAddressMempoolRequest(addresses []string) []byte {
 }
 
 // GetAddressMempool returns GetAddressDeltas but for the mempool:
+//
 //   - Only Mempool
 //   - Negative "satoshis" = Vin
 //   - Positve "satoshis"  = Vout
-// {
-// 	"address": "3M366gYcKHbvun6YYF1Xim6sDeT5JSTVUy",
-// 	"txid": "ff21363aa331f2dc7bbf70acc7eefb7a4080645d30b4e319ca190ceaecbcce42",
-// 	"index": 0,
-// 	"satoshis": -10684303,
-// 	"timestamp": 1463602662,
-// 	"prevtxid": "0c15f067d6b082f4dcc2740f039d33bb4f47b23c79ceae880ca759268389f82a",
-// 	"prevout": 1
-// },
-func (as *AddrServer) GetAddressMempool(addresses []string) (GetAddressMempoolResponse, error) {
+//
+// An entry looks like:
+//
+//	{
+//		"address": "3M366gYcKHbvun6YYF1Xim6sDeT5JSTVUy",
+//		"txid": "ff21363aa331f2dc7bbf70acc7eefb7a4080645d30b4e319ca190ceaecbcce42",
+//		"index": 0,
+//		"satoshis": -10684303,
+//		"timestamp": 1463602662,
+//		"prevtxid": "0c15f067d6b082f4dcc2740f039d33bb4f47b23c79ceae880ca759268389f82a",
+//		"prevout": 1
+//	},
+func (as *AddrServer) GetAddressMempool(ctx context.Context, addresses []string) (GetAddressMempoolResponse, error) {
 	out := GetAddressMempoolResponse{}
-	req, err := http.NewRequest("POST", as.URL(), bytes.NewBuffer(getAddressMempoolRequest(addresses)))
-	if err != nil {
-		return out, err
-	}
-	req.Header.Set("Content-Type", "text/plain")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return out, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return out, err
-	}
-	err = json.Unmarshal(body, &out)
-	if err != nil {
-		return out, err
-	}
-	return out, nil
+	err := as.postBitcore(ctx, "getaddressmempool", getAddressMempoolRequest(addresses), &out)
+	return out, err
 }
 
 // GetAddressMempoolResponse is the response struct for GetAddressMempool
@@ -308,30 +282,10 @@ func getBlockHashesRequest(start, end int) []byte {
 }
 
 // GetBlockHashes returns blockhashes between two unix epoch timestamps (seconds)
-func (as *AddrServer) GetBlockHashes(end, start int) (GetBlockHashesResponse, error) {
+func (as *AddrServer) GetBlockHashes(ctx context.Context, end, start int) (GetBlockHashesResponse, error) {
 	out := GetBlockHashesResponse{}
-	req, err := http.NewRequest("POST", as.URL(), bytes.NewBuffer(getBlockHashesRequest(end, start)))
-	if err != nil {
-		return out, err
-	}
-	req.Header.Set("Content-Type", "text/plain")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return out, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return out, err
-	}
-	err = json.Unmarshal(body, &out)
-	if err != nil {
-		return out, err
-	}
-	return out, nil
+	err := as.postBitcore(ctx, "getblockhashes", getBlockHashesRequest(end, start), &out)
+	return out, err
 }
 
 // GetBlockHashesResponse is response struct for GetBlockHashes
@@ -355,31 +309,10 @@ func getSpentInfoRequest(txid string, index int) []byte {
 }
 
 // GetSpentInfo returns the txid and input index that has spent the output
-func (as *AddrServer) GetSpentInfo(txid string, index int) (GetSpentInfoResponse, error) {
+func (as *AddrServer) GetSpentInfo(ctx context.Context, txid string, index int) (GetSpentInfoResponse, error) {
 	out := GetSpentInfoResponse{}
-	req, err := http.NewRequest("POST", as.URL(), bytes.NewBuffer(getSpentInfoRequest(txid, index)))
-	if err != nil {
-		return out, err
-	}
-	req.Header.Set("Content-Type", "text/plain")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return out, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return out, err
-	}
-
-	err = json.Unmarshal(body, &out)
-	if err != nil {
-		return out, err
-	}
-	return out, nil
+	err := as.postBitcore(ctx, "getspentinfo", getSpentInfoRequest(txid, index), &out)
+	return out, err
 }
 
 // GetSpentInfoResponse is response struct for GetSpentInfo
@@ -408,30 +341,10 @@ func getRawTransactionRequest(addresses string) []byte {
 // previous output value as well as the  address. The vout values will also now include a valueSat
 // (an integer in satoshis). It will also include  spentTxId, spentIndex and spentHeight that corresponds
 // with the input that spent the output.
-func (as *AddrServer) GetRawTransaction(txn string) (GetRawTransactionResponse, error) {
+func (as *AddrServer) GetRawTransaction(ctx context.Context, txn string) (GetRawTransactionResponse, error) {
 	out := GetRawTransactionResponse{}
-	req, err := http.NewRequest("POST", as.URL(), bytes.NewBuffer(getRawTransactionRequest(txn)))
-	if err != nil {
-		return out, err
-	}
-	req.Header.Set("Content-Type", "text/plain")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return out, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return out, err
-	}
-	err = json.Unmarshal(body, &out)
-	if err != nil {
-		return out, err
-	}
-	return out, nil
+	err := as.postBitcore(ctx, "getrawtransaction", getRawTransactionRequest(txn), &out)
+	return out, err
 }
 
 // GetRawTransactionResponse facilitates return
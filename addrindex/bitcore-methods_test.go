@@ -1,6 +1,7 @@
 package addrindex
 
 import (
+	"context"
 	"testing"
 )
 
@@ -23,6 +24,7 @@ func bitcoreTestSetup() *AddrServer {
 		Pass:    testPass,
 		SSL:     testSSL,
 		Port:    testPort,
+		Network: NetworkMainnet,
 		Version: "test",
 		Commit:  "test",
 		Branch:  "test",
@@ -32,7 +34,7 @@ func bitcoreTestSetup() *AddrServer {
 func TestGetAddressTxIDs(t *testing.T) {
 	t.Parallel()
 	as := bitcoreTestSetup()
-	out, err := as.GetAddressTxIDs([]string{testAddress}, startBlock, endBlock)
+	out, err := as.GetAddressTxIDs(context.Background(), []string{testAddress}, startBlock, endBlock)
 
 	if err != nil {
 		t.Fatal(err)
@@ -46,7 +48,7 @@ func TestGetAddressTxIDs(t *testing.T) {
 func TestGetAddressDeltas(t *testing.T) {
 	t.Parallel()
 	as := bitcoreTestSetup()
-	out, err := as.GetAddressDeltas([]string{testAddress}, startBlock, endBlock)
+	out, err := as.GetAddressDeltas(context.Background(), []string{testAddress}, startBlock, endBlock)
 
 	if err != nil {
 		t.Fatal(err)
@@ -60,7 +62,7 @@ func TestGetAddressDeltas(t *testing.T) {
 func TestGetAddressBalance(t *testing.T) {
 	t.Parallel()
 	as := bitcoreTestSetup()
-	out, err := as.GetAddressBalance([]string{testAddress})
+	out, err := as.GetAddressBalance(context.Background(), []string{testAddress})
 
 	if err != nil {
 		t.Fatal(err)
@@ -74,7 +76,7 @@ func TestGetAddressBalance(t *testing.T) {
 func TestGetAddressUTXOs(t *testing.T) {
 	t.Parallel()
 	as := bitcoreTestSetup()
-	out, err := as.GetAddressUTXOs([]string{testAddress})
+	out, err := as.GetAddressUTXOs(context.Background(), []string{testAddress})
 
 	if err != nil {
 		t.Fatal(err)
@@ -94,21 +96,21 @@ func TestGetAddressMempool(t *testing.T) {
 	as := bitcoreTestSetup()
 
 	// Fetch the raw mempool from the server
-	mp, err := as.Client.GetRawMempool()
+	mp, err := as.Client.GetRawMempool(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Fetch details for one of those transactions
 	tx := mp[0].String()
-	raw, err := as.GetRawTransaction(tx)
+	raw, err := as.GetRawTransaction(context.Background(), tx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Run GetAddressMempool with the resulting address
 	address := raw.Result.Vout[0].ScriptPubKey.Addresses[0]
-	out, err := as.GetAddressMempool([]string{address})
+	out, err := as.GetAddressMempool(context.Background(), []string{address})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,7 +132,7 @@ func TestGetBlockHashes(t *testing.T) {
 	t.Parallel()
 	as := bitcoreTestSetup()
 
-	hashes, err := as.GetBlockHashes(testBlockEndTime, testBlockStartTime)
+	hashes, err := as.GetBlockHashes(context.Background(), testBlockEndTime, testBlockStartTime)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -144,7 +146,7 @@ func TestGetSpentInfo(t *testing.T) {
 	t.Parallel()
 	as := bitcoreTestSetup()
 
-	spent, err := as.GetSpentInfo(testTransaction, testTransactionIndex)
+	spent, err := as.GetSpentInfo(context.Background(), testTransaction, testTransactionIndex)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -157,7 +159,7 @@ func TestGetSpentInfo(t *testing.T) {
 func TestGetRawTransaction(t *testing.T) {
 	t.Parallel()
 	as := bitcoreTestSetup()
-	txn, err := as.GetRawTransaction(testTransaction)
+	txn, err := as.GetRawTransaction(context.Background(), testTransaction)
 	if err != nil {
 		t.Fatal(err)
 	}
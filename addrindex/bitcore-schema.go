@@ -116,6 +116,8 @@ type UTXOInsOut struct {
 	Txid          string  `json:"txid"`
 	OutputIndex   int     `json:"vout"`
 	Script        string  `json:"script,omitempty"`
+	ScriptType    string  `json:"scriptType,omitempty"`
+	Path          string  `json:"path,omitempty"`
 	Satoshis      int     `json:"satoshis,omitempty"`
 	Amount        float64 `json:"amount,omitempty"`
 	Height        int     `json:"height,omitempty"`
@@ -1,13 +1,12 @@
 package addrindex
 
 import (
+	"context"
 	"encoding/json"
-	"log"
 	"sync"
 	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
-	"github.com/btcsuite/btcd/chaincfg/chainhash"
 )
 
 // Blocks represents the cached /blocks response
@@ -18,11 +17,11 @@ type Blocks struct {
 }
 
 // GetBlocksResponse pulls new values for the blocks
-func (as *AddrServer) GetBlocksResponse(limit int64) []byte {
+func (as *AddrServer) GetBlocksResponse(ctx context.Context, limit int64) []byte {
 	now := time.Now()
-	blocks, err := as.GetBlockHashes(int(now.Unix()), int(now.Add(-24*time.Hour).Unix()))
+	blocks, err := as.GetBlockHashes(ctx, int(now.Unix()), int(now.Add(-24*time.Hour).Unix()))
 	if err != nil {
-		log.Println("Failed fetching block hashes")
+		logger(ctx).Warn("Failed fetching block hashes", "error", err)
 		return []byte("")
 	}
 	var toQuery []string
@@ -31,18 +30,14 @@ func (as *AddrServer) GetBlocksResponse(limit int64) []byte {
 	}
 	toQuery = toQuery[:limit]
 
+	blocksData, errs := as.GetBlocksVerbose(ctx, toQuery)
+	if err := firstError(errs); err != nil {
+		logger(ctx).Warn("Failed fetching block data", "error", err)
+		return []byte("")
+	}
+
 	var out []GetBlocksResponse
-	for _, blh := range toQuery {
-		blockHash, err := chainhash.NewHashFromStr(blh)
-		if err != nil {
-			log.Println("Failed creating chainhash from block data")
-			continue
-		}
-		block, err := as.Client.GetBlockVerbose(blockHash)
-		if err != nil {
-			log.Println("Failed fetching block data")
-			return []byte("")
-		}
+	for _, block := range blocksData {
 		out = append(out, newGetBlockResponse(block))
 	}
 	ret := &Blocks{
@@ -0,0 +1,363 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/gorilla/mux"
+	"github.com/jackzampolin/addrindex-server/blockstack"
+)
+
+// blockstackConfirmations is how deep the blocks of an address scan must be
+// for its operations to be stored. Newer blocks are scanned on every lookup.
+const blockstackConfirmations = 6
+
+// BlockstackBlock is the response of /blockstack/block/{height}
+type BlockstackBlock struct {
+	Height int64             `json:"height"`
+	Hash   string            `json:"hash"`
+	Ops    []blockstack.TxOp `json:"ops"`
+}
+
+// BlockstackOpsPage is the response of /blockstack/addr/{addr}/ops
+type BlockstackOpsPage struct {
+	TotalItems int               `json:"totalItems"`
+	PagesTotal int               `json:"pagesTotal"`
+	PageSize   int               `json:"pageSize"`
+	Ops        []blockstack.TxOp `json:"ops"`
+
+	// Next is the cursor for the following page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// setBlockstackConfig opens the store of address operations. It defaults to
+// blockstack.db next to the built-in index or the config file, and to a
+// temporary directory kept until Close without either or when that can't be
+// opened, as config directories are often read only or shared. Only a store
+// path set explicitly has to open. Operations from blocks that left the best
+// chain are dropped after reorgs, so nothing is stored while reorg detection
+// is off.
+func (as *AddrServer) setBlockstackConfig(cfg *AddrServerConfig) error {
+	as.BlockstackStorePath = cfg.BlockstackStorePath
+	if as.ReorgDepth < 0 {
+		return nil
+	}
+	var store *blockstack.Store
+	switch {
+	case as.BlockstackStorePath != "":
+		s, err := blockstack.OpenStore(as.BlockstackStorePath)
+		if err != nil {
+			return err
+		}
+		store = s
+	case cfg.IndexPath != "":
+		store = as.openDefaultBlockstackStore(siblingPath(cfg.IndexPath, ".blockstack.db"))
+	case cfg.ConfigFile != "":
+		store = as.openDefaultBlockstackStore(siblingPath(cfg.ConfigFile, ".blockstack.db"))
+	default:
+		store = as.openTempBlockstackStore()
+	}
+	if store == nil {
+		return nil
+	}
+	as.blockstackStore = store
+	as.OnReorg(func(ev ReorgEvent) {
+		if err := store.Rewind(int32(ev.ForkHeight) + 1); err != nil {
+			slog.Warn("Failed rewinding the Blockstack store", "forkHeight", ev.ForkHeight, "error", err)
+		}
+	})
+	return nil
+}
+
+// openDefaultBlockstackStore opens the store at path, falling back to a
+// temporary one
+func (as *AddrServer) openDefaultBlockstackStore(path string) *blockstack.Store {
+	store, err := blockstack.OpenStore(path)
+	if err != nil {
+		slog.Warn("Failed opening the Blockstack store, using a temporary one", "path", path, "error", err)
+		return as.openTempBlockstackStore()
+	}
+	return store
+}
+
+// openTempBlockstackStore opens a store in a temporary directory, removed on
+// Close. Without one, Blockstack operations are scanned on every lookup.
+func (as *AddrServer) openTempBlockstackStore() *blockstack.Store {
+	dir, err := os.MkdirTemp("", "addrindex-blockstack")
+	if err != nil {
+		slog.Warn("Failed creating a temporary Blockstack store, operations won't be stored", "error", err)
+		return nil
+	}
+	store, err := blockstack.OpenStore(filepath.Join(dir, "blockstack.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		slog.Warn("Failed opening a temporary Blockstack store, operations won't be stored", "error", err)
+		return nil
+	}
+	as.blockstackTemp = dir
+	return store
+}
+
+// siblingPath replaces the extension of path with ext
+func siblingPath(path, ext string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ext
+}
+
+// closeBlockstack closes the store of address operations, removing it when
+// it's temporary
+func (as *AddrServer) closeBlockstack() {
+	if as.blockstackStore == nil {
+		return
+	}
+	if err := as.blockstackStore.Close(); err != nil {
+		slog.Warn("Failed closing the Blockstack store", "error", err)
+	}
+	if as.blockstackTemp != "" {
+		os.RemoveAll(as.blockstackTemp)
+	}
+}
+
+// HandleBlockstackAddrOps handles the /blockstack/addr/{addr}/ops route.
+// Operations are listed newest first and paged like /txs?address=.
+func (as *AddrServer) HandleBlockstackAddrOps(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	addr := mux.Vars(r)["addr"]
+	decoded, err := as.DecodeAddress(addr)
+	if err != nil {
+		writeError(w, fmt.Sprintf("invalid %s address", as.Network), InvalidInput(err))
+		return
+	}
+	params, err := parsePageParams(r.URL.Query())
+	if err != nil {
+		writeError(w, "invalid paging parameters", InvalidInput(err))
+		return
+	}
+
+	ops, err := as.addressOps(r.Context(), addr)
+	if err != nil {
+		writeError(w, "error scanning address for Blockstack operations", addressIndexError([]btcutil.Address{decoded}, err))
+		return
+	}
+
+	items := make([]txAnchor, len(ops))
+	byTxid := map[string]blockstack.TxOp{}
+	for i, op := range ops {
+		items[len(ops)-1-i] = txAnchor{Txid: op.Txid, Height: op.BlockHeight, Index: *op.Vtxindex}
+		byTxid[op.Txid] = op
+	}
+	anchors, next := pageTxAnchors(items, params)
+	out := BlockstackOpsPage{
+		TotalItems: len(items),
+		PagesTotal: (len(items) + params.size - 1) / params.size,
+		PageSize:   params.size,
+		Ops:        []blockstack.TxOp{},
+		Next:       next,
+	}
+	for _, a := range anchors {
+		out.Ops = append(out.Ops, byTxid[a.Txid])
+	}
+
+	b, _ := json.Marshal(out)
+	w.Write(b)
+}
+
+// addressOps returns the operations of the confirmed transactions of addr,
+// oldest first. Only the blocks after the last stored scan are scanned, and
+// the operations at least blockstackConfirmations deep are stored. Without a
+// store every lookup scans all blocks.
+func (as *AddrServer) addressOps(ctx context.Context, addr string) ([]blockstack.TxOp, error) {
+	stored, scanned := []blockstack.TxOp{}, int32(-1)
+	if as.blockstackStore != nil {
+		var err error
+		if stored, scanned, err = as.blockstackStore.Ops(addr); err != nil {
+			return nil, err
+		}
+	}
+	info, err := as.Client.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tip := int(info.Blocks)
+	start := int(scanned) + 1
+	if start < as.StartBlock {
+		start = as.StartBlock
+	}
+	if start > tip {
+		return stored, nil
+	}
+
+	// Deltas carry the height and block position of the transactions
+	deltas, err := as.GetAddressDeltas(ctx, []string{addr}, start, tip)
+	if err != nil {
+		return nil, err
+	}
+	anchors := txAnchors(deltas.Result)
+	txids := make([]string, len(anchors))
+	for i, a := range anchors {
+		txids[len(anchors)-1-i] = a.Txid
+	}
+	txs, errs := as.GetRawTransactions(ctx, txids)
+	if err := firstError(errs); err != nil {
+		return nil, err
+	}
+
+	var found, deep []blockstack.TxOp
+	final := tip - blockstackConfirmations
+	for i, tx := range txs {
+		msg, err := decodeTxHex(tx.Hex)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", txids[i], err)
+		}
+		op, err := blockstack.Decode(msg, as.Params)
+		if err != nil {
+			continue
+		}
+		a := anchors[len(anchors)-1-i]
+		txOp := newTxOp(tx, op)
+		txOp.BlockHeight = a.Height
+		txOp.Vtxindex = &a.Index
+		found = append(found, txOp)
+		if a.Height <= final {
+			deep = append(deep, txOp)
+		}
+	}
+	if as.blockstackStore != nil && final >= start {
+		if err := as.blockstackStore.Add(addr, int32(final), deep); err != nil {
+			return nil, err
+		}
+	}
+	return append(stored, found...), nil
+}
+
+// HandleBlockstackTx handles the /blockstack/tx/{txid} route
+func (as *AddrServer) HandleBlockstackTx(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	txid := mux.Vars(r)["txid"]
+
+	tx, err := as.GetRawTransaction(r.Context(), txid)
+	if err != nil {
+		writeError(w, "error fetching transaction", err)
+		return
+	}
+	msg, err := decodeTxHex(tx.Result.Hex)
+	if err != nil {
+		writeError(w, "error decoding transaction", err)
+		return
+	}
+	op, err := blockstack.Decode(msg, as.Params)
+	if err != nil {
+		writeError(w, "error decoding Blockstack operation", NotFound(fmt.Errorf("transaction %s: %w", txid, err)))
+		return
+	}
+
+	out, _ := json.Marshal(newTxOp(&tx.Result, op))
+	w.Write(out)
+}
+
+// HandleBlockstackBlock handles the /blockstack/block/{height} route.
+// Operations that don't match the wire format are left out, as Blockstack
+// nodes ignore them.
+func (as *AddrServer) HandleBlockstackBlock(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	h, err := ParseHeight(mux.Vars(r)["height"])
+	if err != nil {
+		writeError(w, "error parsing blockheight", InvalidInput(err))
+		return
+	}
+
+	hash, err := as.Client.GetBlockHash(r.Context(), h)
+	if err != nil {
+		writeError(w, "error fetching blockhash", err)
+		return
+	}
+	out := BlockstackBlock{Height: h, Hash: hash.String(), Ops: []blockstack.TxOp{}}
+
+	// There are no operations before Blockstack started
+	if h >= int64(as.StartBlock) {
+		block, err := as.Client.GetBlock(r.Context(), hash)
+		if err != nil {
+			writeError(w, "error fetching block", err)
+			return
+		}
+		out.Ops, err = as.blockstackOps(r.Context(), block, int(h))
+		if err != nil {
+			writeError(w, "error fetching Blockstack transactions", err)
+			return
+		}
+	}
+
+	b, _ := json.Marshal(out)
+	w.Write(b)
+}
+
+// blockstackOps decodes the Blockstack operations of block and looks up
+// their senders
+func (as *AddrServer) blockstackOps(ctx context.Context, block *wire.MsgBlock, height int) ([]blockstack.TxOp, error) {
+	out := []blockstack.TxOp{}
+	var txids []string
+	for i, tx := range block.Transactions {
+		op, err := blockstack.Decode(tx, as.Params)
+		if err != nil {
+			continue
+		}
+		vtxindex := i
+		txids = append(txids, tx.TxHash().String())
+		out = append(out, blockstack.TxOp{Txid: txids[len(txids)-1], BlockHeight: height, Vtxindex: &vtxindex, Op: op})
+	}
+
+	txs, errs := as.GetRawTransactions(ctx, txids)
+	for i := range out {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if len(txs[i].Vin) > 0 {
+			out[i].Sender = txs[i].Vin[0].Address
+		}
+	}
+	return out, nil
+}
+
+func newTxOp(tx *TransactionIns, op *blockstack.Op) blockstack.TxOp {
+	out := blockstack.TxOp{Txid: tx.Txid, BlockHeight: tx.Height, Op: op}
+	if len(tx.Vin) > 0 {
+		out.Sender = tx.Vin[0].Address
+	}
+	return out
+}
+
+// decodeTxHex decodes a serialized transaction
+func decodeTxHex(s string) (*wire.MsgTx, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	tx := &wire.MsgTx{}
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
@@ -0,0 +1,177 @@
+package addrindex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/gorilla/mux"
+	"github.com/jackzampolin/addrindex-server/blockstack"
+)
+
+func TestHandleBlockstackTx(t *testing.T) {
+	txid := "d4b7a02a6ae8a6fd2ef0a4e6fd8b5b1c2e5a4e4a77e79d3a54b8b7bd1c5c33b1"
+	sender := "1DzFvZ4mJFETpbJ86NKUGM4Pfe6yjZ8Lac"
+	as := fakeBitcore(t, 200, `{"result":{"hex":"`+testExpectedBlockHash+`","txid":"`+txid+`","height":500000,"vin":[{"address":"`+sender+`"}]},"error":null,"id":null}`, 0)
+	as.Params = &chaincfg.MainNetParams
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blockstack/tx/{txid}", as.HandleBlockstackTx)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/blockstack/tx/"+txid, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected '%d', got '%d' %s\n", http.StatusOK, rr.Code, rr.Body)
+	}
+
+	var op blockstack.TxOp
+	if err := json.Unmarshal(rr.Body.Bytes(), &op); err != nil {
+		t.Fatal(err)
+	}
+	if op.Op == nil || op.Opcode != blockstack.NameUpdate || op.Sender != sender || op.BlockHeight != 500000 || op.Txid != txid {
+		t.Errorf("Expected a NAME_UPDATE from '%s', got '%s'\n", sender, rr.Body)
+	}
+
+	// Transactions without an operation aren't found
+	as = fakeBitcore(t, 200, `{"result":{"hex":"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff00ffffffff0100000000000000001976a9148ef6cfc4c8ee2e6142001c94275ff47d3f05886588ac00000000","txid":"`+txid+`"},"error":null,"id":null}`, 0)
+	as.Params = &chaincfg.MainNetParams
+	router = mux.NewRouter()
+	router.HandleFunc("/blockstack/tx/{txid}", as.HandleBlockstackTx)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/blockstack/tx/"+txid, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected '%d', got '%d' %s\n", http.StatusNotFound, rr.Code, rr.Body)
+	}
+}
+
+func TestHandleBlockstackAddrOps(t *testing.T) {
+	addr := "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"
+	noop := "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff00ffffffff0100000000000000001976a9148ef6cfc4c8ee2e6142001c94275ff47d3f05886588ac00000000"
+	tip := 500100
+	deltas := []map[string]interface{}{
+		{"txid": "aa", "height": 500000, "blockindex": 3, "address": addr},
+		{"txid": "bb", "height": 500050, "blockindex": 1, "address": addr},
+		{"txid": "cc", "height": 500098, "blockindex": 7, "address": addr},
+	}
+	hexes := map[string]string{"aa": testExpectedBlockHash, "bb": noop, "cc": testExpectedBlockHash}
+	var scans []int
+	node := &fakeNode{answer: func(req fakeRequest) (interface{}, *btcjson.RPCError) {
+		switch req.Method {
+		case "getinfo":
+			return map[string]interface{}{"blocks": tip}, nil
+		case "getaddressdeltas":
+			var params struct{ Start int }
+			req.param(0, &params)
+			scans = append(scans, params.Start)
+			out := []map[string]interface{}{}
+			for _, d := range deltas {
+				if d["height"].(int) >= params.Start {
+					out = append(out, d)
+				}
+			}
+			return out, nil
+		case "getrawtransaction":
+			var txid string
+			req.param(0, &txid)
+			return map[string]interface{}{"txid": txid, "hex": hexes[txid], "vin": []map[string]string{{"address": addr}}}, nil
+		}
+		return nil, nil
+	}}
+	as := node.start(t)
+	cfg := &AddrServerConfig{BlockstackStorePath: filepath.Join(t.TempDir(), "blockstack.db")}
+	as.setNetwork("mainnet")
+	as.setReorgConfig(cfg)
+	if err := as.setBlockstackConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer as.closeBlockstack()
+	router := mux.NewRouter()
+	router.HandleFunc("/blockstack/addr/{addr}/ops", as.HandleBlockstackAddrOps)
+	get := func(query string) BlockstackOpsPage {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/blockstack/addr/"+addr+"/ops"+query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected '%d', got '%d' %s\n", http.StatusOK, rr.Code, rr.Body)
+		}
+		var out BlockstackOpsPage
+		if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	page := get("?pageSize=1")
+	if page.TotalItems != 2 || len(page.Ops) != 1 || page.Ops[0].Txid != "cc" || page.Next == "" {
+		t.Errorf("Expected 'cc' of '%d' operations, got '%+v'\n", 2, page)
+	}
+	page = get("?pageSize=1&cursor=" + page.Next)
+	if len(page.Ops) != 1 || page.Ops[0].Txid != "aa" || *page.Ops[0].Vtxindex != 3 || page.Ops[0].Sender != addr || page.Next != "" {
+		t.Errorf("Expected 'aa' at vtxindex '%d', got '%+v'\n", 3, page)
+	}
+
+	// The second lookup only scans the blocks that weren't deep enough to store
+	tip++
+	page = get("")
+	if len(page.Ops) != 2 || page.Ops[0].Txid != "cc" || page.Ops[1].Txid != "aa" {
+		t.Errorf("Expected 'cc, aa', got '%+v'\n", page.Ops)
+	}
+	if len(scans) != 3 || scans[0] != BlockstackStartBlock || scans[2] != 500095 {
+		t.Errorf("Expected scans from '%d', got '%v'\n", 500095, scans)
+	}
+}
+
+func TestBlockstackStorePath(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name     string
+		cfg      *AddrServerConfig
+		expected string
+	}{
+		{"next to the index", &AddrServerConfig{IndexPath: filepath.Join(dir, "index.db"), ConfigFile: filepath.Join(dir, "config.yaml")}, filepath.Join(dir, "index.blockstack.db")},
+		{"next to the config", &AddrServerConfig{ConfigFile: filepath.Join(dir, "config.yaml")}, filepath.Join(dir, "config.blockstack.db")},
+	}
+	for _, c := range cases {
+		as := &AddrServer{}
+		as.setReorgConfig(c.cfg)
+		if err := as.setBlockstackConfig(c.cfg); err != nil {
+			t.Fatal(err)
+		}
+		as.closeBlockstack()
+		if _, err := os.Stat(c.expected); err != nil || as.blockstackTemp != "" {
+			t.Errorf("%s: Expected the store at '%s', got '%v'\n", c.name, c.expected, err)
+		}
+	}
+
+	// A default path that can't be opened falls back to a temporary store,
+	// one set explicitly fails
+	notDir := filepath.Join(dir, "file")
+	if err := os.WriteFile(notDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	as := &AddrServer{}
+	cfg := &AddrServerConfig{ConfigFile: filepath.Join(notDir, "config.yaml")}
+	as.setReorgConfig(cfg)
+	if err := as.setBlockstackConfig(cfg); err != nil || as.blockstackStore == nil || as.blockstackTemp == "" {
+		t.Errorf("Expected a temporary store, got '%v'\n", err)
+	}
+	as.closeBlockstack()
+	as = &AddrServer{}
+	cfg = &AddrServerConfig{BlockstackStorePath: filepath.Join(notDir, "blockstack.db")}
+	as.setReorgConfig(cfg)
+	if err := as.setBlockstackConfig(cfg); err == nil {
+		as.closeBlockstack()
+		t.Errorf("Expected an explicit store path that can't be opened to fail\n")
+	}
+
+	// Without reorg detection stored operations couldn't be rewound
+	as = &AddrServer{}
+	cfg = &AddrServerConfig{ReorgDepth: -1, BlockstackStorePath: filepath.Join(dir, "off.db")}
+	as.setReorgConfig(cfg)
+	if err := as.setBlockstackConfig(cfg); err != nil || as.blockstackStore != nil {
+		t.Errorf("Expected no store with reorg detection off, got '%v'\n", err)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil"
+)
+
+// broadcastCheckTimeout bounds looking up a transaction after a broadcast
+// with an unknown outcome, and sending it again
+const broadcastCheckTimeout = 10 * time.Second
+
+// SendTransaction broadcasts tx. A broadcast that fails without an answer
+// from the node may or may not have reached it. Rather than report that as
+// a failure, which invites the client to send it again, the node is asked
+// whether it knows the transaction and it is only sent again if it doesn't.
+func (as *AddrServer) SendTransaction(ctx context.Context, tx *btcutil.Tx) (*chainhash.Hash, error) {
+	hash, err := as.Client.SendRawTransaction(ctx, tx.MsgTx(), true)
+	if err == nil || !ambiguousBroadcast(err) {
+		return hash, err
+	}
+	txid := tx.Hash().String()
+	logger(ctx).Warn("Broadcast outcome unknown, looking up transaction", "txid", txid, "error", err)
+
+	// The request may have timed out, the lookup gets its own deadline
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), broadcastCheckTimeout)
+	defer cancel()
+
+	_, lookupErr := as.GetRawTransaction(ctx, txid)
+	var rpcErr *btcjson.RPCError
+	switch {
+	case lookupErr == nil:
+		return tx.Hash(), nil
+	case !errors.As(lookupErr, &rpcErr) || rpcErr.Code != rpcInvalidAddressOrKey:
+		return nil, broadcastUnknown(txid, err)
+	}
+
+	hash, err = as.Client.SendRawTransaction(ctx, tx.MsgTx(), true)
+	switch {
+	case err == nil:
+		return hash, nil
+	case alreadyKnown(err):
+		return tx.Hash(), nil
+	case ambiguousBroadcast(err):
+		return nil, broadcastUnknown(txid, err)
+	}
+	return nil, err
+}
+
+// ambiguousBroadcast returns whether a broadcast that failed with err may
+// have reached the node
+func ambiguousBroadcast(err error) bool {
+	var rpcErr *btcjson.RPCError
+	return !errors.As(err, &rpcErr) && !errors.Is(err, ErrRPCBusy) && !notReceived(err)
+}
+
+// alreadyKnown returns whether the node rejected a broadcast because it
+// already has the transaction
+func alreadyKnown(err error) bool {
+	var rpcErr *btcjson.RPCError
+	if !errors.As(err, &rpcErr) {
+		return false
+	}
+	return rpcErr.Code == rpcVerifyAlreadyInChain || strings.Contains(rpcErr.Message, "already")
+}
+
+func broadcastUnknown(txid string, err error) error {
+	return &APIError{
+		Status: http.StatusBadGateway,
+		Code:   CodeBroadcastUnknown,
+		Err:    fmt.Errorf("transaction %s may or may not have reached the node, look it up before sending it again: %s", txid, err),
+	}
+}
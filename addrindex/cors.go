@@ -0,0 +1,223 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackzampolin/addrindex-server/apikey"
+)
+
+// Defaults for the CORS settings in AddrServerConfig
+var (
+	DefaultCORSMethods = []string{"GET", "POST"}
+	DefaultCORSHeaders = []string{"Content-Type", apikey.Header, RequestIDHeader}
+	DefaultCORSMaxAge  = 10 * time.Minute
+)
+
+// corsExposedHeaders are response headers browsers let scripts read
+var corsExposedHeaders = strings.Join([]string{RequestIDHeader, "Retry-After"}, ", ")
+
+// corsPolicy decides which cross origin requests browsers may make
+type corsPolicy struct {
+	origins     []originPattern
+	methods     map[string]bool
+	headers     map[string]bool
+	allowAll    bool
+	credentials bool
+
+	allowMethods string
+	allowHeaders string
+	maxAge       string
+}
+
+// originPattern matches an origin exactly, or with a single * wildcard
+// standing in for at least one character, e.g. https://*.example.com
+type originPattern struct {
+	prefix   string
+	suffix   string
+	wildcard bool
+}
+
+func (p originPattern) match(origin string) bool {
+	if !p.wildcard {
+		return origin == p.prefix
+	}
+	return len(origin) > len(p.prefix)+len(p.suffix) &&
+		strings.HasPrefix(origin, p.prefix) &&
+		strings.HasSuffix(origin, p.suffix)
+}
+
+func newCORSPolicy(origins, methods, headers []string, maxAge time.Duration, credentials bool) (*corsPolicy, error) {
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultCORSMaxAge
+	}
+
+	out := &corsPolicy{
+		methods:      map[string]bool{},
+		headers:      map[string]bool{},
+		credentials:  credentials,
+		allowMethods: strings.ToUpper(strings.Join(methods, ", ")),
+		allowHeaders: strings.Join(headers, ", "),
+		maxAge:       strconv.Itoa(int(maxAge.Seconds())),
+	}
+	for _, m := range methods {
+		out.methods[strings.ToUpper(m)] = true
+	}
+	for _, h := range headers {
+		out.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, o := range origins {
+		switch strings.Count(o, "*") {
+		case 0:
+			out.origins = append(out.origins, originPattern{prefix: o})
+		case 1:
+			if o == "*" {
+				out.allowAll = true
+				continue
+			}
+			i := strings.Index(o, "*")
+			out.origins = append(out.origins, originPattern{prefix: o[:i], suffix: o[i+1:], wildcard: true})
+		default:
+			return nil, fmt.Errorf("invalid CORS origin %q, only one * is allowed", o)
+		}
+	}
+	// Echoing any origin with credentials would let every site make
+	// credentialed reads
+	if out.allowAll && credentials {
+		return nil, fmt.Errorf("CORS origin * can't be combined with credentials, list the allowed origins")
+	}
+	return out, nil
+}
+
+func (c *corsPolicy) allowedOrigin(origin string) bool {
+	if c.allowAll {
+		return true
+	}
+	for _, p := range c.origins {
+		if p.match(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders checks every header in an Access-Control-Request-Headers list is allowed
+func (c *corsPolicy) allowedHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !c.headers[http.CanonicalHeaderKey(h)] {
+			return false
+		}
+	}
+	return true
+}
+
+// middleware adds CORS headers for allowed origins and answers preflight
+// requests without passing them on, so they aren't subject to API key or
+// rate limit checks
+func (c *corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+
+		if origin == "" || !c.allowedOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if !c.methods[r.Header.Get("Access-Control-Request-Method")] || !c.allowedHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		if c.allowAll {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", c.allowMethods)
+		w.Header().Set("Access-Control-Allow-Headers", c.allowHeaders)
+		w.Header().Set("Access-Control-Max-Age", c.maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// setCORSConfig turns on CORS handling when allowed origins are configured
+func (as *AddrServer) setCORSConfig(cfg *AddrServerConfig) error {
+	if len(cfg.CORSOrigins) == 0 {
+		return nil
+	}
+	cors, err := newCORSPolicy(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders, cfg.CORSMaxAge, cfg.CORSCredentials)
+	if err != nil {
+		return err
+	}
+	as.cors = cors
+	return nil
+}
+
+// addPreflightRoutes registers an OPTIONS route for every path on the router
+// so preflight requests match a route and reach the CORS middleware
+func addPreflightRoutes(router *mux.Router) {
+	var paths []string
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			paths = append(paths, tmpl)
+		}
+		return nil
+	})
+	seen := map[string]bool{}
+	for _, path := range paths {
+		if !seen[path] {
+			seen[path] = true
+			router.HandleFunc(path, handlePreflight).Methods("OPTIONS")
+		}
+	}
+}
+
+// handlePreflight answers OPTIONS requests the CORS middleware passes on,
+// i.e. ones that aren't preflights
+func handlePreflight(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,88 @@
+package addrindex
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSOriginPatterns(t *testing.T) {
+	c, err := newCORSPolicy([]string{"https://wallet.example.com", "https://*.blockstack.org"}, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"https://wallet.example.com":     true,
+		"https://evil.example.com":       false,
+		"https://app.blockstack.org":     true,
+		"https://.blockstack.org":        false,
+		"http://app.blockstack.org":      false,
+		"https://blockstack.org.evil.io": false,
+	}
+	for origin, expected := range cases {
+		if c.allowedOrigin(origin) != expected {
+			t.Errorf("Expected '%t' for origin %s, got '%t'\n", expected, origin, !expected)
+		}
+	}
+
+	if _, err := newCORSPolicy([]string{"https://*.*.example.com"}, nil, nil, 0, false); err == nil {
+		t.Errorf("Expected error for origin with two wildcards\n")
+	}
+	if _, err := newCORSPolicy([]string{"*"}, nil, nil, 0, true); err == nil {
+		t.Errorf("Expected error for any origin with credentials\n")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	as := &AddrServer{}
+	as.setCORSConfig(&AddrServerConfig{
+		CORSOrigins:     []string{"https://wallet.example.com"},
+		CORSMaxAge:      time.Hour,
+		CORSCredentials: true,
+	})
+	router := as.Router()
+
+	for _, path := range []string{"/tx/send", "/messages/verify"} {
+		req := httptest.NewRequest("OPTIONS", path, nil)
+		req.Header.Set("Origin", "https://wallet.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type, x-api-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != 204 {
+			t.Errorf("Expected '204' for preflight of %s, got '%d'\n", path, w.Code)
+		}
+		h := w.Header()
+		if h.Get("Access-Control-Allow-Origin") != "https://wallet.example.com" || h.Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("Expected origin to be allowed with credentials, got '%s' and '%s'\n", h.Get("Access-Control-Allow-Origin"), h.Get("Access-Control-Allow-Credentials"))
+		}
+		if h.Get("Access-Control-Allow-Methods") != "GET, POST" || h.Get("Access-Control-Max-Age") != "3600" {
+			t.Errorf("Expected methods 'GET, POST' and max age '3600', got '%s' and '%s'\n", h.Get("Access-Control-Allow-Methods"), h.Get("Access-Control-Max-Age"))
+		}
+	}
+
+	// Disallowed origins and methods are refused
+	for _, c := range []struct{ origin, method string }{
+		{"https://evil.example.com", "POST"},
+		{"https://wallet.example.com", "DELETE"},
+	} {
+		req := httptest.NewRequest("OPTIONS", "/tx/send", nil)
+		req.Header.Set("Origin", c.origin)
+		req.Header.Set("Access-Control-Request-Method", c.method)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 403 || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Expected '403' for %s from %s, got '%d'\n", c.method, c.origin, w.Code)
+		}
+	}
+
+	// Simple requests get the allow and expose headers
+	req := httptest.NewRequest("GET", "/version", nil)
+	req.Header.Set("Origin", "https://wallet.example.com")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 || w.Header().Get("Access-Control-Expose-Headers") == "" {
+		t.Errorf("Expected '200' with exposed headers, got '%d'\n", w.Code)
+	}
+}
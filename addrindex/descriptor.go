@@ -0,0 +1,583 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/jackzampolin/addrindex-server/segwit"
+)
+
+// Output descriptors (BIP 380-386) describe the scripts a wallet pays to.
+// The descriptors parsed here are pkh, wpkh, sh, wsh, multi, sortedmulti,
+// tr with a single key, addr and raw, with hex or extended public keys.
+
+const (
+	descriptorInputCharset    = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	descriptorChecksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+func descriptorPolymod(symbols []uint64) uint64 {
+	gen := [5]uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd}
+	chk := uint64(1)
+	for _, v := range symbols {
+		top := chk >> 35
+		chk = (chk&0x7ffffffff)<<5 ^ v
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// DescriptorChecksum returns the checksum of a descriptor without one
+func DescriptorChecksum(desc string) (string, error) {
+	var symbols, groups []uint64
+	for i := 0; i < len(desc); i++ {
+		v := strings.IndexByte(descriptorInputCharset, desc[i])
+		if v < 0 {
+			return "", fmt.Errorf("invalid character %q in descriptor", desc[i])
+		}
+		symbols = append(symbols, uint64(v&31))
+		groups = append(groups, uint64(v>>5))
+		if len(groups) == 3 {
+			symbols = append(symbols, groups[0]*9+groups[1]*3+groups[2])
+			groups = groups[:0]
+		}
+	}
+	switch len(groups) {
+	case 1:
+		symbols = append(symbols, groups[0])
+	case 2:
+		symbols = append(symbols, groups[0]*3+groups[1])
+	}
+	chk := descriptorPolymod(append(symbols, 0, 0, 0, 0, 0, 0, 0, 0)) ^ 1
+	out := make([]byte, 8)
+	for i := range out {
+		out[i] = descriptorChecksumCharset[(chk>>uint(5*(7-i)))&31]
+	}
+	return string(out), nil
+}
+
+// Descriptor is a parsed output descriptor
+type Descriptor struct {
+	// String is the descriptor with its checksum
+	String string
+	root   descNode
+}
+
+// Ranged returns whether the descriptor derives a script per index
+func (d *Descriptor) Ranged() bool {
+	return d.root.ranged()
+}
+
+// Script returns the scriptPubKey at index of a ranged descriptor, or the
+// only scriptPubKey of one that isn't ranged
+func (d *Descriptor) Script(index uint32) ([]byte, error) {
+	return d.root.script(index)
+}
+
+// ParseDescriptor parses a descriptor for net. A checksum is verified when
+// present.
+func ParseDescriptor(desc string, net *chaincfg.Params) (*Descriptor, error) {
+	body := desc
+	if i := strings.IndexByte(desc, '#'); i >= 0 {
+		body = desc[:i]
+	}
+	checksum, err := DescriptorChecksum(body)
+	if err != nil {
+		return nil, err
+	}
+	if body != desc && desc[len(body)+1:] != checksum {
+		return nil, fmt.Errorf("invalid descriptor checksum %q, expected %q", desc[len(body)+1:], checksum)
+	}
+	p := &descParser{s: body, net: net}
+	root, err := p.parse(ctxTop)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("unexpected %q after descriptor", p.s[p.pos:])
+	}
+	return &Descriptor{String: body + "#" + checksum, root: root}, nil
+}
+
+// Where in a descriptor an expression appears, which limits what it may be
+type descContext int
+
+const (
+	ctxTop descContext = iota
+	ctxSH
+	ctxWSH
+)
+
+type descNode interface {
+	script(index uint32) ([]byte, error)
+	ranged() bool
+}
+
+type descParser struct {
+	s   string
+	pos int
+	net *chaincfg.Params
+}
+
+// expect consumes s or fails
+func (p *descParser) expect(s string) error {
+	if !strings.HasPrefix(p.s[p.pos:], s) {
+		return fmt.Errorf("expected %q at position %d", s, p.pos)
+	}
+	p.pos += len(s)
+	return nil
+}
+
+// arg returns the text up to the next top level comma or closing parenthesis
+func (p *descParser) arg() string {
+	start, depth := p.pos, 0
+	for ; p.pos < len(p.s); p.pos++ {
+		switch p.s[p.pos] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth == 0 {
+				return p.s[start:p.pos]
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				return p.s[start:p.pos]
+			}
+		}
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *descParser) parse(ctx descContext) (descNode, error) {
+	i := strings.IndexByte(p.s[p.pos:], '(')
+	if i < 0 {
+		return nil, fmt.Errorf("expected a script expression at position %d", p.pos)
+	}
+	name := p.s[p.pos : p.pos+i]
+	p.pos += i + 1
+
+	var (
+		node descNode
+		err  error
+	)
+	switch name {
+	case "pkh":
+		var k *descKey
+		if k, err = p.key(ctx == ctxWSH, false); err == nil {
+			node = &pkhNode{key: k}
+		}
+	case "wpkh":
+		if ctx == ctxWSH {
+			return nil, fmt.Errorf("wpkh() can't be nested in wsh()")
+		}
+		var k *descKey
+		if k, err = p.key(true, false); err == nil {
+			node = &wpkhNode{key: k}
+		}
+	case "sh":
+		if ctx != ctxTop {
+			return nil, fmt.Errorf("sh() must be the top level expression")
+		}
+		var inner descNode
+		if inner, err = p.parse(ctxSH); err == nil {
+			node = &shNode{inner: inner}
+		}
+	case "wsh":
+		if ctx == ctxWSH {
+			return nil, fmt.Errorf("wsh() can't be nested in wsh()")
+		}
+		var inner descNode
+		if inner, err = p.parse(ctxWSH); err == nil {
+			node = &wshNode{inner: inner}
+		}
+	case "multi", "sortedmulti":
+		node, err = p.multi(ctx, name == "sortedmulti")
+	case "tr":
+		if ctx != ctxTop {
+			return nil, fmt.Errorf("tr() must be the top level expression")
+		}
+		var k *descKey
+		if k, err = p.key(true, true); err == nil {
+			node = &trNode{key: k}
+		}
+		if err == nil && p.pos < len(p.s) && p.s[p.pos] == ',' {
+			return nil, fmt.Errorf("tr() with a script tree isn't supported")
+		}
+	case "addr":
+		if ctx != ctxTop {
+			return nil, fmt.Errorf("addr() must be the top level expression")
+		}
+		var addr btcutil.Address
+		if addr, err = segwit.DecodeAddress(p.arg(), p.net); err == nil && !addr.IsForNet(p.net) {
+			err = fmt.Errorf("address is not for %s", NetworkName(p.net))
+		}
+		if err == nil {
+			var b []byte
+			if b, err = payToAddrScript(addr); err == nil {
+				node = &rawNode{b: b}
+			}
+		}
+	case "raw":
+		if ctx != ctxTop {
+			return nil, fmt.Errorf("raw() must be the top level expression")
+		}
+		var b []byte
+		if b, err = hex.DecodeString(p.arg()); err == nil {
+			node = &rawNode{b: b}
+		}
+	default:
+		return nil, fmt.Errorf("unknown script expression %q", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %s", name, err)
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// maxMultisigKeys is the most keys a CHECKMULTISIG script can hold
+const maxMultisigKeys = 20
+
+func (p *descParser) multi(ctx descContext, sorted bool) (descNode, error) {
+	if ctx == ctxTop {
+		return nil, fmt.Errorf("bare multisig isn't supported, wrap it in sh() or wsh()")
+	}
+	k, err := strconv.Atoi(p.arg())
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold: %s", err)
+	}
+	node := &multiNode{k: k, sorted: sorted}
+	for p.pos < len(p.s) && p.s[p.pos] == ',' {
+		p.pos++
+		key, err := p.key(ctx == ctxWSH, false)
+		if err != nil {
+			return nil, err
+		}
+		node.keys = append(node.keys, key)
+	}
+	if k < 1 || k > len(node.keys) {
+		return nil, fmt.Errorf("threshold %d out of range for %d keys", k, len(node.keys))
+	}
+	max := maxMultisigKeys
+	if ctx == ctxSH {
+		// P2SH redeem scripts are limited to 520 bytes
+		max = 15
+	}
+	if len(node.keys) > max {
+		return nil, fmt.Errorf("at most %d keys are allowed", max)
+	}
+	return node, nil
+}
+
+// descKey is a key expression, a hex public key or an extended public key
+// with an unhardened derivation path, optionally ending in /* for ranges
+type descKey struct {
+	pub    []byte
+	xpub   *hdkeychain.ExtendedKey
+	path   []uint32
+	ranged bool
+	xonly  bool
+}
+
+// key parses a key expression. Segwit keys must be compressed; taproot keys
+// may be given as 32 byte x-only keys.
+func (p *descParser) key(compressed, xonly bool) (*descKey, error) {
+	s := p.arg()
+	if strings.HasPrefix(s, "[") {
+		// Key origin info documents where the key came from, it doesn't change the scripts
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return nil, fmt.Errorf("key origin %q isn't closed", s)
+		}
+		origin := strings.Split(s[1:end], "/")
+		if len(origin[0]) != 8 {
+			return nil, fmt.Errorf("key origin fingerprint %q isn't 8 hex characters", origin[0])
+		}
+		if _, err := hex.DecodeString(origin[0]); err != nil {
+			return nil, fmt.Errorf("key origin fingerprint %q isn't hex", origin[0])
+		}
+		s = s[end+1:]
+	}
+
+	if b, err := hex.DecodeString(s); err == nil {
+		switch {
+		case xonly && len(b) == 32:
+			return &descKey{pub: b, xonly: true}, nil
+		case len(b) == 33 || (len(b) == 65 && !compressed):
+			if _, err := btcec.ParsePubKey(b, btcec.S256()); err != nil {
+				return nil, err
+			}
+			return &descKey{pub: b}, nil
+		case len(b) == 65:
+			return nil, fmt.Errorf("uncompressed keys aren't allowed in segwit scripts")
+		}
+		return nil, fmt.Errorf("invalid public key length %d", len(b))
+	}
+
+	parts := strings.Split(s, "/")
+	xpub, err := hdkeychain.NewKeyFromString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %q: %s", parts[0], err)
+	}
+	if xpub.IsPrivate() {
+		return nil, fmt.Errorf("private keys aren't accepted")
+	}
+	if !xpub.IsForNet(p.net) {
+		return nil, fmt.Errorf("key %q is not for %s", parts[0], NetworkName(p.net))
+	}
+	out := &descKey{xpub: xpub}
+	for i, step := range parts[1:] {
+		if step == "*" && i == len(parts)-2 {
+			out.ranged = true
+			break
+		}
+		if strings.HasSuffix(step, "'") || strings.HasSuffix(step, "h") {
+			return nil, fmt.Errorf("hardened derivation %q needs a private key", step)
+		}
+		n, err := strconv.ParseUint(step, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid derivation step %q", step)
+		}
+		out.path = append(out.path, uint32(n))
+	}
+	return out, nil
+}
+
+// pubKey returns the serialized public key at index
+func (k *descKey) pubKey(index uint32) ([]byte, error) {
+	if k.xpub == nil {
+		return k.pub, nil
+	}
+	key := k.xpub
+	path := k.path
+	if k.ranged {
+		path = append(append([]uint32{}, path...), index)
+	}
+	for _, i := range path {
+		var err error
+		if key, err = key.Derive(i); err != nil {
+			return nil, err
+		}
+	}
+	pub, err := key.ECPubKey()
+	if err != nil {
+		return nil, err
+	}
+	return pub.SerializeCompressed(), nil
+}
+
+type pkhNode struct{ key *descKey }
+
+func (n *pkhNode) ranged() bool { return n.key.ranged }
+
+func (n *pkhNode) script(index uint32) ([]byte, error) {
+	pub, err := n.key.pubKey(index)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_DUP).AddOp(txscript.OP_HASH160).
+		AddData(btcutil.Hash160(pub)).AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_CHECKSIG).Script()
+}
+
+type wpkhNode struct{ key *descKey }
+
+func (n *wpkhNode) ranged() bool { return n.key.ranged }
+
+func (n *wpkhNode) script(index uint32) ([]byte, error) {
+	pub, err := n.key.pubKey(index)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(btcutil.Hash160(pub)).Script()
+}
+
+type shNode struct{ inner descNode }
+
+func (n *shNode) ranged() bool { return n.inner.ranged() }
+
+func (n *shNode) script(index uint32) ([]byte, error) {
+	redeem, err := n.inner.script(index)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_HASH160).AddData(btcutil.Hash160(redeem)).
+		AddOp(txscript.OP_EQUAL).Script()
+}
+
+type wshNode struct{ inner descNode }
+
+func (n *wshNode) ranged() bool { return n.inner.ranged() }
+
+func (n *wshNode) script(index uint32) ([]byte, error) {
+	witness, err := n.inner.script(index)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(witness)
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(h[:]).Script()
+}
+
+type multiNode struct {
+	k      int
+	keys   []*descKey
+	sorted bool
+}
+
+func (n *multiNode) ranged() bool {
+	for _, k := range n.keys {
+		if k.ranged {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *multiNode) script(index uint32) ([]byte, error) {
+	pubs := make([][]byte, len(n.keys))
+	for i, k := range n.keys {
+		pub, err := k.pubKey(index)
+		if err != nil {
+			return nil, err
+		}
+		pubs[i] = pub
+	}
+	if n.sorted {
+		sort.Slice(pubs, func(i, j int) bool { return bytes.Compare(pubs[i], pubs[j]) < 0 })
+	}
+	b := txscript.NewScriptBuilder().AddInt64(int64(n.k))
+	for _, pub := range pubs {
+		b.AddData(pub)
+	}
+	return b.AddInt64(int64(len(pubs))).AddOp(txscript.OP_CHECKMULTISIG).Script()
+}
+
+type trNode struct{ key *descKey }
+
+func (n *trNode) ranged() bool { return n.key.ranged }
+
+// script returns the BIP 86 output for a key path only taproot key
+func (n *trNode) script(index uint32) ([]byte, error) {
+	pub, err := n.key.pubKey(index)
+	if err != nil {
+		return nil, err
+	}
+	if n.key.xonly {
+		pub = append([]byte{0x02}, pub...)
+	}
+	internal, err := btcec.ParsePubKey(pub, btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	output, err := taprootTweak(internal)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_1).AddData(output).Script()
+}
+
+// taprootTweak returns the x-only output key of a taproot internal key with
+// no script tree, Q = P + H_TapTweak(P)G with P taken with an even Y
+func taprootTweak(internal *btcec.PublicKey) ([]byte, error) {
+	curve := btcec.S256()
+	x, y := internal.X, new(big.Int).Set(internal.Y)
+	if y.Bit(0) == 1 {
+		y.Sub(curve.P, y)
+	}
+	px := make([]byte, 32)
+	x.FillBytes(px)
+
+	t := taggedHash("TapTweak", px)
+	if new(big.Int).SetBytes(t).Cmp(curve.N) >= 0 {
+		return nil, fmt.Errorf("taproot tweak out of range")
+	}
+	tx, ty := curve.ScalarBaseMult(t)
+	qx, _ := curve.Add(x, y, tx, ty)
+	out := make([]byte, 32)
+	qx.FillBytes(out)
+	return out, nil
+}
+
+// taggedHash is the BIP 340 tagged hash of msg
+func taggedHash(tag string, msg []byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+type rawNode struct{ b []byte }
+
+func (n *rawNode) ranged() bool { return false }
+
+func (n *rawNode) script(uint32) ([]byte, error) { return n.b, nil }
+
+// payToAddrScript returns the scriptPubKey paying to addr
+func payToAddrScript(addr btcutil.Address) ([]byte, error) {
+	if sw, ok := addr.(*segwit.Address); ok {
+		return txscript.NewScriptBuilder().AddOp(txscript.OP_1 - 1 + sw.WitnessVersion()).
+			AddData(sw.WitnessProgram()).Script()
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+// scriptAddress returns the address a scriptPubKey pays to, or nil if the
+// script has no address
+func scriptAddress(script []byte, net *chaincfg.Params) btcutil.Address {
+	var (
+		addr btcutil.Address
+		err  error
+	)
+	switch ScriptType(script) {
+	case ScriptPubKeyHash:
+		addr, err = btcutil.NewAddressPubKeyHash(script[3:23], net)
+	case ScriptScriptHash:
+		addr, err = btcutil.NewAddressScriptHashFromHash(script[2:22], net)
+	case ScriptWitnessV0KeyHash:
+		addr, err = btcutil.NewAddressWitnessPubKeyHash(script[2:], net)
+	case ScriptWitnessV0ScriptHash:
+		addr, err = btcutil.NewAddressWitnessScriptHash(script[2:], net)
+	case ScriptWitnessV1Taproot, ScriptWitnessUnknown:
+		version, program, _ := segwit.WitnessProgram(script)
+		addr, err = segwit.NewAddress(version, program, net)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return addr
+}
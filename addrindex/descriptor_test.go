@@ -0,0 +1,234 @@
+package addrindex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/jackzampolin/addrindex-server/internal/chaintest"
+)
+
+const (
+	testKey1 = "03a34b99f22c790c4e36b2b3c2c35a36db06226e41c692fc82b8b56ac1c540c5bd"
+	testKey2 = "02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5"
+)
+
+func TestDescriptorChecksum(t *testing.T) {
+	sum, err := DescriptorChecksum("raw(deadbeef)")
+	if err != nil || sum != "89f8spxm" {
+		t.Errorf("Expected '89f8spxm', got '%s' '%v'\n", sum, err)
+	}
+	if _, err := ParseDescriptor("raw(deadbeef)#89f8spxm", &chaincfg.MainNetParams); err != nil {
+		t.Errorf("Expected valid checksum to parse, got '%s'\n", err)
+	}
+	if _, err := ParseDescriptor("raw(deadbeef)#89f8spxn", &chaincfg.MainNetParams); err == nil {
+		t.Errorf("Expected invalid checksum to fail\n")
+	}
+	d, _ := ParseDescriptor("raw(deadbeef)", &chaincfg.MainNetParams)
+	if d.String != "raw(deadbeef)#89f8spxm" {
+		t.Errorf("Expected checksum to be added, got '%s'\n", d.String)
+	}
+}
+
+func descriptorAddress(t *testing.T, desc string, index uint32) string {
+	d, err := ParseDescriptor(desc, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("%s: %s", desc, err)
+	}
+	script, err := d.Script(index)
+	if err != nil {
+		t.Fatalf("%s: %s", desc, err)
+	}
+	addr := scriptAddress(script, &chaincfg.MainNetParams)
+	if addr == nil {
+		t.Fatalf("%s: no address for script %x", desc, script)
+	}
+	return addr.EncodeAddress()
+}
+
+func TestDescriptorScripts(t *testing.T) {
+	// The BIP 84 test account as an xpub, as descriptors expect
+	zpub, _ := hdkeychain.NewKeyFromString(testZpub)
+	xpub, _ := zpub.CloneWithVersion(chaincfg.MainNetParams.HDPublicKeyID[:])
+
+	key1, _ := hex.DecodeString(testKey1)
+	key2, _ := hex.DecodeString(testKey2)
+	shwpkh, _ := btcutil.NewAddressScriptHash(append([]byte{0x00, 0x14}, btcutil.Hash160(key1)...), &chaincfg.MainNetParams)
+	pub1, _ := btcutil.NewAddressPubKey(key1, &chaincfg.MainNetParams)
+	pub2, _ := btcutil.NewAddressPubKey(key2, &chaincfg.MainNetParams)
+	multisig, _ := txscript.MultiSigScript([]*btcutil.AddressPubKey{pub2, pub1}, 2)
+	witnessHash := sha256.Sum256(multisig)
+	wsh, _ := btcutil.NewAddressWitnessScriptHash(witnessHash[:], &chaincfg.MainNetParams)
+
+	cases := []struct {
+		desc     string
+		index    uint32
+		expected string
+	}{
+		{"wpkh([73c5da0a/84'/0'/0']" + xpub.String() + "/0/*)", 0, "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"},
+		{"wpkh(" + xpub.String() + "/0/*)", 1, "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+		{"wpkh(" + xpub.String() + "/1/0)", 7, "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"},
+		{"tr(cc8a4bc64d897bddc5fbc2f670f7a8ba0b386779106cf1223c6fc5d7cd6fc115)", 0, "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr"},
+		{"sh(wpkh(" + testKey1 + "))", 0, shwpkh.EncodeAddress()},
+		{"wsh(multi(2," + testKey2 + "," + testKey1 + "))", 0, wsh.EncodeAddress()},
+		{"wsh(sortedmulti(2," + testKey1 + "," + testKey2 + "))", 0, wsh.EncodeAddress()},
+		{"addr(bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr)", 0, "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr"},
+	}
+	for _, c := range cases {
+		if got := descriptorAddress(t, c.desc, c.index); got != c.expected {
+			t.Errorf("Expected '%s' for %s at %d, got '%s'\n", c.expected, c.desc, c.index, got)
+		}
+	}
+
+	invalid := []string{
+		"wsh(wpkh(" + testKey1 + "))",
+		"wsh(sh(wpkh(" + testKey1 + ")))",
+		"wpkh(" + xpub.String() + "/0'/*)",
+		"wpkh(04" + strings.Repeat("00", 64) + ")",
+		"multi(1," + testKey1 + ")",
+		"wsh(multi(3," + testKey1 + "," + testKey2 + "))",
+		"tr(" + testKey1 + ",pk(" + testKey2 + "))",
+		"pkh(" + testKey1 + "))",
+		"combo(" + testKey1 + ")",
+	}
+	for _, desc := range invalid {
+		if _, err := ParseDescriptor(desc, &chaincfg.MainNetParams); err == nil {
+			t.Errorf("Expected %s not to parse\n", desc)
+		}
+	}
+}
+
+func TestTaprootTweakOddY(t *testing.T) {
+	// Internal keys with odd and even Y and the same X tweak to the same output
+	even, _ := hex.DecodeString("02" + testKey1[2:])
+	odd, _ := hex.DecodeString("03" + testKey1[2:])
+	e, _ := btcec.ParsePubKey(even, btcec.S256())
+	o, _ := btcec.ParsePubKey(odd, btcec.S256())
+	a, _ := taprootTweak(e)
+	b, _ := taprootTweak(o)
+	if hex.EncodeToString(a) != hex.EncodeToString(b) {
+		t.Errorf("Expected '%x', got '%x'\n", a, b)
+	}
+}
+
+func TestScanObjectJSON(t *testing.T) {
+	var req DescriptorScanRequest
+	body := `{"descriptors": ["raw(deadbeef)", {"desc": "a", "range": 5}, {"desc": "b", "range": [2, 4]}]}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Descriptors[0].Desc != "raw(deadbeef)" || req.Descriptors[0].Range != nil {
+		t.Errorf("Expected a plain descriptor, got '%+v'\n", req.Descriptors[0])
+	}
+	if *req.Descriptors[1].Range != [2]uint32{0, 5} {
+		t.Errorf("Expected '[0 5]', got '%v'\n", *req.Descriptors[1].Range)
+	}
+	if *req.Descriptors[2].Range != [2]uint32{2, 4} {
+		t.Errorf("Expected '[2 4]', got '%v'\n", *req.Descriptors[2].Range)
+	}
+	if err := json.Unmarshal([]byte(`{"descriptors": [{"desc": "a", "range": [4, 2]}]}`), &req); err == nil {
+		t.Errorf("Expected a backwards range to fail\n")
+	}
+}
+
+func TestDescriptorScanFallback(t *testing.T) {
+	unspents := `{"result": {"success": true, "height": 110, "unspents": [
+		{"txid": "aa", "vout": 1, "scriptPubKey": "deadbeef", "amount": 0.5, "height": 101}
+	], "total_amount": 0.5}}`
+	as := fakeBitcore(t, http.StatusOK, unspents, 0)
+	as.Params = &chaincfg.MainNetParams
+
+	descs, err := as.parseScanRequest(DescriptorScanRequest{Descriptors: []ScanObject{{Desc: "raw(deadbeef)"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := as.scanDescriptor(context.Background(), descs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Source != SourceScanTxOutSet || res.Balance != 50000000 || len(res.UTXOs) != 1 {
+		t.Errorf("Expected '%s' with balance '50000000', got '%s' with '%d'\n", SourceScanTxOutSet, res.Source, res.Balance)
+	}
+	if res.UTXOs[0].Confirmations != 10 || res.UTXOs[0].ScriptType != ScriptNonStandard {
+		t.Errorf("Expected '10' confirmations, got '%d'\n", res.UTXOs[0].Confirmations)
+	}
+
+	as = fakeBitcore(t, http.StatusNotFound, `{"result": null, "error": {"code": -32601, "message": "Method not found"}}`, 0)
+	as.Params = &chaincfg.MainNetParams
+	_, err = as.scanDescriptor(context.Background(), descs[0])
+	if e := classifyError(err); e.Status != http.StatusNotImplemented || e.Code != CodeUnsupportedAddressType {
+		t.Errorf("Expected '501 %s', got '%d %s'\n", CodeUnsupportedAddressType, e.Status, e.Code)
+	}
+
+	if _, err := as.parseScanRequest(DescriptorScanRequest{Descriptors: []ScanObject{
+		{Desc: "wpkh(" + testKey1 + ")"},
+		{Desc: "raw(deadbeef)", Range: &[2]uint32{0, maxDescriptorScripts}},
+	}}); err != nil {
+		t.Errorf("Expected ranges on unranged descriptors to be ignored, got '%s'\n", err)
+	}
+}
+
+func TestDescriptorScanFallbackAfterChunk(t *testing.T) {
+	// The first chunk of addresses is covered by the address index, the
+	// second has a segwit address the index rejects
+	desc, err := ParseDescriptor("pkh("+testKey1+")", &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := descriptorScripts{desc: desc}
+	for i := 0; i < MaxAddressesPerRequest; i++ {
+		_, script := chaintest.Address(t, byte(i))
+		ds.scripts = append(ds.scripts, script)
+		ds.indexes = append(ds.indexes, uint32(i))
+	}
+	wpkh, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(make([]byte, 20)).Script()
+	ds.scripts = append(ds.scripts, wpkh)
+	ds.indexes = append(ds.indexes, MaxAddressesPerRequest)
+
+	first, _ := chaintest.Address(t, 0)
+	node := &fakeNode{answer: func(req fakeRequest) (interface{}, *btcjson.RPCError) {
+		switch req.Method {
+		case "getinfo":
+			return map[string]interface{}{"blocks": 110}, nil
+		case "getaddressutxos", "getaddressmempool":
+			var params struct{ Addresses []string }
+			req.param(0, &params)
+			for _, addr := range params.Addresses {
+				if strings.HasPrefix(addr, "bc1") {
+					return nil, &btcjson.RPCError{Code: rpcInvalidAddressOrKey, Message: "Invalid address"}
+				}
+			}
+			if req.Method == "getaddressmempool" {
+				return []interface{}{}, nil
+			}
+			return []map[string]interface{}{
+				{"address": first, "txid": "aa", "outputIndex": 1, "script": "76a914", "satoshis": 50000000, "height": 101},
+			}, nil
+		case "scantxoutset":
+			return map[string]interface{}{"success": true, "height": 110, "unspents": []map[string]interface{}{
+				{"txid": "aa", "vout": 1, "scriptPubKey": "deadbeef", "amount": 0.5, "height": 101},
+			}, "total_amount": 0.5}, nil
+		}
+		return nil, nil
+	}}
+	as := node.start(t)
+	as.Params = &chaincfg.MainNetParams
+
+	res, err := as.scanDescriptor(context.Background(), ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Source != SourceScanTxOutSet || len(res.UTXOs) != 1 || res.Balance != 50000000 {
+		t.Errorf("Expected '%s' with '%d' UTXO and balance '%d', got '%s' with '%d' and '%d'\n", SourceScanTxOutSet, 1, 50000000, res.Source, len(res.UTXOs), res.Balance)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcutil"
+)
+
+// DefaultDescriptorRange is the number of indexes scanned for a ranged
+// descriptor without a range, the same as scantxoutset's default
+const DefaultDescriptorRange = 1000
+
+const (
+	// maxDescriptorScripts caps the scripts derived for one scan request
+	maxDescriptorScripts = 10000
+	maxDescriptorBody    = 1 << 20
+
+	rpcMethodNotFound btcjson.RPCErrorCode = -32601
+)
+
+// Where the results for a descriptor came from
+const (
+	SourceAddressIndex = "addressindex"
+	SourceScanTxOutSet = "scantxoutset"
+)
+
+// ScanObject is a descriptor to scan, with the range of indexes to derive
+// for ranged descriptors. Like with scantxoutset it may be given as a plain
+// string, and the range as an end index or a [begin, end] pair.
+type ScanObject struct {
+	Desc  string
+	Range *[2]uint32
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (o *ScanObject) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &o.Desc); err == nil {
+		return nil
+	}
+	var obj struct {
+		Desc  string          `json:"desc"`
+		Range json.RawMessage `json:"range"`
+	}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return err
+	}
+	o.Desc = obj.Desc
+	if len(obj.Range) == 0 {
+		return nil
+	}
+	var end uint32
+	if err := json.Unmarshal(obj.Range, &end); err == nil {
+		o.Range = &[2]uint32{0, end}
+		return nil
+	}
+	var pair [2]uint32
+	if err := json.Unmarshal(obj.Range, &pair); err != nil {
+		return fmt.Errorf("range must be an end index or a [begin, end] pair")
+	}
+	if pair[0] > pair[1] {
+		return fmt.Errorf("range begin %d is after end %d", pair[0], pair[1])
+	}
+	o.Range = &pair
+	return nil
+}
+
+// DescriptorScanRequest models a post request to the /descriptor/scan route
+type DescriptorScanRequest struct {
+	Descriptors []ScanObject `json:"descriptors"`
+}
+
+// DescriptorResult is the balance and UTXOs of a single descriptor
+type DescriptorResult struct {
+	Descriptor string      `json:"descriptor"`
+	Range      *[2]uint32  `json:"range,omitempty"`
+	Source     string      `json:"source"`
+	Balance    int         `json:"balance"`
+	UTXOs      UTXOInsOuts `json:"utxos"`
+
+	// Indexes maps the addresses holding UTXOs to the index they were derived at
+	Indexes map[string]uint32 `json:"indexes,omitempty"`
+}
+
+// DescriptorScanResponse models a response to the /descriptor/scan route
+type DescriptorScanResponse struct {
+	Balance     int                `json:"balance"`
+	Descriptors []DescriptorResult `json:"descriptors"`
+}
+
+// descriptorScripts is a parsed descriptor with its derived scripts
+type descriptorScripts struct {
+	desc    *Descriptor
+	rng     *[2]uint32
+	scripts [][]byte
+	indexes []uint32
+}
+
+// parseScanRequest parses and derives the scripts of every descriptor in req
+func (as *AddrServer) parseScanRequest(req DescriptorScanRequest) ([]descriptorScripts, error) {
+	if len(req.Descriptors) == 0 {
+		return nil, fmt.Errorf("no descriptors to scan")
+	}
+	total := 0
+	out := make([]descriptorScripts, 0, len(req.Descriptors))
+	for _, obj := range req.Descriptors {
+		desc, err := ParseDescriptor(obj.Desc, as.Params)
+		if err != nil {
+			return nil, fmt.Errorf("descriptor %q: %s", obj.Desc, err)
+		}
+		ds := descriptorScripts{desc: desc}
+		indexes := []uint32{0}
+		if desc.Ranged() {
+			ds.rng = obj.Range
+			if ds.rng == nil {
+				ds.rng = &[2]uint32{0, DefaultDescriptorRange - 1}
+			}
+			if total += int(ds.rng[1]-ds.rng[0]) + 1; total > maxDescriptorScripts {
+				return nil, fmt.Errorf("at most %d scripts can be scanned at once", maxDescriptorScripts)
+			}
+			indexes = indexes[:0]
+			for i := ds.rng[0]; ; i++ {
+				indexes = append(indexes, i)
+				if i == ds.rng[1] {
+					break
+				}
+			}
+		}
+		for _, i := range indexes {
+			script, err := desc.Script(i)
+			if err != nil {
+				return nil, fmt.Errorf("descriptor %q at index %d: %s", obj.Desc, i, err)
+			}
+			ds.scripts = append(ds.scripts, script)
+			ds.indexes = append(ds.indexes, i)
+		}
+		out = append(out, ds)
+	}
+	return out, nil
+}
+
+// scanDescriptor returns the UTXOs of a descriptor from the address index,
+// falling back to scantxoutset when the scripts have no address or the
+// address index doesn't cover their type
+func (as *AddrServer) scanDescriptor(ctx context.Context, ds descriptorScripts) (DescriptorResult, error) {
+	out := DescriptorResult{Descriptor: ds.desc.String, Range: ds.rng, Source: SourceAddressIndex, UTXOs: UTXOInsOuts{}}
+
+	indexes := map[string]uint32{}
+	var addrs []btcutil.Address
+	for i, script := range ds.scripts {
+		addr := scriptAddress(script, as.Params)
+		if addr == nil {
+			return as.scanTxOutSetResult(ctx, out)
+		}
+		addrs = append(addrs, addr)
+		indexes[addr.EncodeAddress()] = ds.indexes[i]
+	}
+
+	for _, chunk := range chunkAddresses(addrs) {
+		utxos, err := as.addressUTXOs(ctx, chunk)
+		if err != nil {
+			if classifyError(err).Code == CodeUnsupportedAddressType {
+				return as.scanTxOutSetResult(ctx, out)
+			}
+			return out, err
+		}
+		out.UTXOs = append(out.UTXOs, utxos...)
+	}
+	sort.Stable(out.UTXOs)
+
+	for _, u := range out.UTXOs {
+		out.Balance += u.Satoshis
+		if ds.rng != nil {
+			if out.Indexes == nil {
+				out.Indexes = map[string]uint32{}
+			}
+			out.Indexes[u.Address] = indexes[u.Address]
+		}
+	}
+	return out, nil
+}
+
+// scanTxOutSetResult fills in out by scanning the UTXO set for the descriptor,
+// replacing the UTXOs found in the address index so far
+func (as *AddrServer) scanTxOutSetResult(ctx context.Context, out DescriptorResult) (DescriptorResult, error) {
+	out.Source = SourceScanTxOutSet
+	out.UTXOs = UTXOInsOuts{}
+	out.Balance = 0
+	out.Indexes = nil
+	res, err := as.ScanTxOutSet(ctx, out.Descriptor, out.Range)
+	if err != nil {
+		return out, err
+	}
+	for _, u := range res.Result.Unspents {
+		amount, err := btcutil.NewAmount(u.Amount)
+		if err != nil {
+			return out, err
+		}
+		utxo := UTXOInsOut{
+			Txid:        u.Txid,
+			OutputIndex: u.Vout,
+			Script:      u.ScriptPubKey,
+			Satoshis:    int(amount),
+			Amount:      u.Amount,
+			Height:      u.Height,
+		}
+		if script, err := hex.DecodeString(u.ScriptPubKey); err == nil {
+			utxo.ScriptType = ScriptType(script)
+			if addr := scriptAddress(script, as.Params); addr != nil {
+				utxo.Address = addr.EncodeAddress()
+			}
+		}
+		if res.Result.Height > 0 && u.Height > 0 {
+			utxo.Confirmations = res.Result.Height - u.Height + 1
+		}
+		out.UTXOs = append(out.UTXOs, utxo)
+		out.Balance += utxo.Satoshis
+	}
+	sort.Stable(out.UTXOs)
+	return out, nil
+}
+
+func scanTxOutSetRequest(desc string, rng *[2]uint32) []byte {
+	obj := map[string]interface{}{"desc": desc}
+	if rng != nil {
+		obj["range"] = rng
+	}
+	srtr := BitcoreRequest{
+		JSONRPC: "1.0",
+		Method:  "scantxoutset",
+		Params:  []interface{}{"start", []interface{}{obj}},
+	}
+	out, err := json.Marshal(srtr)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// ScanTxOutSet scans the UTXO set for the scripts of a descriptor. The node
+// runs one scan at a time, so scans are serialized here and a scan started
+// by another client is reported as the node being busy.
+func (as *AddrServer) ScanTxOutSet(ctx context.Context, desc string, rng *[2]uint32) (ScanTxOutSetResponse, error) {
+	as.scanMu.Lock()
+	defer as.scanMu.Unlock()
+
+	out := ScanTxOutSetResponse{}
+	err := as.postBitcore(ctx, "scantxoutset", scanTxOutSetRequest(desc, rng), &out)
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) {
+		switch {
+		case rpcErr.Code == rpcMethodNotFound:
+			return out, &APIError{
+				Status: http.StatusNotImplemented,
+				Code:   CodeUnsupportedAddressType,
+				Err:    fmt.Errorf("the node's address index doesn't cover the descriptor's scripts and it doesn't support scantxoutset"),
+			}
+		case strings.Contains(rpcErr.Message, "in progress"):
+			return out, &APIError{Status: http.StatusServiceUnavailable, Code: CodeNodeBusy, Err: err}
+		}
+	}
+	return out, err
+}
+
+// ScanTxOutSetResponse is the response struct for ScanTxOutSet
+type ScanTxOutSetResponse struct {
+	Result struct {
+		Success  bool `json:"success"`
+		Height   int  `json:"height"`
+		Unspents []struct {
+			Txid         string  `json:"txid"`
+			Vout         int     `json:"vout"`
+			ScriptPubKey string  `json:"scriptPubKey"`
+			Amount       float64 `json:"amount"`
+			Height       int     `json:"height"`
+		} `json:"unspents"`
+		TotalAmount float64 `json:"total_amount"`
+	} `json:"result"`
+	Error interface{} `json:"error"`
+	ID    interface{} `json:"id"`
+}
+
+// HandleDescriptorScan handles the /descriptor/scan route
+func (as *AddrServer) HandleDescriptorScan(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req DescriptorScanRequest
+
+	// Read post body
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDescriptorBody))
+	if err != nil {
+		writeError(w, "unable to read post body", InvalidInput(err))
+		return
+	}
+
+	// Unmarshal
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		writeError(w, "unable to unmarshall body", InvalidInput(err))
+		return
+	}
+
+	descs, err := as.parseScanRequest(req)
+	if err != nil {
+		writeError(w, "invalid descriptor", InvalidInput(err))
+		return
+	}
+
+	out := DescriptorScanResponse{Descriptors: []DescriptorResult{}}
+	for _, ds := range descs {
+		res, err := as.scanDescriptor(r.Context(), ds)
+		if err != nil {
+			writeError(w, fmt.Sprintf("error scanning %s", ds.desc.String), err)
+			return
+		}
+		out.Balance += res.Balance
+		out.Descriptors = append(out.Descriptors, res)
+	}
+	o, _ := json.Marshal(out)
+	w.Write(o)
+}
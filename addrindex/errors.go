@@ -0,0 +1,123 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// Machine readable error codes returned in the `code` field of PostError
+const (
+	CodeInvalidInput           = "invalid_input"
+	CodeNotFound               = "not_found"
+	CodeTxRejected             = "tx_rejected"
+	CodeTxAlreadyInChain       = "tx_already_in_chain"
+	CodeUnsupportedAddressType = "unsupported_address_type"
+	CodeRateLimited            = "rate_limited"
+	CodeNodeSyncing            = "node_syncing"
+	CodeNodeBusy               = "node_busy"
+	CodeUpstreamError          = "upstream_error"
+	CodeUpstreamTimeout        = "upstream_timeout"
+	CodeUpstreamUnavailable    = "upstream_unavailable"
+	CodeBroadcastUnknown       = "broadcast_unknown"
+)
+
+// bitcoind JSON-RPC error codes, see src/rpc/protocol.h
+const (
+	rpcInvalidAddressOrKey     btcjson.RPCErrorCode = -5
+	rpcInvalidParameter        btcjson.RPCErrorCode = -8
+	rpcClientInInitialDownload btcjson.RPCErrorCode = -10
+	rpcVerifyError             btcjson.RPCErrorCode = -25
+	rpcVerifyRejected          btcjson.RPCErrorCode = -26
+	rpcVerifyAlreadyInChain    btcjson.RPCErrorCode = -27
+	rpcInWarmup                btcjson.RPCErrorCode = -28
+)
+
+// APIError is an error along with the HTTP status and code clients see it as
+type APIError struct {
+	Status int
+	Code   string
+	Err    error
+}
+
+func (e *APIError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidInput marks err as caused by a bad request
+func InvalidInput(err error) error {
+	return &APIError{Status: http.StatusBadRequest, Code: CodeInvalidInput, Err: err}
+}
+
+// NotFound marks err as caused by a missing resource
+func NotFound(err error) error {
+	return &APIError{Status: http.StatusNotFound, Code: CodeNotFound, Err: err}
+}
+
+// classifyError maps err to the status and code it's reported with. Errors
+// from bitcoind are mapped by their RPC error code, failures talking to the
+// node are upstream errors.
+func classifyError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.Code {
+		case rpcInvalidAddressOrKey:
+			return &APIError{Status: http.StatusNotFound, Code: CodeNotFound, Err: err}
+		case rpcInvalidParameter:
+			return &APIError{Status: http.StatusBadRequest, Code: CodeInvalidInput, Err: err}
+		case rpcVerifyError, rpcVerifyRejected:
+			return &APIError{Status: http.StatusBadRequest, Code: CodeTxRejected, Err: err}
+		case rpcVerifyAlreadyInChain:
+			return &APIError{Status: http.StatusBadRequest, Code: CodeTxAlreadyInChain, Err: err}
+		case rpcInWarmup, rpcClientInInitialDownload:
+			return &APIError{Status: http.StatusServiceUnavailable, Code: CodeNodeSyncing, Err: err}
+		}
+		return &APIError{Status: http.StatusBadGateway, Code: CodeUpstreamError, Err: err}
+	}
+
+	if errors.Is(err, ErrRPCBusy) || isWorkQueueFull(err) {
+		return &APIError{Status: http.StatusServiceUnavailable, Code: CodeNodeBusy, Err: err}
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return &APIError{Status: http.StatusServiceUnavailable, Code: CodeUpstreamUnavailable, Err: err}
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &APIError{Status: http.StatusGatewayTimeout, Code: CodeUpstreamTimeout, Err: err}
+	}
+	return &APIError{Status: http.StatusBadGateway, Code: CodeUpstreamError, Err: err}
+}
+
+// writeError reports err to the client with the status it maps to
+func writeError(w http.ResponseWriter, msg string, err error) {
+	apiErr := classifyError(err)
+	w.WriteHeader(apiErr.Status)
+	w.Write(NewPostError(msg, apiErr))
+}
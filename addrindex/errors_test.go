@@ -0,0 +1,150 @@
+package addrindex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/gorilla/mux"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestClassifyError(t *testing.T) {
+	rpcErr := func(code btcjson.RPCErrorCode) error {
+		return &btcjson.RPCError{Code: code, Message: "node error"}
+	}
+	cases := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"invalid input", InvalidInput(fmt.Errorf("bad txid")), 400, CodeInvalidInput},
+		{"not found", NotFound(fmt.Errorf("no page")), 404, CodeNotFound},
+		{"-5 no such tx", rpcErr(-5), 404, CodeNotFound},
+		{"-8 bad parameter", rpcErr(-8), 400, CodeInvalidInput},
+		{"-25 missing inputs", rpcErr(-25), 400, CodeTxRejected},
+		{"-26 rejected", rpcErr(-26), 400, CodeTxRejected},
+		{"-27 already in chain", rpcErr(-27), 400, CodeTxAlreadyInChain},
+		{"-28 warming up", rpcErr(-28), 503, CodeNodeSyncing},
+		{"-10 initial download", rpcErr(-10), 503, CodeNodeSyncing},
+		{"other rpc error", rpcErr(-1), 502, CodeUpstreamError},
+		{"wrapped rpc error", fmt.Errorf("fetching: %w", rpcErr(-5)), 404, CodeNotFound},
+		{"busy", ErrRPCBusy, 503, CodeNodeBusy},
+		{"deadline", context.DeadlineExceeded, 504, CodeUpstreamTimeout},
+		{"net timeout", &net.OpError{Op: "read", Err: timeoutError{}}, 504, CodeUpstreamTimeout},
+		{"connection refused", errors.New("connection refused"), 502, CodeUpstreamError},
+	}
+	for _, c := range cases {
+		got := classifyError(c.err)
+		if got.Status != c.status || got.Code != c.code {
+			t.Errorf("%s: Expected '%d %s', got '%d %s'\n", c.name, c.status, c.code, got.Status, got.Code)
+		}
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	txid := "b3922b88ba526df9cab9634785892de245004c96c36ede9b5b50f68abe584e98"
+	cases := []struct {
+		name   string
+		as     *AddrServer
+		ctx    func() (context.Context, context.CancelFunc)
+		status int
+		code   string
+	}{
+		{
+			name:   "missing transaction",
+			as:     fakeBitcore(t, 500, `{"result":null,"error":{"code":-5,"message":"No information available about transaction"},"id":null}`, 0),
+			status: 404,
+			code:   CodeNotFound,
+		},
+		{
+			name:   "node warming up",
+			as:     fakeBitcore(t, 500, `{"result":null,"error":{"code":-28,"message":"Loading block index..."},"id":null}`, 0),
+			status: 503,
+			code:   CodeNodeSyncing,
+		},
+		{
+			name:   "garbage from node",
+			as:     fakeBitcore(t, 502, `<html>bad gateway</html>`, 0),
+			status: 502,
+			code:   CodeUpstreamError,
+		},
+		{
+			name: "slow node",
+			as:   fakeBitcore(t, 200, `{}`, 100*time.Millisecond),
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 10*time.Millisecond)
+			},
+			status: 504,
+			code:   CodeUpstreamTimeout,
+		},
+		{
+			name:   "unreachable node",
+			as:     &AddrServer{Client: testClient(t, "127.0.0.1:1")},
+			status: 502,
+			code:   CodeUpstreamError,
+		},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/tx/"+txid, nil)
+		if c.ctx != nil {
+			ctx, cancel := c.ctx()
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		req = mux.SetURLVars(req, map[string]string{"txid": txid})
+		w := httptest.NewRecorder()
+		c.as.HandleTxGet(w, req)
+
+		var pe PostError
+		json.Unmarshal(w.Body.Bytes(), &pe)
+		if w.Code != c.status || pe.Code != c.code {
+			t.Errorf("%s: Expected '%d %s', got '%d %s'\n", c.name, c.status, c.code, w.Code, pe.Code)
+		}
+	}
+}
+
+func TestHandlerInvalidInput(t *testing.T) {
+	as := &AddrServer{}
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/block/nothex", nil), map[string]string{"blockHash": "nothex"})
+	w := httptest.NewRecorder()
+	as.HandleGetBlock(w, req)
+
+	var pe PostError
+	json.Unmarshal(w.Body.Bytes(), &pe)
+	if w.Code != 400 || pe.Code != CodeInvalidInput {
+		t.Errorf("Expected '400 %s', got '%d %s'\n", CodeInvalidInput, w.Code, pe.Code)
+	}
+}
+
+func TestBlockTxsPage(t *testing.T) {
+	hash := "000000000000000000166e75b4a7ee6c4dd07a2b0b5e2b3a3f4d5b8c1b4a7e6f"
+	as := fakeBitcore(t, 200, `{"result":{"hash":"`+hash+`","tx":["aa","bb"]},"error":null,"id":null}`, 0)
+	cases := map[string]int{
+		"-1":                  400,
+		"x":                   400,
+		"1":                   404,
+		"9223372036854775807": 404,
+	}
+	for page, expected := range cases {
+		w := httptest.NewRecorder()
+		as.HandleGetTransactions(w, httptest.NewRequest("GET", "/txs?block="+hash+"&page="+page, nil))
+		if w.Code != expected {
+			t.Errorf("Expected '%d' for page %s, got '%d' %s\n", expected, page, w.Code, w.Body)
+		}
+	}
+}
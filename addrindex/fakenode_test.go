@@ -0,0 +1,176 @@
+package addrindex
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// fakeRequest is a JSON-RPC call to a fakeNode
+type fakeRequest struct {
+	ID     interface{}       `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// param decodes the ith parameter of the call into v
+func (req fakeRequest) param(i int, v interface{}) {
+	if i < len(req.Params) {
+		json.Unmarshal(req.Params[i], v)
+	}
+}
+
+// noReply leaves a call in a batch unanswered
+var noReply = &btcjson.RPCError{Message: "no reply"}
+
+// fakeNode is a JSON-RPC node for tests. A single call is answered with the
+// next raw reply queued for its method, then by answer, and is otherwise
+// dropped. A reply of "drop" closes the connection without answering and a
+// reply of "busy" is bitcoind's full work queue. Calls in a batch are all
+// answered by answer, in reverse order. When status is set every request
+// gets status and body as is.
+type fakeNode struct {
+	mu      sync.Mutex
+	answer  func(req fakeRequest) (interface{}, *btcjson.RPCError)
+	replies map[string][]string
+	status  int
+	body    string
+	delay   time.Duration
+	calls   map[string]int
+	batches int
+}
+
+// start serves the node and returns a server using it
+func (n *fakeNode) start(t *testing.T) *AddrServer {
+	srv := httptest.NewServer(http.HandlerFunc(n.serve))
+	t.Cleanup(srv.Close)
+	return &AddrServer{
+		Client:       testClient(t, strings.TrimPrefix(srv.URL, "http://")),
+		RPCBatchSize: 4,
+	}
+}
+
+// count returns the number of calls of method so far
+func (n *fakeNode) count(method string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls[method]
+}
+
+// batchCount returns the number of batches so far
+func (n *fakeNode) batchCount() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.batches
+}
+
+func (n *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(n.delay)
+	var body json.RawMessage
+	json.NewDecoder(r.Body).Decode(&body)
+	batch := bytes.HasPrefix(body, []byte("["))
+	var reqs []fakeRequest
+	if batch {
+		json.Unmarshal(body, &reqs)
+	} else {
+		var req fakeRequest
+		json.Unmarshal(body, &req)
+		reqs = append(reqs, req)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.calls == nil {
+		n.calls = map[string]int{}
+	}
+	for _, req := range reqs {
+		n.calls[req.Method]++
+	}
+	if n.status != 0 {
+		w.WriteHeader(n.status)
+		w.Write([]byte(n.body))
+		return
+	}
+	if batch {
+		n.batches++
+		out := []interface{}{}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			if resp := n.reply(reqs[i]); resp != nil {
+				out = append(out, resp)
+			}
+		}
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+
+	req := reqs[0]
+	if queue := n.replies[req.Method]; len(queue) > 0 {
+		n.replies[req.Method] = queue[1:]
+		switch queue[0] {
+		case "drop":
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case "busy":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Work queue depth exceeded"))
+		default:
+			w.Write([]byte(queue[0]))
+		}
+		return
+	}
+	resp := n.reply(req)
+	if resp == nil {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// reply answers req, or returns nil to leave it unanswered
+func (n *fakeNode) reply(req fakeRequest) map[string]interface{} {
+	if n.answer == nil {
+		return nil
+	}
+	result, err := n.answer(req)
+	if err == noReply {
+		return nil
+	}
+	return map[string]interface{}{"result": result, "error": err, "id": req.ID}
+}
+
+// fakeBitcore serves a fixed JSON-RPC response, after a delay
+func fakeBitcore(t *testing.T, status int, body string, delay time.Duration) *AddrServer {
+	return (&fakeNode{status: status, body: body, delay: delay}).start(t)
+}
+
+// testClient returns a client for a single backend node at host
+func testClient(t *testing.T, host string) *RPCClient {
+	b, err := NewBackend(BackendConfig{Host: host, Usr: "user", Pass: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRPCClient([]*Backend{b})
+}
+
+// testBackends returns a client for unreachable backends with the given
+// statuses
+func testBackends(t *testing.T, statuses ...BackendStatus) *RPCClient {
+	var backends []*Backend
+	for _, s := range statuses {
+		b, err := NewBackend(BackendConfig{Name: s.Name, Host: "127.0.0.1:1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.setStatus(s)
+		backends = append(backends, b)
+	}
+	return newRPCClient(backends)
+}
@@ -0,0 +1,198 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil"
+)
+
+// Defaults for the readiness settings in AddrServerConfig
+const (
+	DefaultReadyMaxBlocksBehind = 2
+	DefaultReadyMaxTipAge       = 2 * time.Hour
+)
+
+// HealthCheck is the result of a single readiness check
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadyResponse models a response to the /readyz route
+type ReadyResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// setHealthConfig copies the readiness settings off the config, filling in
+// defaults. A negative value disables the check.
+func (as *AddrServer) setHealthConfig(cfg *AddrServerConfig) {
+	as.ReadyMaxBlocksBehind = cfg.ReadyMaxBlocksBehind
+	if as.ReadyMaxBlocksBehind == 0 {
+		as.ReadyMaxBlocksBehind = DefaultReadyMaxBlocksBehind
+	}
+	as.ReadyMaxTipAge = cfg.ReadyMaxTipAge
+	if as.ReadyMaxTipAge == 0 {
+		as.ReadyMaxTipAge = DefaultReadyMaxTipAge
+	}
+}
+
+// HandleHealthz handles the /healthz route. It only reports that the process
+// is up and serving.
+func (as *AddrServer) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// HandleReadyz handles the /readyz route
+func (as *AddrServer) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	out := as.Ready(r.Context())
+	if out.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	o, _ := json.Marshal(out)
+	w.Write(o)
+}
+
+// Ready checks that the node is reachable, has the bitcore indexes enabled,
+// is caught up with its headers and has a recent tip
+func (as *AddrServer) Ready(ctx context.Context) ReadyResponse {
+	var checks []HealthCheck
+	out := ReadyResponse{Status: "ready"}
+	defer func() {
+		for _, c := range checks {
+			if !c.OK {
+				out.Status = "not ready"
+			}
+		}
+		out.Checks = checks
+	}()
+
+	chainInfo, err := as.Client.GetBlockChainInfo(ctx)
+	if err != nil {
+		checks = append(checks, failedCheck("rpc", err))
+		return out
+	}
+	checks = append(checks, HealthCheck{Name: "rpc", OK: true, Detail: fmt.Sprintf("connected to %s node", chainInfo.Chain)})
+
+	hash, err := chainhash.NewHashFromStr(chainInfo.BestBlockHash)
+	if err != nil {
+		checks = append(checks, failedCheck("tip", err))
+		return out
+	}
+	tip, err := as.Client.GetBlockVerbose(ctx, hash)
+	if err != nil {
+		checks = append(checks, failedCheck("tip", err))
+		return out
+	}
+
+	checks = append(checks,
+		as.checkAddressIndex(ctx),
+		as.checkSpentIndex(ctx, tip),
+		as.checkTimestampIndex(ctx),
+		as.checkSync(chainInfo),
+		as.checkTipAge(tip),
+	)
+	if as.index != nil {
+		checks = append(checks, as.checkIndex(chainInfo))
+	}
+	return out
+}
+
+func failedCheck(name string, err error) HealthCheck {
+	return HealthCheck{Name: name, Error: err.Error()}
+}
+
+// checkAddressIndex probes getaddressbalance with an address on the current network
+func (as *AddrServer) checkAddressIndex(ctx context.Context) HealthCheck {
+	addr, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), as.Params)
+	if err != nil {
+		return failedCheck("addressindex", err)
+	}
+	_, err = as.GetAddressBalance(ctx, []string{addr.EncodeAddress()})
+	if err != nil {
+		return failedCheck("addressindex", err)
+	}
+	return HealthCheck{Name: "addressindex", OK: true}
+}
+
+// checkSpentIndex looks up an outpoint that the tip block is known to spend
+func (as *AddrServer) checkSpentIndex(ctx context.Context, tip *btcjson.GetBlockVerboseResult) HealthCheck {
+	if len(tip.Tx) < 2 {
+		return HealthCheck{Name: "spentindex", OK: true, Detail: "skipped, tip block only has a coinbase"}
+	}
+	tx, err := as.GetRawTransaction(ctx, tip.Tx[1])
+	if err != nil {
+		return failedCheck("spentindex", err)
+	}
+	if len(tx.Result.Vin) == 0 {
+		return HealthCheck{Name: "spentindex", OK: true, Detail: "skipped, no inputs to probe"}
+	}
+	vin := tx.Result.Vin[0]
+	_, err = as.GetSpentInfo(ctx, vin.Txid, vin.Vout)
+	if err != nil {
+		return failedCheck("spentindex", err)
+	}
+	return HealthCheck{Name: "spentindex", OK: true}
+}
+
+// checkTimestampIndex probes getblockhashes over the last minute
+func (as *AddrServer) checkTimestampIndex(ctx context.Context) HealthCheck {
+	now := time.Now()
+	_, err := as.GetBlockHashes(ctx, int(now.Unix()), int(now.Add(-time.Minute).Unix()))
+	if err != nil {
+		return failedCheck("timestampindex", err)
+	}
+	return HealthCheck{Name: "timestampindex", OK: true}
+}
+
+// checkSync checks the node's blocks are within ReadyMaxBlocksBehind of its headers
+func (as *AddrServer) checkSync(chainInfo *btcjson.GetBlockChainInfoResult) HealthCheck {
+	behind := chainInfo.Headers - chainInfo.Blocks
+	out := HealthCheck{
+		Name:   "sync",
+		OK:     true,
+		Detail: fmt.Sprintf("%d blocks behind headers (max %d)", behind, as.ReadyMaxBlocksBehind),
+	}
+	if as.ReadyMaxBlocksBehind >= 0 && int(behind) > as.ReadyMaxBlocksBehind {
+		out.OK = false
+	}
+	return out
+}
+
+// checkTipAge checks the tip block is newer than ReadyMaxTipAge
+func (as *AddrServer) checkTipAge(tip *btcjson.GetBlockVerboseResult) HealthCheck {
+	age := time.Since(time.Unix(tip.Time, 0)).Round(time.Second)
+	out := HealthCheck{
+		Name:   "tip",
+		OK:     true,
+		Detail: fmt.Sprintf("tip %d is %v old (max %v)", tip.Height, age, as.ReadyMaxTipAge),
+	}
+	if as.ReadyMaxTipAge > 0 && age > as.ReadyMaxTipAge {
+		out.OK = false
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+package addrindex
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+func TestHandleHealthz(t *testing.T) {
+	as := &AddrServer{}
+	w := httptest.NewRecorder()
+	as.HandleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 || w.Body.String() != `{"status":"ok"}` {
+		t.Errorf("Expected '200 {\"status\":\"ok\"}', got '%d %s'\n", w.Code, w.Body.String())
+	}
+}
+
+func TestHealthConfigDefaults(t *testing.T) {
+	as := &AddrServer{}
+	as.setHealthConfig(&AddrServerConfig{})
+	if as.ReadyMaxBlocksBehind != DefaultReadyMaxBlocksBehind || as.ReadyMaxTipAge != DefaultReadyMaxTipAge {
+		t.Errorf("Expected default readiness settings, got '%d' and '%v'\n", as.ReadyMaxBlocksBehind, as.ReadyMaxTipAge)
+	}
+}
+
+func TestHealthCheckSync(t *testing.T) {
+	as := &AddrServer{ReadyMaxBlocksBehind: 2}
+	if c := as.checkSync(&btcjson.GetBlockChainInfoResult{Blocks: 100, Headers: 102}); !c.OK {
+		t.Errorf("Expected node 2 blocks behind to be ready: %s\n", c.Detail)
+	}
+	if c := as.checkSync(&btcjson.GetBlockChainInfoResult{Blocks: 100, Headers: 103}); c.OK {
+		t.Errorf("Expected node 3 blocks behind not to be ready: %s\n", c.Detail)
+	}
+	as.ReadyMaxBlocksBehind = -1
+	if c := as.checkSync(&btcjson.GetBlockChainInfoResult{Blocks: 0, Headers: 500000}); !c.OK {
+		t.Errorf("Expected disabled sync check to pass: %s\n", c.Detail)
+	}
+}
+
+func TestHealthCheckTipAge(t *testing.T) {
+	as := &AddrServer{ReadyMaxTipAge: time.Hour}
+	if c := as.checkTipAge(&btcjson.GetBlockVerboseResult{Time: time.Now().Add(-time.Minute).Unix()}); !c.OK {
+		t.Errorf("Expected recent tip to be ready: %s\n", c.Detail)
+	}
+	if c := as.checkTipAge(&btcjson.GetBlockVerboseResult{Time: time.Now().Add(-2 * time.Hour).Unix()}); c.OK {
+		t.Errorf("Expected stale tip not to be ready: %s\n", c.Detail)
+	}
+}
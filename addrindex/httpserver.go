@@ -0,0 +1,76 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Defaults for the HTTP server settings in AddrServerConfig
+const (
+	DefaultReadTimeout     = 15 * time.Second
+	DefaultWriteTimeout    = 60 * time.Second
+	DefaultIdleTimeout     = 120 * time.Second
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultMaxHeaderBytes  = 1 << 20
+)
+
+// setHTTPConfig copies the HTTP server settings off the config, filling in defaults
+func (as *AddrServer) setHTTPConfig(cfg *AddrServerConfig) {
+	as.Bind = cfg.Bind
+	as.ReadTimeout = durationOrDefault(cfg.ReadTimeout, DefaultReadTimeout)
+	as.WriteTimeout = durationOrDefault(cfg.WriteTimeout, DefaultWriteTimeout)
+	as.IdleTimeout = durationOrDefault(cfg.IdleTimeout, DefaultIdleTimeout)
+	as.ShutdownTimeout = durationOrDefault(cfg.ShutdownTimeout, DefaultShutdownTimeout)
+	as.MaxHeaderBytes = cfg.MaxHeaderBytes
+	if as.MaxHeaderBytes <= 0 {
+		as.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	as.TLSCert = cfg.TLSCert
+	as.TLSKey = cfg.TLSKey
+	as.TLSClientCA = cfg.TLSClientCA
+	as.TLSClientAuth = cfg.TLSClientAuth
+	as.TLSRedirectPort = cfg.TLSRedirectPort
+}
+
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// ListenAddr returns the address the HTTP server binds to. An empty Bind
+// listens on all interfaces.
+func (as *AddrServer) ListenAddr() string {
+	return net.JoinHostPort(as.Bind, strconv.Itoa(as.Port))
+}
+
+// HTTPServer returns an http.Server for the handler with the configured
+// timeouts and header limits
+func (as *AddrServer) HTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              as.ListenAddr(),
+		Handler:           handler,
+		ReadTimeout:       as.ReadTimeout,
+		ReadHeaderTimeout: as.ReadTimeout,
+		WriteTimeout:      as.WriteTimeout,
+		IdleTimeout:       as.IdleTimeout,
+		MaxHeaderBytes:    as.MaxHeaderBytes,
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// DefaultTxsConcurrency is the number of transactions of a /txs page that
+// are fetched at once
+const DefaultTxsConcurrency = 8
+
+// TxError is a transaction of a page that couldn't be fetched, returned in
+// place of the transaction when partial results are requested
+type TxError struct {
+	Index int    `json:"index"`
+	Txid  string `json:"txid"`
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// BlockTxs models a response to the /txs?block= route with partial results
+type BlockTxs struct {
+	Txs    []*btcjson.TxRawResult `json:"txs"`
+	Errors []TxError              `json:"errors,omitempty"`
+}
+
+func (as *AddrServer) setTxsConfig(cfg *AddrServerConfig) {
+	as.TxsConcurrency = cfg.TxsConcurrency
+	if as.TxsConcurrency <= 0 {
+		as.TxsConcurrency = DefaultTxsConcurrency
+	}
+}
+
+// fetchAll calls fetch for every index below n on at most workers goroutines
+// and returns the error of each call. Unless partial is set the first failure
+// cancels the remaining calls and is returned as err.
+func fetchAll(ctx context.Context, n, workers int, partial bool, fetch func(ctx context.Context, i int) error) (errs []error, err error) {
+	errs = make([]error, n)
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if errs[i] = fetch(ctx, i); errs[i] != nil && !partial {
+					cancel()
+				}
+			}
+		}()
+	}
+
+	sent := 0
+feed:
+	for ; sent < n; sent++ {
+		select {
+		case next <- sent:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	for i := sent; i < n; i++ {
+		errs[i] = ctx.Err()
+	}
+	if partial {
+		return errs, nil
+	}
+
+	// Calls cut short by the cancellation fail with context.Canceled, report
+	// the failure that caused it
+	for _, e := range errs {
+		if e != nil && (err == nil || errors.Is(err, context.Canceled) && !errors.Is(e, context.Canceled)) {
+			err = e
+		}
+	}
+	return errs, err
+}
+
+// txErrors returns the failed transactions of a page
+func txErrors(txids []string, errs []error) []TxError {
+	var out []TxError
+	for i, err := range errs {
+		if err != nil {
+			out = append(out, TxError{Index: i, Txid: txids[i], Error: err.Error(), Code: classifyError(err).Code})
+		}
+	}
+	return out
+}
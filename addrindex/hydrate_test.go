@@ -0,0 +1,101 @@
+package addrindex
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchAllOrder(t *testing.T) {
+	out := make([]int, 20)
+	var inFlight, peak int32
+	_, err := fetchAll(context.Background(), len(out), 4, false, func(ctx context.Context, i int) error {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		// Finish later items first
+		time.Sleep(time.Duration(len(out)-i) * time.Millisecond)
+		out[i] = i * i
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range out {
+		if v != i*i {
+			t.Errorf("Expected '%d' at %d, got '%d'\n", i*i, i, v)
+		}
+	}
+	if peak > 4 {
+		t.Errorf("Expected at most '%d' fetches in flight, got '%d'\n", 4, peak)
+	}
+}
+
+func TestFetchAllErrors(t *testing.T) {
+	failing := fmt.Errorf("tx 3 failed")
+	fetch := func(ctx context.Context, i int) error {
+		if i == 3 {
+			return failing
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+			return nil
+		}
+	}
+
+	// Without partial the failure cancels the page and is returned
+	_, err := fetchAll(context.Background(), 10, 4, false, fetch)
+	if err != failing {
+		t.Errorf("Expected '%v', got '%v'\n", failing, err)
+	}
+
+	// With partial every other item succeeds
+	errs, err := fetchAll(context.Background(), 10, 4, true, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range errs {
+		if (i == 3) != (e != nil) {
+			t.Errorf("Expected only item 3 to fail, got '%v' for %d\n", e, i)
+		}
+	}
+
+	txErrs := txErrors([]string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}, errs)
+	if len(txErrs) != 1 || txErrs[0].Index != 3 || txErrs[0].Txid != "d" || txErrs[0].Code != CodeUpstreamError {
+		t.Errorf("Expected one error for 'd', got '%+v'\n", txErrs)
+	}
+}
+
+func TestFetchAllLatency(t *testing.T) {
+	txid := "b3922b88ba526df9cab9634785892de245004c96c36ede9b5b50f68abe584e98"
+	as := fakeBitcore(t, 200, `{"result":{"txid":"`+txid+`"},"error":null,"id":null}`, 20*time.Millisecond)
+
+	page := func(workers int) time.Duration {
+		start := time.Now()
+		_, err := fetchAll(context.Background(), 10, workers, false, func(ctx context.Context, i int) error {
+			tx, err := as.GetRawTransaction(ctx, txid)
+			if err == nil && tx.Result.Txid != txid {
+				err = fmt.Errorf("got txid %s", tx.Result.Txid)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	serial, concurrent := page(1), page(DefaultTxsConcurrency)
+	if concurrent*2 > serial {
+		t.Errorf("Expected a page with %d workers to take under half of '%s', got '%s'\n", DefaultTxsConcurrency, serial, concurrent)
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jackzampolin/addrindex-server/index"
+)
+
+const (
+	// indexSyncInterval is how often the built-in index and its mempool view
+	// follow the node
+	indexSyncInterval = 5 * time.Second
+
+	// indexFetchAhead is how many blocks are fetched at once and connected
+	// in one database transaction while the index catches up
+	indexFetchAhead = 16
+
+	// indexStepTimeout bounds each step of the index sync
+	indexStepTimeout = time.Minute
+)
+
+// indexMethods are the bitcore methods the built-in index answers instead of
+// the node. getrawtransaction is only answered when verbose.
+var indexMethods = map[string]bool{
+	"getaddresstxids":   true,
+	"getaddressdeltas":  true,
+	"getaddressbalance": true,
+	"getaddressutxos":   true,
+	"getaddressmempool": true,
+	"getblockhashes":    true,
+	"getspentinfo":      true,
+	"getrawtransaction": true,
+	"getinfo":           true,
+}
+
+// setIndexConfig opens the built-in address index when indexPath is set.
+// It keeps undo data for reorgDepth blocks.
+func (as *AddrServer) setIndexConfig(cfg *AddrServerConfig) error {
+	as.IndexPath = cfg.IndexPath
+	if as.IndexPath == "" {
+		return nil
+	}
+	depth := as.ReorgDepth
+	if depth <= 0 {
+		depth = DefaultReorgDepth
+	}
+	ix, err := index.Open(as.IndexPath, as.Params, depth)
+	if err != nil {
+		return err
+	}
+	as.index = ix
+	as.mempool = newMempoolIndex()
+	return nil
+}
+
+// syncIndex keeps the built-in index and its mempool view in step with the
+// node every indexSyncInterval until quit is closed
+func (as *AddrServer) syncIndex(quit <-chan struct{}) {
+	ticker := time.NewTicker(indexSyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := as.syncIndexBlocks(quit); err != nil {
+			slog.Warn("Failed syncing the address index", "error", err)
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), indexStepTimeout)
+			if err := as.refreshMempool(ctx); err != nil {
+				slog.Warn("Failed refreshing the mempool index", "error", err)
+			}
+			cancel()
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncIndexBlocks disconnects index blocks that left the node's best chain
+// and connects the ones it's missing, until the index reaches the node's tip
+// or quit is closed. The calls are pinned to one backend so the index
+// follows a single chain.
+func (as *AddrServer) syncIndexBlocks(quit <-chan struct{}) error {
+	candidates := as.Client.candidates(context.Background())
+	if len(candidates) == 0 {
+		return ErrNoBackends
+	}
+	backend := candidates[0]
+	for {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+		ctx, cancel := context.WithTimeout(withBackend(context.Background(), backend), indexStepTimeout)
+		done, err := as.syncIndexStep(ctx)
+		cancel()
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// syncIndexStep disconnects the index tip if it left the best chain, or
+// connects up to indexFetchAhead blocks. It returns whether the index is at
+// the node's tip. The calls of a step are pinned to one backend, so backends
+// at different heights or on different chains can't be mixed.
+func (as *AddrServer) syncIndexStep(ctx context.Context) (bool, error) {
+	candidates := as.Client.candidates(ctx)
+	if len(candidates) == 0 {
+		return false, ErrNoBackends
+	}
+	ctx = withBackend(ctx, candidates[0])
+	nodeTip, err := as.Client.GetBlockCount(ctx)
+	if err != nil {
+		return false, err
+	}
+	height, hash, err := as.index.Tip()
+	if err != nil {
+		return false, err
+	}
+	indexHeight.Set(float64(height))
+
+	// The index is checked at the node's tip when it's ahead, so a stale
+	// fork left past the node's tip is unwound too
+	check, checkHash := height, hash
+	if int64(check) > nodeTip {
+		check = int32(nodeTip)
+		var ok bool
+		if checkHash, ok, err = as.index.BlockHash(check); err != nil || !ok {
+			return false, fmt.Errorf("no block at height %d in the address index: %v", check, err)
+		}
+	}
+	if check >= 0 {
+		nodeHash, err := as.Client.GetBlockHash(ctx, int64(check))
+		if err != nil {
+			return false, err
+		}
+		if *nodeHash != checkHash {
+			slog.Warn("Disconnecting block that left the best chain from the address index", "height", height, "hash", hash)
+			return false, as.index.DisconnectTip()
+		}
+	}
+	if int64(height) >= nodeTip {
+		return true, nil
+	}
+
+	n := int(nodeTip - int64(height))
+	if n > indexFetchAhead {
+		n = indexFetchAhead
+	}
+	blocks := make([]*wire.MsgBlock, n)
+	_, err = fetchAll(ctx, n, as.TxsConcurrency, false, func(ctx context.Context, i int) error {
+		hash, err := as.Client.GetBlockHash(ctx, int64(height)+1+int64(i))
+		if err != nil {
+			return err
+		}
+		blocks[i], err = as.Client.GetBlock(ctx, hash)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// The chain changed while the blocks were fetched, the next step
+	// disconnects the stale tip
+	if err := as.index.ConnectBlocks(blocks, height+1); err != nil && err != index.ErrNotNext {
+		return false, err
+	}
+	return false, nil
+}
+
+// indexSynced returns an error while the index is more than
+// ReadyMaxBlocksBehind blocks behind the node
+func (as *AddrServer) indexSynced() error {
+	height, _, err := as.index.Tip()
+	if err != nil {
+		return err
+	}
+	tip := as.tipHeight.Load()
+	if tip == 0 || as.ReadyMaxBlocksBehind < 0 || tip-int64(height) <= int64(as.ReadyMaxBlocksBehind) {
+		return nil
+	}
+	return &APIError{
+		Status: http.StatusServiceUnavailable,
+		Code:   CodeNodeSyncing,
+		Err:    fmt.Errorf("the address index is at block %d, the node at %d", height, tip),
+	}
+}
+
+// checkIndex checks the built-in index is within ReadyMaxBlocksBehind of the node
+func (as *AddrServer) checkIndex(chainInfo *btcjson.GetBlockChainInfoResult) HealthCheck {
+	height, _, err := as.index.Tip()
+	if err != nil {
+		return failedCheck("index", err)
+	}
+	behind := int64(chainInfo.Blocks) - int64(height)
+	out := HealthCheck{
+		Name:   "index",
+		OK:     true,
+		Detail: fmt.Sprintf("%d blocks behind the node (max %d)", behind, as.ReadyMaxBlocksBehind),
+	}
+	if as.ReadyMaxBlocksBehind >= 0 && behind > int64(as.ReadyMaxBlocksBehind) {
+		out.OK = false
+	}
+	return out
+}
+
+// indexAnswers returns whether the built-in index answers req
+func (as *AddrServer) indexAnswers(req BitcoreRequest) bool {
+	if as.index == nil || !indexMethods[req.Method] {
+		return false
+	}
+	if req.Method != "getrawtransaction" {
+		return true
+	}
+	if len(req.Params) < 2 {
+		return false
+	}
+	switch v := req.Params[1].(type) {
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	}
+	return false
+}
+
+// postIndex answers a bitcore call from the built-in index, unmarshalling
+// the result into out as if it came from the node
+func (as *AddrServer) postIndex(ctx context.Context, req BitcoreRequest, out interface{}) error {
+	res, err := as.callIndex(ctx, req)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(map[string]json.RawMessage{"result": res})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// addressParams are the parameters of the bitcore address methods
+type addressParams struct {
+	Addresses []string `json:"addresses"`
+	Start     int32    `json:"start"`
+	End       int32    `json:"end"`
+}
+
+// callIndex answers a bitcore call from the built-in index
+func (as *AddrServer) callIndex(ctx context.Context, req BitcoreRequest) (json.RawMessage, error) {
+	var params []json.RawMessage
+	b, err := json.Marshal(req.Params)
+	if err == nil {
+		err = json.Unmarshal(b, &params)
+	}
+	if err != nil {
+		return nil, &btcjson.RPCError{Code: btcjson.ErrRPCInvalidParams.Code, Message: err.Error()}
+	}
+	param := func(i int, out interface{}) error {
+		if i >= len(params) {
+			return &btcjson.RPCError{Code: btcjson.ErrRPCInvalidParams.Code, Message: fmt.Sprintf("missing parameter %d of %s", i+1, req.Method)}
+		}
+		if err := json.Unmarshal(params[i], out); err != nil {
+			return &btcjson.RPCError{Code: btcjson.ErrRPCInvalidParams.Code, Message: err.Error()}
+		}
+		return nil
+	}
+
+	var result interface{}
+	switch req.Method {
+	case "getaddressmempool":
+		var p addressParams
+		if err := param(0, &p); err != nil {
+			return nil, err
+		}
+		result = as.mempool.entries(p.Addresses)
+
+	case "getaddresstxids", "getaddressdeltas", "getaddressbalance", "getaddressutxos":
+		var p addressParams
+		if err := param(0, &p); err != nil {
+			return nil, err
+		}
+		if err := as.indexSynced(); err != nil {
+			return nil, err
+		}
+		result, err = as.indexAddressCall(req.Method, p)
+
+	case "getblockhashes":
+		var high, low uint32
+		if err := param(0, &high); err != nil {
+			return nil, err
+		}
+		if err := param(1, &low); err != nil {
+			return nil, err
+		}
+		result, err = as.index.BlockHashes(high, low)
+
+	case "getspentinfo":
+		var p struct {
+			Txid  string `json:"txid"`
+			Index uint32 `json:"index"`
+		}
+		if err := param(0, &p); err != nil {
+			return nil, err
+		}
+		result, err = as.indexSpentInfo(p.Txid, p.Index)
+
+	case "getrawtransaction":
+		var txid string
+		if err := param(0, &txid); err != nil {
+			return nil, err
+		}
+		result, err = as.indexRawTransaction(ctx, txid)
+
+	case "getinfo":
+		result, err = as.Client.GetInfo(ctx)
+
+	default:
+		return nil, btcjson.ErrRPCMethodNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// indexAddressCall answers the confirmed address methods in the node's format
+func (as *AddrServer) indexAddressCall(method string, p addressParams) (interface{}, error) {
+	switch method {
+	case "getaddresstxids":
+		return as.index.TxIDs(p.Addresses, p.Start, p.End)
+
+	case "getaddressdeltas":
+		deltas, err := as.index.Deltas(p.Addresses, p.Start, p.End)
+		out := make([]AddressDelta, len(deltas))
+		for i, d := range deltas {
+			out[i] = AddressDelta{
+				Satoshis:   int(d.Satoshis),
+				Txid:       d.Txid,
+				Index:      int(d.Index),
+				Blockindex: int(d.BlockIndex),
+				Height:     int(d.Height),
+				Address:    d.Address,
+			}
+		}
+		return out, err
+
+	case "getaddressbalance":
+		balance, err := as.index.Balance(p.Addresses)
+		return AddressBalance{Balance: int(balance.Balance), Received: int(balance.Received)}, err
+	}
+
+	utxos, err := as.index.UTXOs(p.Addresses)
+	out := make([]UTXOIns, len(utxos))
+	for i, u := range utxos {
+		out[i] = UTXOIns{
+			Address:     u.Address,
+			Txid:        u.Txid,
+			OutputIndex: int(u.Index),
+			Script:      hex.EncodeToString(u.Script),
+			Satoshis:    int(u.Satoshis),
+			Height:      int(u.Height),
+		}
+	}
+	return out, err
+}
+
+// indexSpentInfo answers getspentinfo
+func (as *AddrServer) indexSpentInfo(txid string, vout uint32) (*SpentInfo, error) {
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		return nil, &btcjson.RPCError{Code: rpcInvalidParameter, Message: err.Error()}
+	}
+	spent, err := as.index.Spent(hash, vout)
+	if err != nil {
+		return nil, err
+	}
+	if spent == nil {
+		return nil, &btcjson.RPCError{Code: rpcInvalidAddressOrKey, Message: "Unable to get spent info"}
+	}
+	return &SpentInfo{Txid: spent.Txid, Index: int(spent.Index), Height: int(spent.Height)}, nil
+}
+
+// indexRawTransaction fetches a transaction from the node and adds the
+// fields of bitcore's spent index. Transactions in the index are fetched from
+// their block so the node doesn't need txindex.
+func (as *AddrServer) indexRawTransaction(ctx context.Context, txid string) (*TransactionIns, error) {
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		return nil, &btcjson.RPCError{Code: rpcInvalidParameter, Message: err.Error()}
+	}
+	height, blockHash, inBlock, err := as.index.TxBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	params := []interface{}{txid, 1}
+	if inBlock {
+		params = append(params, blockHash.String())
+	}
+	body, err := json.Marshal(BitcoreRequest{JSONRPC: "1.0", Method: "getrawtransaction", Params: params})
+	if err != nil {
+		return nil, err
+	}
+	var res GetRawTransactionResponse
+	if err := as.postNode(ctx, "getrawtransaction", body, &res); err != nil {
+		return nil, err
+	}
+
+	tx := &res.Result
+	if inBlock && tx.Height == 0 {
+		tx.Height = int(height)
+	}
+	for i := range tx.Vin {
+		vin := &tx.Vin[i]
+		prev, err := chainhash.NewHashFromStr(vin.Txid)
+		if vin.Txid == "" || err != nil {
+			continue
+		}
+		if o := as.prevOutput(wire.OutPoint{Hash: *prev, Index: uint32(vin.Vout)}); o != nil {
+			vin.Address = o.Address
+			vin.ValueSat = int(o.Satoshis)
+			vin.Value = float64(o.Satoshis) / 100000000
+		}
+	}
+	for i := range tx.Vout {
+		vout := &tx.Vout[i]
+		vout.ValueSat = int(math.Round(vout.Value * 100000000))
+		if len(vout.ScriptPubKey.Addresses) == 0 {
+			// Bitcoin Core 22 replaced addresses with address
+			if script, err := hex.DecodeString(vout.ScriptPubKey.Hex); err == nil {
+				if addr := as.index.Address(script); addr != "" {
+					vout.ScriptPubKey.Addresses = []string{addr}
+				}
+			}
+		}
+		spent, err := as.index.Spent(hash, uint32(vout.N))
+		if err == nil && spent != nil {
+			vout.SpentTxID = spent.Txid
+			vout.SpentIndex = int(spent.Index)
+			vout.SpentHeight = int(spent.Height)
+		}
+	}
+	return tx, nil
+}
+
+// prevOutput returns the output an input spends from the index or mempool,
+// or nil if it doesn't pay to an address
+func (as *AddrServer) prevOutput(op wire.OutPoint) *index.Output {
+	if spent, err := as.index.Spent(&op.Hash, op.Index); err == nil && spent != nil && spent.Output != nil {
+		return spent.Output
+	}
+	if o, err := as.index.Output(&op.Hash, op.Index); err == nil && o != nil {
+		return o
+	}
+	return as.mempool.output(op)
+}
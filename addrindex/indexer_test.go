@@ -0,0 +1,185 @@
+package addrindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/jackzampolin/addrindex-server/internal/chaintest"
+)
+
+// testChain is the chain of a stock node without an address index, for a
+// fakeNode to answer from
+type testChain struct {
+	blocks  []*wire.MsgBlock
+	mempool []*wire.MsgTx
+}
+
+func (c *testChain) answer(req fakeRequest) (interface{}, *btcjson.RPCError) {
+	notFound := &btcjson.RPCError{Code: rpcInvalidAddressOrKey, Message: "not found"}
+	switch req.Method {
+	case "getblockcount":
+		return len(c.blocks) - 1, nil
+	case "getblockhash":
+		var h int
+		req.param(0, &h)
+		if h >= len(c.blocks) {
+			return nil, &btcjson.RPCError{Code: rpcInvalidParameter, Message: "Block height out of range"}
+		}
+		return c.blocks[h].BlockHash().String(), nil
+	case "getblock":
+		var hash string
+		req.param(0, &hash)
+		for _, b := range c.blocks {
+			if b.BlockHash().String() == hash {
+				var buf bytes.Buffer
+				b.Serialize(&buf)
+				return hex.EncodeToString(buf.Bytes()), nil
+			}
+		}
+		return nil, notFound
+	case "getrawmempool":
+		out := []string{}
+		for _, tx := range c.mempool {
+			out = append(out, tx.TxHash().String())
+		}
+		return out, nil
+	case "getrawtransaction":
+		var txid string
+		req.param(0, &txid)
+		for _, tx := range c.mempool {
+			if tx.TxHash().String() == txid {
+				var buf bytes.Buffer
+				tx.Serialize(&buf)
+				return hex.EncodeToString(buf.Bytes()), nil
+			}
+		}
+		return nil, notFound
+	case "getblockchaininfo":
+		return map[string]interface{}{"chain": "main", "blocks": len(c.blocks) - 1, "headers": len(c.blocks) - 1}, nil
+	case "getnetworkinfo":
+		return map[string]interface{}{"version": 220000, "protocolversion": 70016, "connections": 8}, nil
+	}
+	return nil, btcjson.ErrRPCMethodNotFound
+}
+
+func TestIndexSync(t *testing.T) {
+	ctx := context.Background()
+	a, aScript := chaintest.Address(t, 1)
+	b, bScript := chaintest.Address(t, 2)
+
+	cb0 := chaintest.Coinbase(0, wire.NewTxOut(50, aScript))
+	block0 := chaintest.Block(nil, cb0)
+	tx1 := chaintest.Spend(cb0, 0, wire.NewTxOut(30, bScript), wire.NewTxOut(20, aScript))
+	block1 := chaintest.Block(block0, chaintest.Coinbase(1, wire.NewTxOut(50, bScript)), tx1)
+
+	chain := &testChain{blocks: []*wire.MsgBlock{block0, block1}}
+	as := (&fakeNode{answer: chain.answer}).start(t)
+	as.setNetwork("mainnet")
+	if err := as.setIndexConfig(&AddrServerConfig{IndexPath: filepath.Join(t.TempDir(), "index.db")}); err != nil {
+		t.Fatal(err)
+	}
+	defer as.index.Close()
+
+	balance := func(addr string) int {
+		res, err := as.GetAddressBalance(ctx, []string{addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Result.Balance
+	}
+
+	if err := as.syncIndexBlocks(make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	if got := balance(a); got != 20 {
+		t.Errorf("Expected '%d', got '%d'\n", 20, got)
+	}
+	res, err := as.GetRawTransaction(ctx, tx1.TxHash().String())
+	if err == nil || classifyError(err).Code != CodeNotFound {
+		t.Errorf("Expected the node to be asked for '%s', got '%+v' '%v'\n", tx1.TxHash(), res, err)
+	}
+
+	// Block 1 is replaced by a branch where tx1 isn't mined
+	block1b := chaintest.Block(block0, chaintest.Coinbase(2, wire.NewTxOut(50, bScript)))
+	chain.blocks = []*wire.MsgBlock{block0, block1b, chaintest.Block(block1b, chaintest.Coinbase(3))}
+	if err := as.syncIndexBlocks(make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	if height, hash, _ := as.index.Tip(); height != 2 || hash != chain.blocks[2].BlockHash() {
+		t.Errorf("Expected tip '%d', got '%d'\n", 2, height)
+	}
+	if got := balance(a); got != 50 {
+		t.Errorf("Expected '%d', got '%d'\n", 50, got)
+	}
+
+	// tx1 is back in the mempool
+	chain.mempool = []*wire.MsgTx{tx1}
+	if err := as.refreshMempool(ctx); err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := btcutil.DecodeAddress(a, as.Params)
+	utxos, err := as.addressUTXOs(ctx, []btcutil.Address{decoded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].Txid != tx1.TxHash().String() || utxos[0].Satoshis != 20 || utxos[0].Confirmations != 0 {
+		t.Errorf("Expected only the unconfirmed change of '%s', got '%+v'\n", tx1.TxHash(), utxos)
+	}
+
+	chain.mempool = nil
+	if err := as.refreshMempool(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if mp, _ := as.GetAddressMempool(ctx, []string{a, b}); len(mp.Result) != 0 {
+		t.Errorf("Expected an empty mempool, got '%+v'\n", mp.Result)
+	}
+}
+
+func TestIndexSyncAheadOfNode(t *testing.T) {
+	_, aScript := chaintest.Address(t, 1)
+	block0 := chaintest.Block(nil, chaintest.Coinbase(0, wire.NewTxOut(50, aScript)))
+	block1 := chaintest.Block(block0, chaintest.Coinbase(1))
+	block2 := chaintest.Block(block1, chaintest.Coinbase(2))
+
+	chain := &testChain{blocks: []*wire.MsgBlock{block0, block1, block2}}
+	as := (&fakeNode{answer: chain.answer}).start(t)
+	as.setNetwork("mainnet")
+	if err := as.setIndexConfig(&AddrServerConfig{IndexPath: filepath.Join(t.TempDir(), "index.db")}); err != nil {
+		t.Fatal(err)
+	}
+	defer as.index.Close()
+	if err := as.syncIndexBlocks(make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+
+	// A node behind on the same chain leaves the index alone
+	chain.blocks = []*wire.MsgBlock{block0, block1}
+	if err := as.syncIndexBlocks(make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	if height, _, _ := as.index.Tip(); height != 2 {
+		t.Errorf("Expected tip '%d', got '%d'\n", 2, height)
+	}
+
+	// A shorter best chain unwinds the index past the node's tip
+	block1b := chaintest.Block(block0, chaintest.Coinbase(3))
+	chain.blocks = []*wire.MsgBlock{block0, block1b}
+	if err := as.syncIndexBlocks(make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	if height, hash, _ := as.index.Tip(); height != 1 || hash != block1b.BlockHash() {
+		t.Errorf("Expected tip '%d' at '%s', got '%d' at '%s'\n", 1, block1b.BlockHash(), height, hash)
+	}
+	if hash, ok, _ := as.index.BlockHash(0); !ok || hash != block0.BlockHash() {
+		t.Errorf("Expected '%s' at height '%d', got '%s'\n", block0.BlockHash(), 0, hash)
+	}
+	if _, ok, _ := as.index.BlockHash(2); ok {
+		t.Errorf("Expected no block above the tip\n")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackzampolin/addrindex-server/apikey"
+)
+
+// RequestIDHeader is the header request IDs are read from and written to
+const RequestIDHeader = "X-Request-ID"
+
+// Supported values for the `logFormat` config option
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+// validRequestID limits the request IDs accepted from clients to something
+// safe to put in logs and headers
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// ConfigureLogging sets up the process wide structured logger. Output from
+// the standard library log package is routed through it as well.
+func ConfigureLogging(format, level string) error {
+	var lvl slog.Level
+	if level == "" {
+		level = "info"
+	}
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown logLevel %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case LogFormatJSON, "":
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	case LogFormatText:
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	default:
+		return fmt.Errorf("unknown logFormat %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// RequestID returns the request ID stored in the context, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// logger returns the default logger annotated with the context's request ID
+func logger(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loggedQuery returns the query of u for the access log, with API keys sent
+// in the query string redacted
+func loggedQuery(u *url.URL) string {
+	query := u.Query()
+	if _, ok := query[apikey.QueryParam]; !ok {
+		return u.RawQuery
+	}
+	query.Set(apikey.QueryParam, "REDACTED")
+	return query.Encode()
+}
+
+// LoggingMiddleware assigns every request an ID, taken from the X-Request-ID
+// header when the client sends a valid one, echoes it in the response and
+// writes a structured access log line when the request completes.
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(WithRequestID(r.Context(), id))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		logger(r.Context()).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query", loggedQuery(r.URL),
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
@@ -0,0 +1,58 @@
+package addrindex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLoggingMiddlewareRequestID(t *testing.T) {
+	var seen string
+	handler := LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+
+	// A valid client supplied ID is propagated
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set(RequestIDHeader, "client-id-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if seen != "client-id-1" || w.Header().Get(RequestIDHeader) != "client-id-1" {
+		t.Errorf("Expected request ID 'client-id-1', got '%s' in context and '%s' in header\n", seen, w.Header().Get(RequestIDHeader))
+	}
+
+	// An invalid one is replaced with a generated ID
+	req = httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set(RequestIDHeader, "bad id\nwith newline")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if len(seen) != 32 || w.Header().Get(RequestIDHeader) != seen {
+		t.Errorf("Expected generated request ID, got '%s' in context and '%s' in header\n", seen, w.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestLoggedQuery(t *testing.T) {
+	u, _ := url.Parse("/txs?address=1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2&apikey=aik_secret")
+	if q := loggedQuery(u); strings.Contains(q, "aik_secret") || !strings.Contains(q, "apikey=REDACTED") {
+		t.Errorf("Expected the key redacted, got '%s'\n", q)
+	}
+	u, _ = url.Parse("/txs?pageSize=5&page=1")
+	if q := loggedQuery(u); q != "pageSize=5&page=1" {
+		t.Errorf("Expected '%s', got '%s'\n", "pageSize=5&page=1", q)
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	if err := ConfigureLogging("xml", "info"); err == nil {
+		t.Errorf("Expected error for unknown log format\n")
+	}
+	if err := ConfigureLogging("json", "loud"); err == nil {
+		t.Errorf("Expected error for unknown log level\n")
+	}
+	if err := ConfigureLogging("text", "debug"); err != nil {
+		t.Errorf("Unexpected error: %s\n", err.Error())
+	}
+	ConfigureLogging("", "")
+}
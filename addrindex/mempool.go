@@ -0,0 +1,218 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jackzampolin/addrindex-server/index"
+)
+
+// mempoolIndex holds the address inputs and outputs of the node's mempool
+// transactions when the built-in index answers getaddressmempool
+type mempoolIndex struct {
+	mu sync.RWMutex
+	// txs holds the entries of each mempool transaction
+	txs map[chainhash.Hash][]AddrMempoolTransaction
+	// byAddress holds the mempool transactions of each address
+	byAddress map[string]map[chainhash.Hash]bool
+	// outputs holds the outputs of mempool transactions, which their
+	// children spend
+	outputs map[wire.OutPoint]index.Output
+}
+
+func newMempoolIndex() *mempoolIndex {
+	return &mempoolIndex{
+		txs:       map[chainhash.Hash][]AddrMempoolTransaction{},
+		byAddress: map[string]map[chainhash.Hash]bool{},
+		outputs:   map[wire.OutPoint]index.Output{},
+	}
+}
+
+// refreshMempool brings the mempool index in line with the node's mempool.
+// Transactions that left it are dropped and new ones fetched in batches.
+func (as *AddrServer) refreshMempool(ctx context.Context) error {
+	hashes, err := as.Client.GetRawMempool(ctx)
+	if err != nil {
+		return err
+	}
+	m := as.mempool
+	current := map[chainhash.Hash]bool{}
+	var reqs []BitcoreRequest
+	m.mu.RLock()
+	for _, h := range hashes {
+		current[*h] = true
+		if _, ok := m.txs[*h]; !ok {
+			reqs = append(reqs, BitcoreRequest{JSONRPC: "1.0", Method: "getrawtransaction", Params: []interface{}{h.String(), 0}})
+		}
+	}
+	m.mu.RUnlock()
+
+	// Transactions that were mined or evicted since the mempool was read
+	// can't be fetched and are skipped
+	var added []*wire.MsgTx
+	for _, res := range as.Batch(ctx, reqs) {
+		var raw string
+		if res.Unmarshal(&raw) != nil {
+			continue
+		}
+		b, err := hex.DecodeString(raw)
+		if err != nil {
+			continue
+		}
+		tx := &wire.MsgTx{}
+		if tx.Deserialize(bytes.NewReader(b)) == nil {
+			added = append(added, tx)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for txid, entries := range m.txs {
+		if !current[txid] {
+			m.remove(txid, entries)
+		}
+	}
+	// Outputs go in first so children find the parents they spend
+	for _, tx := range added {
+		txid := tx.TxHash()
+		for i, out := range tx.TxOut {
+			if addr := as.index.Address(out.PkScript); addr != "" {
+				m.outputs[wire.OutPoint{Hash: txid, Index: uint32(i)}] = index.Output{Address: addr, Satoshis: out.Value, Script: out.PkScript}
+			}
+		}
+	}
+	now := int(time.Now().Unix())
+	for _, tx := range added {
+		m.add(tx.TxHash(), as.mempoolEntries(tx, now))
+	}
+	return nil
+}
+
+// mempoolEntries returns the address inputs and outputs of tx. Callers hold
+// the mempool lock.
+func (as *AddrServer) mempoolEntries(tx *wire.MsgTx, now int) []AddrMempoolTransaction {
+	txid := tx.TxHash()
+	out := []AddrMempoolTransaction{}
+	for i, in := range tx.TxIn {
+		prev := in.PreviousOutPoint
+		o, ok := as.mempool.outputs[prev]
+		if !ok {
+			confirmed, err := as.index.Output(&prev.Hash, prev.Index)
+			if err != nil || confirmed == nil {
+				continue
+			}
+			o = *confirmed
+		}
+		out = append(out, AddrMempoolTransaction{
+			Address:   o.Address,
+			Txid:      txid.String(),
+			Index:     i,
+			Satoshis:  -int(o.Satoshis),
+			Timestamp: now,
+			Prevtxid:  prev.Hash.String(),
+			Prevout:   int(prev.Index),
+		})
+	}
+	for i := range tx.TxOut {
+		o, ok := as.mempool.outputs[wire.OutPoint{Hash: txid, Index: uint32(i)}]
+		if !ok {
+			continue
+		}
+		out = append(out, AddrMempoolTransaction{
+			Address:   o.Address,
+			Txid:      txid.String(),
+			Index:     i,
+			Satoshis:  int(o.Satoshis),
+			Timestamp: now,
+		})
+	}
+	return out
+}
+
+func (m *mempoolIndex) add(txid chainhash.Hash, entries []AddrMempoolTransaction) {
+	m.txs[txid] = entries
+	for _, e := range entries {
+		if m.byAddress[e.Address] == nil {
+			m.byAddress[e.Address] = map[chainhash.Hash]bool{}
+		}
+		m.byAddress[e.Address][txid] = true
+	}
+}
+
+func (m *mempoolIndex) remove(txid chainhash.Hash, entries []AddrMempoolTransaction) {
+	delete(m.txs, txid)
+	for _, e := range entries {
+		delete(m.byAddress[e.Address], txid)
+		if len(m.byAddress[e.Address]) == 0 {
+			delete(m.byAddress, e.Address)
+		}
+		if e.Prevtxid == "" {
+			delete(m.outputs, wire.OutPoint{Hash: txid, Index: uint32(e.Index)})
+		}
+	}
+}
+
+// output returns an output of a mempool transaction
+func (m *mempoolIndex) output(op wire.OutPoint) *index.Output {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if o, ok := m.outputs[op]; ok {
+		return &o
+	}
+	return nil
+}
+
+// entries returns the mempool inputs and outputs of addrs, oldest first
+func (m *mempoolIndex) entries(addrs []string) []AddrMempoolTransaction {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []AddrMempoolTransaction{}
+	want := map[string]bool{}
+	for _, a := range addrs {
+		want[a] = true
+	}
+	seen := map[chainhash.Hash]bool{}
+	for _, a := range addrs {
+		for txid := range m.byAddress[a] {
+			if seen[txid] {
+				continue
+			}
+			seen[txid] = true
+			for _, e := range m.txs[txid] {
+				if want[e.Address] {
+					out = append(out, e)
+				}
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Timestamp != out[j].Timestamp {
+			return out[i].Timestamp < out[j].Timestamp
+		}
+		if out[i].Txid != out[j].Txid {
+			return out[i].Txid < out[j].Txid
+		}
+		return out[i].Satoshis < out[j].Satoshis
+	})
+	return out
+}
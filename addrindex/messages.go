@@ -0,0 +1,83 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+const messageMagic = "Bitcoin Signed Message:\n"
+
+// messageHash returns the hash signed by signmessage
+func messageHash(message string) []byte {
+	var buf bytes.Buffer
+	wire.WriteVarString(&buf, 0, messageMagic)
+	wire.WriteVarString(&buf, 0, message)
+	return chainhash.DoubleHashB(buf.Bytes())
+}
+
+// verifyMessage checks a BIP 137 signature from a P2SH-P2WPKH or P2WPKH
+// address, which bitcoind's verifymessage only accepts for P2PKH addresses.
+// Signatures made with compressed P2PKH headers (31-34), as most wallets
+// produce for segwit addresses, are accepted too. Other segwit addresses
+// need BIP 322 signatures, which aren't supported.
+func verifyMessage(addr btcutil.Address, signature, message string) (bool, error) {
+	switch addr.(type) {
+	case *btcutil.AddressScriptHash, *btcutil.AddressWitnessPubKeyHash:
+	default:
+		return false, &APIError{
+			Status: http.StatusNotImplemented,
+			Code:   CodeUnsupportedAddressType,
+			Err:    fmt.Errorf("verifying messages signed by %s addresses isn't supported", AddressScriptType(addr)),
+		}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false, InvalidInput(fmt.Errorf("malformed base64 encoding"))
+	}
+	if len(sig) != 65 || sig[0] < 27 || sig[0] > 42 {
+		return false, InvalidInput(fmt.Errorf("malformed signature"))
+	}
+
+	// Segwit headers encode the same recovery id as compressed P2PKH ones
+	header := sig[0]
+	compact := append([]byte{27 + 4 + (header-27)&3}, sig[1:]...)
+	if header < 31 {
+		compact[0] = header
+	}
+	pub, compressed, err := btcec.RecoverCompact(btcec.S256(), compact, messageHash(message))
+	if err != nil || !compressed {
+		return false, nil
+	}
+	keyHash := btcutil.Hash160(pub.SerializeCompressed())
+
+	switch a := addr.(type) {
+	case *btcutil.AddressWitnessPubKeyHash:
+		return bytes.Equal(a.ScriptAddress(), keyHash), nil
+	case *btcutil.AddressScriptHash:
+		redeem := append([]byte{0x00, 0x14}, keyHash...)
+		return bytes.Equal(a.ScriptAddress(), btcutil.Hash160(redeem)), nil
+	}
+	return false, nil
+}
@@ -0,0 +1,256 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// chainHeightInterval is how often the chain height gauge is refreshed
+const chainHeightInterval = 30 * time.Second
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "addrindex",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "addrindex",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	rpcCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "addrindex",
+		Subsystem: "rpc",
+		Name:      "calls_total",
+		Help:      "JSON-RPC calls to bitcoind by method.",
+	}, []string{"method"})
+
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "addrindex",
+		Subsystem: "rpc",
+		Name:      "errors_total",
+		Help:      "JSON-RPC calls to bitcoind that failed, by method.",
+	}, []string{"method"})
+
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "addrindex",
+		Subsystem: "rpc",
+		Name:      "duration_seconds",
+		Help:      "JSON-RPC call latency by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	rpcInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "addrindex",
+		Subsystem: "rpc",
+		Name:      "in_flight",
+		Help:      "JSON-RPC calls to bitcoind currently holding a concurrency slot.",
+	})
+
+	rpcRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "addrindex",
+		Subsystem: "rpc",
+		Name:      "retries_total",
+		Help:      "JSON-RPC calls retried after a transient failure, by method.",
+	}, []string{"method"})
+
+	rpcFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "addrindex",
+		Subsystem: "rpc",
+		Name:      "failovers_total",
+		Help:      "JSON-RPC calls retried on another backend after a backend failed, by method.",
+	}, []string{"method"})
+
+	backendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "addrindex",
+		Subsystem: "backend",
+		Name:      "up",
+		Help:      "Whether the last health check of a backend node passed.",
+	}, []string{"backend"})
+
+	backendHeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "addrindex",
+		Subsystem: "backend",
+		Name:      "height",
+		Help:      "Block height of a backend node at its last health check.",
+	}, []string{"backend"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "addrindex",
+		Subsystem: "http",
+		Name:      "rate_limited_total",
+		Help:      "HTTP requests rejected by the per client rate limit, by route template.",
+	}, []string{"route"})
+
+	indexHeight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "addrindex",
+		Subsystem: "index",
+		Name:      "height",
+		Help:      "Height of the last block in the built-in address index.",
+	})
+
+	reorgs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "addrindex",
+		Subsystem: "chain",
+		Name:      "reorgs_total",
+		Help:      "Reorganizations of the best chain seen by the reorg detector.",
+	})
+
+	reorgDepth = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "addrindex",
+		Subsystem: "chain",
+		Name:      "reorg_depth_blocks",
+		Help:      "Blocks removed from the best chain by each reorganization.",
+		Buckets:   []float64{1, 2, 3, 5, 10, 20, 50, 100},
+	})
+
+	chainHeight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "addrindex",
+		Subsystem: "chain",
+		Name:      "height",
+		Help:      "Block height of the backing node.",
+	})
+
+	priceProviderUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "addrindex",
+		Subsystem: "price",
+		Name:      "provider_up",
+		Help:      "Whether the last fetch from a price provider succeeded.",
+	}, []string{"provider"})
+
+	priceProviderLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "addrindex",
+		Subsystem: "price",
+		Name:      "provider_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful fetch from a price provider.",
+	}, []string{"provider"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests,
+		httpDuration,
+		rpcCalls,
+		rpcErrors,
+		rpcDuration,
+		rpcInFlight,
+		rpcRetries,
+		rpcFailovers,
+		backendUp,
+		backendHeight,
+		rateLimited,
+		chainHeight,
+		reorgs,
+		reorgDepth,
+		indexHeight,
+		priceProviderUp,
+		priceProviderLastSuccess,
+	)
+}
+
+// observeRPC records and logs a call to bitcoind. It is meant to be deferred
+// with a pointer to the caller's named error result.
+func observeRPC(ctx context.Context, method string, start time.Time, err *error) {
+	took := time.Since(start)
+	rpcCalls.WithLabelValues(method).Inc()
+	rpcDuration.WithLabelValues(method).Observe(took.Seconds())
+	if *err != nil {
+		rpcErrors.WithLabelValues(method).Inc()
+		logger(ctx).Warn("rpc call failed", "rpc_method", method, "duration_ms", took.Milliseconds(), "error", (*err).Error())
+		return
+	}
+	logger(ctx).Debug("rpc call", "rpc_method", method, "duration_ms", took.Milliseconds())
+}
+
+// observePrice records the health of a price provider. The providers report
+// a zero price when they fail.
+func observePrice(provider string, price float64) {
+	if price == 0 {
+		priceProviderUp.WithLabelValues(provider).Set(0)
+		return
+	}
+	priceProviderUp.WithLabelValues(provider).Set(1)
+	priceProviderLastSuccess.WithLabelValues(provider).SetToCurrentTime()
+}
+
+// statusRecorder captures the status code and body size written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// metricsMiddleware records request counts and latency keyed by the mux
+// route template rather than the raw URL
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		if route == "" {
+			route = "unknown"
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// pollChainHeight keeps the chain height gauge up to date
+func (as *AddrServer) pollChainHeight(quit <-chan struct{}) {
+	ticker := time.NewTicker(chainHeightInterval)
+	defer ticker.Stop()
+	for {
+		height, err := as.Client.GetBlockCount(context.Background())
+		if err != nil {
+			slog.Warn("Failed fetching chain height", "error", err)
+		} else {
+			chainHeight.Set(float64(height))
+			as.tipHeight.Store(height)
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package addrindex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.HandleFunc("/test/{addr}/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}).Methods("GET")
+
+	for _, addr := range []string{"a", "b", "c"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test/"+addr+"/metrics", nil))
+	}
+
+	count := testutil.ToFloat64(httpRequests.WithLabelValues("/test/{addr}/metrics", "GET", "404"))
+	if count != 3 {
+		t.Errorf("Expected '3' requests for the route template, got '%v'\n", count)
+	}
+}
+
+func TestObservePrice(t *testing.T) {
+	observePrice("test", 0)
+	if up := testutil.ToFloat64(priceProviderUp.WithLabelValues("test")); up != 0 {
+		t.Errorf("Expected provider to be down, got '%v'\n", up)
+	}
+	observePrice("test", 6500.12)
+	if up := testutil.ToFloat64(priceProviderUp.WithLabelValues("test")); up != 1 {
+		t.Errorf("Expected provider to be up, got '%v'\n", up)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/jackzampolin/addrindex-server/segwit"
+)
+
+// Supported values for the `network` config option
+const (
+	NetworkMainnet  = "mainnet"
+	NetworkTestnet3 = "testnet3"
+	NetworkRegtest  = "regtest"
+	NetworkSignet   = "signet"
+)
+
+// NetworkParams returns the chain parameters for a network name. Both the
+// config names and the names bitcoind reports in getblockchaininfo are accepted.
+func NetworkParams(network string) (*chaincfg.Params, error) {
+	switch network {
+	case NetworkMainnet, "main":
+		return &chaincfg.MainNetParams, nil
+	case NetworkTestnet3, "testnet", "test":
+		return &chaincfg.TestNet3Params, nil
+	case NetworkRegtest:
+		return &chaincfg.RegressionNetParams, nil
+	case NetworkSignet:
+		return &chaincfg.SigNetParams, nil
+	default:
+		return nil, fmt.Errorf("unknown network %q", network)
+	}
+}
+
+// NetworkName returns the canonical config name for a set of chain parameters
+func NetworkName(params *chaincfg.Params) string {
+	switch params.Net {
+	case chaincfg.MainNetParams.Net:
+		return NetworkMainnet
+	case chaincfg.TestNet3Params.Net:
+		return NetworkTestnet3
+	case chaincfg.RegressionNetParams.Net:
+		return NetworkRegtest
+	case chaincfg.SigNetParams.Net:
+		return NetworkSignet
+	default:
+		return params.Name
+	}
+}
+
+// NetworkStartBlock returns the first block the server searches for address
+// history on a network. Only mainnet has blockstack history worth skipping.
+func NetworkStartBlock(network string) int {
+	if network == NetworkMainnet {
+		return BlockstackStartBlock
+	}
+	return 0
+}
+
+const (
+	// networkDetectTimeout is how long startup waits for the node to report
+	// its chain when no network is configured
+	networkDetectTimeout = 2 * time.Minute
+	// networkDetectInterval is how often the node is asked meanwhile
+	networkDetectInterval = 2 * time.Second
+)
+
+// setNetwork configures the chain parameters for the server. When no network
+// is configured it is detected from the node, waiting for the node to answer.
+// Guessing would reject every address of the actual network.
+func (as *AddrServer) setNetwork(network string) error {
+	var (
+		params *chaincfg.Params
+		err    error
+	)
+	if network == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), networkDetectTimeout)
+		defer cancel()
+		params, err = as.detectNetwork(ctx, networkDetectInterval)
+		if err != nil {
+			return fmt.Errorf("failed detecting the network, set network in the config: %s", err)
+		}
+	} else {
+		params, err = NetworkParams(network)
+		if err != nil {
+			return err
+		}
+	}
+	as.Params = params
+	as.Network = NetworkName(params)
+	as.StartBlock = NetworkStartBlock(as.Network)
+	return nil
+}
+
+// detectNetwork asks the node which chain it is on, every interval until it
+// answers or ctx is done
+func (as *AddrServer) detectNetwork(ctx context.Context, interval time.Duration) (*chaincfg.Params, error) {
+	for {
+		info, err := as.Client.GetBlockChainInfo(ctx)
+		if err == nil {
+			return NetworkParams(info.Chain)
+		}
+		slog.Warn("Failed detecting network, retrying", "error", err, "retryIn", interval)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(interval):
+		}
+	}
+}
+
+// DecodeAddress decodes an address and checks that it belongs to the network
+// the server is running against
+func (as *AddrServer) DecodeAddress(addr string) (btcutil.Address, error) {
+	out, err := segwit.DecodeAddress(addr, as.Params)
+	if err != nil {
+		return nil, err
+	}
+	if !out.IsForNet(as.Params) {
+		return nil, fmt.Errorf("address %s is not valid on %s", addr, as.Network)
+	}
+	return out, nil
+}
+
+// MaxAddressesPerRequest caps the number of addresses routes taking a list
+// of addresses accept
+const MaxAddressesPerRequest = 100
+
+// DecodeAddressList decodes a comma separated list of addresses for the
+// network the server is running against
+func (as *AddrServer) DecodeAddressList(list string) ([]btcutil.Address, error) {
+	parts := strings.Split(list, ",")
+	if len(parts) > MaxAddressesPerRequest {
+		return nil, fmt.Errorf("got %d addresses, at most %d are accepted", len(parts), MaxAddressesPerRequest)
+	}
+	out := make([]btcutil.Address, 0, len(parts))
+	for _, addr := range parts {
+		decoded, err := as.DecodeAddress(addr)
+		if err != nil {
+			return nil, fmt.Errorf("address %q: %s", addr, err)
+		}
+		out = append(out, decoded)
+	}
+	return out, nil
+}
+
+func encodeAddresses(addrs []btcutil.Address) []string {
+	out := make([]string, len(addrs))
+	for i, addr := range addrs {
+		out[i] = addr.EncodeAddress()
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package addrindex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestNetworkParams(t *testing.T) {
+	for _, name := range []string{"main", "test", "regtest", "signet", NetworkMainnet, NetworkTestnet3} {
+		params, err := NetworkParams(name)
+		if err != nil {
+			t.Fatalf("Failed fetching params for '%s': %s\n", name, err.Error())
+		}
+		if _, err := NetworkParams(NetworkName(params)); err != nil {
+			t.Errorf("Network name '%s' does not round trip: %s\n", NetworkName(params), err.Error())
+		}
+	}
+
+	if _, err := NetworkParams("simnet"); err == nil {
+		t.Errorf("Expected error for unknown network\n")
+	}
+}
+
+func TestDecodeAddressNetwork(t *testing.T) {
+	mainnet := &AddrServer{}
+	mainnet.Params, _ = NetworkParams(NetworkMainnet)
+	mainnet.Network = NetworkMainnet
+
+	regtest := &AddrServer{}
+	regtest.Params, _ = NetworkParams(NetworkRegtest)
+	regtest.Network = NetworkRegtest
+
+	if _, err := mainnet.DecodeAddress(testAddress); err != nil {
+		t.Errorf("Expected '%s' to decode on mainnet: %s\n", testAddress, err.Error())
+	}
+
+	if _, err := regtest.DecodeAddress(testAddress); err == nil {
+		t.Errorf("Expected '%s' to be rejected on regtest\n", testAddress)
+	}
+
+	if _, err := mainnet.DecodeAddress("bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080"); err == nil {
+		t.Errorf("Expected regtest bech32 address to be rejected on mainnet\n")
+	}
+
+	if NetworkStartBlock(NetworkRegtest) != 0 || NetworkStartBlock(NetworkMainnet) != BlockstackStartBlock {
+		t.Errorf("Unexpected network start blocks\n")
+	}
+}
+
+func TestDetectNetwork(t *testing.T) {
+	// The node drops the first call and answers once it's up
+	node := &fakeNode{
+		replies: map[string][]string{"getblockchaininfo": {"drop"}},
+		answer: func(req fakeRequest) (interface{}, *btcjson.RPCError) {
+			return map[string]interface{}{"chain": "regtest"}, nil
+		},
+	}
+	as := node.start(t)
+	params, err := as.detectNetwork(context.Background(), time.Millisecond)
+	if err != nil || params.Net != chaincfg.RegressionNetParams.Net || node.count("getblockchaininfo") != 2 {
+		t.Errorf("Expected '%s' after '%d' calls, got '%v' '%v' after '%d'\n", NetworkRegtest, 2, params, err, node.count("getblockchaininfo"))
+	}
+
+	// A node that never answers fails detection instead of guessing
+	as = (&fakeNode{}).start(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if params, err := as.detectNetwork(ctx, time.Millisecond); err == nil {
+		t.Errorf("Expected an error, got '%s'\n", params.Name)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// Page sizes for /txs?address=
+const (
+	DefaultTxsPageSize = 10
+	MaxTxsPageSize     = 50
+)
+
+// TxsPage models a response to the /txs?address= route
+type TxsPage struct {
+	TotalItems int               `json:"totalItems"`
+	PagesTotal int               `json:"pagesTotal"`
+	PageSize   int               `json:"pageSize"`
+	Txs        []*TransactionIns `json:"txs"`
+
+	// Next is the cursor for the following page, empty on the last page
+	Next string `json:"next,omitempty"`
+
+	// Errors are the transactions that couldn't be fetched, which are null
+	// in Txs, when partial results are requested
+	Errors []TxError `json:"errors,omitempty"`
+}
+
+// txAnchor is the position of a confirmed transaction in the chain, which
+// pages are anchored to so they stay put as new blocks come in
+type txAnchor struct {
+	Txid   string
+	Height int
+	Index  int
+}
+
+// before returns whether a is older than b
+func (a txAnchor) before(b txAnchor) bool {
+	return a.Height < b.Height || (a.Height == b.Height && a.Index < b.Index)
+}
+
+// txAnchors returns the transactions of deltas, newest first
+func txAnchors(deltas []AddressDelta) []txAnchor {
+	seen := map[string]bool{}
+	out := []txAnchor{}
+	for _, d := range deltas {
+		if seen[d.Txid] {
+			continue
+		}
+		seen[d.Txid] = true
+		out = append(out, txAnchor{Txid: d.Txid, Height: d.Height, Index: d.Blockindex})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[j].before(out[i]) })
+	return out
+}
+
+// encodeCursor returns an opaque cursor for the page after a
+func encodeCursor(a txAnchor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", a.Height, a.Index)))
+}
+
+func decodeCursor(s string) (txAnchor, error) {
+	var a txAnchor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		_, err = fmt.Sscanf(string(b), "%d:%d", &a.Height, &a.Index)
+	}
+	if err != nil || a.Height < 0 || a.Index < 0 {
+		return a, fmt.Errorf("invalid cursor %q", s)
+	}
+	return a, nil
+}
+
+// pageParams are the paging query parameters of /txs?address=
+type pageParams struct {
+	size   int
+	page   int
+	cursor *txAnchor
+}
+
+// parsePageParams reads pageSize, cursor and page from query. A cursor takes
+// precedence over a page number.
+func parsePageParams(query url.Values) (pageParams, error) {
+	out := pageParams{size: DefaultTxsPageSize}
+	if s := query.Get("pageSize"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size < 1 || size > MaxTxsPageSize {
+			return out, fmt.Errorf("pageSize must be between 1 and %d", MaxTxsPageSize)
+		}
+		out.size = size
+	}
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil {
+			return out, err
+		}
+		out.cursor = &cursor
+		return out, nil
+	}
+	page, err := parsePage(query.Get("page"))
+	if err != nil {
+		return out, err
+	}
+	out.page = page
+	return out, nil
+}
+
+// parsePage parses a page number, 0 when s is empty
+func parsePage(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	page, err := strconv.Atoi(s)
+	if err != nil || page < 0 {
+		return 0, fmt.Errorf("page must be a non-negative integer")
+	}
+	return page, nil
+}
+
+// pageTxAnchors returns the page of items, which are newest first, selected
+// by p and the cursor for the page after it
+func pageTxAnchors(items []txAnchor, p pageParams) ([]txAnchor, string) {
+	start := len(items)
+	if p.page <= len(items)/p.size {
+		start = p.page * p.size
+	}
+	if p.cursor != nil {
+		start = sort.Search(len(items), func(i int) bool { return items[i].before(*p.cursor) })
+	}
+	end := start + p.size
+	if end > len(items) {
+		end = len(items)
+	}
+	page := items[start:end]
+	next := ""
+	if end < len(items) && len(page) > 0 {
+		next = encodeCursor(page[len(page)-1])
+	}
+	return page, next
+}
@@ -0,0 +1,142 @@
+package addrindex
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+// testAnchors returns n transactions, two to a block, newest first
+func testAnchors(n int) []txAnchor {
+	var deltas []AddressDelta
+	for i := 0; i < n; i++ {
+		deltas = append(deltas, AddressDelta{Txid: fmt.Sprintf("tx%d", i), Height: 100 + i/2, Blockindex: i % 2})
+		// Spends show up as a second delta for the same transaction
+		deltas = append(deltas, AddressDelta{Txid: fmt.Sprintf("tx%d", i), Height: 100 + i/2, Blockindex: i % 2, Satoshis: -1})
+	}
+	return txAnchors(deltas)
+}
+
+func TestTxAnchors(t *testing.T) {
+	items := testAnchors(5)
+	if len(items) != 5 {
+		t.Fatalf("Expected '5' transactions, got '%d'\n", len(items))
+	}
+	for i, expected := range []string{"tx4", "tx3", "tx2", "tx1", "tx0"} {
+		if items[i].Txid != expected {
+			t.Errorf("Expected '%s' at %d, got '%s'\n", expected, i, items[i].Txid)
+		}
+	}
+}
+
+func TestPageTxAnchors(t *testing.T) {
+	cases := []struct {
+		name  string
+		items int
+		page  int
+		size  int
+		first string
+		len   int
+		next  bool
+	}{
+		{"no transactions", 0, 0, 10, "", 0, false},
+		{"partial first page", 3, 0, 10, "tx2", 3, false},
+		{"exactly one page", 10, 0, 10, "tx9", 10, false},
+		{"one more than a page", 11, 0, 10, "tx10", 10, true},
+		{"last partial page", 11, 1, 10, "tx0", 1, false},
+		{"last full page", 20, 1, 10, "tx9", 10, false},
+		{"past the end", 11, 2, 10, "", 0, false},
+		{"far past the end", 11, 1 << 62, 10, "", 0, false},
+		{"page size one", 3, 1, 1, "tx1", 1, true},
+	}
+	for _, c := range cases {
+		page, next := pageTxAnchors(testAnchors(c.items), pageParams{page: c.page, size: c.size})
+		if len(page) != c.len {
+			t.Errorf("%s: Expected '%d' items, got '%d'\n", c.name, c.len, len(page))
+		}
+		if len(page) > 0 && page[0].Txid != c.first {
+			t.Errorf("%s: Expected first item '%s', got '%s'\n", c.name, c.first, page[0].Txid)
+		}
+		if (next != "") != c.next {
+			t.Errorf("%s: Expected next cursor '%t', got '%s'\n", c.name, c.next, next)
+		}
+	}
+}
+
+func TestCursorPagination(t *testing.T) {
+	items := testAnchors(25)
+
+	// Walking the cursors visits every transaction once, newest first
+	var seen []string
+	params := pageParams{size: 10}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("Expected '3' pages, got more\n")
+		}
+		page, next := pageTxAnchors(items, params)
+		for _, a := range page {
+			seen = append(seen, a.Txid)
+		}
+		if next == "" {
+			break
+		}
+		cursor, err := decodeCursor(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.cursor = &cursor
+	}
+	if len(seen) != 25 || seen[0] != "tx24" || seen[24] != "tx0" {
+		t.Errorf("Expected tx24 through tx0, got '%v'\n", seen)
+	}
+
+	// Pages stay put when new transactions are confirmed
+	first, next := pageTxAnchors(items, pageParams{size: 10})
+	cursor, _ := decodeCursor(next)
+	grown := append(testAnchors(27)[:2], items...)
+	second, _ := pageTxAnchors(grown, pageParams{size: 10, cursor: &cursor})
+	if first[9].Txid != "tx15" || second[0].Txid != "tx14" {
+		t.Errorf("Expected second page to start at 'tx14', got '%s'\n", second[0].Txid)
+	}
+
+	// A cursor past the oldest transaction is an empty last page
+	oldest := txAnchor{Height: 0, Index: 0}
+	page, next := pageTxAnchors(items, pageParams{size: 10, cursor: &oldest})
+	if len(page) != 0 || next != "" {
+		t.Errorf("Expected an empty last page, got '%d' items\n", len(page))
+	}
+}
+
+func TestParsePageParams(t *testing.T) {
+	cursor := encodeCursor(txAnchor{Height: 500000, Index: 3})
+	cases := []struct {
+		query string
+		size  int
+		page  int
+		valid bool
+	}{
+		{"", DefaultTxsPageSize, 0, true},
+		{"pageSize=50&page=2", 50, 2, true},
+		{"pageSize=51", 0, 0, false},
+		{"pageSize=0", 0, 0, false},
+		{"page=-1", 0, 0, false},
+		{"cursor=" + cursor + "&page=3", DefaultTxsPageSize, 0, true},
+		{"cursor=notacursor", 0, 0, false},
+	}
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		p, err := parsePageParams(query)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: Expected valid '%t', got '%v'\n", c.query, c.valid, err)
+			continue
+		}
+		if c.valid && (p.size != c.size || p.page != c.page) {
+			t.Errorf("%s: Expected size '%d' page '%d', got '%d' '%d'\n", c.query, c.size, c.page, p.size, p.page)
+		}
+	}
+	query, _ := url.ParseQuery("cursor=" + cursor)
+	p, _ := parsePageParams(query)
+	if p.cursor == nil || p.cursor.Height != 500000 || p.cursor.Index != 3 {
+		t.Errorf("Expected cursor at '500000:3', got '%v'\n", p.cursor)
+	}
+}
@@ -1,17 +1,21 @@
 package addrindex
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // NewCurrencyData returns the struct that manages currency data
-func NewCurrencyData() *CurrencyData {
+func NewCurrencyData(ctx context.Context) *CurrencyData {
 	cd := &CurrencyData{}
-	cd.Get()
+	cd.Get(ctx)
 	return cd
 }
 
@@ -32,10 +36,22 @@ func (c *CurrencyData) JSON() []byte {
 }
 
 // Refresh refreshes the bitcoin price for the currency info struct
-func (c *CurrencyData) Get() {
-	c.Data.Binance = binancePrice()
-	c.Data.BlockchainInfo = blockchainInfoPrice()
-	c.Data.Coinbase = coinbasePrice()
+func (c *CurrencyData) Get(ctx context.Context) {
+	c.Data.Binance = fetchPrice(ctx, "binance", binancePrice)
+	c.Data.BlockchainInfo = fetchPrice(ctx, "blockchainInfo", blockchainInfoPrice)
+	c.Data.Coinbase = fetchPrice(ctx, "coinbase", coinbasePrice)
+}
+
+// fetchPrice calls a price provider inside a span and records its health
+func fetchPrice(ctx context.Context, provider string, get func(context.Context) float64) float64 {
+	ctx, span := startSpan(ctx, "price "+provider, attribute.String("price.provider", provider))
+	defer span.End()
+	price := get(ctx)
+	observePrice(provider, price)
+	if price == 0 {
+		span.SetStatus(codes.Error, "price fetch failed")
+	}
+	return price
 }
 
 type getBinancePriceResponse struct {
@@ -58,43 +74,45 @@ type getCoinbasePriceResponse struct {
 	} `json:"data"`
 }
 
-func blockchainInfoPrice() float64 {
+func blockchainInfoPrice(ctx context.Context) float64 {
 	req, err := http.NewRequest("GET", "https://blockchain.info/tobtc?currency=usd&value=1000", nil)
 	if err != nil {
-		log.Println("Failed updating coinbase price - request creation failed")
+		slog.Warn("Failed updating price", "provider", "blockchainInfo", "stage", "request creation failed", "error", err)
 		return 0.0
 	}
+	req = req.WithContext(ctx)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Failed updating coinbase price - call failed")
+		slog.Warn("Failed updating price", "provider", "blockchainInfo", "stage", "call failed", "error", err)
 		return 0.0
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Println("Failed updating coinbase price - failed reading body")
+		slog.Warn("Failed updating price", "provider", "blockchainInfo", "stage", "failed reading body", "error", err)
 		return 0.0
 	}
 
 	o, err := strconv.ParseFloat(string(body), 64)
 	if err != nil {
-		log.Println("Failed updating coinbase price - failed parsing float")
+		slog.Warn("Failed updating price", "provider", "blockchainInfo", "stage", "failed parsing float", "error", err)
 		return 0.0
 	}
 
 	return (1 / o) * 1000
 }
 
-func coinbasePrice() float64 {
+func coinbasePrice(ctx context.Context) float64 {
 	out := getCoinbasePriceResponse{}
 	req, err := http.NewRequest("GET", "https://api.coinbase.com/v2/prices/spot?currency=USD", nil)
 	if err != nil {
-		log.Println("Failed updating coinbase price - request creation failed")
+		slog.Warn("Failed updating price", "provider", "coinbase", "stage", "request creation failed", "error", err)
 		return 0.0
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("CB-VERSION", "2015-04-08")
@@ -102,64 +120,65 @@ func coinbasePrice() float64 {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Failed updating coinbase price - call failed")
+		slog.Warn("Failed updating price", "provider", "coinbase", "stage", "call failed", "error", err)
 		return 0.0
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Println("Failed updating coinbase price - failed reading body")
+		slog.Warn("Failed updating price", "provider", "coinbase", "stage", "failed reading body", "error", err)
 		return 0.0
 	}
 
 	err = json.Unmarshal(body, &out)
 	if err != nil {
-		log.Println("Failed updating coinbase price - failed unmarshalling json")
+		slog.Warn("Failed updating price", "provider", "coinbase", "stage", "failed unmarshalling json", "error", err)
 		return 0.0
 	}
 
 	o, err := strconv.ParseFloat(out.Data.Amount, 64)
 	if err != nil {
-		log.Println("Failed updating coinbase price - failed parsing float")
+		slog.Warn("Failed updating price", "provider", "coinbase", "stage", "failed parsing float", "error", err)
 		return 0.0
 	}
 
 	return o
 }
 
-func binancePrice() float64 {
+func binancePrice(ctx context.Context) float64 {
 	out := getBinancePriceResponse{}
 	req, err := http.NewRequest("GET", "https://www.bitstamp.net/api/ticker/", nil)
 	if err != nil {
-		log.Println("Failed updating binance price - request creation failed")
+		slog.Warn("Failed updating price", "provider", "binance", "stage", "request creation failed", "error", err)
 		return 0.0
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Failed updating binance price - call failed")
+		slog.Warn("Failed updating price", "provider", "binance", "stage", "call failed", "error", err)
 		return 0.0
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Println("Failed updating binance price - failed reading body")
+		slog.Warn("Failed updating price", "provider", "binance", "stage", "failed reading body", "error", err)
 		return 0.0
 	}
 
 	err = json.Unmarshal(body, &out)
 	if err != nil {
-		log.Println("Failed updating binance price - failed unmarshalling json")
+		slog.Warn("Failed updating price", "provider", "binance", "stage", "failed unmarshalling json", "error", err)
 		return 0.0
 	}
 
 	o, err := strconv.ParseFloat(out.Last, 64)
 	if err != nil {
-		log.Println("Failed updating binance price - failed parsing float")
+		slog.Warn("Failed updating price", "provider", "binance", "stage", "failed parsing float", "error", err)
 		return 0.0
 	}
 
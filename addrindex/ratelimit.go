@@ -0,0 +1,288 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Defaults for the rate limiting settings in AddrServerConfig
+const (
+	DefaultRPCQueueTimeout = 5 * time.Second
+
+	// clientIdleTimeout is how long a client's bucket is kept after its last request
+	clientIdleTimeout = 10 * time.Minute
+)
+
+// DefaultRouteCosts weights routes by roughly the number of RPC calls they
+// make. Routes not listed cost 1. The rateCosts config option overrides these.
+var DefaultRouteCosts = map[string]int{
+	"/txs":                            11,
+	"/addr/{addr}/utxo":               3,
+	"/addr/{addr}/balance":            2,
+	"/addr/{addr}/totalReceived":      2,
+	"/addr/{addr}/totalSent":          2,
+	"/addr/{addr}/unconfirmedBalance": 2,
+	"/addrs/{addrs}/utxo":             3,
+	"/xpub/{xpub}/addresses":          8,
+	"/xpub/{xpub}/balance":            10,
+	"/xpub/{xpub}/utxo":               12,
+	"/xpub/{xpub}/txs":                20,
+	"/descriptor/scan":                20,
+	"/blocks":                         5,
+	"/tx/{txid}":                      2,
+	"/blockstack/tx/{txid}":           2,
+	"/blockstack/block/{height}":      4,
+	"/blockstack/addr/{addr}/ops":     8,
+}
+
+// ErrRPCBusy is returned when no slot to call the node frees up in time
+var ErrRPCBusy = errors.New("too many concurrent requests to the node")
+
+// rpcSemaphore caps the number of concurrent calls to the node. A nil
+// semaphore doesn't limit anything.
+type rpcSemaphore struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newRPCSemaphore(size int, timeout time.Duration) *rpcSemaphore {
+	if size <= 0 {
+		return nil
+	}
+	return &rpcSemaphore{slots: make(chan struct{}, size), timeout: timeout}
+}
+
+// acquire waits for a free slot, giving up after the queue timeout or when
+// ctx is done. The returned function releases the slot.
+func (s *rpcSemaphore) acquire(ctx context.Context) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		rpcInFlight.Inc()
+		return func() {
+			<-s.slots
+			rpcInFlight.Dec()
+		}, nil
+	case <-timer.C:
+		return nil, ErrRPCBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// clientLimiter holds a token bucket per client IP. Requests take as many
+// tokens as their route costs.
+type clientLimiter struct {
+	limit   rate.Limit
+	burst   int
+	costs   map[string]int
+	trusted []*net.IPNet
+	now     func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*clientBucket
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiter(perSecond float64, burst int, costs map[string]int, trustedProxies []string) (*clientLimiter, error) {
+	if burst < 1 {
+		burst = int(math.Ceil(perSecond))
+	}
+	out := &clientLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		costs:   map[string]int{},
+		now:     time.Now,
+		clients: map[string]*clientBucket{},
+	}
+	// Route templates are matched regardless of case, as viper lowercases
+	// the keys of the rateCosts option
+	for route, cost := range DefaultRouteCosts {
+		out.costs[strings.ToLower(route)] = cost
+	}
+	for route, cost := range costs {
+		out.costs[strings.ToLower(route)] = cost
+	}
+	for _, p := range trustedProxies {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", p, err)
+		}
+		out.trusted = append(out.trusted, n)
+	}
+	return out, nil
+}
+
+func (cl *clientLimiter) isTrusted(ip net.IP) bool {
+	for _, n := range cl.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client making the request. When the
+// connection comes from a trusted proxy, X-Forwarded-For is walked from the
+// nearest hop back to the first address that isn't a trusted proxy.
+func (cl *clientLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !cl.isTrusted(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !cl.isTrusted(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// cost returns the number of tokens a request for route takes
+func (cl *clientLimiter) cost(route string) int {
+	cost, ok := cl.costs[strings.ToLower(route)]
+	if !ok || cost < 1 {
+		cost = 1
+	}
+	if cost > cl.burst {
+		cost = cl.burst
+	}
+	return cost
+}
+
+// allow takes cost tokens from the client's bucket, returning how long to
+// wait before retrying when there aren't enough
+func (cl *clientLimiter) allow(client string, cost int) (bool, time.Duration) {
+	now := cl.now()
+	cl.mu.Lock()
+	b, ok := cl.clients[client]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(cl.limit, cl.burst)}
+		cl.clients[client] = b
+	}
+	b.lastSeen = now
+	cl.mu.Unlock()
+
+	r := b.limiter.ReserveN(now, cost)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// evict drops buckets for clients that haven't been seen in a while
+func (cl *clientLimiter) evict() {
+	cutoff := cl.now().Add(-clientIdleTimeout)
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for client, b := range cl.clients {
+		if b.lastSeen.Before(cutoff) {
+			delete(cl.clients, client)
+		}
+	}
+}
+
+func (cl *clientLimiter) watch(quit <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			cl.evict()
+		}
+	}
+}
+
+// middleware rejects requests from clients that are out of tokens with a 429
+func (cl *clientLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		if publicRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := cl.clientIP(r)
+		if ok, wait := cl.allow(client, cl.cost(route)); !ok {
+			rateLimited.WithLabelValues(route).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write(NewPostError("rate limit exceeded", &APIError{
+				Status: http.StatusTooManyRequests,
+				Code:   CodeRateLimited,
+				Err:    fmt.Errorf("too many requests from %s, retry in %v", client, wait.Round(time.Millisecond)),
+			}))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setRateLimitConfig sets up per client rate limiting and the cap on
+// concurrent calls to the node
+func (as *AddrServer) setRateLimitConfig(cfg *AddrServerConfig) error {
+	as.Client.sem = newRPCSemaphore(cfg.MaxRPCConcurrency, durationOrDefault(cfg.RPCQueueTimeout, DefaultRPCQueueTimeout))
+	if cfg.RateLimit <= 0 {
+		return nil
+	}
+	cl, err := newClientLimiter(cfg.RateLimit, cfg.RateBurst, cfg.RateCosts, cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	as.limiter = cl
+	as.startWorker(cl.watch)
+	return nil
+}
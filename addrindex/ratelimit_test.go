@@ -0,0 +1,136 @@
+package addrindex
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+func TestRateLimitClientIP(t *testing.T) {
+	cl, err := newClientLimiter(1, 1, nil, []string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remote, xff, expected string
+	}{
+		// Untrusted peers can't spoof their address
+		{"1.2.3.4:5000", "9.9.9.9", "1.2.3.4"},
+		// Trusted proxies are skipped from the right
+		{"10.0.0.1:5000", "9.9.9.9, 8.8.8.8, 192.168.1.1", "8.8.8.8"},
+		// A proxy with no X-Forwarded-For is the client
+		{"10.0.0.1:5000", "", "10.0.0.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/txs", nil)
+		req.RemoteAddr = c.remote
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if got := cl.clientIP(req); got != c.expected {
+			t.Errorf("Expected '%s' for %s via %q, got '%s'\n", c.expected, c.remote, c.xff, got)
+		}
+	}
+
+	if _, err := newClientLimiter(1, 1, nil, []string{"not-an-ip"}); err == nil {
+		t.Errorf("Expected error for invalid trusted proxy\n")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	cl, _ := newClientLimiter(1, 12, map[string]int{"/blocks": 20}, nil)
+	now := time.Now()
+	cl.now = func() time.Time { return now }
+
+	router := mux.NewRouter()
+	router.Use(cl.middleware)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router.HandleFunc("/txs", ok)
+	router.HandleFunc("/sync", ok)
+	router.HandleFunc("/blocks", ok)
+	router.HandleFunc("/healthz", ok)
+
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "1.2.3.4:5000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// /txs costs 11 of the 12 tokens, leaving one for /sync
+	for _, path := range []string{"/txs", "/sync"} {
+		if w := do(path); w.Code != 200 {
+			t.Errorf("Expected '200' for %s, got '%d'\n", path, w.Code)
+		}
+	}
+	w := do("/sync")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected '429' with Retry-After '1', got '%d' with '%s'\n", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := do("/healthz"); w.Code != 200 {
+		t.Errorf("Expected public route to skip rate limiting, got '%d'\n", w.Code)
+	}
+
+	// Costs above the burst are capped so the route stays reachable
+	now = now.Add(12 * time.Second)
+	if w := do("/blocks"); w.Code != 200 {
+		t.Errorf("Expected '200' for /blocks once refilled, got '%d'\n", w.Code)
+	}
+}
+
+func TestRateCostsFromConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(strings.NewReader(`
+rateCosts:
+  /addr/{addr}/totalReceived: 7
+  /blocks: 9
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg AddrServerConfig
+	if err := v.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := newClientLimiter(1, 20, cfg.RateCosts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for route, expected := range map[string]int{
+		"/addr/{addr}/totalReceived":      7,
+		"/blocks":                         9,
+		"/addr/{addr}/unconfirmedBalance": DefaultRouteCosts["/addr/{addr}/unconfirmedBalance"],
+	} {
+		if got := cl.cost(route); got != expected {
+			t.Errorf("Expected '%d' for %s, got '%d'\n", expected, route, got)
+		}
+	}
+}
+
+func TestRPCSemaphore(t *testing.T) {
+	var unlimited *rpcSemaphore
+	if _, err := unlimited.acquire(context.Background()); err != nil {
+		t.Errorf("Expected nil semaphore not to limit, got '%s'\n", err)
+	}
+
+	sem := newRPCSemaphore(1, 10*time.Millisecond)
+	release, err := sem.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sem.acquire(context.Background()); err != ErrRPCBusy {
+		t.Errorf("Expected '%v' while the slot is held, got '%v'\n", ErrRPCBusy, err)
+	}
+	release()
+	if _, err := sem.acquire(context.Background()); err != nil {
+		t.Errorf("Expected slot to be free after release, got '%s'\n", err)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackzampolin/addrindex-server/cache"
+)
+
+// Defaults for the reorg settings in AddrServerConfig
+const (
+	DefaultReorgDepth         = 100
+	DefaultReorgCheckInterval = 10 * time.Second
+
+	// reorgHistory is how many reorgs are kept for /reorgs
+	reorgHistory = 50
+)
+
+// ReorgBlock is a block on one side of a reorg
+type ReorgBlock struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// ReorgEvent describes a change of the best chain. Removed blocks are no
+// longer on it and Added blocks replaced them. ForkHash is empty when the
+// fork is deeper than the tracked blocks.
+type ReorgEvent struct {
+	DetectedAt time.Time    `json:"detectedAt"`
+	Backend    string       `json:"backend,omitempty"`
+	ForkHeight int64        `json:"forkHeight"`
+	ForkHash   string       `json:"forkHash"`
+	Depth      int          `json:"depth"`
+	Removed    []ReorgBlock `json:"removed"`
+	Added      []ReorgBlock `json:"added"`
+}
+
+// ReorgsResponse is the response of the /reorgs route
+type ReorgsResponse struct {
+	Tip     *ReorgBlock  `json:"tip"`
+	Tracked int          `json:"tracked"`
+	Reorgs  []ReorgEvent `json:"reorgs"`
+}
+
+// blockHashes returns the hashes of the best chain blocks at heights
+type blockHashes func(ctx context.Context, heights []int64) ([]string, error)
+
+// reorgDetector tracks the hashes of the last depth blocks of the best chain
+// and notices when the node's best chain no longer contains them
+type reorgDetector struct {
+	depth int
+
+	mu       sync.Mutex
+	chain    []ReorgBlock // contiguous, lowest height first
+	events   []ReorgEvent // newest first
+	handlers []func(ReorgEvent)
+}
+
+// setReorgConfig copies the reorg settings off the config, filling in
+// defaults. A negative reorgDepth disables the detector.
+func (as *AddrServer) setReorgConfig(cfg *AddrServerConfig) {
+	as.ReorgDepth = cfg.ReorgDepth
+	if as.ReorgDepth == 0 {
+		as.ReorgDepth = DefaultReorgDepth
+	}
+	as.ReorgCheckInterval = durationOrDefault(cfg.ReorgCheckInterval, DefaultReorgCheckInterval)
+	as.reorgs = &reorgDetector{depth: as.ReorgDepth}
+	// The page cache is made here, before the detector starts, so reorgs
+	// seen before Router runs purge it too
+	as.pageCache = cache.NewMemoryCache()
+	as.OnReorg(as.purgeReorged)
+}
+
+// OnReorg registers f to be called with every reorg detected
+func (as *AddrServer) OnReorg(f func(ReorgEvent)) {
+	as.reorgs.mu.Lock()
+	defer as.reorgs.mu.Unlock()
+	as.reorgs.handlers = append(as.reorgs.handlers, f)
+}
+
+// watchReorgs checks for reorgs every ReorgCheckInterval until quit is closed
+func (as *AddrServer) watchReorgs(quit <-chan struct{}) {
+	ticker := time.NewTicker(as.ReorgCheckInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), as.ReorgCheckInterval)
+		if err := as.checkReorg(ctx); err != nil {
+			slog.Warn("Failed checking for reorgs", "error", err)
+		}
+		cancel()
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkReorg compares the tracked blocks with the best chain of the backend
+// that serves requests. The calls are pinned to it so that backends a block
+// apart don't look like a reorg.
+func (as *AddrServer) checkReorg(ctx context.Context) error {
+	candidates := as.Client.candidates(ctx)
+	if len(candidates) == 0 {
+		return ErrNoBackends
+	}
+	b := candidates[0]
+	ctx = withBackend(ctx, b)
+	tip, err := as.Client.GetBlockCount(ctx)
+	if err != nil {
+		return err
+	}
+	ev, err := as.reorgs.update(ctx, tip, as.blockHashes)
+	if err != nil || ev == nil {
+		return err
+	}
+	ev.Backend = b.Name
+	slog.Warn("Chain reorganization", "backend", b.Name, "forkHeight", ev.ForkHeight, "forkHash", ev.ForkHash, "depth", ev.Depth, "added", len(ev.Added))
+	reorgs.Inc()
+	reorgDepth.Observe(float64(ev.Depth))
+	as.reorgs.emit(*ev)
+	return nil
+}
+
+// blockHashes fetches the hashes of the blocks at heights in batches
+func (as *AddrServer) blockHashes(ctx context.Context, heights []int64) ([]string, error) {
+	reqs := make([]BitcoreRequest, len(heights))
+	for i, h := range heights {
+		reqs[i] = BitcoreRequest{JSONRPC: "1.0", Method: "getblockhash", Params: []interface{}{h}}
+	}
+	out := make([]string, len(heights))
+	for i, res := range as.Batch(ctx, reqs) {
+		if err := res.Unmarshal(&out[i]); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// purgeReorged drops cached pages that mention a block that left the best
+// chain, and the cached /blocks pages, which miss the blocks that replaced
+// them
+func (as *AddrServer) purgeReorged(ev ReorgEvent) {
+	if as.pageCache == nil {
+		return
+	}
+	n := as.pageCache.Purge(func(key string, content []byte) bool {
+		if strings.HasPrefix(key, "/blocks") {
+			return true
+		}
+		for _, b := range ev.Removed {
+			if bytes.Contains(content, []byte(b.Hash)) {
+				return true
+			}
+		}
+		return false
+	})
+	slog.Info("Purged cached pages after reorg", "forkHeight", ev.ForkHeight, "pages", n)
+}
+
+// update brings the tracked blocks up to the node's tip and returns the reorg
+// it found, if any. A node behind the tracked blocks is left alone until it
+// catches up.
+func (d *reorgDetector) update(ctx context.Context, tip int64, hashes blockHashes) (*ReorgEvent, error) {
+	d.mu.Lock()
+	chain := d.chain
+	d.mu.Unlock()
+
+	// fork is the index of the highest tracked block still on the best chain
+	fork := -1
+	if len(chain) > 0 {
+		top := len(chain) - 1
+		for top >= 0 && chain[top].Height > tip {
+			top--
+		}
+		if top < 0 {
+			return nil, nil
+		}
+		got, err := hashes(ctx, []int64{chain[top].Height})
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case got[0] == chain[top].Hash && top < len(chain)-1:
+			return nil, nil
+		case got[0] == chain[top].Hash:
+			fork = top
+		case top > 0:
+			heights := make([]int64, top)
+			for i := range heights {
+				heights[i] = chain[i].Height
+			}
+			got, err := hashes(ctx, heights)
+			if err != nil {
+				return nil, err
+			}
+			for i := top - 1; i >= 0; i-- {
+				if got[i] == chain[i].Hash {
+					fork = i
+					break
+				}
+			}
+		}
+	}
+
+	// Fetch the blocks past the fork, at most the last depth blocks
+	keep := chain[:fork+1]
+	start := tip - int64(d.depth) + 1
+	switch {
+	case fork >= 0 && chain[fork].Height+1 >= start:
+		start = chain[fork].Height + 1
+	case fork >= 0:
+		keep = nil
+	case len(chain) > 0 && chain[0].Height > start:
+		start = chain[0].Height
+	}
+	if start < 0 {
+		start = 0
+	}
+	var added []ReorgBlock
+	if start <= tip {
+		heights := make([]int64, tip-start+1)
+		for i := range heights {
+			heights[i] = start + int64(i)
+		}
+		got, err := hashes(ctx, heights)
+		if err != nil {
+			return nil, err
+		}
+		for i, h := range heights {
+			added = append(added, ReorgBlock{Height: h, Hash: got[i]})
+		}
+	}
+
+	next := append(append([]ReorgBlock{}, keep...), added...)
+	if len(next) > d.depth {
+		next = next[len(next)-d.depth:]
+	}
+	d.mu.Lock()
+	d.chain = next
+	d.mu.Unlock()
+
+	if len(chain) == 0 || fork == len(chain)-1 {
+		return nil, nil
+	}
+	ev := &ReorgEvent{
+		DetectedAt: time.Now().UTC(),
+		ForkHeight: chain[0].Height - 1,
+		Removed:    append([]ReorgBlock{}, chain[fork+1:]...),
+		Added:      added,
+	}
+	if fork >= 0 {
+		ev.ForkHeight, ev.ForkHash = chain[fork].Height, chain[fork].Hash
+	}
+	ev.Depth = len(ev.Removed)
+	return ev, nil
+}
+
+// emit records ev for /reorgs and calls the handlers registered for reorgs
+func (d *reorgDetector) emit(ev ReorgEvent) {
+	d.mu.Lock()
+	d.events = append([]ReorgEvent{ev}, d.events...)
+	if len(d.events) > reorgHistory {
+		d.events = d.events[:reorgHistory]
+	}
+	handlers := append([]func(ReorgEvent){}, d.handlers...)
+	d.mu.Unlock()
+
+	for _, f := range handlers {
+		f(ev)
+	}
+}
+
+// snapshot returns the tracked tip, how many blocks are tracked and the
+// recent reorgs
+func (d *reorgDetector) snapshot() ReorgsResponse {
+	out := ReorgsResponse{Reorgs: []ReorgEvent{}}
+	if d == nil {
+		return out
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.chain) > 0 {
+		tip := d.chain[len(d.chain)-1]
+		out.Tip = &tip
+	}
+	out.Tracked = len(d.chain)
+	out.Reorgs = append(out.Reorgs, d.events...)
+	return out
+}
+
+// HandleGetReorgs handles the /reorgs route
+func (as *AddrServer) HandleGetReorgs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.Marshal(as.reorgs.snapshot())
+	w.Write(out)
+}
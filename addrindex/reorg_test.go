@@ -0,0 +1,100 @@
+package addrindex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// fakeChain answers block hash lookups from a map of heights to hashes
+type fakeChain map[int64]string
+
+func (c fakeChain) hashes(ctx context.Context, heights []int64) ([]string, error) {
+	out := make([]string, len(heights))
+	for i, h := range heights {
+		hash, ok := c[h]
+		if !ok {
+			return nil, fmt.Errorf("no block at height %d", h)
+		}
+		out[i] = hash
+	}
+	return out, nil
+}
+
+func TestReorgDetector(t *testing.T) {
+	ctx := context.Background()
+	d := &reorgDetector{depth: 5}
+	chain := fakeChain{}
+	for h := int64(0); h <= 12; h++ {
+		chain[h] = fmt.Sprintf("a%d", h)
+	}
+
+	if ev, err := d.update(ctx, 10, chain.hashes); ev != nil || err != nil {
+		t.Errorf("Expected no reorg, got '%+v' '%v'\n", ev, err)
+	}
+	if ev, _ := d.update(ctx, 12, chain.hashes); ev != nil || d.chain[0].Height != 8 || len(d.chain) != 5 {
+		t.Errorf("Expected blocks '%d' to '%d' tracked, got '%+v' '%+v'\n", 8, 12, d.chain, ev)
+	}
+
+	// Blocks 11 and 12 are replaced by a longer branch
+	chain[11], chain[12], chain[13] = "b11", "b12", "b13"
+	ev, err := d.update(ctx, 13, chain.hashes)
+	if err != nil || ev == nil {
+		t.Fatalf("Expected a reorg, got '%v'\n", err)
+	}
+	if ev.ForkHeight != 10 || ev.ForkHash != "a10" || ev.Depth != 2 || len(ev.Added) != 3 || ev.Removed[1].Hash != "a12" || ev.Added[2].Hash != "b13" {
+		t.Errorf("Expected a fork at '%d' removing '%d' blocks, got '%+v'\n", 10, 2, ev)
+	}
+
+	// A node behind the tracked tip on the same chain isn't a reorg
+	if ev, _ := d.update(ctx, 12, chain.hashes); ev != nil {
+		t.Errorf("Expected no reorg, got '%+v'\n", ev)
+	}
+
+	// Nothing tracked is left on the best chain
+	for h := int64(0); h <= 14; h++ {
+		chain[h] = fmt.Sprintf("c%d", h)
+	}
+	ev, err = d.update(ctx, 14, chain.hashes)
+	if err != nil || ev == nil || ev.ForkHash != "" || ev.ForkHeight != 8 || ev.Depth != 5 {
+		t.Errorf("Expected a fork below '%d', got '%+v' '%v'\n", 9, ev, err)
+	}
+	if d.chain[len(d.chain)-1].Hash != "c14" || len(d.chain) != 5 {
+		t.Errorf("Expected '%s' tracked, got '%+v'\n", "c14", d.chain)
+	}
+}
+
+func TestReorgPurge(t *testing.T) {
+	as := &AddrServer{Params: &chaincfg.MainNetParams}
+	as.setReorgConfig(&AddrServerConfig{})
+	c := as.pageCache
+	as.Router()
+	if as.pageCache != c {
+		t.Errorf("Expected the router to use the page cache reorgs purge\n")
+	}
+	as.pageCache.Set("/blocks?limit=10", []byte(`{"blocks":[]}`), time.Minute)
+	as.pageCache.Set("/block/a12", []byte(`{"hash":"a12"}`), time.Minute)
+	as.pageCache.Set("/currency", []byte(`{"rate":1}`), time.Minute)
+
+	as.reorgs.emit(ReorgEvent{ForkHeight: 10, ForkHash: "a10", Depth: 2, Removed: []ReorgBlock{{11, "a11"}, {12, "a12"}}})
+	for key, cached := range map[string]bool{"/blocks?limit=10": false, "/block/a12": false, "/currency": true} {
+		if got := as.pageCache.Get(key) != nil; got != cached {
+			t.Errorf("Expected %s cached '%t', got '%t'\n", key, cached, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	as.HandleGetReorgs(rr, httptest.NewRequest("GET", "/reorgs", nil))
+	var out ReorgsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Reorgs) != 1 || out.Reorgs[0].ForkHash != "a10" {
+		t.Errorf("Expected '%d' reorg, got '%+v'\n", 1, out.Reorgs)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// Defaults for the retry and circuit breaker settings in AddrServerConfig
+const (
+	DefaultRPCRetries       = 2
+	DefaultRPCRetryBackoff  = 100 * time.Millisecond
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+
+	// maxRetryBackoff caps the wait before a retry
+	maxRetryBackoff = 2 * time.Second
+)
+
+var (
+	// ErrWorkQueueFull is returned when the node turns a call away because
+	// its RPC work queue is full
+	ErrWorkQueueFull = errors.New("node work queue depth exceeded")
+
+	// ErrCircuitOpen is returned when every backend is failing fast
+	ErrCircuitOpen = errors.New("backend is failing, circuit breaker open")
+)
+
+// setRetryConfig copies the retry and circuit breaker settings onto the
+// client and its backends, filling in defaults. Negative retries or
+// breakerThreshold disable retries or the breaker.
+func (as *AddrServer) setRetryConfig(cfg *AddrServerConfig) {
+	as.Client.retries = cfg.RPCRetries
+	if as.Client.retries == 0 {
+		as.Client.retries = DefaultRPCRetries
+	}
+	as.Client.backoff = durationOrDefault(cfg.RPCRetryBackoff, DefaultRPCRetryBackoff)
+	threshold := cfg.BreakerThreshold
+	if threshold == 0 {
+		threshold = DefaultBreakerThreshold
+	}
+	cooldown := durationOrDefault(cfg.BreakerCooldown, DefaultBreakerCooldown)
+	for _, b := range as.Client.backends {
+		b.breaker = &circuitBreaker{threshold: threshold, cooldown: cooldown}
+	}
+}
+
+// isTransient returns whether err is a failure that is likely to go away if
+// the call is made again shortly: a full work queue or a connection dropped
+// while the node restarts. Timeouts aren't retried, the node is already
+// struggling with the call.
+func isTransient(err error) bool {
+	var netErr net.Error
+	switch {
+	case notReceived(err):
+		return true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || strings.Contains(err.Error(), "connection reset")
+}
+
+// notReceived returns whether err shows the node never got to the call, so
+// it's safe to make it again even if it isn't idempotent
+func notReceived(err error) bool {
+	var opErr *net.OpError
+	switch {
+	case isWorkQueueFull(err), errors.Is(err, ErrCircuitOpen):
+		return true
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return true
+	}
+	return false
+}
+
+// isWorkQueueFull returns whether the node turned the call away because its
+// work queue is full. rpcclient reports the node's plain text reply in the
+// error.
+func isWorkQueueFull(err error) bool {
+	return errors.Is(err, ErrWorkQueueFull) || strings.Contains(err.Error(), "Work queue depth exceeded")
+}
+
+// isFailure returns whether err counts against a backend's circuit breaker.
+// Errors returned by the node are answers, and cancelled calls or calls
+// turned away by the server's own semaphore say nothing about the backend.
+func isFailure(ctx context.Context, err error) bool {
+	var rpcErr *btcjson.RPCError
+	return err != nil && ctx.Err() == nil && !errors.As(err, &rpcErr) && !errors.Is(err, ErrRPCBusy)
+}
+
+// canRetry returns whether a call that failed with err can be made again.
+// Broadcasts are only retried when the node never got them.
+func canRetry(ctx context.Context, method string, err error) bool {
+	if !isFailure(ctx, err) {
+		return false
+	}
+	if method == "sendrawtransaction" {
+		return notReceived(err)
+	}
+	return isTransient(err)
+}
+
+// retryBackoff returns the wait before retry number attempt, exponential
+// with full jitter
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt)
+	if d <= 0 || d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// callRetrying makes a call on b, retrying transient failures
+func (c *RPCClient) callRetrying(ctx context.Context, b *Backend, method string, f func(context.Context, *Backend) error) error {
+	for attempt := 0; ; attempt++ {
+		err := c.callBackend(ctx, b, f)
+		if attempt >= c.retries || !canRetry(ctx, method, err) {
+			return err
+		}
+		rpcRetries.WithLabelValues(method).Inc()
+		logger(ctx).Debug("Retrying RPC call", "method", method, "backend", b.Name, "attempt", attempt+1, "error", err)
+		timer := time.NewTimer(retryBackoff(c.backoff, attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// circuitBreaker fails calls to a backend fast once threshold calls in a row
+// have failed. After cooldown a single call is let through, which closes the
+// breaker if it succeeds and opens it again if it fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Circuit breaker states reported in BackendStatus
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// allow returns whether a call can be made
+func (cb *circuitBreaker) allow() bool {
+	if cb == nil || cb.threshold <= 0 {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.failures < cb.threshold {
+		return true
+	}
+	if cb.probing || time.Now().Before(cb.openUntil) {
+		return false
+	}
+	cb.probing = true
+	return true
+}
+
+// record notes the outcome of a call. It returns whether the call opened
+// the breaker.
+func (cb *circuitBreaker) record(ctx context.Context, err error) bool {
+	if cb == nil || cb.threshold <= 0 {
+		return false
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+	if err == nil {
+		cb.failures = 0
+		return false
+	}
+	if !isFailure(ctx, err) {
+		return false
+	}
+	cb.failures++
+	if cb.failures < cb.threshold {
+		return false
+	}
+	cb.openUntil = time.Now().Add(cb.cooldown)
+	return true
+}
+
+// state returns the state of the breaker
+func (cb *circuitBreaker) state() string {
+	if cb == nil || cb.threshold <= 0 {
+		return CircuitClosed
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch {
+	case cb.failures < cb.threshold:
+		return CircuitClosed
+	case cb.probing || !time.Now().Before(cb.openUntil):
+		return CircuitHalfOpen
+	}
+	return CircuitOpen
+}
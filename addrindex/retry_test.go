@@ -0,0 +1,138 @@
+package addrindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+func TestRetryTransient(t *testing.T) {
+	tx := `{"result":{"txid":"aa"},"error":null,"id":1}`
+	node := &fakeNode{replies: map[string][]string{"getrawtransaction": {"busy", "drop", tx}}}
+	as := node.start(t)
+	as.setRetryConfig(&AddrServerConfig{RPCRetryBackoff: time.Millisecond})
+	res, err := as.GetRawTransaction(context.Background(), "aa")
+	if err != nil || res.Result.Txid != "aa" {
+		t.Errorf("Expected '%s', got '%s' '%v'\n", "aa", res.Result.Txid, err)
+	}
+	if node.count("getrawtransaction") != 3 {
+		t.Errorf("Expected '%d' calls, got '%d'\n", 3, node.count("getrawtransaction"))
+	}
+
+	// Retries run out, and errors from the node aren't retried
+	node = &fakeNode{replies: map[string][]string{"getrawtransaction": {"busy", "busy", "busy", tx}}}
+	as = node.start(t)
+	as.setRetryConfig(&AddrServerConfig{RPCRetryBackoff: time.Millisecond})
+	_, err = as.GetRawTransaction(context.Background(), "aa")
+	if classifyError(err).Code != CodeNodeBusy || node.count("getrawtransaction") != 3 {
+		t.Errorf("Expected '%s' after '%d' calls, got '%v' after '%d'\n", CodeNodeBusy, 3, err, node.count("getrawtransaction"))
+	}
+	node = &fakeNode{replies: map[string][]string{"getrawtransaction": {`{"result":null,"error":{"code":-5,"message":"No information"},"id":1}`}}}
+	as = node.start(t)
+	as.setRetryConfig(&AddrServerConfig{RPCRetryBackoff: time.Millisecond})
+	_, err = as.GetRawTransaction(context.Background(), "aa")
+	if classifyError(err).Code != CodeNotFound || node.count("getrawtransaction") != 1 {
+		t.Errorf("Expected '%s' after '%d' call, got '%v' after '%d'\n", CodeNotFound, 1, err, node.count("getrawtransaction"))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	cb := &circuitBreaker{threshold: 2, cooldown: 20 * time.Millisecond}
+	failed := errors.New("connection reset by peer")
+
+	cb.record(ctx, failed)
+	cb.record(ctx, &btcjson.RPCError{Code: -5})
+	if !cb.allow() || cb.state() != CircuitClosed {
+		t.Errorf("Expected '%s', got '%s'\n", CircuitClosed, cb.state())
+	}
+	if !cb.record(ctx, failed) || cb.allow() || cb.state() != CircuitOpen {
+		t.Errorf("Expected '%s', got '%s'\n", CircuitOpen, cb.state())
+	}
+
+	// After the cooldown one probe is let through
+	time.Sleep(30 * time.Millisecond)
+	if !cb.allow() || cb.allow() || cb.state() != CircuitHalfOpen {
+		t.Errorf("Expected a single probe while '%s', got '%s'\n", CircuitHalfOpen, cb.state())
+	}
+	cb.record(ctx, failed)
+	if cb.allow() {
+		t.Errorf("Expected '%s' after a failed probe, got '%s'\n", CircuitOpen, cb.state())
+	}
+	time.Sleep(30 * time.Millisecond)
+	cb.allow()
+	cb.record(ctx, nil)
+	if !cb.allow() || cb.state() != CircuitClosed {
+		t.Errorf("Expected '%s' after a successful probe, got '%s'\n", CircuitClosed, cb.state())
+	}
+}
+
+func TestCircuitOpenFailsFast(t *testing.T) {
+	node := &fakeNode{}
+	as := node.start(t)
+	as.setRetryConfig(&AddrServerConfig{RPCRetries: -1, BreakerThreshold: 2})
+	for i := 0; i < 4; i++ {
+		as.GetRawTransaction(context.Background(), "aa")
+	}
+	_, err := as.GetRawTransaction(context.Background(), "aa")
+	if classifyError(err).Code != CodeUpstreamUnavailable || node.count("getrawtransaction") != 2 {
+		t.Errorf("Expected '%s' after '%d' calls, got '%v' after '%d'\n", CodeUpstreamUnavailable, 2, err, node.count("getrawtransaction"))
+	}
+}
+
+func TestSendTransaction(t *testing.T) {
+	msg := wire.NewMsgTx(1)
+	msg.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 1}, []byte{0x51}, nil))
+	msg.AddTxOut(wire.NewTxOut(5000, []byte{0x51}))
+	tx := btcutil.NewTx(msg)
+	txid := tx.Hash().String()
+
+	sent := fmt.Sprintf(`{"result":"%s","error":null,"id":1}`, txid)
+	known := `{"result":{"txid":"` + txid + `"},"error":null,"id":1}`
+	unknown := `{"result":null,"error":{"code":-5,"message":"No such mempool or blockchain transaction"},"id":1}`
+	inMempool := `{"result":null,"error":{"code":-26,"message":"txn-already-in-mempool"},"id":1}`
+	rejected := `{"result":null,"error":{"code":-26,"message":"min relay fee not met"},"id":1}`
+
+	cases := []struct {
+		name    string
+		send    []string
+		lookup  []string
+		code    string
+		sends   int
+		lookups int
+	}{
+		{"sent", []string{sent}, nil, "", 1, 0},
+		{"rejected", []string{rejected}, nil, CodeTxRejected, 1, 0},
+		{"work queue full", []string{"busy", sent}, nil, "", 2, 0},
+		{"dropped and known", []string{"drop"}, []string{known}, "", 1, 1},
+		{"dropped and unknown", []string{"drop", sent}, []string{unknown}, "", 2, 1},
+		{"dropped and raced", []string{"drop", inMempool}, []string{unknown}, "", 2, 1},
+		{"dropped twice", []string{"drop", "drop"}, []string{unknown}, CodeBroadcastUnknown, 2, 1},
+		{"lookup fails", []string{"drop"}, []string{"drop", "drop", "drop"}, CodeBroadcastUnknown, 1, 3},
+	}
+	for _, c := range cases {
+		node := &fakeNode{replies: map[string][]string{
+			"getinfo":            {`{"result":{"version":140000},"error":null,"id":1}`},
+			"sendrawtransaction": c.send,
+			"getrawtransaction":  c.lookup,
+		}}
+		as := node.start(t)
+		as.setRetryConfig(&AddrServerConfig{RPCRetryBackoff: time.Millisecond})
+		hash, err := as.SendTransaction(context.Background(), tx)
+		switch {
+		case c.code == "" && (err != nil || hash.String() != txid):
+			t.Errorf("%s: Expected '%s', got '%v' '%v'\n", c.name, txid, hash, err)
+		case c.code != "" && classifyError(err).Code != c.code:
+			t.Errorf("%s: Expected '%s', got '%v'\n", c.name, c.code, err)
+		}
+		if node.count("sendrawtransaction") != c.sends || node.count("getrawtransaction") != c.lookups {
+			t.Errorf("%s: Expected '%d' sends and '%d' lookups, got '%d' and '%d'\n", c.name, c.sends, c.lookups, node.count("sendrawtransaction"), node.count("getrawtransaction"))
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// RPCClient wraps the rpcclient.Client of each backend node and instruments
+// the calls the server makes with metrics, logging and tracing. Calls go to
+// the best backend and fail over to the others.
+type RPCClient struct {
+	// Client is the client of the first backend
+	*rpcclient.Client
+
+	backends []*Backend
+
+	// retries is how many times transient failures are retried, with a
+	// backoff starting at backoff
+	retries int
+	backoff time.Duration
+
+	// maxLag is how many blocks behind the best backend a backend may be
+	// and still serve reads, negative for no limit
+	maxLag int
+
+	// sem caps the number of calls in flight to the nodes, shared with the
+	// bitcore methods
+	sem *rpcSemaphore
+}
+
+func newRPCClient(backends []*Backend) *RPCClient {
+	out := &RPCClient{backends: backends, maxLag: DefaultReadyMaxBlocksBehind}
+	if len(backends) > 0 {
+		out.Client = backends[0].client
+	}
+	return out
+}
+
+// call runs f as the RPC method against the best backend, instrumented and
+// holding a slot on the concurrency semaphore for the duration of the call.
+// Transient failures are retried, and when the backend still can't be
+// reached the call is made on the next one. Backends with an open circuit
+// breaker are skipped, unless the call is pinned to them.
+func (c *RPCClient) call(ctx context.Context, method string, f func(context.Context, *Backend) error) (err error) {
+	ctx, done := startRPC(ctx, method)
+	defer done(&err)
+	_, pinned := ctx.Value(backendKey{}).(*Backend)
+	err = ErrNoBackends
+	tried := false
+	for _, b := range c.candidates(ctx) {
+		if !pinned && !b.breaker.allow() {
+			if !tried {
+				err = ErrCircuitOpen
+			}
+			continue
+		}
+		if tried {
+			rpcFailovers.WithLabelValues(method).Inc()
+			logger(ctx).Warn("Failing over RPC call", "method", method, "backend", b.Name, "error", err)
+		}
+		tried = true
+		err = c.callRetrying(ctx, b, method, f)
+		if b.breaker.record(ctx, err) {
+			logger(ctx).Warn("Opening circuit breaker", "backend", b.Name, "error", err)
+		}
+		if !canFailover(ctx, method, err) {
+			if err == nil {
+				recordBackend(ctx, b)
+			}
+			return err
+		}
+		b.markDown(err)
+	}
+	return err
+}
+
+func (c *RPCClient) callBackend(ctx context.Context, b *Backend, f func(context.Context, *Backend) error) error {
+	release, err := c.sem.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return f(ctx, b)
+}
+
+// Statuses returns the health of every backend
+func (c *RPCClient) Statuses() []BackendStatus {
+	out := make([]BackendStatus, len(c.backends))
+	for i, b := range c.backends {
+		out[i] = b.Status()
+	}
+	return out
+}
+
+// Shutdown shuts down the client of every backend
+func (c *RPCClient) Shutdown() {
+	for _, b := range c.backends {
+		b.client.Shutdown()
+	}
+}
+
+// WaitForShutdown waits for the client of every backend to shut down
+func (c *RPCClient) WaitForShutdown() {
+	for _, b := range c.backends {
+		b.client.WaitForShutdown()
+	}
+}
+
+// GetInfo wraps rpcclient.Client.GetInfo. Bitcoin Core removed getinfo in
+// 0.16, for it the result is put together from getblockchaininfo and
+// getnetworkinfo.
+func (c *RPCClient) GetInfo(ctx context.Context) (out *btcjson.InfoWalletResult, err error) {
+	err = c.call(ctx, "getinfo", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetInfo()
+		var rpcErr *btcjson.RPCError
+		if errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCMethodNotFound.Code {
+			out, err = infoFromChain(b)
+		}
+		return err
+	})
+	return out, err
+}
+
+func infoFromChain(b *Backend) (*btcjson.InfoWalletResult, error) {
+	chain, err := b.client.GetBlockChainInfo()
+	if err != nil {
+		return nil, err
+	}
+	network, err := b.client.GetNetworkInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &btcjson.InfoWalletResult{
+		Version:         network.Version,
+		ProtocolVersion: network.ProtocolVersion,
+		Blocks:          chain.Blocks,
+		TimeOffset:      network.TimeOffset,
+		Connections:     network.Connections,
+		Difficulty:      chain.Difficulty,
+		TestNet:         chain.Chain == "test",
+		RelayFee:        network.RelayFee,
+		Errors:          network.Warnings,
+	}, nil
+}
+
+// GetBlockCount wraps rpcclient.Client.GetBlockCount
+func (c *RPCClient) GetBlockCount(ctx context.Context) (out int64, err error) {
+	err = c.call(ctx, "getblockcount", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetBlockCount()
+		return err
+	})
+	return out, err
+}
+
+// GetBlockChainInfo wraps rpcclient.Client.GetBlockChainInfo
+func (c *RPCClient) GetBlockChainInfo(ctx context.Context) (out *btcjson.GetBlockChainInfoResult, err error) {
+	err = c.call(ctx, "getblockchaininfo", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetBlockChainInfo()
+		return err
+	})
+	return out, err
+}
+
+// GetBlock wraps rpcclient.Client.GetBlock
+func (c *RPCClient) GetBlock(ctx context.Context, hash *chainhash.Hash) (out *wire.MsgBlock, err error) {
+	err = c.call(ctx, "getblock", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetBlock(hash)
+		return err
+	})
+	return out, err
+}
+
+// GetRawMempool wraps rpcclient.Client.GetRawMempool
+func (c *RPCClient) GetRawMempool(ctx context.Context) (out []*chainhash.Hash, err error) {
+	err = c.call(ctx, "getrawmempool", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetRawMempool()
+		return err
+	})
+	return out, err
+}
+
+// GetBlockVerbose wraps rpcclient.Client.GetBlockVerbose
+func (c *RPCClient) GetBlockVerbose(ctx context.Context, hash *chainhash.Hash) (out *btcjson.GetBlockVerboseResult, err error) {
+	err = c.call(ctx, "getblock", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetBlockVerbose(hash)
+		return err
+	})
+	return out, err
+}
+
+// GetBlockHash wraps rpcclient.Client.GetBlockHash
+func (c *RPCClient) GetBlockHash(ctx context.Context, height int64) (out *chainhash.Hash, err error) {
+	err = c.call(ctx, "getblockhash", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetBlockHash(height)
+		return err
+	})
+	return out, err
+}
+
+// GetBestBlockHash wraps rpcclient.Client.GetBestBlockHash
+func (c *RPCClient) GetBestBlockHash(ctx context.Context) (out *chainhash.Hash, err error) {
+	err = c.call(ctx, "getbestblockhash", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetBestBlockHash()
+		return err
+	})
+	return out, err
+}
+
+// GetDifficulty wraps rpcclient.Client.GetDifficulty
+func (c *RPCClient) GetDifficulty(ctx context.Context) (out float64, err error) {
+	err = c.call(ctx, "getdifficulty", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetDifficulty()
+		return err
+	})
+	return out, err
+}
+
+// GetRawTransactionVerbose wraps rpcclient.Client.GetRawTransactionVerbose
+func (c *RPCClient) GetRawTransactionVerbose(ctx context.Context, txHash *chainhash.Hash) (out *btcjson.TxRawResult, err error) {
+	err = c.call(ctx, "getrawtransaction", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.GetRawTransactionVerbose(txHash)
+		return err
+	})
+	return out, err
+}
+
+// SendRawTransaction wraps rpcclient.Client.SendRawTransaction
+func (c *RPCClient) SendRawTransaction(ctx context.Context, tx *wire.MsgTx, allowHighFees bool) (out *chainhash.Hash, err error) {
+	err = c.call(ctx, "sendrawtransaction", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.SendRawTransaction(tx, allowHighFees)
+		return err
+	})
+	return out, err
+}
+
+// VerifyMessage wraps rpcclient.Client.VerifyMessage
+func (c *RPCClient) VerifyMessage(ctx context.Context, address btcutil.Address, signature, message string) (out bool, err error) {
+	err = c.call(ctx, "verifymessage", func(_ context.Context, b *Backend) (err error) {
+		out, err = b.client.VerifyMessage(address, signature, message)
+		return err
+	})
+	return out, err
+}
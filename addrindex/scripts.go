@@ -0,0 +1,129 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/jackzampolin/addrindex-server/segwit"
+)
+
+// scriptPubKey types, named as bitcoind names them
+const (
+	ScriptPubKeyHash          = "pubkeyhash"
+	ScriptScriptHash          = "scripthash"
+	ScriptWitnessV0KeyHash    = "witness_v0_keyhash"
+	ScriptWitnessV0ScriptHash = "witness_v0_scripthash"
+	ScriptWitnessV1Taproot    = "witness_v1_taproot"
+	ScriptWitnessUnknown      = "witness_unknown"
+	ScriptNullData            = "nulldata"
+	ScriptNonStandard         = "nonstandard"
+)
+
+// ScriptType returns the type of a scriptPubKey
+func ScriptType(script []byte) string {
+	switch {
+	case len(script) == 25 && script[0] == txscript.OP_DUP && script[1] == txscript.OP_HASH160 &&
+		script[2] == txscript.OP_DATA_20 && script[23] == txscript.OP_EQUALVERIFY && script[24] == txscript.OP_CHECKSIG:
+		return ScriptPubKeyHash
+	case len(script) == 23 && script[0] == txscript.OP_HASH160 && script[1] == txscript.OP_DATA_20 &&
+		script[22] == txscript.OP_EQUAL:
+		return ScriptScriptHash
+	case len(script) > 0 && script[0] == txscript.OP_RETURN:
+		return ScriptNullData
+	}
+	version, program, ok := segwit.WitnessProgram(script)
+	switch {
+	case !ok:
+		return ScriptNonStandard
+	case version == 0 && len(program) == 20:
+		return ScriptWitnessV0KeyHash
+	case version == 0 && len(program) == 32:
+		return ScriptWitnessV0ScriptHash
+	case version == 1 && len(program) == 32:
+		return ScriptWitnessV1Taproot
+	case version == 0:
+		return ScriptNonStandard
+	}
+	return ScriptWitnessUnknown
+}
+
+// AddressScriptType returns the type of scriptPubKey paying to addr
+func AddressScriptType(addr btcutil.Address) string {
+	switch a := addr.(type) {
+	case *btcutil.AddressPubKeyHash, *btcutil.AddressPubKey:
+		return ScriptPubKeyHash
+	case *btcutil.AddressScriptHash:
+		return ScriptScriptHash
+	case *btcutil.AddressWitnessPubKeyHash:
+		return ScriptWitnessV0KeyHash
+	case *btcutil.AddressWitnessScriptHash:
+		return ScriptWitnessV0ScriptHash
+	case *segwit.Address:
+		if a.WitnessVersion() == 1 && len(a.WitnessProgram()) == 32 {
+			return ScriptWitnessV1Taproot
+		}
+		return ScriptWitnessUnknown
+	}
+	return ScriptNonStandard
+}
+
+// utxoScriptType returns the script type of a UTXO from its script, falling
+// back to the type of the address it pays to when the node didn't return one
+func (as *AddrServer) utxoScriptType(script, address string) string {
+	if b, err := hex.DecodeString(script); err == nil && len(b) > 0 {
+		return ScriptType(b)
+	}
+	if addr, err := as.DecodeAddress(address); err == nil {
+		return AddressScriptType(addr)
+	}
+	return ""
+}
+
+// isSegwit returns whether addr is a native segwit address
+func isSegwit(addr btcutil.Address) bool {
+	switch addr.(type) {
+	case *btcutil.AddressWitnessPubKeyHash, *btcutil.AddressWitnessScriptHash, *segwit.Address:
+		return true
+	}
+	return false
+}
+
+// addressIndexError explains an error from an address index RPC. Address
+// indexes from pre-segwit bitcore nodes reject native segwit and taproot
+// addresses as invalid, which is reported as unsupported rather than as an
+// unknown address.
+func addressIndexError(addrs []btcutil.Address, err error) error {
+	var rpcErr *btcjson.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != rpcInvalidAddressOrKey {
+		return err
+	}
+	for _, addr := range addrs {
+		if isSegwit(addr) {
+			return &APIError{
+				Status: http.StatusNotImplemented,
+				Code:   CodeUnsupportedAddressType,
+				Err:    fmt.Errorf("the node's address index doesn't cover %s addresses: %s", AddressScriptType(addr), err),
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package addrindex
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/jackzampolin/addrindex-server/segwit"
+)
+
+func TestScriptType(t *testing.T) {
+	cases := map[string]string{
+		"76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac":                   ScriptPubKeyHash,
+		"a9147ccd3d1c4e31a6ee2e3e7a2fe94ebd5a7b2d4e6e87":                       ScriptScriptHash,
+		"0014751e76e8199196d454941c45d1b3a323f1433bd6":                         ScriptWitnessV0KeyHash,
+		"00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262": ScriptWitnessV0ScriptHash,
+		"512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798": ScriptWitnessV1Taproot,
+		"5210751e76e8199196d454941c45d1b3a323":                                 ScriptWitnessUnknown,
+		"6a0b68656c6c6f20776f726c64":                                           ScriptNullData,
+		"0010751e76e8199196d454941c45d1b3a323":                                 ScriptNonStandard,
+		"51":                                                                   ScriptNonStandard,
+	}
+	for script, expected := range cases {
+		b, _ := hex.DecodeString(script)
+		if got := ScriptType(b); got != expected {
+			t.Errorf("Expected '%s' for %s, got '%s'\n", expected, script, got)
+		}
+	}
+}
+
+func TestAddressScriptType(t *testing.T) {
+	cases := map[string]string{
+		"1BoatSLRHtKNngkdXEeobR76b53LETtpyT":                             ScriptPubKeyHash,
+		"3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy":                             ScriptScriptHash,
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4":                     ScriptWitnessV0KeyHash,
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0": ScriptWitnessV1Taproot,
+	}
+	for addr, expected := range cases {
+		decoded, err := segwit.DecodeAddress(addr, &chaincfg.MainNetParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := AddressScriptType(decoded); got != expected {
+			t.Errorf("Expected '%s' for %s, got '%s'\n", expected, addr, got)
+		}
+	}
+
+	as := &AddrServer{Network: NetworkMainnet, Params: &chaincfg.MainNetParams}
+	if got := as.utxoScriptType("", "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"); got != ScriptWitnessV0KeyHash {
+		t.Errorf("Expected '%s' from the address, got '%s'\n", ScriptWitnessV0KeyHash, got)
+	}
+}
+
+func TestAddressIndexError(t *testing.T) {
+	legacy, _ := segwit.DecodeAddress("1BoatSLRHtKNngkdXEeobR76b53LETtpyT", &chaincfg.MainNetParams)
+	taproot, _ := segwit.DecodeAddress("bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", &chaincfg.MainNetParams)
+	invalid := &btcjson.RPCError{Code: rpcInvalidAddressOrKey, Message: "Invalid address"}
+
+	err := addressIndexError([]btcutil.Address{legacy, taproot}, invalid)
+	if e := classifyError(err); e.Status != http.StatusNotImplemented || e.Code != CodeUnsupportedAddressType {
+		t.Errorf("Expected '%d %s', got '%d %s'\n", http.StatusNotImplemented, CodeUnsupportedAddressType, e.Status, e.Code)
+	}
+	if err := addressIndexError([]btcutil.Address{legacy}, invalid); err != invalid {
+		t.Errorf("Expected legacy address errors to pass through, got '%v'\n", err)
+	}
+	other := errors.New("connection refused")
+	if err := addressIndexError([]btcutil.Address{taproot}, other); err != other {
+		t.Errorf("Expected other errors to pass through, got '%v'\n", err)
+	}
+}
+
+func TestVerifyMessage(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyHash := btcutil.Hash160(priv.PubKey().SerializeCompressed())
+	p2wpkh, _ := btcutil.NewAddressWitnessPubKeyHash(keyHash, &chaincfg.MainNetParams)
+	p2sh, _ := btcutil.NewAddressScriptHash(append([]byte{0x00, 0x14}, keyHash...), &chaincfg.MainNetParams)
+	other, _ := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &chaincfg.MainNetParams)
+
+	sig, err := btcec.SignCompact(btcec.S256(), priv, messageHash("hello"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(offset byte) string {
+		s := append([]byte{sig[0] + offset}, sig[1:]...)
+		return base64.StdEncoding.EncodeToString(s)
+	}
+
+	cases := []struct {
+		name     string
+		addr     btcutil.Address
+		sig      string
+		message  string
+		expected bool
+	}{
+		{"p2wpkh header", p2wpkh, sign(8), "hello", true},
+		{"p2wpkh with compressed p2pkh header", p2wpkh, sign(0), "hello", true},
+		{"p2sh-p2wpkh header", p2sh, sign(4), "hello", true},
+		{"wrong message", p2wpkh, sign(8), "goodbye", false},
+		{"wrong address", other, sign(8), "hello", false},
+	}
+	for _, c := range cases {
+		ok, err := verifyMessage(c.addr, c.sig, c.message)
+		if err != nil {
+			t.Errorf("%s: Expected no error, got '%s'\n", c.name, err)
+		}
+		if ok != c.expected {
+			t.Errorf("%s: Expected '%t', got '%t'\n", c.name, c.expected, ok)
+		}
+	}
+
+	if _, err := verifyMessage(p2wpkh, "not base64!", "hello"); classifyError(err).Code != CodeInvalidInput {
+		t.Errorf("Expected '%s', got '%v'\n", CodeInvalidInput, err)
+	}
+	taproot, _ := segwit.NewAddress(1, make([]byte, 32), &chaincfg.MainNetParams)
+	if _, err := verifyMessage(taproot, sign(0), "hello"); classifyError(err).Code != CodeUnsupportedAddressType {
+		t.Errorf("Expected '%s', got '%v'\n", CodeUnsupportedAddressType, err)
+	}
+}
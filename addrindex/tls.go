@@ -0,0 +1,207 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Supported values for the `tlsClientAuth` config option
+const (
+	TLSClientAuthRequire = "require"
+	TLSClientAuthVerify  = "verify"
+)
+
+// certReloadInterval is how often the cert and key files are checked for changes
+const certReloadInterval = 10 * time.Second
+
+// TLSEnabled returns true when a certificate and key are configured
+func (as *AddrServer) TLSEnabled() bool {
+	return as.TLSCert != "" && as.TLSKey != ""
+}
+
+// TLSConfig returns the tls.Config for serving HTTPS. The certificate is
+// reloaded whenever the cert or key file changes on disk. When a client CA
+// bundle is configured, callers must present a certificate signed by it
+// ("require"), or may optionally present one ("verify"). tlsClientAuth
+// without a client CA bundle is an error.
+func (as *AddrServer) TLSConfig() (*tls.Config, error) {
+	out := &tls.Config{MinVersion: tls.VersionTLS12}
+	if err := as.setTLSClientAuth(out); err != nil {
+		return nil, err
+	}
+
+	kp, err := newKeypairReloader(as.TLSCert, as.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	out.GetCertificate = kp.GetCertificate
+	as.startWorker(func(quit <-chan struct{}) {
+		kp.watch(quit, certReloadInterval)
+	})
+	return out, nil
+}
+
+// setTLSClientAuth configures client certificate authentication on cfg
+func (as *AddrServer) setTLSClientAuth(cfg *tls.Config) error {
+	if as.TLSClientCA == "" {
+		if as.TLSClientAuth != "" {
+			return fmt.Errorf("tlsClientAuth %q needs a tlsClientCA bundle", as.TLSClientAuth)
+		}
+		return nil
+	}
+
+	switch as.TLSClientAuth {
+	case TLSClientAuthRequire, "":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case TLSClientAuthVerify:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("unknown tlsClientAuth %q", as.TLSClientAuth)
+	}
+
+	pem, err := ioutil.ReadFile(as.TLSClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in client CA bundle %s", as.TLSClientCA)
+	}
+	cfg.ClientCAs = pool
+	return nil
+}
+
+// RedirectServer returns an http.Server that redirects plain HTTP requests
+// on the redirect port to the HTTPS listener
+func (as *AddrServer) RedirectServer() *http.Server {
+	return &http.Server{
+		Addr:              net.JoinHostPort(as.Bind, strconv.Itoa(as.TLSRedirectPort)),
+		Handler:           http.HandlerFunc(as.handleHTTPSRedirect),
+		ReadTimeout:       as.ReadTimeout,
+		ReadHeaderTimeout: as.ReadTimeout,
+		WriteTimeout:      as.WriteTimeout,
+		IdleTimeout:       as.IdleTimeout,
+		MaxHeaderBytes:    as.MaxHeaderBytes,
+	}
+}
+
+func (as *AddrServer) handleHTTPSRedirect(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if as.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(as.Port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// keypairReloader holds the serving certificate and swaps it out when the
+// files backing it change
+type keypairReloader struct {
+	certPath string
+	keyPath  string
+	modTime  time.Time
+	cert     *tls.Certificate
+	mu       sync.RWMutex
+}
+
+func newKeypairReloader(certPath, keyPath string) (*keypairReloader, error) {
+	kp := &keypairReloader{certPath: certPath, keyPath: keyPath}
+	if err := kp.reload(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// reload loads the keypair from disk
+func (kp *keypairReloader) reload() error {
+	modTime, err := kp.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(kp.certPath, kp.keyPath)
+	if err != nil {
+		return err
+	}
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.cert = &cert
+	kp.modTime = modTime
+	return nil
+}
+
+// latestModTime returns the newer of the cert and key modification times
+func (kp *keypairReloader) latestModTime() (time.Time, error) {
+	var out time.Time
+	for _, path := range []string{kp.certPath, kp.keyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return out, err
+		}
+		if fi.ModTime().After(out) {
+			out = fi.ModTime()
+		}
+	}
+	return out, nil
+}
+
+// watch polls the cert and key files and reloads them when they change. A
+// failed reload keeps serving the previous certificate.
+func (kp *keypairReloader) watch(quit <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			modTime, err := kp.latestModTime()
+			if err != nil {
+				slog.Warn("Failed checking TLS keypair", "error", err)
+				continue
+			}
+			kp.mu.RLock()
+			changed := !modTime.Equal(kp.modTime)
+			kp.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := kp.reload(); err != nil {
+				slog.Warn("Failed reloading TLS keypair", "error", err)
+				continue
+			}
+			slog.Info("Reloaded TLS keypair", "cert", kp.certPath)
+		}
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (kp *keypairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.cert, nil
+}
@@ -0,0 +1,138 @@
+package addrindex
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestKeypair writes a self signed cert and key for the common name
+func writeTestKeypair(t *testing.T, dir, cn string, modTime time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed generating key: %s\n", err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed creating cert: %s\n", err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed marshalling key: %s\n", err.Error())
+	}
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	os.Chtimes(certPath, modTime, modTime)
+	os.Chtimes(keyPath, modTime, modTime)
+	return certPath, keyPath
+}
+
+func TestKeypairReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addrindex-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := writeTestKeypair(t, dir, "first", time.Now().Add(-time.Minute))
+	kp, err := newKeypairReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Failed loading keypair: %s\n", err.Error())
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		kp.watch(quit, 10*time.Millisecond)
+		close(done)
+	}()
+
+	writeTestKeypair(t, dir, "second", time.Now())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		cert, _ := kp.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		if leaf.Subject.CommonName == "second" {
+			close(quit)
+			<-done
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(quit)
+	t.Fatalf("Expected keypair to be reloaded\n")
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeypair(t, dir, "server", time.Now())
+	cases := []struct {
+		name string
+		ca   string
+		auth string
+		err  bool
+		mode tls.ClientAuthType
+	}{
+		{"no client auth", "", "", false, tls.NoClientCert},
+		{"require", certPath, "", false, tls.RequireAndVerifyClientCert},
+		{"verify", certPath, TLSClientAuthVerify, false, tls.VerifyClientCertIfGiven},
+		{"auth without a CA", "", TLSClientAuthRequire, true, 0},
+		{"unknown auth", certPath, "always", true, 0},
+		{"missing CA", filepath.Join(dir, "missing.pem"), "", true, 0},
+		{"CA without certs", keyPath, "", true, 0},
+	}
+	for _, c := range cases {
+		as := &AddrServer{TLSCert: certPath, TLSKey: keyPath, TLSClientCA: c.ca, TLSClientAuth: c.auth, quit: make(chan struct{})}
+		cfg, err := as.TLSConfig()
+		close(as.quit)
+		as.workers.Wait()
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: Expected an error\n", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Expected no error, got '%v'\n", c.name, err)
+			continue
+		}
+		if cfg.ClientAuth != c.mode || cfg.GetCertificate == nil {
+			t.Errorf("%s: Expected '%s', got '%s'\n", c.name, c.mode, cfg.ClientAuth)
+		}
+	}
+}
+
+func TestHandleHTTPSRedirect(t *testing.T) {
+	as := &AddrServer{Port: 8443}
+	w := httptest.NewRecorder()
+	as.handleHTTPSRedirect(w, httptest.NewRequest("GET", "http://example.com:8080/addr/foo/utxo?x=1", nil))
+
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected '%d' status, got '%d'\n", http.StatusMovedPermanently, w.Code)
+	}
+	expected := "https://example.com:8443/addr/foo/utxo?x=1"
+	if w.Header().Get("Location") != expected {
+		t.Errorf("Expected redirect to '%s', got '%s'\n", expected, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,58 @@
+package addrindex
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	otel.SetTracerProvider(tp)
+
+	router := mux.NewRouter()
+	router.Use(tracingMiddleware)
+	router.HandleFunc("/test/{txid}", func(w http.ResponseWriter, r *http.Request) {
+		func() (err error) {
+			_, done := startRPC(r.Context(), "getrawtransaction")
+			defer done(&err)
+			return fmt.Errorf("no such transaction")
+		}()
+		w.WriteHeader(502)
+	}).Methods("GET")
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/test/abc", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected '2' spans, got '%d'\n", len(spans))
+	}
+	rpc, server := spans[0], spans[1]
+
+	if server.Name != "GET /test/{txid}" {
+		t.Errorf("Expected server span named by route template, got '%s'\n", server.Name)
+	}
+	if server.SpanContext.TraceID().String() != traceID {
+		t.Errorf("Expected incoming trace '%s' to be continued, got '%s'\n", traceID, server.SpanContext.TraceID())
+	}
+	if rpc.Name != "rpc getrawtransaction" || rpc.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("Expected rpc span to be a child of the server span\n")
+	}
+	if len(rpc.Events) == 0 {
+		t.Errorf("Expected rpc error to be recorded on the span\n")
+	}
+}
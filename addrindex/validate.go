@@ -0,0 +1,196 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gorilla/mux"
+)
+
+// Patterns for route variables. Requests with variables of the wrong shape
+// don't match a route; the validation middleware checks the rest.
+const (
+	hashPattern      = "[0-9a-fA-F]{64}"
+	heightPattern    = "[0-9]+"
+	addressPattern   = "[a-zA-Z0-9]+"
+	addressesPattern = "[a-zA-Z0-9,]+"
+)
+
+var hashRegexp = regexp.MustCompile("^" + hashPattern + "$")
+
+// ParseHash parses a txid or block hash, which must be 64 hex characters
+func ParseHash(s string) (*chainhash.Hash, error) {
+	if !hashRegexp.MatchString(s) {
+		return nil, fmt.Errorf("%q is not 64 hex characters", s)
+	}
+	return chainhash.NewHashFromStr(s)
+}
+
+// ParseHeight parses a block height, which must be non-negative
+func ParseHeight(s string) (int64, error) {
+	h, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a block height", s)
+	}
+	if h < 0 {
+		return 0, fmt.Errorf("block height %d is negative", h)
+	}
+	return h, nil
+}
+
+// checkHeight checks height isn't above the chain tip. The tip is refreshed
+// from the node when height is above the last one seen.
+func (as *AddrServer) checkHeight(ctx context.Context, height int64) error {
+	if height <= as.tipHeight.Load() {
+		return nil
+	}
+	tip, err := as.Client.GetBlockCount(ctx)
+	if err != nil {
+		return err
+	}
+	as.tipHeight.Store(tip)
+	if height > tip {
+		return InvalidInput(fmt.Errorf("block height %d is above the chain tip %d", height, tip))
+	}
+	return nil
+}
+
+// validateRequest checks the route variables and query parameters of a
+// request before any call is made to the node
+func (as *AddrServer) validateRequest(r *http.Request) error {
+	vars := mux.Vars(r)
+	if addr, ok := vars["addr"]; ok {
+		if _, err := as.DecodeAddress(addr); err != nil {
+			return InvalidInput(fmt.Errorf("invalid %s address %q: %s", as.Network, addr, err))
+		}
+	}
+	if addrs, ok := vars["addrs"]; ok {
+		if _, err := as.DecodeAddressList(addrs); err != nil {
+			return InvalidInput(fmt.Errorf("invalid %s address list: %s", as.Network, err))
+		}
+	}
+	if xpub, ok := vars["xpub"]; ok {
+		if _, err := as.parseXpub(xpub, r.URL.Query().Get("script")); err != nil {
+			return InvalidInput(err)
+		}
+	}
+	for _, name := range []string{"txid", "blockHash"} {
+		if v, ok := vars[name]; ok {
+			if _, err := ParseHash(v); err != nil {
+				return InvalidInput(err)
+			}
+		}
+	}
+	if v, ok := vars["height"]; ok {
+		h, err := ParseHeight(v)
+		if err != nil {
+			return InvalidInput(err)
+		}
+		if err := as.checkHeight(r.Context(), h); err != nil {
+			return err
+		}
+	}
+
+	query := r.URL.Query()
+	for _, name := range []string{"address", "block"} {
+		if len(query[name]) > 1 {
+			return InvalidInput(fmt.Errorf("only one %s accepted in query", name))
+		}
+	}
+	if addr := query.Get("address"); addr != "" {
+		if _, err := as.DecodeAddress(addr); err != nil {
+			return InvalidInput(fmt.Errorf("invalid %s address %q: %s", as.Network, addr, err))
+		}
+	}
+	if block := query.Get("block"); block != "" {
+		if _, err := ParseHash(block); err != nil {
+			return InvalidInput(err)
+		}
+	}
+	return nil
+}
+
+// validationMiddleware rejects requests with invalid addresses, hashes or
+// heights with a 400
+func (as *AddrServer) validationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := as.validateRequest(r); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeError(w, "invalid request", err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleNotFound answers requests that don't match any route, including ones
+// with malformed route variables
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeError(w, "no route matches the request", NotFound(fmt.Errorf("%s %s not found", r.Method, r.URL.Path)))
+}
+
+// routeTemplate returns the path template of the route matched for r with
+// variable patterns stripped, e.g. /tx/{txid}, or "" if no route matched
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return stripPatterns(tmpl)
+}
+
+// stripPatterns removes the :pattern part of every {name:pattern} in a route template
+func stripPatterns(tmpl string) string {
+	var sb strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '{' {
+			sb.WriteByte(tmpl[i])
+			continue
+		}
+		end := strings.IndexAny(tmpl[i:], ":}")
+		if end < 0 {
+			sb.WriteString(tmpl[i:])
+			break
+		}
+		sb.WriteString(tmpl[i : i+end])
+		sb.WriteByte('}')
+
+		// Skip to the brace closing the variable; patterns may contain braces
+		depth := 0
+		for i += end; i < len(tmpl); i++ {
+			if tmpl[i] == '{' {
+				depth++
+			} else if tmpl[i] == '}' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,79 @@
+package addrindex
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/gorilla/mux"
+)
+
+func TestValidateRequest(t *testing.T) {
+	as := &AddrServer{Network: NetworkMainnet, Params: &chaincfg.MainNetParams}
+	as.tipHeight.Store(500000)
+	hash := "000000000000000000166e75b4a7ee6c4dd07a2b0b5e2b3a3f4d5b8c1b4a7e6f"
+
+	cases := []struct {
+		name  string
+		url   string
+		vars  map[string]string
+		valid bool
+	}{
+		{"base58 address", "/addr/x/utxo", map[string]string{"addr": "1BoatSLRHtKNngkdXEeobR76b53LETtpyT"}, true},
+		{"taproot address", "/addr/x/utxo", map[string]string{"addr": "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0"}, true},
+		{"testnet address on mainnet", "/addr/x/utxo", map[string]string{"addr": "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"}, false},
+		{"address list", "/addrs/x/utxo", map[string]string{"addrs": "1BoatSLRHtKNngkdXEeobR76b53LETtpyT,bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"}, true},
+		{"bad address in list", "/addrs/x/utxo", map[string]string{"addrs": "1BoatSLRHtKNngkdXEeobR76b53LETtpyT,"}, false},
+		{"txid", "/tx/x", map[string]string{"txid": hash}, true},
+		{"short txid", "/tx/x", map[string]string{"txid": hash[2:]}, false},
+		{"height below tip", "/block-index/x", map[string]string{"height": "499999"}, true},
+		{"negative height", "/block-index/x", map[string]string{"height": "-1"}, false},
+		{"block query", "/txs?block=" + hash, nil, true},
+		{"bad block query", "/txs?block=abc", nil, false},
+		{"two addresses", "/txs?address=1BoatSLRHtKNngkdXEeobR76b53LETtpyT&address=1BoatSLRHtKNngkdXEeobR76b53LETtpyT", nil, false},
+		{"bad address query", "/txs?address=bc1qbad", nil, false},
+	}
+	for _, c := range cases {
+		req := mux.SetURLVars(httptest.NewRequest("GET", c.url, nil), c.vars)
+		err := as.validateRequest(req)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: Expected valid '%t', got '%v'\n", c.name, c.valid, err)
+		}
+		if err != nil && classifyError(err).Status != 400 {
+			t.Errorf("%s: Expected '400', got '%d'\n", c.name, classifyError(err).Status)
+		}
+	}
+}
+
+func TestRouteValidation(t *testing.T) {
+	as := &AddrServer{Network: NetworkMainnet, Params: &chaincfg.MainNetParams}
+	router := as.Router()
+	cases := map[string]int{
+		"/addr/1BoatSLRHtKNngkdXEeobR76b53LETtpyX/balance": 400,
+		"/addr/not-an-address/balance":                     404,
+		"/tx/abc":                                          404,
+		"/block-index/-5":                                  404,
+		"/txs?block=abc":                                   400,
+	}
+	for path, expected := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expected {
+			t.Errorf("Expected '%d' for %s, got '%d'\n", expected, path, w.Code)
+		}
+	}
+}
+
+func TestStripPatterns(t *testing.T) {
+	cases := map[string]string{
+		"/tx/{txid:[0-9a-fA-F]{64}}":         "/tx/{txid}",
+		"/addr/{addr:[a-zA-Z0-9]+}/utxo":     "/addr/{addr}/utxo",
+		"/addr/{addr}/utxo":                  "/addr/{addr}/utxo",
+		"/a/{x:[0-9]{1,2}}/b/{y:[a-z]{3}}/c": "/a/{x}/b/{y}/c",
+	}
+	for in, expected := range cases {
+		if got := stripPatterns(in); got != expected {
+			t.Errorf("Expected '%s', got '%s'\n", expected, got)
+		}
+	}
+}
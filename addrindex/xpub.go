@@ -0,0 +1,486 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrindex
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/gorilla/mux"
+)
+
+// Limits on the gap limit, the number of consecutive unused addresses after
+// which a chain is considered exhausted
+const (
+	DefaultXpubGapLimit = 20
+	MaxXpubGapLimit     = 200
+
+	// maxXpubAddresses caps the addresses derived per chain, so a wallet
+	// with endless history can't tie up the node
+	maxXpubAddresses = 10000
+
+	xpubPageSize = 10
+)
+
+// Script types addresses are derived for, in output descriptor notation
+const (
+	XpubPKH    = "pkh"
+	XpubSHWPKH = "sh-wpkh"
+	XpubWPKH   = "wpkh"
+)
+
+// xpubVersions maps the version bytes of extended public keys to the script
+// type wallets derive with them (SLIP 132) and whether they're for mainnet
+var xpubVersions = map[uint32]struct {
+	script  string
+	mainnet bool
+}{
+	0x0488b21e: {XpubPKH, true},     // xpub
+	0x049d7cb2: {XpubSHWPKH, true},  // ypub
+	0x04b24746: {XpubWPKH, true},    // zpub
+	0x043587cf: {XpubPKH, false},    // tpub
+	0x044a5262: {XpubSHWPKH, false}, // upub
+	0x045f1cf6: {XpubWPKH, false},   // vpub
+}
+
+// setXpubConfig copies the xpub settings off the config, filling in defaults
+func (as *AddrServer) setXpubConfig(cfg *AddrServerConfig) {
+	as.XpubGapLimit = cfg.XpubGapLimit
+	if as.XpubGapLimit <= 0 {
+		as.XpubGapLimit = DefaultXpubGapLimit
+	}
+	if as.XpubGapLimit > MaxXpubGapLimit {
+		as.XpubGapLimit = MaxXpubGapLimit
+	}
+}
+
+// xpubWallet is an extended public key and the script type to derive for
+type xpubWallet struct {
+	key    *hdkeychain.ExtendedKey
+	script string
+	net    *chaincfg.Params
+}
+
+// parseXpub parses an extended public key for the server's network. The
+// script type is taken from the key's version bytes unless script is set.
+func (as *AddrServer) parseXpub(s, script string) (*xpubWallet, error) {
+	key, err := hdkeychain.NewKeyFromString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended public key: %s", err)
+	}
+	if key.IsPrivate() {
+		return nil, fmt.Errorf("extended private keys aren't accepted")
+	}
+	version, ok := xpubVersions[binary.BigEndian.Uint32(key.Version())]
+	if !ok {
+		return nil, fmt.Errorf("unknown extended public key version %x", key.Version())
+	}
+	if version.mainnet != (as.Params.Net == chaincfg.MainNetParams.Net) {
+		return nil, fmt.Errorf("extended public key is not for %s", as.Network)
+	}
+	out := &xpubWallet{key: key, script: version.script, net: as.Params}
+	switch script {
+	case "":
+	case XpubPKH, XpubSHWPKH, XpubWPKH:
+		out.script = script
+	default:
+		return nil, fmt.Errorf("unknown script type %q, expected %s, %s or %s", script, XpubPKH, XpubSHWPKH, XpubWPKH)
+	}
+	return out, nil
+}
+
+// derivedAddress is an address derived from an extended public key
+type derivedAddress struct {
+	addr  btcutil.Address
+	chain uint32
+	index uint32
+}
+
+func (d derivedAddress) path() string {
+	return fmt.Sprintf("m/%d/%d", d.chain, d.index)
+}
+
+// encode returns the address of a public key for the wallet's script type
+func (w *xpubWallet) encode(pub *btcec.PublicKey) (btcutil.Address, error) {
+	keyHash := btcutil.Hash160(pub.SerializeCompressed())
+	switch w.script {
+	case XpubSHWPKH:
+		return btcutil.NewAddressScriptHash(append([]byte{0x00, 0x14}, keyHash...), w.net)
+	case XpubWPKH:
+		return btcutil.NewAddressWitnessPubKeyHash(keyHash, w.net)
+	}
+	return btcutil.NewAddressPubKeyHash(keyHash, w.net)
+}
+
+// derive returns the addresses at indexes [start, start+n) of a chain
+func (w *xpubWallet) derive(chainKey *hdkeychain.ExtendedKey, chain, start, n uint32) ([]derivedAddress, error) {
+	out := make([]derivedAddress, 0, n)
+	for i := start; i < start+n; i++ {
+		child, err := chainKey.Derive(i)
+		if err == hdkeychain.ErrInvalidChild {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pub, err := child.ECPubKey()
+		if err != nil {
+			return nil, err
+		}
+		addr, err := w.encode(pub)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, derivedAddress{addr: addr, chain: chain, index: i})
+	}
+	return out, nil
+}
+
+// XpubAddress is the activity of an address derived from an extended public key
+type XpubAddress struct {
+	Address     string `json:"address"`
+	Path        string `json:"path"`
+	Txs         int    `json:"txs"`
+	Received    int    `json:"received"`
+	Balance     int    `json:"balance"`
+	Unconfirmed int    `json:"unconfirmedBalance"`
+}
+
+// XpubAddresses models a response to the /xpub/<xpub>/addresses route
+type XpubAddresses struct {
+	Type               string        `json:"type"`
+	GapLimit           int           `json:"gapLimit"`
+	Addresses          []XpubAddress `json:"addresses"`
+	NextReceiveIndex   uint32        `json:"nextReceiveIndex"`
+	NextReceiveAddress string        `json:"nextReceiveAddress"`
+	NextChangeIndex    uint32        `json:"nextChangeIndex"`
+	NextChangeAddress  string        `json:"nextChangeAddress"`
+}
+
+// XpubBalance models a response to the /xpub/<xpub>/balance route
+type XpubBalance struct {
+	Balance     int `json:"balance"`
+	Received    int `json:"totalReceived"`
+	Sent        int `json:"totalSent"`
+	Unconfirmed int `json:"unconfirmedBalance"`
+	XpubAddresses
+}
+
+// XpubTxs models a response to the /xpub/<xpub>/txs route
+type XpubTxs struct {
+	TotalItems int              `json:"totalItems"`
+	PagesTotal int              `json:"pagesTotal"`
+	Page       int              `json:"page"`
+	Txs        []TransactionIns `json:"txs"`
+}
+
+// xpubScan is the result of scanning a wallet's receive and change chains
+type xpubScan struct {
+	XpubAddresses
+	used    []derivedAddress
+	heights map[string]int
+}
+
+func (s *xpubScan) addrs() []btcutil.Address {
+	out := make([]btcutil.Address, len(s.used))
+	for i, d := range s.used {
+		out[i] = d.addr
+	}
+	return out
+}
+
+func (s *xpubScan) paths() map[string]string {
+	out := make(map[string]string, len(s.used))
+	for _, d := range s.used {
+		out[d.addr.EncodeAddress()] = d.path()
+	}
+	return out
+}
+
+// scanXpub derives the receive (0) and change (1) chains of a wallet in
+// batches of gap addresses until gap consecutive addresses are unused
+func (as *AddrServer) scanXpub(ctx context.Context, w *xpubWallet, gap int) (*xpubScan, error) {
+	out := &xpubScan{
+		XpubAddresses: XpubAddresses{Type: w.script, GapLimit: gap, Addresses: []XpubAddress{}},
+		heights:       map[string]int{},
+	}
+	for chain := uint32(0); chain < 2; chain++ {
+		chainKey, err := w.key.Derive(chain)
+		if err != nil {
+			return nil, err
+		}
+		lastUsed := -1
+		var derived []derivedAddress
+		for start := 0; start-lastUsed-1 < gap && start < maxXpubAddresses; start += gap {
+			batch, err := w.derive(chainKey, chain, uint32(start), uint32(gap))
+			if err != nil {
+				return nil, err
+			}
+			derived = append(derived, batch...)
+			activity, err := as.addressActivity(ctx, batch, out.heights)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range batch {
+				// Activity past the gap isn't part of the wallet
+				if int(d.index)-lastUsed > gap {
+					break
+				}
+				a, ok := activity[d.addr.EncodeAddress()]
+				if !ok {
+					continue
+				}
+				a.Path = d.path()
+				out.Addresses = append(out.Addresses, *a)
+				out.used = append(out.used, d)
+				lastUsed = int(d.index)
+			}
+		}
+
+		// The next unused address is the first derived after the last used one
+		var next derivedAddress
+		for _, d := range derived {
+			if int(d.index) > lastUsed {
+				next = d
+				break
+			}
+		}
+		if next.addr == nil {
+			return nil, fmt.Errorf("no unused address within the first %d on chain %d", maxXpubAddresses, chain)
+		}
+		if chain == 0 {
+			out.NextReceiveIndex, out.NextReceiveAddress = next.index, next.addr.EncodeAddress()
+		} else {
+			out.NextChangeIndex, out.NextChangeAddress = next.index, next.addr.EncodeAddress()
+		}
+	}
+	return out, nil
+}
+
+// addressActivity returns the activity of the addresses in batch that have
+// any, confirmed or in the mempool, recording the heights of their
+// confirmed transactions in heights
+func (as *AddrServer) addressActivity(ctx context.Context, batch []derivedAddress, heights map[string]int) (map[string]*XpubAddress, error) {
+	addrs := make([]btcutil.Address, len(batch))
+	for i, d := range batch {
+		addrs[i] = d.addr
+	}
+	encoded := encodeAddresses(addrs)
+
+	deltas, err := as.GetAddressDeltas(ctx, encoded, 0, 0)
+	if err != nil {
+		return nil, addressIndexError(addrs, err)
+	}
+	mempool, err := as.GetAddressMempool(ctx, encoded)
+	if err != nil {
+		return nil, addressIndexError(addrs, err)
+	}
+
+	out := map[string]*XpubAddress{}
+	seen := map[string]map[string]bool{}
+	get := func(addr, txid string) *XpubAddress {
+		a, ok := out[addr]
+		if !ok {
+			a = &XpubAddress{Address: addr}
+			out[addr] = a
+			seen[addr] = map[string]bool{}
+		}
+		if !seen[addr][txid] {
+			seen[addr][txid] = true
+			a.Txs++
+		}
+		return a
+	}
+	for _, d := range deltas.Result {
+		a := get(d.Address, d.Txid)
+		a.Balance += d.Satoshis
+		if d.Satoshis > 0 {
+			a.Received += d.Satoshis
+		}
+		heights[d.Txid] = d.Height
+	}
+	for _, m := range mempool.Result {
+		get(m.Address, m.Txid).Unconfirmed += m.Satoshis
+	}
+	return out, nil
+}
+
+// chunkAddresses splits addrs into chunks the node is asked about at once
+func chunkAddresses(addrs []btcutil.Address) [][]btcutil.Address {
+	var out [][]btcutil.Address
+	for len(addrs) > MaxAddressesPerRequest {
+		out = append(out, addrs[:MaxAddressesPerRequest])
+		addrs = addrs[MaxAddressesPerRequest:]
+	}
+	if len(addrs) > 0 {
+		out = append(out, addrs)
+	}
+	return out
+}
+
+// xpubRequest parses the xpub, script type and gap limit of a request and
+// scans the wallet
+func (as *AddrServer) xpubRequest(r *http.Request) (*xpubScan, error) {
+	query := r.URL.Query()
+	w, err := as.parseXpub(mux.Vars(r)["xpub"], query.Get("script"))
+	if err != nil {
+		return nil, InvalidInput(err)
+	}
+	gap := as.XpubGapLimit
+	if g := query.Get("gap"); g != "" {
+		gap, err = strconv.Atoi(g)
+		if err != nil || gap < 1 || gap > MaxXpubGapLimit {
+			return nil, InvalidInput(fmt.Errorf("gap must be between 1 and %d", MaxXpubGapLimit))
+		}
+	}
+	return as.scanXpub(r.Context(), w, gap)
+}
+
+// HandleXpubAddresses handles the /xpub/<xpub>/addresses route
+func (as *AddrServer) HandleXpubAddresses(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	scan, err := as.xpubRequest(r)
+	if err != nil {
+		writeError(w, "error scanning extended public key", err)
+		return
+	}
+	out, _ := json.Marshal(scan.XpubAddresses)
+	w.Write(out)
+}
+
+// HandleXpubBalance handles the /xpub/<xpub>/balance route
+func (as *AddrServer) HandleXpubBalance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	scan, err := as.xpubRequest(r)
+	if err != nil {
+		writeError(w, "error scanning extended public key", err)
+		return
+	}
+
+	out := XpubBalance{XpubAddresses: scan.XpubAddresses}
+	for _, chunk := range chunkAddresses(scan.addrs()) {
+		balance, err := as.GetAddressBalance(r.Context(), encodeAddresses(chunk))
+		if err != nil {
+			writeError(w, "error fetching balance for extended public key", addressIndexError(chunk, err))
+			return
+		}
+		out.Balance += balance.Result.Balance
+		out.Received += balance.Result.Received
+	}
+	out.Sent = out.Received - out.Balance
+	for _, a := range scan.Addresses {
+		out.Unconfirmed += a.Unconfirmed
+	}
+	o, _ := json.Marshal(out)
+	w.Write(o)
+}
+
+// HandleXpubUTXO handles the /xpub/<xpub>/utxo route
+func (as *AddrServer) HandleXpubUTXO(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	scan, err := as.xpubRequest(r)
+	if err != nil {
+		writeError(w, "error scanning extended public key", err)
+		return
+	}
+
+	paths := scan.paths()
+	out := UTXOInsOuts{}
+	for _, chunk := range chunkAddresses(scan.addrs()) {
+		utxos, err := as.addressUTXOs(r.Context(), chunk)
+		if err != nil {
+			writeError(w, "error fetching utxos for extended public key", err)
+			return
+		}
+		for _, u := range utxos {
+			u.Path = paths[u.Address]
+			out = append(out, u)
+		}
+	}
+	sort.Stable(out)
+	o, _ := json.Marshal(out)
+	w.Write(o)
+}
+
+// HandleXpubTxs handles the /xpub/<xpub>/txs route. Confirmed transactions
+// are returned oldest first, xpubPageSize to a page.
+func (as *AddrServer) HandleXpubTxs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	page, err := parsePage(r.URL.Query().Get("page"))
+	if err != nil {
+		writeError(w, "failed parsing ?page={val}", InvalidInput(err))
+		return
+	}
+
+	scan, err := as.xpubRequest(r)
+	if err != nil {
+		writeError(w, "error scanning extended public key", err)
+		return
+	}
+
+	seen := map[string]bool{}
+	var txids []string
+	for _, chunk := range chunkAddresses(scan.addrs()) {
+		res, err := as.GetAddressTxIDs(r.Context(), encodeAddresses(chunk), 0, 0)
+		if err != nil {
+			writeError(w, "error fetching transactions for extended public key", addressIndexError(chunk, err))
+			return
+		}
+		for _, txid := range res.Result {
+			if !seen[txid] {
+				seen[txid] = true
+				txids = append(txids, txid)
+			}
+		}
+	}
+	sort.SliceStable(txids, func(i, j int) bool {
+		return scan.heights[txids[i]] < scan.heights[txids[j]]
+	})
+
+	out := XpubTxs{
+		TotalItems: len(txids),
+		PagesTotal: (len(txids) + xpubPageSize - 1) / xpubPageSize,
+		Page:       page,
+		Txs:        []TransactionIns{},
+	}
+	// The page is checked before multiplying so huge pages can't overflow
+	start := len(txids)
+	if page <= len(txids)/xpubPageSize {
+		start = page * xpubPageSize
+	}
+	end := start + xpubPageSize
+	if end > len(txids) {
+		end = len(txids)
+	}
+	txs, errs := as.GetRawTransactions(r.Context(), txids[start:end])
+	if err := firstError(errs); err != nil {
+		writeError(w, "error fetching transaction", err)
+		return
+	}
+	for _, tx := range txs {
+		out.Txs = append(out.Txs, *tx)
+	}
+	o, _ := json.Marshal(out)
+	w.Write(o)
+}
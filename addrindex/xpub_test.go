@@ -0,0 +1,146 @@
+package addrindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/gorilla/mux"
+)
+
+// BIP 84 test vector, account m/84'/0'/0'
+const testZpub = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+
+func TestParseXpub(t *testing.T) {
+	as := &AddrServer{Network: NetworkMainnet, Params: &chaincfg.MainNetParams}
+	w, err := as.parseXpub(testZpub, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.script != XpubWPKH {
+		t.Errorf("Expected '%s', got '%s'\n", XpubWPKH, w.script)
+	}
+	for chain, expected := range []string{"bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu", "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"} {
+		chainKey, _ := w.key.Derive(uint32(chain))
+		addrs, err := w.derive(chainKey, uint32(chain), 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := addrs[0].addr.EncodeAddress(); got != expected {
+			t.Errorf("Expected '%s' at m/%d/0, got '%s'\n", expected, chain, got)
+		}
+	}
+
+	w, _ = as.parseXpub(testZpub, XpubPKH)
+	if w.script != XpubPKH {
+		t.Errorf("Expected script override '%s', got '%s'\n", XpubPKH, w.script)
+	}
+	if _, err := as.parseXpub(testZpub, "tr"); err == nil {
+		t.Errorf("Expected unknown script type to fail\n")
+	}
+	if _, err := as.parseXpub(testZpub[:len(testZpub)-1]+"t", ""); err == nil {
+		t.Errorf("Expected bad checksum to fail\n")
+	}
+	testnet := &AddrServer{Network: NetworkTestnet3, Params: &chaincfg.TestNet3Params}
+	if _, err := testnet.parseXpub(testZpub, ""); err == nil {
+		t.Errorf("Expected mainnet key to fail on testnet\n")
+	}
+}
+
+// fakeAddressIndex serves a fakeNode answering address index calls as if
+// used had the given number of transactions of 1000 satoshis each
+func fakeAddressIndex(t *testing.T, used map[string]int) *AddrServer {
+	node := &fakeNode{answer: func(req fakeRequest) (interface{}, *btcjson.RPCError) {
+		var params struct {
+			Addresses []string `json:"addresses"`
+		}
+		req.param(0, &params)
+		switch req.Method {
+		case "getaddressdeltas":
+			deltas := []AddressDelta{}
+			for _, addr := range params.Addresses {
+				for i := 0; i < used[addr]; i++ {
+					deltas = append(deltas, AddressDelta{Address: addr, Txid: fmt.Sprintf("%s-%d", addr, i), Satoshis: 1000, Height: 100 + i})
+				}
+			}
+			return deltas, nil
+		case "getaddressbalance":
+			total := 0
+			for _, addr := range params.Addresses {
+				total += used[addr] * 1000
+			}
+			return AddressBalance{Balance: total, Received: total}, nil
+		case "getaddressmempool":
+			return []AddrMempoolTransaction{}, nil
+		}
+		return nil, nil
+	}}
+	as := node.start(t)
+	as.Network = NetworkMainnet
+	as.Params = &chaincfg.MainNetParams
+	as.setXpubConfig(&AddrServerConfig{XpubGapLimit: 5})
+	return as
+}
+
+func TestXpubGapLimit(t *testing.T) {
+	as := fakeAddressIndex(t, nil)
+	w, _ := as.parseXpub(testZpub, "")
+	receive, _ := w.key.Derive(0)
+	change, _ := w.key.Derive(1)
+	r, _ := w.derive(receive, 0, 0, 20)
+	c, _ := w.derive(change, 1, 0, 20)
+
+	// Index 6 is within the gap of index 3, index 13 isn't within the gap of 6
+	as = fakeAddressIndex(t, map[string]int{
+		r[0].addr.EncodeAddress():  2,
+		r[3].addr.EncodeAddress():  1,
+		r[6].addr.EncodeAddress():  1,
+		r[13].addr.EncodeAddress(): 1,
+		c[0].addr.EncodeAddress():  1,
+	})
+	req := httptest.NewRequest("GET", "/xpub/"+testZpub+"/balance", nil)
+	w2 := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/xpub/{xpub}/balance", as.HandleXpubBalance)
+	router.ServeHTTP(w2, req)
+	if w2.Code != 200 {
+		t.Fatalf("Expected '200', got '%d' %s\n", w2.Code, w2.Body.String())
+	}
+
+	var out XpubBalance
+	json.Unmarshal(w2.Body.Bytes(), &out)
+	if len(out.Addresses) != 4 {
+		t.Errorf("Expected '4' used addresses, got '%d'\n", len(out.Addresses))
+	}
+	if out.NextReceiveIndex != 7 || out.NextReceiveAddress != r[7].addr.EncodeAddress() {
+		t.Errorf("Expected next receive index '7', got '%d'\n", out.NextReceiveIndex)
+	}
+	if out.NextChangeIndex != 1 {
+		t.Errorf("Expected next change index '1', got '%d'\n", out.NextChangeIndex)
+	}
+	if out.Balance != 5000 || out.Received != 5000 || out.Sent != 0 {
+		t.Errorf("Expected balance '5000', got '%d'\n", out.Balance)
+	}
+	if out.Addresses[0].Path != "m/0/0" || out.Addresses[0].Txs != 2 {
+		t.Errorf("Expected 'm/0/0' with '2' txs, got '%s' with '%d'\n", out.Addresses[0].Path, out.Addresses[0].Txs)
+	}
+
+	req = httptest.NewRequest("GET", "/xpub/"+testZpub+"/balance?gap=0", nil)
+	w2 = httptest.NewRecorder()
+	router.ServeHTTP(w2, req)
+	if w2.Code != 400 {
+		t.Errorf("Expected '400' for gap 0, got '%d'\n", w2.Code)
+	}
+
+	router.HandleFunc("/xpub/{xpub}/txs", as.HandleXpubTxs)
+	for page, expected := range map[string]int{"-1": 400, "9223372036854775807": 200} {
+		w2 = httptest.NewRecorder()
+		router.ServeHTTP(w2, httptest.NewRequest("GET", "/xpub/"+testZpub+"/txs?page="+page, nil))
+		if w2.Code != expected {
+			t.Errorf("Expected '%d' for page %s, got '%d' %s\n", expected, page, w2.Code, w2.Body)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package apikey
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuthenticator(t *testing.T, keys ...Key) *Authenticator {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := Save(path, keys); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func status(err error) int {
+	if err == nil {
+		return 200
+	}
+	return err.(*Error).Status
+}
+
+func TestAuthorizeScopes(t *testing.T) {
+	readSecret, read, _ := Generate("reader", []string{ScopeRead})
+	bothSecret, both, _ := Generate("wallet", []string{ScopeRead, ScopeBroadcast})
+	revokedSecret, revoked, _ := Generate("old", []string{ScopeRead})
+	now := time.Now()
+	revoked.Revoked = &now
+	a := newTestAuthenticator(t, read, both, revoked)
+
+	cases := []struct {
+		secret, scope string
+		expected      int
+	}{
+		{"", ScopeRead, 401},
+		{"aik_notakey", ScopeRead, 401},
+		{revokedSecret, ScopeRead, 401},
+		{readSecret, ScopeRead, 200},
+		{readSecret, ScopeBroadcast, 403},
+		{bothSecret, ScopeBroadcast, 200},
+	}
+	for _, c := range cases {
+		if _, err := a.Authorize(c.secret, c.scope); status(err) != c.expected {
+			t.Errorf("Expected '%d' for %q with scope %s, got '%d'\n", c.expected, c.secret, c.scope, status(err))
+		}
+	}
+}
+
+func TestAuthorizeLimits(t *testing.T) {
+	secret, key, _ := Generate("limited", []string{ScopeRead})
+	key.RateLimit = 1
+	key.Burst = 2
+	key.DailyQuota = 3
+	a := newTestAuthenticator(t, key)
+	now := time.Date(2018, 6, 1, 23, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	// The burst is used up, then the limiter refuses until a token refills
+	for i, expected := range []int{200, 200, 429} {
+		if _, err := a.Authorize(secret, ScopeRead); status(err) != expected {
+			t.Errorf("Expected '%d' for request %d, got '%d'\n", expected, i, status(err))
+		}
+	}
+	now = now.Add(time.Second)
+	if _, err := a.Authorize(secret, ScopeRead); err != nil {
+		t.Errorf("Expected request after refill to be allowed, got '%s'\n", err)
+	}
+
+	// The quota is used up until midnight UTC
+	now = now.Add(time.Second)
+	_, err := a.Authorize(secret, ScopeRead)
+	if status(err) != 429 || err.(*Error).RetryAfter != time.Hour-2*time.Second {
+		t.Errorf("Expected quota to be exceeded until midnight, got '%v'\n", err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := a.Authorize(secret, ScopeRead); err != nil {
+		t.Errorf("Expected quota to reset on a new day, got '%s'\n", err)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := LoadUsage(a.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := usage[key.ID]; u.Total != 4 || u.DayCount != 1 || u.Day != "2018-06-02" {
+		t.Errorf("Expected '4' total and '1' request on 2018-06-02, got '%d' and '%d' on %s\n", u.Total, u.DayCount, u.Day)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	secret, key, _ := Generate("reader", []string{ScopeRead})
+	a := newTestAuthenticator(t, key)
+	handler := a.Middleware(func(r *http.Request) string {
+		if r.URL.Path == "/healthz" {
+			return ""
+		}
+		return ScopeRead
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	header := httptest.NewRequest("GET", "/txs", nil)
+	header.Header.Set(Header, secret)
+	cases := []struct {
+		req      *http.Request
+		expected int
+	}{
+		{httptest.NewRequest("GET", "/healthz", nil), 200},
+		{httptest.NewRequest("GET", "/txs", nil), 401},
+		{header, 200},
+		{httptest.NewRequest("GET", "/txs?apikey="+secret, nil), 200},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, c.req)
+		if w.Code != c.expected {
+			t.Errorf("Expected '%d' for %s, got '%d'\n", c.expected, c.req.URL, w.Code)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	secret, key, err := Generate("reader", []string{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key.ID) != 8 || strings.Contains(secret, key.ID) {
+		t.Errorf("Expected an 8 character ID apart from the secret, got '%s' for '%s'\n", key.ID, secret)
+	}
+	if key.Hash != Hash(secret) {
+		t.Errorf("Expected '%s', got '%s'\n", Hash(secret), key.Hash)
+	}
+}
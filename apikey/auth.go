@@ -0,0 +1,271 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apikey
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// Header and query parameter clients pass their key in
+const (
+	Header     = "X-API-Key"
+	QueryParam = "apikey"
+)
+
+var requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "addrindex",
+	Subsystem: "apikey",
+	Name:      "requests_total",
+	Help:      "Requests checked against API keys by key ID and result.",
+}, []string{"key", "result"})
+
+func init() {
+	prometheus.MustRegister(requests)
+}
+
+// Machine readable codes for refused requests
+const (
+	CodeUnauthorized  = "unauthorized"
+	CodeForbidden     = "forbidden"
+	CodeRateLimited   = "rate_limited"
+	CodeQuotaExceeded = "quota_exceeded"
+)
+
+// Error is returned when a request is refused
+type Error struct {
+	Status     int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type entry struct {
+	Key
+	limiter *rate.Limiter
+}
+
+// Authenticator checks requests against the keys in a key file, enforcing
+// scopes, rate limits and daily quotas and counting usage
+type Authenticator struct {
+	path    string
+	modTime time.Time
+	keys    map[string]*entry
+	usage   map[string]Usage
+	dirty   bool
+	now     func() time.Time
+	mu      sync.Mutex
+}
+
+// NewAuthenticator loads the keys and usage counters for the key file at path
+func NewAuthenticator(path string) (*Authenticator, error) {
+	usage, err := LoadUsage(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{path: path, usage: usage, now: time.Now}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload reads the key file, keeping the rate limiter state of keys whose
+// limits haven't changed
+func (a *Authenticator) reload() error {
+	var modTime time.Time
+	if fi, err := os.Stat(a.path); err == nil {
+		modTime = fi.ModTime()
+	}
+	keys, err := Load(a.path)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[string]*entry, len(keys))
+	for _, k := range keys {
+		e := &entry{Key: k}
+		if old, ok := a.keys[k.Hash]; ok && old.RateLimit == k.RateLimit && old.Burst == k.Burst {
+			e.limiter = old.limiter
+		} else if k.RateLimit > 0 {
+			burst := k.Burst
+			if burst < 1 {
+				burst = int(math.Ceil(k.RateLimit))
+			}
+			e.limiter = rate.NewLimiter(rate.Limit(k.RateLimit), burst)
+		}
+		out[k.Hash] = e
+	}
+	a.keys = out
+	a.modTime = modTime
+	return nil
+}
+
+// Authorize checks that secret is an active key granted scope and within its
+// limits, and counts the request against it
+func (a *Authenticator) Authorize(secret, scope string) (Key, error) {
+	if secret == "" {
+		requests.WithLabelValues("", "missing").Inc()
+		return Key{}, &Error{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "API key required"}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.keys[Hash(secret)]
+	if !ok || !e.Active() {
+		requests.WithLabelValues("", "invalid").Inc()
+		return Key{}, &Error{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "invalid API key"}
+	}
+	if !e.HasScope(scope) {
+		requests.WithLabelValues(e.ID, "forbidden").Inc()
+		return e.Key, &Error{Status: http.StatusForbidden, Code: CodeForbidden, Message: fmt.Sprintf("API key lacks the %q scope", scope)}
+	}
+
+	now := a.now().UTC()
+	day := now.Format("2006-01-02")
+	u := a.usage[e.ID]
+	if u.Day != day {
+		u.Day, u.DayCount = day, 0
+	}
+	if e.DailyQuota > 0 && u.DayCount >= e.DailyQuota {
+		requests.WithLabelValues(e.ID, "quota").Inc()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return e.Key, &Error{Status: http.StatusTooManyRequests, Code: CodeQuotaExceeded, Message: "daily quota exceeded", RetryAfter: midnight.Sub(now)}
+	}
+	if e.limiter != nil {
+		r := e.limiter.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+			r.CancelAt(now)
+			requests.WithLabelValues(e.ID, "rate_limited").Inc()
+			return e.Key, &Error{Status: http.StatusTooManyRequests, Code: CodeRateLimited, Message: "rate limit exceeded", RetryAfter: delay}
+		}
+	}
+
+	u.Total++
+	u.DayCount++
+	u.LastUsed = now
+	a.usage[e.ID] = u
+	a.dirty = true
+	requests.WithLabelValues(e.ID, "ok").Inc()
+	return e.Key, nil
+}
+
+// Flush writes the usage counters to disk if they've changed
+func (a *Authenticator) Flush() error {
+	a.mu.Lock()
+	if !a.dirty {
+		a.mu.Unlock()
+		return nil
+	}
+	usage := make(map[string]Usage, len(a.usage))
+	for id, u := range a.usage {
+		usage[id] = u
+	}
+	a.dirty = false
+	a.mu.Unlock()
+	return SaveUsage(a.path, usage)
+}
+
+// Watch polls the key file for changes, so keys created or revoked with the
+// admin commands take effect without a restart, and periodically flushes the
+// usage counters. Counters are flushed one last time when quit is closed.
+func (a *Authenticator) Watch(quit <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			if err := a.Flush(); err != nil {
+				slog.Warn("Failed saving API key usage", "error", err)
+			}
+			return
+		case <-ticker.C:
+			if err := a.Flush(); err != nil {
+				slog.Warn("Failed saving API key usage", "error", err)
+			}
+			fi, err := os.Stat(a.path)
+			if err != nil {
+				slog.Warn("Failed checking API key file", "error", err)
+				continue
+			}
+			a.mu.Lock()
+			changed := !fi.ModTime().Equal(a.modTime)
+			a.mu.Unlock()
+			if !changed {
+				continue
+			}
+			if err := a.reload(); err != nil {
+				slog.Warn("Failed reloading API key file", "error", err)
+				continue
+			}
+			slog.Info("Reloaded API keys", "file", a.path)
+		}
+	}
+}
+
+// Middleware returns middleware that requires requests to carry a key,
+// either in the X-API-Key header or the apikey query parameter, granted the
+// scope scopeFor returns for the request. Requests for which scopeFor
+// returns "" are let through without a key.
+func (a *Authenticator) Middleware(scopeFor func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scope := scopeFor(r)
+			if scope == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			secret := r.Header.Get(Header)
+			if secret == "" {
+				secret = r.URL.Query().Get(QueryParam)
+			}
+			if _, err := a.Authorize(secret, scope); err != nil {
+				writeError(w, err.(*Error))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeError(w http.ResponseWriter, e *Error) {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	out, _ := json.Marshal(map[string]string{
+		"message": "request refused",
+		"error":   e.Message,
+		"code":    e.Code,
+	})
+	w.Write(out)
+}
@@ -0,0 +1,187 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Scopes a key can be granted
+const (
+	ScopeRead      = "read"
+	ScopeBroadcast = "broadcast"
+)
+
+// keyPrefix marks a string as an addrindex API key
+const keyPrefix = "aik_"
+
+// Key is an API key as stored in the key file. Only a hash of the secret is
+// kept; the secret itself is shown once when the key is created.
+type Key struct {
+	ID         string     `json:"id"`
+	Hash       string     `json:"hash"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	RateLimit  float64    `json:"rateLimit,omitempty"`
+	Burst      int        `json:"burst,omitempty"`
+	DailyQuota int64      `json:"dailyQuota,omitempty"`
+	Created    time.Time  `json:"created"`
+	Revoked    *time.Time `json:"revoked,omitempty"`
+}
+
+// HasScope returns true if the key was granted scope
+func (k Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Active returns true if the key hasn't been revoked
+func (k Key) Active() bool {
+	return k.Revoked == nil
+}
+
+// Usage holds the request counters for a key
+type Usage struct {
+	Total    int64     `json:"total"`
+	Day      string    `json:"day"`
+	DayCount int64     `json:"dayCount"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// ValidScope returns an error for scopes other than read and broadcast
+func ValidScope(scope string) error {
+	switch scope {
+	case ScopeRead, ScopeBroadcast:
+		return nil
+	}
+	return fmt.Errorf("unknown scope %q, expected %q or %q", scope, ScopeRead, ScopeBroadcast)
+}
+
+// Hash returns the hex encoded sha256 of a key secret
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate creates a new key, returning the secret to hand to the client
+// alongside the Key to store
+func Generate(name string, scopes []string) (string, Key, error) {
+	// The ID is shown in listings, logs and metrics, so it's drawn apart
+	// from the secret
+	b := make([]byte, 28)
+	if _, err := rand.Read(b); err != nil {
+		return "", Key{}, err
+	}
+	secret := keyPrefix + hex.EncodeToString(b[:24])
+	for _, s := range scopes {
+		if err := ValidScope(s); err != nil {
+			return "", Key{}, err
+		}
+	}
+	return secret, Key{
+		ID:      hex.EncodeToString(b[24:]),
+		Hash:    Hash(secret),
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+	}, nil
+}
+
+// UsagePath returns the path usage counters for the key file at path are
+// kept in. The server is the only writer of the usage file and the admin
+// commands the only writers of the key file.
+func UsagePath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".usage.json"
+}
+
+// Load reads the keys from the file at path. A missing file holds no keys.
+func Load(path string) ([]Key, error) {
+	var out []Key
+	if err := readJSON(path, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Save writes keys to the file at path
+func Save(path string, keys []Key) error {
+	return writeJSON(path, keys)
+}
+
+// LoadUsage reads the usage counters, keyed by key ID, for the key file at path
+func LoadUsage(path string) (map[string]Usage, error) {
+	out := map[string]Usage{}
+	if err := readJSON(UsagePath(path), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SaveUsage writes the usage counters for the key file at path
+func SaveUsage(path string, usage map[string]Usage) error {
+	return writeJSON(UsagePath(path), usage)
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("parsing %s: %s", path, err)
+	}
+	return nil
+}
+
+// writeJSON replaces the file at path atomically so readers never see a
+// partial write
+func writeJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,330 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// Magic starts the OP_RETURN data of every Blockstack operation
+var Magic = []byte("id")
+
+// Names of the virtualchain operations
+const (
+	NamePreorder      = "NAME_PREORDER"
+	NameRegistration  = "NAME_REGISTRATION"
+	NameRenewal       = "NAME_RENEWAL"
+	NameUpdate        = "NAME_UPDATE"
+	NameTransfer      = "NAME_TRANSFER"
+	NameRevoke        = "NAME_REVOKE"
+	NameImport        = "NAME_IMPORT"
+	NamespacePreorder = "NAMESPACE_PREORDER"
+	NamespaceReveal   = "NAMESPACE_REVEAL"
+	NamespaceReady    = "NAMESPACE_READY"
+	Announce          = "ANNOUNCE"
+	TokenTransfer     = "TOKEN_TRANSFER"
+)
+
+// opcodes maps the byte after the magic to the operation. Renewals share
+// the registration opcode.
+var opcodes = map[byte]string{
+	'?': NamePreorder,
+	':': NameRegistration,
+	'+': NameUpdate,
+	'>': NameTransfer,
+	'~': NameRevoke,
+	';': NameImport,
+	'*': NamespacePreorder,
+	'&': NamespaceReveal,
+	'!': NamespaceReady,
+	'#': Announce,
+	'$': TokenTransfer,
+}
+
+// Field sizes of the wire format
+const (
+	hashLen          = 20
+	consensusHashLen = 16
+	nameLen          = 37
+	namespaceIDLen   = 19
+	tokenTypeLen     = 19
+	tokenAmountLen   = 8
+	scratchLen       = 34
+)
+
+var (
+	// ErrNotBlockstack is returned for transactions whose first output isn't
+	// an OP_RETURN with the Blockstack magic
+	ErrNotBlockstack = errors.New("not a Blockstack operation")
+
+	// ErrMalformed is returned for Blockstack operations that don't match
+	// the wire format of their opcode
+	ErrMalformed = errors.New("malformed Blockstack operation")
+)
+
+// Op is a decoded Blockstack operation. Only the fields of its opcode are
+// set.
+type Op struct {
+	Opcode string `json:"opcode"`
+
+	// Name is the fully qualified name of registrations, renewals, revokes
+	// and imports
+	Name        string `json:"name,omitempty"`
+	NamespaceID string `json:"namespaceId,omitempty"`
+	// PreorderHash commits to the name or namespace being preordered, the
+	// script paying for it and its recipient
+	PreorderHash  string `json:"preorderHash,omitempty"`
+	ConsensusHash string `json:"consensusHash,omitempty"`
+	// NameConsensusHash is the hash of the name and a consensus hash in
+	// updates
+	NameConsensusHash string `json:"nameConsensusHash,omitempty"`
+	// NameHash is the hash of the name in transfers
+	NameHash string `json:"nameHash,omitempty"`
+	// ValueHash is the hash of the zone file
+	ValueHash   string `json:"valueHash,omitempty"`
+	KeepData    *bool  `json:"keepData,omitempty"`
+	MessageHash string `json:"messageHash,omitempty"`
+
+	TokenType   string `json:"tokenType,omitempty"`
+	TokenAmount uint64 `json:"tokenAmount,omitempty"`
+	// TokenFee is the amount of tokens burned by preorders paid in tokens
+	TokenFee    uint64 `json:"tokenFee,omitempty"`
+	ScratchArea string `json:"scratchArea,omitempty"`
+
+	Namespace *NamespaceRules `json:"namespace,omitempty"`
+
+	// Recipient is the address receiving the name, namespace or tokens
+	Recipient string `json:"recipient,omitempty"`
+	// BurnAddress is paid the fee of preorders and renewals
+	BurnAddress string `json:"burnAddress,omitempty"`
+	BurnAmount  int64  `json:"burnAmount,omitempty"`
+}
+
+// TxOp is an operation and the transaction carrying it. The sender is the
+// address spent by the first input.
+type TxOp struct {
+	Txid        string `json:"txid"`
+	BlockHeight int    `json:"blockHeight,omitempty"`
+	// Vtxindex is the position of the transaction in its block, when known
+	Vtxindex *int   `json:"vtxindex,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	*Op
+}
+
+// NamespaceRules are the lifetime and price function a namespace is
+// revealed with
+type NamespaceRules struct {
+	Lifetime         uint32 `json:"lifetime"`
+	Coeff            uint8  `json:"coeff"`
+	Base             uint8  `json:"base"`
+	Buckets          []int  `json:"buckets"`
+	NonalphaDiscount int    `json:"nonalphaDiscount"`
+	NoVowelDiscount  int    `json:"noVowelDiscount"`
+	Version          uint16 `json:"version"`
+}
+
+// Payload returns the data of the OP_RETURN script that carries a
+// Blockstack operation, magic included, or nil
+func Payload(script []byte) []byte {
+	if len(script) < 2 || script[0] != txscript.OP_RETURN {
+		return nil
+	}
+	pushes, err := txscript.PushedData(script[1:])
+	if err != nil || len(pushes) != 1 || !bytes.HasPrefix(pushes[0], Magic) || len(pushes[0]) <= len(Magic) {
+		return nil
+	}
+	return pushes[0]
+}
+
+// Decode decodes the Blockstack operation of tx, which is carried by its
+// first output. The recipient and burn outputs follow it at positions set
+// by the opcode. A registration paying a burn output is a renewal.
+func Decode(tx *wire.MsgTx, params *chaincfg.Params) (*Op, error) {
+	if len(tx.TxOut) == 0 {
+		return nil, ErrNotBlockstack
+	}
+	data := Payload(tx.TxOut[0].PkScript)
+	if data == nil {
+		return nil, ErrNotBlockstack
+	}
+	op, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, burn := -1, -1
+	switch op.Opcode {
+	case NamePreorder, NamespacePreorder:
+		burn = 2
+	case NameRegistration:
+		recipient = 1
+		if len(tx.TxOut) > 3 {
+			op.Opcode = NameRenewal
+			burn = 3
+		}
+	case NameImport, NameTransfer, NamespaceReveal, TokenTransfer:
+		recipient = 1
+	}
+	if recipient > 0 && recipient < len(tx.TxOut) {
+		op.Recipient = outputAddress(tx.TxOut[recipient].PkScript, params)
+	}
+	if burn > 0 && burn < len(tx.TxOut) {
+		op.BurnAddress = outputAddress(tx.TxOut[burn].PkScript, params)
+		op.BurnAmount = tx.TxOut[burn].Value
+	}
+	return op, nil
+}
+
+// outputAddress returns the address an output script pays to, or ""
+func outputAddress(script []byte, params *chaincfg.Params) string {
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(script, params)
+	if err != nil || len(addrs) != 1 {
+		return ""
+	}
+	if pk, ok := addrs[0].(*btcutil.AddressPubKey); ok {
+		return pk.AddressPubKeyHash().EncodeAddress()
+	}
+	return addrs[0].EncodeAddress()
+}
+
+// Parse decodes the OP_RETURN data of a Blockstack operation, magic
+// included
+func Parse(data []byte) (*Op, error) {
+	if !bytes.HasPrefix(data, Magic) || len(data) <= len(Magic) {
+		return nil, ErrNotBlockstack
+	}
+	code := data[len(Magic)]
+	opcode, ok := opcodes[code]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown opcode %q", ErrMalformed, code)
+	}
+	p := data[len(Magic)+1:]
+	op := &Op{Opcode: opcode}
+	malformed := fmt.Errorf("%w: %d bytes of %s data", ErrMalformed, len(p), opcode)
+
+	switch opcode {
+	case NamePreorder, NamespacePreorder:
+		// hash(20) consensus hash(16) [token fee(8)]
+		if len(p) != hashLen+consensusHashLen && len(p) != hashLen+consensusHashLen+tokenAmountLen {
+			return nil, malformed
+		}
+		op.PreorderHash = hex.EncodeToString(p[:hashLen])
+		op.ConsensusHash = hex.EncodeToString(p[hashLen : hashLen+consensusHashLen])
+		if len(p) > hashLen+consensusHashLen {
+			op.TokenFee = binary.BigEndian.Uint64(p[hashLen+consensusHashLen:])
+		}
+
+	case NameRegistration:
+		// name, or name zero padded to 37 bytes and value hash(20)
+		switch {
+		case len(p) == nameLen+hashLen:
+			op.Name = trimName(p[:nameLen])
+			op.ValueHash = hex.EncodeToString(p[nameLen:])
+		case len(p) <= nameLen:
+			op.Name = trimName(p)
+		default:
+			return nil, malformed
+		}
+		if op.Name == "" {
+			return nil, malformed
+		}
+
+	case NameRevoke, NameImport:
+		if len(p) > nameLen {
+			return nil, malformed
+		}
+		if op.Name = trimName(p); op.Name == "" {
+			return nil, malformed
+		}
+
+	case NameUpdate:
+		// hash(name, consensus hash)(16) value hash(20)
+		if len(p) != consensusHashLen+hashLen {
+			return nil, malformed
+		}
+		op.NameConsensusHash = hex.EncodeToString(p[:consensusHashLen])
+		op.ValueHash = hex.EncodeToString(p[consensusHashLen:])
+
+	case NameTransfer:
+		// keep data(1) name hash(16) consensus hash(16)
+		if len(p) != 1+2*consensusHashLen || (p[0] != '>' && p[0] != '~') {
+			return nil, malformed
+		}
+		keep := p[0] == '>'
+		op.KeepData = &keep
+		op.NameHash = hex.EncodeToString(p[1 : 1+consensusHashLen])
+		op.ConsensusHash = hex.EncodeToString(p[1+consensusHashLen:])
+
+	case NamespaceReveal:
+		// lifetime(4) coeff(1) base(1) buckets(8) discounts(1) version(2)
+		// namespace ID(1-19)
+		const fixed = 17
+		if len(p) <= fixed || len(p) > fixed+namespaceIDLen {
+			return nil, malformed
+		}
+		rules := &NamespaceRules{
+			Lifetime:         binary.BigEndian.Uint32(p[0:4]),
+			Coeff:            p[4],
+			Base:             p[5],
+			NonalphaDiscount: int(p[14] >> 4),
+			NoVowelDiscount:  int(p[14] & 0x0f),
+			Version:          binary.BigEndian.Uint16(p[15:17]),
+		}
+		for _, b := range p[6:14] {
+			rules.Buckets = append(rules.Buckets, int(b>>4), int(b&0x0f))
+		}
+		op.Namespace = rules
+		op.NamespaceID = string(p[fixed:])
+
+	case NamespaceReady:
+		// '.' namespace ID(1-19)
+		if len(p) < 2 || len(p) > 1+namespaceIDLen || p[0] != '.' {
+			return nil, malformed
+		}
+		op.NamespaceID = string(p[1:])
+
+	case Announce:
+		if len(p) != hashLen {
+			return nil, malformed
+		}
+		op.MessageHash = hex.EncodeToString(p)
+
+	case TokenTransfer:
+		// consensus hash(16) token type(19) amount(8) scratch area(0-34)
+		const fixed = consensusHashLen + tokenTypeLen + tokenAmountLen
+		if len(p) < fixed || len(p) > fixed+scratchLen {
+			return nil, malformed
+		}
+		op.ConsensusHash = hex.EncodeToString(p[:consensusHashLen])
+		op.TokenType = string(bytes.TrimRight(p[consensusHashLen:consensusHashLen+tokenTypeLen], "\x00"))
+		op.TokenAmount = binary.BigEndian.Uint64(p[consensusHashLen+tokenTypeLen : fixed])
+		op.ScratchArea = hex.EncodeToString(p[fixed:])
+	}
+	return op, nil
+}
+
+// trimName strips the zero padding of a name
+func trimName(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
@@ -0,0 +1,146 @@
+package blockstack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// A NAME_UPDATE broadcast on mainnet
+const testUpdateTx = "0100000001ab3e33c13344dde0794a3a1ea03d9f1335a2a08d762b70d943527e9ce9421bc5020000006b483045022100db58090a26c9e3fcbd000c3000210ba7050df65b68e1745b54b695579e2615e00220109b2225eda4c12accf537d16023008121587e61d942494bf02ef3c8667f0a270121023beb2a616698c02d6f64c1ca11a5cccfd722563caccc6a7b5eabd9c6c4158feeffffffff020000000000000000296a2769642bc318e73d4f47f8474028190f1561d9b5319564146d3d4ab1283228a26e82641e96b290ee50b50e00000000001976a9148ef6cfc4c8ee2e6142001c94275ff47d3f05886588ac00000000"
+
+func payload(op byte, parts ...[]byte) []byte {
+	return append([]byte{'i', 'd', op}, bytes.Join(parts, nil)...)
+}
+
+func pad(s string, n int) []byte {
+	return append([]byte(s), make([]byte, n-len(s))...)
+}
+
+func TestParse(t *testing.T) {
+	hash20 := bytes.Repeat([]byte{0xaa}, 20)
+	hash16 := bytes.Repeat([]byte{0xbb}, 16)
+	cases := []struct {
+		name  string
+		data  []byte
+		check func(op *Op) bool
+	}{
+		{"preorder", payload('?', hash20, hash16), func(op *Op) bool {
+			return op.Opcode == NamePreorder && op.PreorderHash == hex.EncodeToString(hash20) && op.ConsensusHash == hex.EncodeToString(hash16) && op.TokenFee == 0
+		}},
+		{"preorder paid in tokens", payload('*', hash20, hash16, []byte{0, 0, 0, 0, 0, 0, 1, 0}), func(op *Op) bool {
+			return op.Opcode == NamespacePreorder && op.TokenFee == 256
+		}},
+		{"registration", payload(':', []byte("muneeb.id")), func(op *Op) bool {
+			return op.Opcode == NameRegistration && op.Name == "muneeb.id" && op.ValueHash == ""
+		}},
+		{"registration with zone file", payload(':', pad("muneeb.id", 37), hash20), func(op *Op) bool {
+			return op.Name == "muneeb.id" && op.ValueHash == hex.EncodeToString(hash20)
+		}},
+		{"update", payload('+', hash16, hash20), func(op *Op) bool {
+			return op.Opcode == NameUpdate && op.NameConsensusHash == hex.EncodeToString(hash16) && op.ValueHash == hex.EncodeToString(hash20)
+		}},
+		{"transfer", payload('>', []byte{'~'}, hash16, hash16), func(op *Op) bool {
+			return op.Opcode == NameTransfer && op.KeepData != nil && !*op.KeepData && op.NameHash == hex.EncodeToString(hash16)
+		}},
+		{"revoke", payload('~', []byte("muneeb.id")), func(op *Op) bool {
+			return op.Opcode == NameRevoke && op.Name == "muneeb.id"
+		}},
+		{"import", payload(';', []byte("muneeb.id")), func(op *Op) bool {
+			return op.Opcode == NameImport && op.Name == "muneeb.id"
+		}},
+		{"namespace reveal", payload('&', []byte{0, 0, 0, 52, 250, 4, 0x66, 0x54, 0x43, 0x32, 0x22, 0x11, 0x11, 0x11, 0xa4, 0, 3}, []byte("id")), func(op *Op) bool {
+			r := op.Namespace
+			return op.Opcode == NamespaceReveal && op.NamespaceID == "id" && r != nil && r.Lifetime == 52 && r.Coeff == 250 && r.Base == 4 &&
+				len(r.Buckets) == 16 && r.Buckets[0] == 6 && r.Buckets[15] == 1 && r.NonalphaDiscount == 10 && r.NoVowelDiscount == 4 && r.Version == 3
+		}},
+		{"namespace ready", payload('!', []byte(".id")), func(op *Op) bool {
+			return op.Opcode == NamespaceReady && op.NamespaceID == "id"
+		}},
+		{"announce", payload('#', hash20), func(op *Op) bool {
+			return op.Opcode == Announce && op.MessageHash == hex.EncodeToString(hash20)
+		}},
+		{"token transfer", payload('$', hash16, pad("STACKS", 19), []byte{0, 0, 0, 0, 0, 0x0f, 0x42, 0x40}, []byte("memo")), func(op *Op) bool {
+			return op.Opcode == TokenTransfer && op.TokenType == "STACKS" && op.TokenAmount == 1000000 && op.ScratchArea == hex.EncodeToString([]byte("memo"))
+		}},
+	}
+	for _, c := range cases {
+		op, err := Parse(c.data)
+		if err != nil {
+			t.Errorf("%s: %v\n", c.name, err)
+			continue
+		}
+		if !c.check(op) {
+			t.Errorf("%s: unexpected decoding '%+v'\n", c.name, op)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"unknown opcode":     payload('x', hash20),
+		"short update":       payload('+', hash16),
+		"bad transfer flag":  payload('>', []byte{'x'}, hash16, hash16),
+		"long name":          payload('~', pad("muneeb.id", 38)),
+		"ready without dot":  payload('!', []byte("id")),
+		"long token scratch": payload('$', hash16, pad("STACKS", 19), make([]byte, 8), make([]byte, 35)),
+	} {
+		if _, err := Parse(data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: Expected '%v', got '%v'\n", name, ErrMalformed, err)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	b, _ := hex.DecodeString(testUpdateTx)
+	tx := &wire.MsgTx{}
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	op, err := Decode(tx, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Opcode != NameUpdate || op.ValueHash != "319564146d3d4ab1283228a26e82641e96b290ee" || op.Recipient != "" {
+		t.Errorf("Expected a NAME_UPDATE, got '%+v'\n", op)
+	}
+
+	owner, _ := btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{1}, 20), &chaincfg.MainNetParams)
+	burn, _ := btcutil.NewAddressPubKeyHash(make([]byte, 20), &chaincfg.MainNetParams)
+	ownerScript, _ := txscript.PayToAddrScript(owner)
+	burnScript, _ := txscript.PayToAddrScript(burn)
+	opReturn, _ := txscript.NullDataScript(payload(':', []byte("muneeb.id")))
+	tx = wire.NewMsgTx(1)
+	tx.AddTxOut(wire.NewTxOut(0, opReturn))
+	tx.AddTxOut(wire.NewTxOut(5500, ownerScript))
+	tx.AddTxOut(wire.NewTxOut(10000, ownerScript))
+	if op, _ := Decode(tx, &chaincfg.MainNetParams); op.Opcode != NameRegistration || op.Recipient != owner.EncodeAddress() || op.BurnAddress != "" {
+		t.Errorf("Expected a registration to '%s', got '%+v'\n", owner, op)
+	}
+	tx.AddTxOut(wire.NewTxOut(2500, burnScript))
+	if op, _ := Decode(tx, &chaincfg.MainNetParams); op.Opcode != NameRenewal || op.BurnAddress != burn.EncodeAddress() || op.BurnAmount != 2500 {
+		t.Errorf("Expected a renewal burning '%d', got '%+v'\n", 2500, op)
+	}
+
+	// Transfers pay the new owner in the second output and change in the third
+	change, _ := btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{2}, 20), &chaincfg.MainNetParams)
+	changeScript, _ := txscript.PayToAddrScript(change)
+	hash16 := bytes.Repeat([]byte{0xbb}, 16)
+	transferReturn, _ := txscript.NullDataScript(payload('>', []byte{'>'}, hash16, hash16))
+	transfer := wire.NewMsgTx(1)
+	transfer.AddTxOut(wire.NewTxOut(0, transferReturn))
+	transfer.AddTxOut(wire.NewTxOut(5500, ownerScript))
+	transfer.AddTxOut(wire.NewTxOut(90000, changeScript))
+	if op, err := Decode(transfer, &chaincfg.MainNetParams); err != nil || op.Opcode != NameTransfer || op.Recipient != owner.EncodeAddress() {
+		t.Errorf("Expected a transfer to '%s', got '%+v' '%v'\n", owner, op, err)
+	}
+
+	tx.TxOut[0], tx.TxOut[1] = tx.TxOut[1], tx.TxOut[0]
+	if _, err := Decode(tx, &chaincfg.MainNetParams); err != ErrNotBlockstack {
+		t.Errorf("Expected '%v', got '%v'\n", ErrNotBlockstack, err)
+	}
+}
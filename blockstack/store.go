@@ -0,0 +1,171 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the store. Heights in keys are big endian so keys sort by them.
+var (
+	// ops maps an address, height and position in the block to the
+	// operation of the transaction there
+	opsBucket = []byte("ops")
+	// scanned maps an address to the height its transactions were scanned
+	// through
+	scannedBucket = []byte("scanned")
+)
+
+// Store keeps the operations found in the transactions of addresses and how
+// far each address was scanned, so later lookups only scan newer blocks
+type Store struct {
+	db *bolt.DB
+}
+
+// OpenStore opens or creates the store at path
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening Blockstack store %s: %s", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{opsBucket, scannedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the store database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Ops returns the stored operations of addr, oldest first, and the height
+// addr was scanned through, -1 if it never was
+func (s *Store) Ops(addr string) ([]TxOp, int32, error) {
+	out := []TxOp{}
+	scanned := int32(-1)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := addrKey(addr)
+		if v := tx.Bucket(scannedBucket).Get(prefix); v != nil {
+			scanned = int32(binary.BigEndian.Uint32(v))
+		}
+		c := tx.Bucket(opsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var op TxOp
+			if err := json.Unmarshal(v, &op); err != nil {
+				return err
+			}
+			out = append(out, op)
+		}
+		return nil
+	})
+	return out, scanned, err
+}
+
+// Add stores the operations found for addr in the blocks after its last
+// scan, through height. Operations must have a Vtxindex.
+func (s *Store) Add(addr string, height int32, ops []TxOp) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		prefix := addrKey(addr)
+		scanned := tx.Bucket(scannedBucket)
+		if v := scanned.Get(prefix); v != nil && int32(binary.BigEndian.Uint32(v)) >= height {
+			return nil
+		}
+		for _, op := range ops {
+			if op.Vtxindex == nil {
+				return fmt.Errorf("operation %s has no vtxindex", op.Txid)
+			}
+			v, err := json.Marshal(op)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(opsBucket).Put(opKey(addr, int32(op.BlockHeight), *op.Vtxindex), v); err != nil {
+				return err
+			}
+		}
+		return scanned.Put(prefix, u32(uint32(height)))
+	})
+}
+
+// Rewind forgets the operations from height on, after the blocks there
+// left the best chain. Addresses scanned past it are rescanned from there.
+func (s *Store) Rewind(height int32) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var stale [][]byte
+		ops := tx.Bucket(opsBucket)
+		err := ops.ForEach(func(k, _ []byte) error {
+			if h := int32(binary.BigEndian.Uint32(k[len(k)-8:])); h >= height {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := ops.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		scanned := tx.Bucket(scannedBucket)
+		var rewound [][]byte
+		err = scanned.ForEach(func(k, v []byte) error {
+			if int32(binary.BigEndian.Uint32(v)) >= height {
+				rewound = append(rewound, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range rewound {
+			if err := scanned.Put(k, u32(uint32(height-1))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func u32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+// addrKey length prefixes addr so no address is the prefix of another
+func addrKey(addr string) []byte {
+	return append([]byte{byte(len(addr))}, addr...)
+}
+
+func opKey(addr string, height int32, vtxindex int) []byte {
+	return append(append(addrKey(addr), u32(uint32(height))...), u32(uint32(vtxindex))...)
+}
@@ -0,0 +1,59 @@
+package blockstack
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func testTxOp(txid string, height, vtxindex int) TxOp {
+	return TxOp{Txid: txid, BlockHeight: height, Vtxindex: &vtxindex, Op: &Op{Opcode: NameUpdate}}
+}
+
+func TestStore(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "blockstack.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	addr := "1DzFvZ4mJFETpbJ86NKUGM4Pfe6yjZ8Lac"
+	if ops, scanned, err := s.Ops(addr); err != nil || len(ops) != 0 || scanned != -1 {
+		t.Errorf("Expected '%d', got '%d' %v\n", -1, scanned, err)
+	}
+
+	if err := s.Add(addr, 120, []TxOp{testTxOp("b", 110, 1), testTxOp("a", 100, 7)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(addr+"x", 120, []TxOp{testTxOp("c", 105, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	ops, scanned, err := s.Ops(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanned != 120 || len(ops) != 2 || ops[0].Txid != "a" || ops[1].Txid != "b" || ops[0].Opcode != NameUpdate {
+		t.Errorf("Expected 'a, b' through '%d', got '%+v' through '%d'\n", 120, ops, scanned)
+	}
+
+	// Scans that are already covered are ignored
+	if err := s.Add(addr, 115, []TxOp{testTxOp("d", 112, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if ops, _, _ := s.Ops(addr); len(ops) != 2 {
+		t.Errorf("Expected '%d', got '%d'\n", 2, len(ops))
+	}
+	if err := s.Add(addr, 130, []TxOp{{Txid: "e", BlockHeight: 125}}); err == nil {
+		t.Errorf("Expected an error for an operation without vtxindex\n")
+	}
+
+	if err := s.Rewind(110); err != nil {
+		t.Fatal(err)
+	}
+	ops, scanned, _ = s.Ops(addr)
+	if scanned != 109 || len(ops) != 1 || ops[0].Txid != "a" {
+		t.Errorf("Expected 'a' through '%d', got '%+v' through '%d'\n", 109, ops, scanned)
+	}
+	if ops, scanned, _ := s.Ops(addr + "x"); scanned != 109 || len(ops) != 1 {
+		t.Errorf("Expected '%d', got '%d'\n", 109, scanned)
+	}
+}
@@ -1,14 +1,34 @@
 package cache
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"sync"
 	"time"
+
+	"github.com/jackzampolin/addrindex-server/apikey"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	// r "gopkg.in/redis.v5"
 )
 
+const tracerName = "github.com/jackzampolin/addrindex-server/cache"
+
+var lookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "addrindex",
+	Subsystem: "cache",
+	Name:      "lookups_total",
+	Help:      "Page cache lookups by result (hit or miss).",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(lookups)
+}
+
 //Storage mecanism for caching strings
 type Storage interface {
 	Get(key string) []byte
@@ -103,14 +123,50 @@ func (c MemoryCache) Set(key string, content []byte, duration time.Duration) {
 	}
 }
 
+// Purge removes the cached contents match returns true for, and returns how
+// many were removed
+func (c MemoryCache) Purge(match func(key string, content []byte) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, item := range c.items {
+		if match(key, item.Content) {
+			delete(c.items, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Key returns the cache key of a request URL: its path and query, without an
+// API key sent in the query string. Pages don't depend on the key that
+// fetched them, and keys must not end up in traces or logs.
+func Key(u *url.URL) string {
+	query := u.Query()
+	if _, ok := query[apikey.QueryParam]; !ok {
+		return u.RequestURI()
+	}
+	query.Del(apikey.QueryParam)
+	out := *u
+	out.RawQuery = query.Encode()
+	return out.RequestURI()
+}
+
 // Middleware is the cache interface for http requests
 func Middleware(duration string, storage Storage, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		key := Key(r.URL)
+		_, span := otel.Tracer(tracerName).Start(r.Context(), "cache lookup", trace.WithAttributes(attribute.String("cache.key", key)))
+		content := storage.Get(key)
+		span.SetAttributes(attribute.Bool("cache.hit", content != nil))
+		span.End()
 
-		content := storage.Get(r.RequestURI)
 		if content != nil {
+			lookups.WithLabelValues("hit").Inc()
 			w.Write(content)
 		} else {
+			lookups.WithLabelValues("miss").Inc()
 			c := httptest.NewRecorder()
 			handler(c, r)
 
@@ -122,9 +178,9 @@ func Middleware(duration string, storage Storage, handler func(w http.ResponseWr
 			content := c.Body.Bytes()
 
 			if d, err := time.ParseDuration(duration); err == nil {
-				storage.Set(r.RequestURI, content, d)
+				storage.Set(key, content, d)
 			} else {
-				log.Printf("[server] Page not cached. err: %s\n", err)
+				slog.Warn("Page not cached", "uri", key, "error", err)
 			}
 
 			w.Write(content)
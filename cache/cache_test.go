@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	cases := map[string]string{
+		"/blocks?limit=10":                   "/blocks?limit=10",
+		"/blocks?limit=10&apikey=ak_secret":  "/blocks?limit=10",
+		"/currency?apikey=ak_secret":         "/currency",
+		"/blocks?apikey=a&apikey=b&limit=10": "/blocks?limit=10",
+	}
+	for uri, expected := range cases {
+		if got := Key(httptest.NewRequest("GET", uri, nil).URL); got != expected {
+			t.Errorf("Expected '%s' for %s, got '%s'\n", expected, uri, got)
+		}
+	}
+}
+
+func TestMiddlewareSharesPagesAcrossKeys(t *testing.T) {
+	c := NewMemoryCache()
+	calls := 0
+	handler := Middleware("1m", c, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("page"))
+	})
+	for _, secret := range []string{"ak_one", "ak_two"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/currency?apikey="+secret, nil))
+	}
+	if calls != 1 {
+		t.Errorf("Expected '%d' call, got '%d'\n", 1, calls)
+	}
+	c.Purge(func(key string, content []byte) bool {
+		if strings.Contains(key, "ak_") {
+			t.Errorf("Expected no API key in cache key, got '%s'\n", key)
+		}
+		return false
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/jackzampolin/addrindex-server/addrindex"
+	"github.com/jackzampolin/addrindex-server/index"
+	"github.com/spf13/cobra"
+)
+
+var (
+	indexFile     string
+	indexNetwork  string
+	importWorkers int
+	importBatch   int
+)
+
+// indexCmd groups the built-in address index commands
+var indexCmd = &cobra.Command{
+	Use:   "index",
+	Short: "manage the built-in address index",
+}
+
+var indexImportCmd = &cobra.Command{
+	Use:   "import [blocksdir]",
+	Short: "builds the built-in address index from the blk*.dat files of a Bitcoin Core blocks directory",
+	Long: `Builds the built-in address index from the blk*.dat files of a Bitcoin Core blocks
+directory, much faster than syncing it over RPC. The node can keep running. An
+interrupted import resumes from the last committed batch, and the server syncs
+the blocks written after the import over RPC.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := indexFile
+		if path == "" && cfg != nil {
+			path = cfg.IndexPath
+		}
+		if path == "" {
+			return fmt.Errorf("no index file, set indexPath in the config or pass --index")
+		}
+		network := indexNetwork
+		if network == "" && cfg != nil {
+			network = cfg.Network
+		}
+		if network == "" {
+			return fmt.Errorf("no network, set network in the config or pass --network")
+		}
+		params, err := addrindex.NetworkParams(network)
+		if err != nil {
+			return err
+		}
+		depth := addrindex.DefaultReorgDepth
+		if cfg != nil && cfg.ReorgDepth > 0 {
+			depth = cfg.ReorgDepth
+		}
+
+		ix, err := index.Open(path, params, depth)
+		if err != nil {
+			return err
+		}
+		defer ix.Close()
+
+		started := time.Now()
+		bf, err := index.OpenBlockFiles(args[0], params, importWorkers)
+		if err != nil {
+			return err
+		}
+		slog.Info("Scanned block files", "dir", args[0], "took", time.Since(started).Round(time.Millisecond))
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		var last time.Time
+		err = ix.Import(ctx, bf, importWorkers, importBatch, func(p index.ImportProgress) {
+			if time.Since(last) < 10*time.Second && p.Height < p.Tip {
+				return
+			}
+			last = time.Now()
+			slog.Info("Imported blocks",
+				"height", p.Height,
+				"tip", p.Tip,
+				"progress", fmt.Sprintf("%.1f%%", 100*float64(p.Height+1)/float64(p.Tip+1)),
+				"blocks_per_sec", fmt.Sprintf("%.0f", float64(p.Blocks)/p.Elapsed.Seconds()),
+			)
+		})
+		if err == context.Canceled {
+			height, _, _ := ix.Tip()
+			return fmt.Errorf("import interrupted at block %d, run it again to resume", height)
+		}
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(indexCmd)
+	indexCmd.AddCommand(indexImportCmd)
+	indexCmd.PersistentFlags().StringVar(&indexFile, "index", "", "index file (default is indexPath from the config)")
+	indexCmd.PersistentFlags().StringVar(&indexNetwork, "network", "", "network of the blocks (default is network from the config)")
+	indexImportCmd.Flags().IntVar(&importWorkers, "workers", runtime.NumCPU(), "block files scanned and blocks decoded in parallel")
+	indexImportCmd.Flags().IntVar(&importBatch, "batch", 500, "blocks committed per database transaction, the resume checkpoint")
+}
@@ -0,0 +1,188 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackzampolin/addrindex-server/apikey"
+	"github.com/spf13/cobra"
+)
+
+var (
+	keyFile       string
+	keyScopes     []string
+	keyRateLimit  float64
+	keyBurst      int
+	keyDailyQuota int64
+)
+
+// keysCmd groups the API key admin commands
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "manage API keys",
+}
+
+var keysCreateCmd = &cobra.Command{
+	Use:   "create [name]",
+	Short: "creates an API key and prints its secret",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := apiKeyFile()
+		if err != nil {
+			return err
+		}
+		keys, err := apikey.Load(path)
+		if err != nil {
+			return err
+		}
+
+		var secret string
+		var key apikey.Key
+		for {
+			secret, key, err = apikey.Generate(args[0], keyScopes)
+			if err != nil {
+				return err
+			}
+			if findKey(keys, key.ID) < 0 {
+				break
+			}
+		}
+		key.RateLimit = keyRateLimit
+		key.Burst = keyBurst
+		key.DailyQuota = keyDailyQuota
+
+		if err := apikey.Save(path, append(keys, key)); err != nil {
+			return err
+		}
+		fmt.Printf("Created key %s (%s). The secret is not stored and won't be shown again:\n%s\n", key.ID, key.Name, secret)
+		return nil
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "lists API keys and their usage",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := apiKeyFile()
+		if err != nil {
+			return err
+		}
+		keys, err := apikey.Load(path)
+		if err != nil {
+			return err
+		}
+		usage, err := apikey.LoadUsage(path)
+		if err != nil {
+			return err
+		}
+
+		today := time.Now().UTC().Format("2006-01-02")
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tRATE\tQUOTA\tTODAY\tTOTAL\tLAST USED\tSTATUS")
+		for _, k := range keys {
+			u := usage[k.ID]
+			if u.Day != today {
+				u.DayCount = 0
+			}
+			status := "active"
+			if !k.Active() {
+				status = "revoked " + k.Revoked.Format(time.RFC3339)
+			}
+			lastUsed := "never"
+			if !u.LastUsed.IsZero() {
+				lastUsed = u.LastUsed.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+				k.ID, k.Name, strings.Join(k.Scopes, ","),
+				limitString(k.RateLimit, "/s"), limitString(float64(k.DailyQuota), "/day"),
+				u.DayCount, u.Total, lastUsed, status,
+			)
+		}
+		return tw.Flush()
+	},
+}
+
+var keysRevokeCmd = &cobra.Command{
+	Use:   "revoke [id]",
+	Short: "revokes an API key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := apiKeyFile()
+		if err != nil {
+			return err
+		}
+		keys, err := apikey.Load(path)
+		if err != nil {
+			return err
+		}
+		i := findKey(keys, args[0])
+		if i < 0 {
+			return fmt.Errorf("no key with id %s", args[0])
+		}
+		if !keys[i].Active() {
+			return fmt.Errorf("key %s is already revoked", args[0])
+		}
+		now := time.Now().UTC()
+		keys[i].Revoked = &now
+		if err := apikey.Save(path, keys); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked key %s (%s)\n", keys[i].ID, keys[i].Name)
+		return nil
+	},
+}
+
+// apiKeyFile returns the key file from --file, falling back to the apiKeys config option
+func apiKeyFile() (string, error) {
+	if keyFile != "" {
+		return keyFile, nil
+	}
+	if cfg != nil && cfg.APIKeys != "" {
+		return cfg.APIKeys, nil
+	}
+	return "", fmt.Errorf("no key file, set apiKeys in the config or pass --file")
+}
+
+func findKey(keys []apikey.Key, id string) int {
+	for i, k := range keys {
+		if k.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func limitString(v float64, unit string) string {
+	if v <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%g%s", v, unit)
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysCreateCmd, keysListCmd, keysRevokeCmd)
+	keysCmd.PersistentFlags().StringVar(&keyFile, "file", "", "API key file (default is apiKeys from the config)")
+	keysCreateCmd.Flags().StringSliceVar(&keyScopes, "scope", []string{apikey.ScopeRead}, "scopes to grant, read and/or broadcast")
+	keysCreateCmd.Flags().Float64Var(&keyRateLimit, "rate", 0, "requests per second allowed, 0 for unlimited")
+	keysCreateCmd.Flags().IntVar(&keyBurst, "burst", 0, "requests allowed in a burst above the rate (default is the rate)")
+	keysCreateCmd.Flags().Int64Var(&keyDailyQuota, "quota", 0, "requests allowed per UTC day, 0 for unlimited")
+}
@@ -86,5 +86,6 @@ func initConfig() {
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		viper.Unmarshal(&cfg)
+		cfg.ConfigFile = viper.ConfigFileUsed()
 	}
 }
@@ -15,12 +15,13 @@
 package cmd
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/gorilla/handlers"
 	"github.com/jackzampolin/addrindex-server/addrindex"
 	"github.com/spf13/cobra"
 )
@@ -31,10 +32,66 @@ var serveCmd = &cobra.Command{
 	Short: "serves the addrindex server",
 	Run: func(cmd *cobra.Command, args []string) {
 		as := addrindex.NewAddrServer(cfg)
-		defer as.Client.Shutdown()
+		srv := as.HTTPServer(addrindex.LoggingMiddleware(as.Router()))
+		servers := []*http.Server{srv}
 
-		log.Println(fmt.Sprintf("Listening on port ':%v'...", as.Port))
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", as.Port), handlers.LoggingHandler(os.Stdout, as.Router())))
+		errs := make(chan error, 2)
+		if as.TLSEnabled() {
+			tlsConfig, err := as.TLSConfig()
+			if err != nil {
+				as.Close()
+				slog.Error("Failed configuring TLS", "error", err)
+				os.Exit(1)
+			}
+			srv.TLSConfig = tlsConfig
+			go func() {
+				slog.Info("Listening with TLS", "addr", srv.Addr)
+				errs <- srv.ListenAndServeTLS("", "")
+			}()
+
+			if as.TLSRedirectPort > 0 {
+				redirect := as.RedirectServer()
+				servers = append(servers, redirect)
+				go func() {
+					slog.Info("Redirecting HTTP to HTTPS", "addr", redirect.Addr)
+					errs <- redirect.ListenAndServe()
+				}()
+			}
+		} else {
+			go func() {
+				slog.Info("Listening", "addr", srv.Addr)
+				errs <- srv.ListenAndServe()
+			}()
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+		failed := false
+		select {
+		case err := <-errs:
+			if err != http.ErrServerClosed {
+				slog.Error("Server failed", "error", err)
+				failed = true
+			}
+		case sig := <-sigs:
+			slog.Info("Draining in-flight requests", "signal", sig.String())
+		}
+
+		// Stop accepting connections and wait for in-flight requests until the deadline
+		ctx, cancel := context.WithTimeout(context.Background(), as.ShutdownTimeout)
+		defer cancel()
+		for _, s := range servers {
+			if err := s.Shutdown(ctx); err != nil {
+				slog.Warn("Failed draining requests", "error", err)
+			}
+		}
+
+		as.Close()
+		slog.Info("Shutdown complete")
+		if failed {
+			os.Exit(1)
+		}
 	},
 }
 
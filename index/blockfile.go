@@ -0,0 +1,314 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// xorKeySize is the size of the key Bitcoin Core 28 and newer obfuscate
+// block files with, kept in blocks/xor.dat
+const xorKeySize = 8
+
+// BlockFiles reads the blocks of a Bitcoin Core blocks directory. Blocks
+// are stored in the order they were downloaded, so the best chain is
+// rebuilt from their headers.
+type BlockFiles struct {
+	params *chaincfg.Params
+	files  []string
+	// key is the XOR obfuscation key, nil when the files are stored as is
+	key []byte
+	// blocks holds the location of every block found in the files
+	blocks map[chainhash.Hash]*blockLocation
+}
+
+// blockLocation is where a block is stored and the header fields needed to
+// rebuild the best chain
+type blockLocation struct {
+	file   int
+	offset int64
+	size   uint32
+	prev   chainhash.Hash
+	bits   uint32
+}
+
+// OpenBlockFiles scans the headers of the blk*.dat files in dir with
+// workers files read in parallel
+func OpenBlockFiles(dir string, params *chaincfg.Params, workers int) (*BlockFiles, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no blk*.dat files in %s", dir)
+	}
+	sort.Strings(files)
+	bf := &BlockFiles{params: params, files: files, blocks: map[chainhash.Hash]*blockLocation{}}
+	if bf.key, err = readXORKey(dir); err != nil {
+		return nil, err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	found := make([]map[chainhash.Hash]*blockLocation, len(files))
+	errs := make([]error, len(files))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				found[i], errs[i] = bf.scan(i)
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for i := range files {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("scanning %s: %s", files[i], errs[i])
+		}
+		// The first copy of a block wins, like in Bitcoin Core
+		for hash, loc := range found[i] {
+			if _, ok := bf.blocks[hash]; !ok {
+				bf.blocks[hash] = loc
+			}
+		}
+	}
+	return bf, nil
+}
+
+// readXORKey reads the obfuscation key of the block files in dir. Older
+// nodes don't write one and an all zero key leaves the files as is.
+func readXORKey(dir string) ([]byte, error) {
+	key, err := os.ReadFile(filepath.Join(dir, "xor.dat"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != xorKeySize {
+		return nil, fmt.Errorf("xor.dat holds %d bytes, expected %d", len(key), xorKeySize)
+	}
+	if bytes.Equal(key, make([]byte, xorKeySize)) {
+		return nil, nil
+	}
+	return key, nil
+}
+
+// xorReader deobfuscates a block file read from its start
+type xorReader struct {
+	r      io.Reader
+	key    []byte
+	offset int64
+}
+
+func (x *xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	if x.key != nil {
+		unxor(p[:n], x.key, x.offset)
+	}
+	x.offset += int64(n)
+	return n, err
+}
+
+// unxor deobfuscates b, read at offset of a block file
+func unxor(b, key []byte, offset int64) {
+	for i := range b {
+		b[i] ^= key[(offset+int64(i))%xorKeySize]
+	}
+}
+
+// scan finds the blocks of file i. Each block is preceded by the network
+// magic and its size. The scan resyncs on the magic after garbage, and
+// stops at the zeroed space preallocated at the end of the file or at a
+// block that is still being written.
+func (bf *BlockFiles) scan(i int) (map[chainhash.Hash]*blockLocation, error) {
+	f, err := os.Open(bf.files[i])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	x := &xorReader{r: f, key: bf.key}
+	r := bufio.NewReaderSize(x, 1<<20)
+	offset := func() int64 { return x.offset - int64(r.Buffered()) }
+
+	magic := make([]byte, 4)
+	binary.LittleEndian.PutUint32(magic, uint32(bf.params.Net))
+	out := map[chainhash.Hash]*blockLocation{}
+	window := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, window); err != nil {
+			return out, nil
+		}
+		for !bytes.Equal(window, magic) {
+			if bytes.Equal(window, make([]byte, 4)) {
+				return out, nil
+			}
+			c, err := r.ReadByte()
+			if err != nil {
+				return out, nil
+			}
+			window = append(window[1:], c)
+		}
+
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return out, nil
+		}
+		start := offset()
+		if size < blockHeaderLen || start+int64(size) > info.Size() {
+			return out, nil
+		}
+		var header wire.BlockHeader
+		if err := header.Deserialize(r); err != nil {
+			return out, nil
+		}
+		if _, err := r.Discard(int(size) - blockHeaderLen); err != nil {
+			return out, nil
+		}
+		out[header.BlockHash()] = &blockLocation{file: i, offset: start, size: size, prev: header.PrevBlock, bits: header.Bits}
+	}
+}
+
+// blockHeaderLen is the size of a serialized block header
+const blockHeaderLen = 80
+
+// BestChain returns the hashes of the chain with the most work found in the
+// files, indexed by height. It fails when the files don't start at the
+// genesis block, as with a pruned node.
+func (bf *BlockFiles) BestChain() ([]chainhash.Hash, error) {
+	genesis := *bf.params.GenesisHash
+	if _, ok := bf.blocks[genesis]; !ok {
+		return nil, fmt.Errorf("the block files don't hold the %s genesis block", bf.params.Name)
+	}
+
+	// Work is summed from the genesis block down each branch. Blocks whose
+	// parents aren't in the files are left out.
+	children := map[chainhash.Hash][]chainhash.Hash{}
+	for hash, loc := range bf.blocks {
+		if hash != genesis {
+			children[loc.prev] = append(children[loc.prev], hash)
+		}
+	}
+	work := map[chainhash.Hash]*big.Int{genesis: blockchain.CalcWork(bf.blocks[genesis].bits)}
+	best := genesis
+	queue := []chainhash.Hash{genesis}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		for _, child := range children[hash] {
+			work[child] = new(big.Int).Add(work[hash], blockchain.CalcWork(bf.blocks[child].bits))
+			queue = append(queue, child)
+			if bf.better(child, best, work) {
+				best = child
+			}
+		}
+	}
+
+	var chain []chainhash.Hash
+	for hash := best; ; hash = bf.blocks[hash].prev {
+		chain = append(chain, hash)
+		if hash == genesis {
+			break
+		}
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// better returns whether block a has more work than b, or as much and was
+// stored first
+func (bf *BlockFiles) better(a, b chainhash.Hash, work map[chainhash.Hash]*big.Int) bool {
+	if c := work[a].Cmp(work[b]); c != 0 {
+		return c > 0
+	}
+	la, lb := bf.blocks[a], bf.blocks[b]
+	if la.file != lb.file {
+		return la.file < lb.file
+	}
+	return la.offset < lb.offset
+}
+
+// blockReader reads blocks from the files, keeping them open
+type blockReader struct {
+	bf    *BlockFiles
+	files map[int]*os.File
+}
+
+func (bf *BlockFiles) newReader() *blockReader {
+	return &blockReader{bf: bf, files: map[int]*os.File{}}
+}
+
+// read reads and decodes the block with hash
+func (br *blockReader) read(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	loc, ok := br.bf.blocks[hash]
+	if !ok {
+		return nil, fmt.Errorf("block %s isn't in the block files", hash)
+	}
+	f, ok := br.files[loc.file]
+	if !ok {
+		var err error
+		if f, err = os.Open(br.bf.files[loc.file]); err != nil {
+			return nil, err
+		}
+		br.files[loc.file] = f
+	}
+	b := make([]byte, loc.size)
+	if _, err := f.ReadAt(b, loc.offset); err != nil {
+		return nil, fmt.Errorf("reading block %s: %s", hash, err)
+	}
+	if br.bf.key != nil {
+		unxor(b, br.bf.key, loc.offset)
+	}
+	block := &wire.MsgBlock{}
+	if err := block.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("decoding block %s: %s", hash, err)
+	}
+	return block, nil
+}
+
+func (br *blockReader) close() {
+	for _, f := range br.files {
+		f.Close()
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ImportProgress is reported after each batch of imported blocks
+type ImportProgress struct {
+	// Height is the new tip of the index
+	Height int32
+	// Tip is the height of the best chain in the block files
+	Tip int32
+	// Blocks were imported since the import started, in Elapsed
+	Blocks  int
+	Elapsed time.Duration
+}
+
+// Import connects the blocks of the best chain in bf that the index is
+// missing. Blocks are read and decoded by workers in parallel and
+// connected in batches of batchSize, each in one database transaction, so
+// an interrupted import resumes from the last committed batch. Undo data is
+// only kept for the last undoDepth blocks. It stops after the current batch
+// when ctx is done.
+func (ix *Index) Import(ctx context.Context, bf *BlockFiles, workers, batchSize int, progress func(ImportProgress)) error {
+	chain, err := bf.BestChain()
+	if err != nil {
+		return err
+	}
+	height, hash, err := ix.Tip()
+	if err != nil {
+		return err
+	}
+	if height >= 0 && (int(height) >= len(chain) || chain[height] != hash) {
+		return fmt.Errorf("index tip %d %s isn't on the best chain of the block files", height, hash)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	batches := make(chan importBatch, 2)
+	go bf.readBatches(ctx, chain, height+1, workers, batchSize, batches)
+
+	undoFrom := int32(len(chain)) - ix.undoDepth
+	started := time.Now()
+	imported := 0
+	for b := range batches {
+		if b.err != nil {
+			return b.err
+		}
+		if err := ix.connectBlocks(b.blocks, b.height, undoFrom); err != nil {
+			return fmt.Errorf("connecting blocks %d to %d: %s", b.height, b.height+int32(len(b.blocks))-1, err)
+		}
+		imported += len(b.blocks)
+		if progress != nil {
+			progress(ImportProgress{
+				Height:  b.height + int32(len(b.blocks)) - 1,
+				Tip:     int32(len(chain)) - 1,
+				Blocks:  imported,
+				Elapsed: time.Since(started),
+			})
+		}
+	}
+	return ctx.Err()
+}
+
+// importBatch holds consecutive blocks, the first at height
+type importBatch struct {
+	height int32
+	blocks []*wire.MsgBlock
+	err    error
+}
+
+// readBatches reads the blocks of chain from height on and sends them in
+// batches, reading ahead while the previous batch is connected
+func (bf *BlockFiles) readBatches(ctx context.Context, chain []chainhash.Hash, height int32, workers, batchSize int, out chan<- importBatch) {
+	defer close(out)
+	readers := make([]*blockReader, workers)
+	for w := range readers {
+		readers[w] = bf.newReader()
+		defer readers[w].close()
+	}
+
+	for start := int(height); start < len(chain); start += batchSize {
+		end := start + batchSize
+		if end > len(chain) {
+			end = len(chain)
+		}
+		b := importBatch{height: int32(start), blocks: make([]*wire.MsgBlock, end-start)}
+		errs := make([]error, workers)
+		var wg sync.WaitGroup
+		for w := range readers {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(b.blocks) && errs[w] == nil; i += workers {
+					b.blocks[i], errs[w] = readers[w].read(chain[start+i])
+				}
+			}(w)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				b.err = err
+				break
+			}
+		}
+
+		select {
+		case out <- b:
+		case <-ctx.Done():
+			return
+		}
+		if b.err != nil {
+			return
+		}
+	}
+}
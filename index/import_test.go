@@ -0,0 +1,146 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jackzampolin/addrindex-server/internal/chaintest"
+)
+
+var testXORKey = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+// blockRecord serializes a block as stored in a blk*.dat file
+func blockRecord(t *testing.T, b *wire.MsgBlock) []byte {
+	var buf bytes.Buffer
+	if err := b.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, 8)
+	binary.LittleEndian.PutUint32(out, uint32(chaincfg.RegressionNetParams.Net))
+	binary.LittleEndian.PutUint32(out[4:], uint32(buf.Len()))
+	return append(out, buf.Bytes()...)
+}
+
+func writeBlockFile(t *testing.T, path string, parts ...[]byte) {
+	b := bytes.Join(parts, nil)
+	for i := range b {
+		b[i] ^= testXORKey[i%xorKeySize]
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testBlockFiles stores a chain with a fork, out of order and obfuscated.
+// b2b and b3b are the best chain.
+func testBlockFiles(t *testing.T) (dir string, g, b1, b2a, b2b, b3b *wire.MsgBlock) {
+	_, aScript := chaintest.Address(t, 1)
+	_, bScript := chaintest.Address(t, 2)
+	g = chaincfg.RegressionNetParams.GenesisBlock
+	cb1 := chaintest.Coinbase(1, wire.NewTxOut(50, aScript))
+	b1 = chaintest.Block(g, cb1)
+	b2a = chaintest.Block(b1, chaintest.Coinbase(2, wire.NewTxOut(50, bScript)), chaintest.Spend(cb1, 0, wire.NewTxOut(50, bScript)))
+	b2b = chaintest.Block(b1, chaintest.Coinbase(3, wire.NewTxOut(50, bScript)))
+	b3b = chaintest.Block(b2b, chaintest.Coinbase(4, wire.NewTxOut(50, bScript)))
+	orphan := chaintest.Block(b3b, chaintest.Coinbase(5))
+	orphan.Header.PrevBlock = chainhash.Hash{1}
+
+	dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "xor.dat"), testXORKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	truncated := blockRecord(t, chaintest.Block(b3b, chaintest.Coinbase(6)))
+	writeBlockFile(t, filepath.Join(dir, "blk00000.dat"),
+		[]byte("garbage"), blockRecord(t, g), blockRecord(t, b2a), blockRecord(t, b1), make([]byte, 64))
+	writeBlockFile(t, filepath.Join(dir, "blk00001.dat"),
+		blockRecord(t, b3b), blockRecord(t, orphan), blockRecord(t, b2b), truncated[:len(truncated)-10])
+	return dir, g, b1, b2a, b2b, b3b
+}
+
+func TestBestChain(t *testing.T) {
+	dir, g, b1, _, b2b, b3b := testBlockFiles(t)
+	bf, err := OpenBlockFiles(dir, &chaincfg.RegressionNetParams, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bf.blocks) != 6 {
+		t.Errorf("Expected '%d' blocks, got '%d'\n", 6, len(bf.blocks))
+	}
+	chain, err := bf.BestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []chainhash.Hash{g.BlockHash(), b1.BlockHash(), b2b.BlockHash(), b3b.BlockHash()}
+	if len(chain) != len(expected) {
+		t.Fatalf("Expected '%v', got '%v'\n", expected, chain)
+	}
+	for i := range expected {
+		if chain[i] != expected[i] {
+			t.Errorf("Expected '%s' at '%d', got '%s'\n", expected[i], i, chain[i])
+		}
+	}
+
+	bf, err = OpenBlockFiles(dir, &chaincfg.MainNetParams, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bf.BestChain(); err == nil {
+		t.Errorf("Expected an error without the mainnet genesis block\n")
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir, g, b1, b2a, _, b3b := testBlockFiles(t)
+	_, aScript := chaintest.Address(t, 1)
+	_, bScript := chaintest.Address(t, 2)
+	bf, err := OpenBlockFiles(dir, &chaincfg.RegressionNetParams, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() *Index {
+		ix, err := Open(filepath.Join(t.TempDir(), "index.db"), &chaincfg.RegressionNetParams, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ix.Close() })
+		return ix
+	}
+
+	// A partly imported index resumes from its tip
+	ix := open()
+	if err := ix.ConnectBlocks([]*wire.MsgBlock{g, b1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	var heights []int32
+	err = ix.Import(context.Background(), bf, 2, 1, func(p ImportProgress) {
+		heights = append(heights, p.Height)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heights) != 2 || heights[0] != 2 || heights[1] != 3 {
+		t.Errorf("Expected progress at '[2 3]', got '%v'\n", heights)
+	}
+	if height, hash, _ := ix.Tip(); height != 3 || hash != b3b.BlockHash() {
+		t.Errorf("Expected tip '%d' '%s', got '%d' '%s'\n", 3, b3b.BlockHash(), height, hash)
+	}
+	checkBalance(t, ix, "a", ix.Address(aScript), 50, 50)
+	checkBalance(t, ix, "b", ix.Address(bScript), 100, 100)
+
+	// An index on another branch isn't touched
+	ix = open()
+	if err := ix.ConnectBlocks([]*wire.MsgBlock{g, b1, b2a}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Import(context.Background(), bf, 2, 10, nil); err == nil {
+		t.Errorf("Expected an error importing over another branch\n")
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/jackzampolin/addrindex-server/segwit"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the index database. Heights, positions and timestamps in keys
+// are big endian so keys sort by them.
+var (
+	// meta holds the tip and the network the index is for
+	metaBucket = []byte("meta")
+	// blocks maps a height to the block hash and timestamp
+	blocksBucket = []byte("blocks")
+	// blocktimes maps a timestamp and height to the block hash
+	timesBucket = []byte("blocktimes")
+	// txs maps a txid to the height and position of its block
+	txsBucket = []byte("txs")
+	// deltas maps an address, height, position, txid, direction and index to
+	// the satoshis the input or output moved
+	deltasBucket = []byte("deltas")
+	// utxos maps an address and outpoint to the height of the output
+	utxosBucket = []byte("utxos")
+	// outputs maps an unspent outpoint to the output
+	outputsBucket = []byte("outputs")
+	// spent maps a spent outpoint to the input spending it and the output
+	spentBucket = []byte("spent")
+	// undo maps a height to the changes needed to disconnect the block
+	undoBucket = []byte("undo")
+
+	buckets = [][]byte{metaBucket, blocksBucket, timesBucket, txsBucket, deltasBucket, utxosBucket, outputsBucket, spentBucket, undoBucket}
+
+	tipKey     = []byte("tip")
+	networkKey = []byte("network")
+)
+
+var (
+	// ErrNotNext is returned when a block doesn't extend the tip of the index
+	ErrNotNext = errors.New("block doesn't extend the index tip")
+
+	// ErrNoUndo is returned when the tip can't be disconnected because its
+	// undo data was pruned. The index has to be rebuilt.
+	ErrNoUndo = errors.New("no undo data for the index tip, the index needs rebuilding")
+)
+
+// Index is an address, spent output and block timestamp index of a chain,
+// kept in a bbolt database. Blocks are connected in order and the last
+// undoDepth of them can be disconnected again.
+type Index struct {
+	db        *bolt.DB
+	params    *chaincfg.Params
+	undoDepth int32
+}
+
+// Open opens or creates the index at path for the network of params
+func Open(path string, params *chaincfg.Params, undoDepth int) (*Index, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening index %s: %s", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		switch network := meta.Get(networkKey); {
+		case network == nil:
+			return meta.Put(networkKey, []byte(params.Name))
+		case string(network) != params.Name:
+			return fmt.Errorf("index %s is for %s, not %s", path, network, params.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Index{db: db, params: params, undoDepth: int32(undoDepth)}, nil
+}
+
+// Close closes the index database
+func (ix *Index) Close() error {
+	return ix.db.Close()
+}
+
+// Tip returns the height and hash of the last connected block. The height
+// is -1 for an empty index.
+func (ix *Index) Tip() (height int32, hash chainhash.Hash, err error) {
+	err = ix.db.View(func(tx *bolt.Tx) error {
+		height, hash = tip(tx)
+		return nil
+	})
+	return height, hash, err
+}
+
+func tip(tx *bolt.Tx) (height int32, hash chainhash.Hash) {
+	v := tx.Bucket(metaBucket).Get(tipKey)
+	if v == nil {
+		return -1, hash
+	}
+	copy(hash[:], v[4:])
+	return int32(binary.BigEndian.Uint32(v)), hash
+}
+
+// ConnectBlocks connects consecutive blocks, the first at height, in one
+// database transaction
+func (ix *Index) ConnectBlocks(blocks []*wire.MsgBlock, height int32) error {
+	return ix.connectBlocks(blocks, height, 0)
+}
+
+// connectBlocks is ConnectBlocks keeping undo data only from height undoFrom
+// on
+func (ix *Index) connectBlocks(blocks []*wire.MsgBlock, height, undoFrom int32) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		for i, block := range blocks {
+			h := height + int32(i)
+			if err := ix.connectBlock(tx, block, h, h >= undoFrom); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ConnectBlock connects block at height. It must extend the tip.
+func (ix *Index) ConnectBlock(block *wire.MsgBlock, height int32) error {
+	return ix.ConnectBlocks([]*wire.MsgBlock{block}, height)
+}
+
+func (ix *Index) connectBlock(tx *bolt.Tx, block *wire.MsgBlock, height int32, keepUndo bool) error {
+	tipHeight, tipHash := tip(tx)
+	if height != tipHeight+1 || (tipHeight >= 0 && block.Header.PrevBlock != tipHash) {
+		return ErrNotNext
+	}
+
+	w := newChangeLog(tx)
+	for pos, mtx := range block.Transactions {
+		if err := ix.connectTx(w, mtx, height, uint32(pos)); err != nil {
+			return err
+		}
+	}
+	hash := block.BlockHash()
+	ts := uint32(block.Header.Timestamp.Unix())
+	if err := w.put(blocksBucket, u32(uint32(height)), cat(hash[:], u32(ts))); err != nil {
+		return err
+	}
+	if err := w.put(timesBucket, cat(u32(ts), u32(uint32(height))), hash[:]); err != nil {
+		return err
+	}
+
+	if keepUndo {
+		undo, err := w.encode()
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(undoBucket).Put(u32(uint32(height)), undo); err != nil {
+			return err
+		}
+		if err := ix.pruneUndo(tx, height); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(metaBucket).Put(tipKey, cat(u32(uint32(height)), hash[:]))
+}
+
+func (ix *Index) connectTx(w *changeLog, mtx *wire.MsgTx, height int32, pos uint32) error {
+	txid := mtx.TxHash()
+	if err := w.put(txsBucket, txid[:], cat(u32(uint32(height)), u32(pos))); err != nil {
+		return err
+	}
+
+	if !isCoinbase(mtx) {
+		for i, in := range mtx.TxIn {
+			op := outpointKey(&in.PreviousOutPoint.Hash, in.PreviousOutPoint.Index)
+			spent := cat(txid[:], u32(uint32(i)), u32(uint32(height)))
+			if v := w.tx.Bucket(outputsBucket).Get(op); v != nil {
+				out := decodeOutput(v)
+				spent = cat(spent, v)
+				if err := w.del(outputsBucket, op); err != nil {
+					return err
+				}
+				if err := w.del(utxosBucket, cat(addrKey(out.Address), op)); err != nil {
+					return err
+				}
+				key := deltaKey(out.Address, height, pos, &txid, false, uint32(i))
+				if err := w.put(deltasBucket, key, u64(uint64(-out.Satoshis))); err != nil {
+					return err
+				}
+			}
+			if err := w.put(spentBucket, op, spent); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, txOut := range mtx.TxOut {
+		addr := ix.Address(txOut.PkScript)
+		if addr == "" {
+			continue
+		}
+		op := outpointKey(&txid, uint32(i))
+		out := Output{Address: addr, Satoshis: txOut.Value, Height: height, Script: txOut.PkScript}
+		if err := w.put(outputsBucket, op, out.encode()); err != nil {
+			return err
+		}
+		if err := w.put(utxosBucket, cat(addrKey(addr), op), u32(uint32(height))); err != nil {
+			return err
+		}
+		key := deltaKey(addr, height, pos, &txid, true, uint32(i))
+		if err := w.put(deltasBucket, key, u64(uint64(txOut.Value))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Address returns the address an output script pays to, or "" when it
+// doesn't pay to a single address. Pay to pubkey outputs are indexed under
+// the pubkey hash address. Witness v1 and later outputs, which btcd doesn't
+// know, are encoded with bech32m.
+func (ix *Index) Address(script []byte) string {
+	if version, program, ok := segwit.WitnessProgram(script); ok && version > 0 {
+		addr, err := segwit.NewAddress(version, program, ix.params)
+		if err != nil {
+			return ""
+		}
+		return addr.EncodeAddress()
+	}
+	class, addrs, _, err := txscript.ExtractPkScriptAddrs(script, ix.params)
+	if err != nil || len(addrs) != 1 || class == txscript.MultiSigTy {
+		return ""
+	}
+	if pk, ok := addrs[0].(*btcutil.AddressPubKey); ok {
+		return pk.AddressPubKeyHash().EncodeAddress()
+	}
+	return addrs[0].EncodeAddress()
+}
+
+// pruneUndo drops the undo data of blocks more than undoDepth below height
+func (ix *Index) pruneUndo(tx *bolt.Tx, height int32) error {
+	cutoff := height - ix.undoDepth
+	if cutoff <= 0 {
+		return nil
+	}
+	var old [][]byte
+	c := tx.Bucket(undoBucket).Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, u32(uint32(cutoff))) <= 0; k, _ = c.Next() {
+		old = append(old, append([]byte{}, k...))
+	}
+	for _, k := range old {
+		if err := tx.Bucket(undoBucket).Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DisconnectTip disconnects the last connected block using its undo data
+func (ix *Index) DisconnectTip() error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		height, _ := tip(tx)
+		if height < 0 {
+			return errors.New("index is empty")
+		}
+		v := tx.Bucket(undoBucket).Get(u32(uint32(height)))
+		if v == nil {
+			return ErrNoUndo
+		}
+		var undo undoLog
+		if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&undo); err != nil {
+			return err
+		}
+		for _, c := range undo.Created {
+			if err := tx.Bucket([]byte(c.Bucket)).Delete(c.Key); err != nil {
+				return err
+			}
+		}
+		for _, c := range undo.Restore {
+			if err := tx.Bucket([]byte(c.Bucket)).Put(c.Key, c.Value); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(undoBucket).Delete(u32(uint32(height))); err != nil {
+			return err
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if height == 0 {
+			return meta.Delete(tipKey)
+		}
+		prev := tx.Bucket(blocksBucket).Get(u32(uint32(height - 1)))
+		if prev == nil {
+			return ErrNoUndo
+		}
+		return meta.Put(tipKey, cat(u32(uint32(height-1)), prev[:chainhash.HashSize]))
+	})
+}
+
+// undoKV is a key written or overwritten by a block
+type undoKV struct {
+	Bucket string
+	Key    []byte
+	Value  []byte
+}
+
+// undoLog is what disconnecting a block takes: deleting the keys it created
+// and restoring the ones it deleted or overwrote
+type undoLog struct {
+	Created []undoKV
+	Restore []undoKV
+}
+
+// changeLog writes the changes of a block and records how to undo them
+type changeLog struct {
+	tx      *bolt.Tx
+	created map[string]undoKV
+	saved   map[string]bool
+	restore []undoKV
+}
+
+func newChangeLog(tx *bolt.Tx) *changeLog {
+	return &changeLog{tx: tx, created: map[string]undoKV{}, saved: map[string]bool{}}
+}
+
+func logKey(bucket, key []byte) string {
+	return string(bucket) + "\x00" + string(key)
+}
+
+// save records the value key had before the block, if any
+func (w *changeLog) save(bucket, key []byte) {
+	k := logKey(bucket, key)
+	if w.saved[k] {
+		return
+	}
+	if _, ok := w.created[k]; ok {
+		return
+	}
+	if old := w.tx.Bucket(bucket).Get(key); old != nil {
+		w.restore = append(w.restore, undoKV{Bucket: string(bucket), Key: cat(key), Value: cat(old)})
+		w.saved[k] = true
+	}
+}
+
+func (w *changeLog) put(bucket, key, value []byte) error {
+	w.save(bucket, key)
+	w.created[logKey(bucket, key)] = undoKV{Bucket: string(bucket), Key: cat(key)}
+	return w.tx.Bucket(bucket).Put(key, value)
+}
+
+func (w *changeLog) del(bucket, key []byte) error {
+	w.save(bucket, key)
+	delete(w.created, logKey(bucket, key))
+	return w.tx.Bucket(bucket).Delete(key)
+}
+
+func (w *changeLog) encode() ([]byte, error) {
+	undo := undoLog{Restore: w.restore}
+	for _, c := range w.created {
+		undo.Created = append(undo.Created, c)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(undo); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func isCoinbase(mtx *wire.MsgTx) bool {
+	if len(mtx.TxIn) != 1 {
+		return false
+	}
+	prev := mtx.TxIn[0].PreviousOutPoint
+	return prev.Index == math.MaxUint32 && prev.Hash == chainhash.Hash{}
+}
+
+func u32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func u64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+// cat returns a new slice holding parts one after the other
+func cat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	if out == nil {
+		out = []byte{}
+	}
+	return out
+}
+
+func outpointKey(hash *chainhash.Hash, index uint32) []byte {
+	return cat(hash[:], u32(index))
+}
+
+// addrKey prefixes the keys of an address. The length keeps an address from
+// matching the keys of another address it's a prefix of.
+func addrKey(addr string) []byte {
+	return cat([]byte{byte(len(addr))}, []byte(addr))
+}
+
+func deltaKey(addr string, height int32, pos uint32, txid *chainhash.Hash, output bool, index uint32) []byte {
+	dir := []byte{0}
+	if output {
+		dir[0] = 1
+	}
+	return cat(addrKey(addr), u32(uint32(height)), u32(pos), txid[:], dir, u32(index))
+}
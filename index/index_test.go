@@ -0,0 +1,156 @@
+package index
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jackzampolin/addrindex-server/internal/chaintest"
+)
+
+func openTestIndex(t *testing.T, undoDepth int) *Index {
+	ix, err := Open(filepath.Join(t.TempDir(), "index.db"), &chaincfg.MainNetParams, undoDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ix.Close() })
+	return ix
+}
+
+func checkBalance(t *testing.T, ix *Index, name, addr string, balance, received int64) {
+	got, err := ix.Balance([]string{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != balance || got.Received != received {
+		t.Errorf("Expected %s balance '%d' received '%d', got '%d' '%d'\n", name, balance, received, got.Balance, got.Received)
+	}
+}
+
+func TestConnectDisconnect(t *testing.T) {
+	ix := openTestIndex(t, 10)
+	a, aScript := chaintest.Address(t, 1)
+	b, bScript := chaintest.Address(t, 2)
+	c, cScript := chaintest.Address(t, 3)
+
+	cb0 := chaintest.Coinbase(0, wire.NewTxOut(50, aScript))
+	block0 := chaintest.Block(nil, cb0)
+	tx1 := chaintest.Spend(cb0, 0, wire.NewTxOut(30, cScript), wire.NewTxOut(20, aScript))
+	tx2 := chaintest.Spend(tx1, 0, wire.NewTxOut(30, bScript), wire.NewTxOut(0, []byte{txscript.OP_RETURN}))
+	block1 := chaintest.Block(block0, chaintest.Coinbase(1, wire.NewTxOut(50, bScript)), tx1, tx2)
+
+	if err := ix.ConnectBlock(block1, 1); err != ErrNotNext {
+		t.Errorf("Expected '%v', got '%v'\n", ErrNotNext, err)
+	}
+	if err := ix.ConnectBlocks([]*wire.MsgBlock{block0, block1}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	connected := func() {
+		checkBalance(t, ix, "a", a, 20, 70)
+		checkBalance(t, ix, "b", b, 80, 80)
+		checkBalance(t, ix, "c", c, 0, 30)
+
+		utxos, _ := ix.UTXOs([]string{a})
+		if len(utxos) != 1 || utxos[0].Txid != tx1.TxHash().String() || utxos[0].Index != 1 || utxos[0].Height != 1 {
+			t.Errorf("Expected '%s:1', got '%+v'\n", tx1.TxHash(), utxos)
+		}
+		txids, _ := ix.TxIDs([]string{a}, 0, 0)
+		if len(txids) != 2 || txids[0] != cb0.TxHash().String() || txids[1] != tx1.TxHash().String() {
+			t.Errorf("Expected the txids of '%s', got '%v'\n", a, txids)
+		}
+		cb0Hash := cb0.TxHash()
+		spent, _ := ix.Spent(&cb0Hash, 0)
+		if spent == nil || spent.Txid != tx1.TxHash().String() || spent.Height != 1 || spent.Output.Address != a || spent.Output.Satoshis != 50 {
+			t.Errorf("Expected '%s' spent by '%s', got '%+v'\n", cb0Hash, tx1.TxHash(), spent)
+		}
+		tx2Hash := tx2.TxHash()
+		if height, hash, ok, _ := ix.TxBlock(&tx2Hash); !ok || height != 1 || hash != block1.BlockHash() {
+			t.Errorf("Expected '%s' in block '%d', got '%d' '%t'\n", tx2Hash, 1, height, ok)
+		}
+		hashes, _ := ix.BlockHashes(uint32(block1.Header.Timestamp.Unix()), uint32(block1.Header.Timestamp.Unix()))
+		if len(hashes) != 1 || hashes[0] != block1.BlockHash().String() {
+			t.Errorf("Expected '%s', got '%v'\n", block1.BlockHash(), hashes)
+		}
+	}
+	connected()
+
+	if err := ix.DisconnectTip(); err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, ix, "a", a, 50, 50)
+	checkBalance(t, ix, "b", b, 0, 0)
+	checkBalance(t, ix, "c", c, 0, 0)
+	if height, hash, _ := ix.Tip(); height != 0 || hash != block0.BlockHash() {
+		t.Errorf("Expected tip '%d', got '%d'\n", 0, height)
+	}
+	cb0Hash, tx1Hash := cb0.TxHash(), tx1.TxHash()
+	if out, _ := ix.Output(&cb0Hash, 0); out == nil || out.Address != a {
+		t.Errorf("Expected '%s:0' unspent again, got '%+v'\n", cb0Hash, out)
+	}
+	if out, _ := ix.Output(&tx1Hash, 0); out != nil {
+		t.Errorf("Expected the outputs of '%s' gone, got '%+v'\n", tx1Hash, out)
+	}
+	if spent, _ := ix.Spent(&cb0Hash, 0); spent != nil {
+		t.Errorf("Expected '%s:0' unspent, got '%+v'\n", cb0Hash, spent)
+	}
+
+	if err := ix.ConnectBlock(block1, 1); err != nil {
+		t.Fatal(err)
+	}
+	connected()
+}
+
+func TestUndoPruned(t *testing.T) {
+	ix := openTestIndex(t, 1)
+	_, script := chaintest.Address(t, 1)
+	var blocks []*wire.MsgBlock
+	var prev *wire.MsgBlock
+	for h := int32(0); h < 3; h++ {
+		prev = chaintest.Block(prev, chaintest.Coinbase(h, wire.NewTxOut(50, script)))
+		blocks = append(blocks, prev)
+	}
+	if err := ix.ConnectBlocks(blocks, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.DisconnectTip(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.DisconnectTip(); err != ErrNoUndo {
+		t.Errorf("Expected '%v', got '%v'\n", ErrNoUndo, err)
+	}
+}
+
+func TestOpenWrongNetwork(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	ix, err := Open(path, &chaincfg.MainNetParams, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.Close()
+	if _, err := Open(path, &chaincfg.TestNet3Params, 10); err == nil {
+		t.Errorf("Expected an error opening a mainnet index for testnet\n")
+	}
+}
+
+func TestTaprootOutputs(t *testing.T) {
+	ix := openTestIndex(t, 10)
+	program, _ := hex.DecodeString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	script := append([]byte{txscript.OP_1, txscript.OP_DATA_32}, program...)
+	taproot := "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0"
+	if got := ix.Address(script); got != taproot {
+		t.Fatalf("Expected '%s', got '%s'\n", taproot, got)
+	}
+
+	cb0 := chaintest.Coinbase(0, wire.NewTxOut(50, script))
+	if err := ix.ConnectBlock(chaintest.Block(nil, cb0), 0); err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, ix, "taproot", taproot, 50, 50)
+	if utxos, _ := ix.UTXOs([]string{taproot}); len(utxos) != 1 || utxos[0].Txid != cb0.TxHash().String() {
+		t.Errorf("Expected '%s:0', got '%+v'\n", cb0.TxHash(), utxos)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Output is an output paying to an address
+type Output struct {
+	Address  string
+	Satoshis int64
+	Height   int32
+	Script   []byte
+}
+
+func (o Output) encode() []byte {
+	return cat(addrKey(o.Address), u64(uint64(o.Satoshis)), u32(uint32(o.Height)), o.Script)
+}
+
+func decodeOutput(v []byte) Output {
+	n := int(v[0])
+	v = v[1:]
+	return Output{
+		Address:  string(v[:n]),
+		Satoshis: int64(binary.BigEndian.Uint64(v[n:])),
+		Height:   int32(binary.BigEndian.Uint32(v[n+8:])),
+		Script:   cat(v[n+12:]),
+	}
+}
+
+// UTXO is an unspent output of an address
+type UTXO struct {
+	Txid  string
+	Index uint32
+	Output
+}
+
+// Delta is the change to the balance of an address by a transaction input,
+// with negative Satoshis, or output
+type Delta struct {
+	Address    string
+	Txid       string
+	Index      uint32
+	BlockIndex uint32
+	Height     int32
+	Satoshis   int64
+}
+
+// Spent is the input spending an output. Output is nil when the output
+// doesn't pay to an address.
+type Spent struct {
+	Txid   string
+	Index  uint32
+	Height int32
+	Output *Output
+}
+
+// Balance is the confirmed balance of addresses and the total they received
+type Balance struct {
+	Balance  int64
+	Received int64
+}
+
+// Deltas returns the inputs and outputs of addrs in blocks start to end,
+// or all of them when start or end is 0, in chain order
+func (ix *Index) Deltas(addrs []string, start, end int32) ([]Delta, error) {
+	out := []Delta{}
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(deltasBucket).Cursor()
+		for _, addr := range unique(addrs) {
+			prefix := addrKey(addr)
+			seek := prefix
+			if start > 0 && end > 0 {
+				seek = cat(prefix, u32(uint32(start)))
+			}
+			for k, v := c.Seek(seek); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				d := decodeDelta(addr, k[len(prefix):], v)
+				if start > 0 && end > 0 && d.Height > end {
+					break
+				}
+				out = append(out, d)
+			}
+		}
+		return nil
+	})
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Height != out[j].Height {
+			return out[i].Height < out[j].Height
+		}
+		return out[i].BlockIndex < out[j].BlockIndex
+	})
+	return out, err
+}
+
+func decodeDelta(addr string, k, v []byte) Delta {
+	var txid chainhash.Hash
+	copy(txid[:], k[8:40])
+	return Delta{
+		Address:    addr,
+		Height:     int32(binary.BigEndian.Uint32(k)),
+		BlockIndex: binary.BigEndian.Uint32(k[4:]),
+		Txid:       txid.String(),
+		Index:      binary.BigEndian.Uint32(k[41:]),
+		Satoshis:   int64(binary.BigEndian.Uint64(v)),
+	}
+}
+
+// TxIDs returns the txids of the transactions of addrs in blocks start to
+// end, or all of them when start or end is 0, in chain order
+func (ix *Index) TxIDs(addrs []string, start, end int32) ([]string, error) {
+	deltas, err := ix.Deltas(addrs, start, end)
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	seen := map[string]bool{}
+	for _, d := range deltas {
+		if !seen[d.Txid] {
+			seen[d.Txid] = true
+			out = append(out, d.Txid)
+		}
+	}
+	return out, nil
+}
+
+// Balance returns the confirmed balance of addrs
+func (ix *Index) Balance(addrs []string) (Balance, error) {
+	var out Balance
+	deltas, err := ix.Deltas(addrs, 0, 0)
+	for _, d := range deltas {
+		out.Balance += d.Satoshis
+		if d.Satoshis > 0 {
+			out.Received += d.Satoshis
+		}
+	}
+	return out, err
+}
+
+// UTXOs returns the unspent outputs of addrs, oldest first
+func (ix *Index) UTXOs(addrs []string) ([]UTXO, error) {
+	out := []UTXO{}
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(utxosBucket).Cursor()
+		outputs := tx.Bucket(outputsBucket)
+		for _, addr := range unique(addrs) {
+			prefix := addrKey(addr)
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				op := k[len(prefix):]
+				v := outputs.Get(op)
+				if v == nil {
+					continue
+				}
+				var txid chainhash.Hash
+				copy(txid[:], op)
+				out = append(out, UTXO{Txid: txid.String(), Index: binary.BigEndian.Uint32(op[chainhash.HashSize:]), Output: decodeOutput(v)})
+			}
+		}
+		return nil
+	})
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Height < out[j].Height })
+	return out, err
+}
+
+// Output returns the unspent output at an outpoint, or nil if it's spent or
+// doesn't pay to an address
+func (ix *Index) Output(hash *chainhash.Hash, index uint32) (*Output, error) {
+	var out *Output
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(outputsBucket).Get(outpointKey(hash, index)); v != nil {
+			o := decodeOutput(v)
+			out = &o
+		}
+		return nil
+	})
+	return out, err
+}
+
+// Spent returns the input spending an outpoint, or nil if it's unspent
+func (ix *Index) Spent(hash *chainhash.Hash, index uint32) (*Spent, error) {
+	var out *Spent
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(spentBucket).Get(outpointKey(hash, index))
+		if v == nil {
+			return nil
+		}
+		var txid chainhash.Hash
+		copy(txid[:], v)
+		out = &Spent{
+			Txid:   txid.String(),
+			Index:  binary.BigEndian.Uint32(v[32:]),
+			Height: int32(binary.BigEndian.Uint32(v[36:])),
+		}
+		if len(v) > 40 {
+			o := decodeOutput(v[40:])
+			out.Output = &o
+		}
+		return nil
+	})
+	return out, err
+}
+
+// TxBlock returns the height and hash of the block a transaction is in. ok
+// is false for transactions that aren't in the index.
+func (ix *Index) TxBlock(txid *chainhash.Hash) (height int32, hash chainhash.Hash, ok bool, err error) {
+	err = ix.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(txsBucket).Get(txid[:])
+		if v == nil {
+			return nil
+		}
+		height = int32(binary.BigEndian.Uint32(v))
+		if b := tx.Bucket(blocksBucket).Get(v[:4]); b != nil {
+			copy(hash[:], b)
+			ok = true
+		}
+		return nil
+	})
+	return height, hash, ok, err
+}
+
+// BlockHash returns the hash of the connected block at height. ok is false
+// above the tip.
+func (ix *Index) BlockHash(height int32) (hash chainhash.Hash, ok bool, err error) {
+	err = ix.db.View(func(tx *bolt.Tx) error {
+		if tip, _ := tip(tx); height < 0 || height > tip {
+			return nil
+		}
+		if b := tx.Bucket(blocksBucket).Get(u32(uint32(height))); b != nil {
+			copy(hash[:], b)
+			ok = true
+		}
+		return nil
+	})
+	return hash, ok, err
+}
+
+// BlockHashes returns the hashes of the blocks with timestamps from low to
+// high, in timestamp order
+func (ix *Index) BlockHashes(high, low uint32) ([]string, error) {
+	out := []string{}
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(timesBucket).Cursor()
+		for k, v := c.Seek(u32(low)); k != nil && binary.BigEndian.Uint32(k) <= high; k, v = c.Next() {
+			var hash chainhash.Hash
+			copy(hash[:], v)
+			out = append(out, hash.String())
+		}
+		return nil
+	})
+	return out, err
+}
+
+func unique(addrs []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, a := range addrs {
+		if !seen[a] {
+			seen[a] = true
+			out = append(out, a)
+		}
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaintest
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// Address returns a mainnet pay to pubkey hash address with a hash of b
+// repeated, and its script
+func Address(t testing.TB, b byte) (string, []byte) {
+	addr, err := btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{b}, 20), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr.EncodeAddress(), script
+}
+
+// Coinbase returns a coinbase transaction, made unique by height
+func Coinbase(height int32, outs ...*wire.TxOut) *wire.MsgTx {
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, math.MaxUint32), []byte{byte(height), 0x51}, nil))
+	for _, o := range outs {
+		tx.AddTxOut(o)
+	}
+	return tx
+}
+
+// Spend returns a transaction spending output index of prev
+func Spend(prev *wire.MsgTx, index uint32, outs ...*wire.TxOut) *wire.MsgTx {
+	tx := wire.NewMsgTx(1)
+	hash := prev.TxHash()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&hash, index), []byte{0x51}, nil))
+	for _, o := range outs {
+		tx.AddTxOut(o)
+	}
+	return tx
+}
+
+// Block returns a block of txs on top of prev, or a genesis block. Blocks
+// are 10 minutes apart, carry the regtest proof of work limit and commit to
+// their transactions, so competing blocks get different hashes.
+func Block(prev *wire.MsgBlock, txs ...*wire.MsgTx) *wire.MsgBlock {
+	var prevHash chainhash.Hash
+	ts := time.Unix(1500000000, 0)
+	if prev != nil {
+		prevHash = prev.BlockHash()
+		ts = prev.Header.Timestamp.Add(10 * time.Minute)
+	}
+	b := wire.NewMsgBlock(wire.NewBlockHeader(1, &prevHash, &chainhash.Hash{}, chaincfg.RegressionNetParams.PowLimitBits, 0))
+	b.Header.Timestamp = ts
+	var utxs []*btcutil.Tx
+	for _, tx := range txs {
+		b.AddTransaction(tx)
+		utxs = append(utxs, btcutil.NewTx(tx))
+	}
+	merkles := blockchain.BuildMerkleTreeStore(utxs, false)
+	b.Header.MerkleRoot = *merkles[len(merkles)-1]
+	return b
+}
@@ -0,0 +1,108 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package segwit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+)
+
+// Address is a segwit address with witness version 1 or above, such as a
+// taproot (v1, 32 byte program) address. btcutil covers version 0.
+type Address struct {
+	hrp     string
+	version byte
+	program []byte
+}
+
+// NewAddress returns an address for a witness version and program on net
+func NewAddress(version byte, program []byte, net *chaincfg.Params) (*Address, error) {
+	if version < 1 || version > 16 {
+		return nil, fmt.Errorf("invalid witness version %d", version)
+	}
+	if len(program) < 2 || len(program) > 40 {
+		return nil, fmt.Errorf("invalid witness program length %d", len(program))
+	}
+	return &Address{hrp: net.Bech32HRPSegwit, version: version, program: program}, nil
+}
+
+// EncodeAddress returns the bech32m encoding of the address
+func (a *Address) EncodeAddress() string {
+	out, _ := Encode(a.hrp, a.version, a.program)
+	return out
+}
+
+// ScriptAddress returns the witness program
+func (a *Address) ScriptAddress() []byte {
+	return a.program
+}
+
+// IsForNet returns whether the address is for the network
+func (a *Address) IsForNet(net *chaincfg.Params) bool {
+	return a.hrp == net.Bech32HRPSegwit
+}
+
+// String returns the address' encoding
+func (a *Address) String() string {
+	return a.EncodeAddress()
+}
+
+// WitnessVersion returns the witness version of the address
+func (a *Address) WitnessVersion() byte {
+	return a.version
+}
+
+// WitnessProgram returns the witness program of the address
+func (a *Address) WitnessProgram() []byte {
+	return a.program
+}
+
+// DecodeAddress decodes base58, bech32 and bech32m addresses for net
+func DecodeAddress(addr string, net *chaincfg.Params) (btcutil.Address, error) {
+	hrp := net.Bech32HRPSegwit
+	if len(addr) > len(hrp)+1 && strings.EqualFold(addr[:len(hrp)+1], hrp+"1") {
+		version, program, err := Decode(addr, hrp)
+		if err != nil {
+			return nil, err
+		}
+		if version == 0 {
+			if len(program) == 20 {
+				return btcutil.NewAddressWitnessPubKeyHash(program, net)
+			}
+			return btcutil.NewAddressWitnessScriptHash(program, net)
+		}
+		return NewAddress(version, program, net)
+	}
+	return btcutil.DecodeAddress(addr, net)
+}
+
+// WitnessProgram splits a segwit scriptPubKey, a version opcode followed by a
+// single 2 to 40 byte push, into its version and program
+func WitnessProgram(script []byte) (byte, []byte, bool) {
+	if len(script) < 4 || len(script) > 42 || int(script[1])+2 != len(script) {
+		return 0, nil, false
+	}
+	switch {
+	case script[0] == txscript.OP_0:
+		return 0, script[2:], true
+	case script[0] >= txscript.OP_1 && script[0] <= txscript.OP_16:
+		return script[0] - txscript.OP_1 + 1, script[2:], true
+	}
+	return 0, nil, false
+}
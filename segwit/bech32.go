@@ -0,0 +1,192 @@
+// Copyright © 2018 Jack Zampolin <jack@blockstack.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package segwit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Segwit addresses are encoded with bech32 (BIP 173) for witness version 0
+// and bech32m (BIP 350) for versions 1 and up. The btcutil release we build
+// against only knows bech32, so both are implemented here.
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// Checksum constants for the two encodings
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	out := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+func bech32Checksum(hrp string, data []byte, constant uint32) []byte {
+	values := append(bech32HRPExpand(hrp), data...)
+	mod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ constant
+	out := make([]byte, 6)
+	for i := range out {
+		out[i] = byte(mod>>uint(5*(5-i))) & 31
+	}
+	return out
+}
+
+// bech32Decode decodes a bech32 or bech32m string, returning the human
+// readable part, the 5 bit data without checksum and the checksum constant
+// the string was encoded with
+func bech32Decode(s string) (string, []byte, uint32, error) {
+	if len(s) > 90 {
+		return "", nil, 0, fmt.Errorf("bech32 string too long")
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, 0, fmt.Errorf("bech32 string has mixed case")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, 0, fmt.Errorf("bech32 separator misplaced")
+	}
+	hrp := s[:pos]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, 0, fmt.Errorf("invalid bech32 prefix character")
+		}
+	}
+	data := make([]byte, 0, len(s)-pos-1)
+	for i := pos + 1; i < len(s); i++ {
+		d := strings.IndexByte(bech32Charset, s[i])
+		if d < 0 {
+			return "", nil, 0, fmt.Errorf("invalid bech32 character %q", s[i])
+		}
+		data = append(data, byte(d))
+	}
+	switch c := bech32Polymod(append(bech32HRPExpand(hrp), data...)); c {
+	case bech32Const, bech32mConst:
+		return hrp, data[:len(data)-6], c, nil
+	}
+	return "", nil, 0, fmt.Errorf("invalid bech32 checksum")
+}
+
+func bech32Encode(hrp string, data []byte, constant uint32) string {
+	combined := append(append([]byte{}, data...), bech32Checksum(hrp, data, constant)...)
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, d := range combined {
+		sb.WriteByte(bech32Charset[d])
+	}
+	return sb.String()
+}
+
+// convertBits regroups data from fromBits to toBits wide values
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<toBits - 1
+	var out []byte
+	for _, v := range data {
+		if uint32(v)>>fromBits != 0 {
+			return nil, fmt.Errorf("invalid data range")
+		}
+		acc = acc<<fromBits | uint32(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxv != 0 {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return out, nil
+}
+
+// Decode decodes a segwit address for the network's bech32 prefix hrp,
+// enforcing bech32 for version 0 and bech32m for later versions
+func Decode(addr, hrp string) (byte, []byte, error) {
+	gotHRP, data, constant, err := bech32Decode(addr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if gotHRP != hrp {
+		return 0, nil, fmt.Errorf("address prefix %q isn't %q", gotHRP, hrp)
+	}
+	if len(data) < 1 {
+		return 0, nil, fmt.Errorf("empty witness program")
+	}
+	version := data[0]
+	if version > 16 {
+		return 0, nil, fmt.Errorf("invalid witness version %d", version)
+	}
+	program, err := convertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(program) < 2 || len(program) > 40 {
+		return 0, nil, fmt.Errorf("invalid witness program length %d", len(program))
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return 0, nil, fmt.Errorf("invalid witness v0 program length %d", len(program))
+	}
+	if version == 0 && constant != bech32Const {
+		return 0, nil, fmt.Errorf("witness v0 address must use bech32")
+	}
+	if version != 0 && constant != bech32mConst {
+		return 0, nil, fmt.Errorf("witness v%d address must use bech32m", version)
+	}
+	return version, program, nil
+}
+
+// Encode encodes a witness version and program as a segwit address with the
+// bech32 prefix hrp
+func Encode(hrp string, version byte, program []byte) (string, error) {
+	data, err := convertBits(program, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	constant := uint32(bech32mConst)
+	if version == 0 {
+		constant = bech32Const
+	}
+	return bech32Encode(hrp, append([]byte{version}, data...), constant), nil
+}
@@ -0,0 +1,87 @@
+package segwit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+)
+
+func TestDecodeAddress(t *testing.T) {
+	valid := []struct {
+		addr    string
+		params  *chaincfg.Params
+		version byte
+		length  int
+	}{
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", &chaincfg.MainNetParams, 0, 20},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", &chaincfg.MainNetParams, 1, 32},
+		{"1BoatSLRHtKNngkdXEeobR76b53LETtpyT", &chaincfg.MainNetParams, 0, 20},
+	}
+	for _, c := range valid {
+		addr, err := DecodeAddress(c.addr, c.params)
+		if err != nil {
+			t.Errorf("Expected %s to decode, got '%s'\n", c.addr, err)
+			continue
+		}
+		if len(addr.ScriptAddress()) != c.length {
+			t.Errorf("Expected '%d' byte program for %s, got '%d'\n", c.length, c.addr, len(addr.ScriptAddress()))
+		}
+		if sw, ok := addr.(*Address); ok && sw.WitnessVersion() != c.version {
+			t.Errorf("Expected witness version '%d' for %s, got '%d'\n", c.version, c.addr, sw.WitnessVersion())
+		}
+		if !strings.EqualFold(addr.EncodeAddress(), c.addr) {
+			t.Errorf("Expected %s to round trip, got '%s'\n", c.addr, addr.EncodeAddress())
+		}
+	}
+
+	program := bytes.Repeat([]byte{0x79}, 32)
+	data, _ := convertBits(program, 8, 5, true)
+	invalid := map[string]string{
+		"v1 with bech32 checksum":   bech32Encode("bc", append([]byte{1}, data...), bech32Const),
+		"v0 with bech32m checksum":  bech32Encode("bc", append([]byte{0}, data...), bech32mConst),
+		"testnet prefix on mainnet": bech32Encode("tb", append([]byte{1}, data...), bech32mConst),
+		"bad checksum":              "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj1",
+		"mixed case":                "bc1P0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0",
+		"garbage":                   "notanaddress",
+	}
+	for name, addr := range invalid {
+		if _, err := DecodeAddress(addr, &chaincfg.MainNetParams); err == nil {
+			t.Errorf("Expected %s (%s) not to decode\n", name, addr)
+		}
+	}
+
+	taproot, err := NewAddress(1, program, &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeAddress(taproot.EncodeAddress(), &chaincfg.TestNet3Params)
+	if err != nil || !bytes.Equal(decoded.ScriptAddress(), program) {
+		t.Errorf("Expected testnet taproot address to round trip, got '%v'\n", err)
+	}
+	var _ btcutil.Address = taproot
+}
+
+func TestWitnessProgram(t *testing.T) {
+	program := bytes.Repeat([]byte{0x79}, 32)
+	cases := []struct {
+		name    string
+		script  []byte
+		version byte
+		ok      bool
+	}{
+		{"v0", append([]byte{0x00, 32}, program...), 0, true},
+		{"v1", append([]byte{0x51, 32}, program...), 1, true},
+		{"v16", append([]byte{0x60, 32}, program...), 16, true},
+		{"length mismatch", append([]byte{0x51, 31}, program...), 0, false},
+		{"not a version opcode", append([]byte{0x6a, 32}, program...), 0, false},
+	}
+	for _, c := range cases {
+		version, got, ok := WitnessProgram(c.script)
+		if ok != c.ok || (ok && (version != c.version || !bytes.Equal(got, program))) {
+			t.Errorf("%s: Expected version '%d' ok '%t', got '%d' '%t'\n", c.name, c.version, c.ok, version, ok)
+		}
+	}
+}